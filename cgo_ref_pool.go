@@ -6,7 +6,9 @@
 package waf
 
 import (
+	"reflect"
 	"strconv"
+	"sync"
 
 	"github.com/DataDog/go-libddwaf/v2/internal/bindings"
 	"github.com/DataDog/go-libddwaf/v2/internal/unsafe"
@@ -25,11 +27,48 @@ import (
 type cgoRefPool struct {
 	stringRefs []string
 	arrayRefs  [][]bindings.WafObject
+
+	// pooled makes AllocWafArray carve the wafObject arrays out of slabs taken from wafObjectSlabPool, see release
+	pooled bool
+	// slabs are the slabs taken from wafObjectSlabPool, to give back with release
+	slabs []*[]bindings.WafObject
+	// slab is what remains of the last slab taken from wafObjectSlabPool
+	slab []bindings.WafObject
+
+	// allocatedBytes is the size of the wafObject tree built with this pool: the size of its wafObjects and the length
+	// of the strings and map keys they reference
+	allocatedBytes uint64
+}
+
+// wafObjectSize is the size of a wafObject, in bytes.
+var wafObjectSize = uint64(reflect.TypeOf(bindings.WafObject{}).Size())
+
+// wafObjectSlabSize is the number of wafObjects in each slab of wafObjectSlabPool. Larger arrays are not pooled.
+const wafObjectSlabSize = 512
+
+// wafObjectSlabPool is a pool of slabs of wafObjects that the wafObject arrays of pooled cgoRefPools are carved out of,
+// so that repeated encodings of similar values reuse the same memory instead of allocating their whole tree again.
+var wafObjectSlabPool = sync.Pool{
+	New: func() any {
+		slab := make([]bindings.WafObject, wafObjectSlabSize)
+		return &slab
+	},
 }
 
 func (refPool *cgoRefPool) append(newRefs cgoRefPool) {
 	refPool.stringRefs = append(refPool.stringRefs, newRefs.stringRefs...)
 	refPool.arrayRefs = append(refPool.arrayRefs, newRefs.arrayRefs...)
+	refPool.slabs = append(refPool.slabs, newRefs.slabs...)
+}
+
+// release gives the slabs of this pool back to wafObjectSlabPool. It must only be called once libddwaf no longer uses
+// any of the wafObjects allocated by this pool, which must not be used anymore either.
+func (refPool *cgoRefPool) release() {
+	for _, slab := range refPool.slabs {
+		wafObjectSlabPool.Put(slab)
+	}
+	refPool.slabs = nil
+	refPool.slab = nil
 }
 
 // AllocCString is used in the rare cases where we need the WAF to receive standard null-terminated strings.
@@ -56,6 +95,7 @@ func (refPool *cgoRefPool) AllocWafString(obj *bindings.WafObject, str string) {
 	}
 
 	refPool.stringRefs = append(refPool.stringRefs, str)
+	refPool.allocatedBytes += uint64(len(str))
 	stringHeader := unsafe.NativeStringUnwrap(str)
 	obj.Value = stringHeader.Data
 	obj.NbEntries = uint64(stringHeader.Len)
@@ -78,13 +118,38 @@ func (refPool *cgoRefPool) AllocWafArray(obj *bindings.WafObject, typ bindings.W
 		return nil
 	}
 
-	goArray := make([]bindings.WafObject, size)
-	refPool.arrayRefs = append(refPool.arrayRefs, goArray)
+	var goArray []bindings.WafObject
+	if refPool.pooled && size <= wafObjectSlabSize {
+		goArray = refPool.allocFromSlab(size)
+	} else {
+		goArray = make([]bindings.WafObject, size)
+		refPool.arrayRefs = append(refPool.arrayRefs, goArray)
+	}
 
+	refPool.allocatedBytes += size * wafObjectSize
 	obj.Value = unsafe.SliceToUintptr(goArray)
 	return goArray
 }
 
+// allocFromSlab returns a zeroed array of size wafObjects carved out of the current slab, taking a new slab from
+// wafObjectSlabPool when the current one is too small.
+func (refPool *cgoRefPool) allocFromSlab(size uint64) []bindings.WafObject {
+	if uint64(len(refPool.slab)) < size {
+		slab := wafObjectSlabPool.Get().(*[]bindings.WafObject)
+		refPool.slabs = append(refPool.slabs, slab)
+		refPool.slab = *slab
+	}
+
+	goArray := refPool.slab[:size:size]
+	refPool.slab = refPool.slab[size:]
+
+	// Slabs are reused, so they may hold the wafObjects of previous encodings
+	for i := range goArray {
+		goArray[i] = bindings.WafObject{}
+	}
+	return goArray
+}
+
 // AllocWafMapKey is used to store a string map key in a wafObject.
 // We take full advantage of the fact that the WAF can receive non-null-terminated strings by directly retrieving the
 // underlying array in the string value using the nativeStringUnwrap function. Hence, removing any copy in the process
@@ -94,6 +159,7 @@ func (refPool *cgoRefPool) AllocWafMapKey(obj *bindings.WafObject, str string) {
 	}
 
 	refPool.stringRefs = append(refPool.stringRefs, str)
+	refPool.allocatedBytes += uint64(len(str))
 	stringHeader := unsafe.NativeStringUnwrap(str)
 	obj.ParameterName = stringHeader.Data
 	obj.ParameterNameLength = uint64(stringHeader.Len)
@@ -6,7 +6,11 @@
 package waf
 
 import (
+	stdcontext "context"
+	"encoding/json"
+	"fmt"
 	"github.com/DataDog/go-libddwaf/v2/timer"
+	"sort"
 	"sync"
 	"time"
 
@@ -21,25 +25,83 @@ import (
 // when calling it multiple times to run its rules every time new addresses
 // become available. Each request must have its own Context.
 type Context struct {
-	handle *Handle // Instance of the WAF
+	handle   *Handle      // Instance of the WAF
+	instance *wafInstance // The instance of the handle this context was created from
 
 	cgoRefs  cgoRefPool          // Used to retain go data referenced by WAF Objects the context holds
 	cContext bindings.WafContext // The C ddwaf_context pointer
 
 	timeoutCount atomic.Uint64 // Cumulative timeout count for this context.
 
+	runCounters runCounters // Counters of the Run calls of this context, see Metrics.
+
+	ruleStats ruleStats // Match counts of the rules of this context, see RuleStats.
+
 	// Mutex protecting the use of cContext which is not thread-safe and cgoRefs.
 	mutex sync.Mutex
 
-	// timer registers the time spent in the WAF and go-libddwaf
+	// timer registers the time spent in the WAF and go-libddwaf. It is replaced by Reset and SetBudget, so it must be
+	// read with the mutex held, see currentTimer
 	timer timer.NodeTimer
 
+	// budget is the time budget of the timer, which Reset renews: the budget of the configuration of the context, unless
+	// SetBudget replaced it
+	budget time.Duration
+
 	// metrics stores the cumulative time spent in various parts of the WAF
 	metrics metricsStore
 
+	// lastRun stores the time spent in various parts of the WAF by the most recent run call
+	lastRun metricsStore
+
 	// truncations provides details about truncations that occurred while
 	// encoding address data for WAF execution.
 	truncations map[TruncationReason][]int
+
+	// lastTruncations counts the truncations that occurred while encoding the address data of the most recent run call
+	lastTruncations Truncations
+
+	// lastRunTimedOut is true when the most recent run call timed out, see LastRunTimedOut
+	lastRunTimedOut atomic.Bool
+
+	// lastRunInputBytes is the size of the address data of the most recent run call once encoded, see
+	// LastRunInputBytes
+	lastRunInputBytes uint64
+
+	// lastRunDroppedValues is the number of values dropped while encoding the address data of the most recent run call,
+	// see LastRunDroppedValues
+	lastRunDroppedValues int
+
+	// prunedRuleTypes are the types of the rules libddwaf no longer evaluates in the ddwaf_context, as one of their rules
+	// matched without involving ephemeral address data, along with the number of the run it matched in, see
+	// LastRunRulesEvaluated
+	prunedRuleTypes map[string]uint64
+
+	// runSequence is the number of run calls of the context, and lastRunAddresses are the addresses the ddwaf_context
+	// was given data for by the most recent one, see LastRunRulesEvaluated
+	runSequence      uint64
+	lastRunAddresses []string
+
+	// config is the configuration of this context, as set by the options it was created with
+	config config
+
+	// matchHandler is the function called with each match of the runs of this context, see SetMatchHandler
+	matchHandler atomic.Pointer[func(Match)]
+
+	// persistentData holds the persistent address data provided to the WAF so far, so that the state of the
+	// underlying ddwaf_context can be re-created when restoring a ContextState.
+	persistentData map[string]any
+}
+
+// ContextState is a snapshot of the state of a Context, as returned by Context.Snapshot. It can be used to roll a
+// Context back to the state it was in when the snapshot was taken using Context.Restore, any number of times, so that
+// many variations of ephemeral or new persistent address data can be evaluated from the same baseline, such as when
+// replaying or fuzzing requests. It only references the Go values of the persistent address data, which must not be
+// modified while it is in use, and no C memory, so its lifetime is independent of the Context and Handle it comes
+// from: it remains valid after they are closed or updated, and the ruleset it is evaluated with is the one of the
+// Context it is restored into.
+type ContextState struct {
+	persistentData map[string]any
 }
 
 // NewContext returns a new WAF context of to the given WAF handle.
@@ -48,7 +110,7 @@ type Context struct {
 // handle. A nil value is returned when the WAF handle can no longer be used
 // or the WAF context couldn't be created.
 func NewContext(handle *Handle) *Context {
-	return NewContextWithBudget(handle, timer.UnlimitedBudget)
+	return NewContextWithOptions(handle)
 }
 
 // NewContextWithBudget returns a new WAF context of to the given WAF handle.
@@ -57,30 +119,57 @@ func NewContext(handle *Handle) *Context {
 // handle. A nil value is returned when the WAF handle can no longer be used
 // or the WAF context couldn't be created.
 func NewContextWithBudget(handle *Handle, budget time.Duration) *Context {
+	return NewContextWithOptions(handle, WithBudget(budget))
+}
+
+// NewContextWithOptions returns a new WAF context of the given WAF handle, configured with the given options. A nil
+// value is returned when the WAF handle can no longer be used or the WAF context couldn't be created, see
+// NewContextWithError to know why.
+func NewContextWithOptions(handle *Handle, options ...Option) *Context {
+	context, _ := NewContextWithError(handle, options...)
+	return context
+}
+
+// NewContextWithError is the same as NewContextWithOptions, but returns why the WAF context couldn't be created instead
+// of only returning nil: errors.ErrHandleClosed when the WAF handle can no longer be used, or an error wrapping
+// errors.ErrContextInit when libddwaf failed to create the underlying ddwaf_context or the context could not be
+// configured.
+func NewContextWithError(handle *Handle, options ...Option) (*Context, error) {
 	// Handle has been released
 	if !handle.retain() {
-		return nil
+		return nil, errors.ErrHandleClosed
 	}
 
-	cContext := wafLib.WafContextInit(handle.cHandle)
-	if cContext == 0 {
-		handle.release() // We couldn't get a context, so we no longer have an implicit reference to the Handle in it...
-		return nil
+	instance := handle.retainInstance()
+	if instance == nil {
+		handle.release()
+		return nil, errors.ErrHandleClosed
 	}
 
-	timer, err := timer.NewTreeTimer(timer.WithBudget(budget), timer.WithComponents(wafRunTag))
+	config := handle.config.with(options)
+
+	timer, err := timer.NewTreeTimer(timer.WithBudget(config.budget), timer.WithComponents(wafRunTag))
 	if err != nil {
-		return nil
+		instance.release()
+		handle.release()
+		return nil, fmt.Errorf("%w: %w", errors.ErrContextInit, err)
+	}
+
+	cContext := wafLib.WafContextInit(instance.cHandle)
+	if cContext == 0 {
+		instance.release()
+		handle.release() // We couldn't get a context, so we no longer have an implicit reference to the Handle in it...
+		return nil, errors.ErrContextInit
 	}
 
-	return &Context{handle: handle, cContext: cContext, timer: timer, metrics: metricsStore{data: make(map[string]time.Duration, 5)}}
+	return trackContextLeak(&Context{handle: handle, instance: instance, cContext: cContext, timer: timer, budget: config.budget, metrics: metricsStore{data: make(map[string]time.Duration, 5)}, config: config}), nil
 }
 
 // RunAddressData provides address data to the Context.Run method. If a given key is present in both
 // RunAddressData.Persistent and RunAddressData.Ephemeral, the value from RunAddressData.Persistent will take precedence.
 type RunAddressData struct {
-	// Persistent address data is scoped to the lifetime of a given Context, and subsquent calls to Context.Run with the
-	// same address name will be silently ignored.
+	// Persistent address data is scoped to the lifetime of a given Context. By default, subsequent calls to Context.Run
+	// with the same address name replace its previous value, see WithPersistentAddressPolicy.
 	Persistent map[string]any
 	// Ephemeral address data is scoped to a given Context.Run call and is not persisted across calls. This is used for
 	// protocols such as gRPC client/server streaming or GraphQL, where a single request can incur multiple subrequests.
@@ -100,51 +189,235 @@ func (d RunAddressData) isEmpty() bool {
 // if the output of TotalTime() exceeds the value of Timeout, the function will immediately return with errors.ErrTimeout
 // The second parameter is deprecated and should be passed to NewContextWithBudget instead.
 func (context *Context) Run(addressData RunAddressData, _ time.Duration) (res Result, err error) {
+	return context.RunWithContext(stdcontext.Background(), addressData)
+}
+
+// RunEphemeral is the same as Run, given the persistent and ephemeral address data as separate maps, either of which
+// can be nil. Persistent address data is retained by the context and evaluated again by the rules needing it in
+// subsequent calls, while ephemeral address data is only evaluated by this call, which is suited to data such as
+// request bodies that should not be retained. A rule only reports its first match in a given context when the match
+// only involves persistent address data, as the rule is then pruned for the rest of the context. A match involving
+// ephemeral address data is reported every time, even if the rule also needs persistent address data of previous calls.
+// The third parameter is deprecated, like the one of Run, and the budget given to NewContextWithBudget is used instead.
+func (context *Context) RunEphemeral(persistent, ephemeral map[string]any, _ time.Duration) (Result, error) {
+	return context.Run(RunAddressData{Persistent: persistent, Ephemeral: ephemeral}, 0)
+}
+
+// singleInputs pools the one-entry maps used by RunSingle, so that its callers need not allocate one for each call.
+var singleInputs = sync.Pool{New: func() any { return make(map[string]any, 1) }}
+
+// RunSingle is the same as RunWithLimits with the default limits, given a single address and its value as ephemeral
+// address data, which is what micro-benchmarks and simple integrations usually need. It is semantically identical to
+// running the WAF with RunAddressData{Ephemeral: map[string]any{address: value}}, but the one-entry map is taken from
+// a pool rather than allocated by each call.
+func (context *Context) RunSingle(address string, value any, timeout time.Duration) (Result, error) {
+	input := singleInputs.Get().(map[string]any)
+	input[address] = value
+	defer func() {
+		delete(input, address)
+		singleInputs.Put(input)
+	}()
+	return context.RunWithLimits(RunAddressData{Ephemeral: input}, EncoderLimits{}, timeout)
+}
+
+// DryRun encodes the given address data the same way Run does with the options of this context, without evaluating the
+// rules nor consuming the budget of the context, and returns the first encoding error: an *errors.UnsupportedValueError
+// with the path of the first value whose type is not supported, if any, or the error of a top-level value that cannot
+// be encoded. It allows checking that new address data encodes cleanly before running the WAF on it, see ValidateInput
+// for a complete report. The persistent address data and rule matches of the context are left untouched.
+func (context *Context) DryRun(values map[string]any) error {
+	encodeTimer, err := timer.NewTimer(timer.WithUnlimitedBudget())
+	if err != nil {
+		return err
+	}
+
+	encoder := newConfiguredEncoder(encodeTimer, context.config)
+	if _, err := encoder.Encode(values); err != nil {
+		return err
+	}
+	if len(encoder.unsupportedValues) > 0 {
+		return encoder.unsupportedValues[0]
+	}
+	return nil
+}
+
+// EncodePreview encodes the given address data the same way Run does with the options of this context, and returns the
+// JSON representation of what libddwaf would receive, decoded back from the encoded data. Unlike the given values, the
+// preview reflects the limits of the encoder, truncated strings and containers appearing shortened, and the values it
+// dropped, which are absent, so that it helps understanding why a rule does not match some address data. As with
+// DryRun, the rules are not evaluated, and the budget, persistent address data and rule matches of the context are left
+// untouched. The error of a top-level value that cannot be encoded is returned, as is the error of json.Marshal, such
+// as for non-finite floats encoded as native floats.
+func (context *Context) EncodePreview(values map[string]any) (json.RawMessage, error) {
+	encodeTimer, err := timer.NewTimer(timer.WithUnlimitedBudget())
+	if err != nil {
+		return nil, err
+	}
+
+	encoder := newConfiguredEncoder(encodeTimer, context.config)
+	obj, err := encoder.Encode(values)
+	if err != nil {
+		return nil, err
+	}
+
+	// The Go references are needed until the value is decoded
+	defer unsafe.KeepAlive(&encoder.cgoRefs)
+
+	dropInvalidObjects(obj)
+	decoded, err := decodeObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(decoded)
+}
+
+// RunWithContext is the same as Run, but stops as soon as possible when ctx is done, returning an error wrapping both
+// errors.ErrCancelled and the error of ctx. The encoding of the address data is interrupted right away, while the
+// evaluation of the rules by libddwaf cannot be: the deadline of ctx, if any, is then used as the timeout of the
+// evaluation when it is shorter than the remaining budget of the context. The budget of the context remains the hard
+// ceiling, and whichever of the budget or ctx fires first wins. Cancellations are not counted as timeouts.
+func (context *Context) RunWithContext(ctx stdcontext.Context, addressData RunAddressData) (res Result, err error) {
+	return context.run(ctx, addressData, EncoderLimits{}, 0)
+}
+
+// RunWithLimits is the same as Run, but encodes the address data of this call with the given limits instead of the
+// default ones. Zero fields of limits fall back to the default limits, and an error wrapping errors.ErrInvalidLimits is
+// returned if any of them is negative. When timeout is positive and shorter than the remaining budget of the context,
+// it is used as the time budget of this call. Note libddwaf applies its own limits regardless of the encoder's, which
+// is reported by Result.WAFTruncated.
+func (context *Context) RunWithLimits(addressData RunAddressData, limits EncoderLimits, timeout time.Duration) (Result, error) {
+	if err := limits.validate(); err != nil {
+		return Result{}, err
+	}
+	return context.run(stdcontext.Background(), addressData, limits, timeout)
+}
+
+// RunDeadline is the same as Run, using the time remaining until the given deadline as the time budget of this call
+// when it is shorter than the remaining budget of the context, as RunWithLimits does with its timeout. When the
+// deadline is already past, errors.ErrTimeout is returned right away, without encoding the address data nor calling
+// libddwaf, and the call is counted as a timeout. Calls without address data are handled as by Run, whatever the
+// deadline.
+func (context *Context) RunDeadline(addressData RunAddressData, deadline time.Time) (Result, error) {
+	if addressData.isEmpty() {
+		// There is nothing to time out, but run still reports the missing address data when strict input is enabled
+		return context.run(stdcontext.Background(), addressData, EncoderLimits{}, 0)
+	}
+
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		context.timeoutCount.Inc()
+		context.lastRunTimedOut.Store(true)
+		context.runCounters.record(Result{}, errors.ErrTimeout)
+		context.handle.runCounters.record(Result{}, errors.ErrTimeout)
+		return Result{}, errors.ErrTimeout
+	}
+	return context.run(stdcontext.Background(), addressData, EncoderLimits{}, remaining)
+}
+
+// run implements RunWithContext and RunWithLimits, see their documentation.
+func (context *Context) run(ctx stdcontext.Context, addressData RunAddressData, limits EncoderLimits, timeout time.Duration) (res Result, err error) {
 	if addressData.isEmpty() {
+		if context.config.strictInput {
+			err = errors.ErrNoInput
+		}
 		return
 	}
 
 	defer func() {
-		if err == errors.ErrTimeout {
+		if isTimeout(err) {
 			context.timeoutCount.Inc()
 		}
+		context.lastRunTimedOut.Store(isTimeout(err))
+		context.runCounters.record(res, err)
+		context.handle.runCounters.record(res, err)
+		context.ruleStats.record(res.Events)
+		context.handleMatches(res.Events)
 	}()
 
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return Result{}, cancelledError(ctxErr)
+	}
+
+	// The timer is read once, as Reset and SetBudget can replace it concurrently
+	contextTimer := context.currentTimer()
+
 	// If the context has already timed out, we don't need to run the WAF again
-	if context.timer.SumExhausted() {
+	if contextTimer.SumExhausted() {
 		return Result{}, errors.ErrTimeout
 	}
 
-	runTimer, err := context.timer.NewNode(wafRunTag,
+	if !context.handle.acquireRunSlot() {
+		return Result{}, errors.ErrBusy
+	}
+	defer context.handle.releaseRunSlot()
+
+	runTimerOptions := []timer.Option{
 		timer.WithComponents(
 			wafEncodeTag,
 			wafDecodeTag,
 			wafDurationTag,
 		),
-	)
+	}
+	if timeout > 0 && timeout < contextTimer.SumRemaining() {
+		runTimerOptions = append(runTimerOptions, timer.WithBudget(timeout))
+	}
+
+	runTimer, err := contextTimer.NewNode(wafRunTag, runTimerOptions...)
 	if err != nil {
 		return Result{}, err
 	}
 
 	runTimer.Start()
 	defer func() {
-		context.metrics.add(wafRunTag, runTimer.Stop())
-		context.metrics.merge(runTimer.Stats())
+		spent := runTimer.Stop()
+		stats := runTimer.Stats()
+		context.metrics.add(wafRunTag, spent)
+		context.metrics.merge(stats)
+
+		stats[wafRunTag] = spent
+		context.lastRun.set(stats)
+	}()
+
+	persistent := addressData.Persistent
+	if context.config.keepAllMatches {
+		// The address data is evaluated in a new ddwaf_context, which needs all the persistent data so far
+		persistent = context.allPersistentData(addressData.Persistent)
+	}
+
+	var (
+		truncations   Truncations
+		inputBytes    uint64
+		droppedValues int
+	)
+	defer func() {
+		context.mutex.Lock()
+		defer context.mutex.Unlock()
+		context.lastTruncations = truncations
+		context.lastRunInputBytes = inputBytes
+		context.lastRunDroppedValues = droppedValues
 	}()
 
 	wafEncodeTimer := runTimer.MustLeaf(wafEncodeTag)
 	wafEncodeTimer.Start()
-	persistentData, persistentEncoder, err := context.encodeOneAddressType(addressData.Persistent, wafEncodeTimer)
+	persistentData, persistentEncoder, err := context.encodeOneAddressType(ctx, persistent, limits, false, 0, wafEncodeTimer)
+	truncations.add(persistentEncoder.truncations)
+	inputBytes += persistentEncoder.cgoRefs.allocatedBytes
+	droppedValues += persistentEncoder.droppedValues
 	if err != nil {
 		wafEncodeTimer.Stop()
 		return res, err
 	}
 
 	// The WAF releases ephemeral address data at the max of each run call, so we need not keep the Go values live beyond
-	// that in the same way we need for persistent data. We hence use a separate encoder.
-	ephemeralData, ephemeralEncoder, err := context.encodeOneAddressType(addressData.Ephemeral, wafEncodeTimer)
+	// that in the same way we need for persistent data. We hence use a separate encoder, whose memory is pooled.
+	ephemeralData, ephemeralEncoder, err := context.encodeOneAddressType(ctx, addressData.Ephemeral, limits, true, inputBytes, wafEncodeTimer)
+	truncations.add(ephemeralEncoder.truncations)
+	inputBytes += ephemeralEncoder.cgoRefs.allocatedBytes
+	droppedValues += ephemeralEncoder.droppedValues
 	if err != nil {
 		wafEncodeTimer.Stop()
+		// The ephemerals may have been partially encoded before failing, and their pooled memory can be reused
+		ephemeralEncoder.cgoRefs.release()
 		return res, err
 	}
 
@@ -158,22 +431,669 @@ func (context *Context) Run(addressData RunAddressData, _ time.Duration) (res Re
 		return res, errors.ErrTimeout
 	}
 
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return res, cancelledError(ctxErr)
+	}
+
+	if context.config.persistentAddressPolicy == RejectPersistentAddress {
+		for addr := range addressData.Persistent {
+			if _, found := context.persistentData[addr]; found {
+				return res, fmt.Errorf("%w: %q", errors.ErrPersistentAddressAlreadySet, addr)
+			}
+		}
+	}
+
+	if context.config.keepAllMatches {
+		if err := context.resetWafContext(); err != nil {
+			return res, err
+		}
+	}
+
 	// Save the Go pointer references to addressesToData that were referenced by the encoder
 	// into C ddwaf_objects. libddwaf's API requires to keep this data for the lifetime of the ddwaf_context.
 	defer context.cgoRefs.append(persistentEncoder.cgoRefs)
 
+	if context.config.inputDump != nil {
+		dumpInput(context.config.inputDump, persistentData, ephemeralData)
+	}
+
+	// libddwaf cannot be interrupted, so the deadline of ctx is the best we can do
+	timeBudget := runTimer.SumRemaining()
+	deadline, hasDeadline := ctx.Deadline()
+	shortenedByDeadline := hasDeadline && time.Until(deadline) < timeBudget
+	if shortenedByDeadline {
+		if timeBudget = time.Until(deadline); timeBudget <= 0 {
+			return res, cancelledError(stdcontext.DeadlineExceeded)
+		}
+	}
+
+	context.runSequence++
+	context.lastRunAddresses = runAddresses(persistent, addressData.Ephemeral)
+
 	wafDecodeTimer := runTimer.MustLeaf(wafDecodeTag)
-	res, err = context.run(persistentData, ephemeralData, wafDecodeTimer, runTimer.SumRemaining())
+	res, err = context.runWaf(persistentData, ephemeralData, wafDecodeTimer, timeBudget)
+	res.WAFTruncated = persistentEncoder.exceedsWafLimits() && persistentData != nil && wafTruncates(persistentData) ||
+		ephemeralEncoder.exceedsWafLimits() && ephemeralData != nil && wafTruncates(ephemeralData)
+	if isTimeout(err) && shortenedByDeadline {
+		err = cancelledError(stdcontext.DeadlineExceeded)
+	}
+	if context.config.keepAllMatches {
+		keepMatchesOf(&res, addressData)
+	} else {
+		context.pruneRules(res.Events, addressData.Ephemeral)
+	}
+	context.recordPersistentData(addressData.Persistent)
 
 	runTimer.AddTime(wafDurationTag, res.TimeSpent)
 
-	// Ensure the ephemerals don't get optimized away by the compiler before the WAF had a chance to use them.
-	unsafe.KeepAlive(ephemeralEncoder.cgoRefs)
+	// libddwaf is done with the ephemerals, whose memory can be reused. This also ensures they don't get optimized
+	// away by the compiler before the WAF had a chance to use them.
+	ephemeralEncoder.cgoRefs.release()
 	unsafe.KeepAlive(persistentEncoder.cgoRefs)
 
 	return
 }
 
+// BatchResult is the result of the evaluation of one of the inputs given to Context.RunBatch.
+type BatchResult struct {
+	// Result holds the events, actions and derivatives reported for the input.
+	Result
+	// Err is the error that occurred while evaluating the input, if any, as Context.Run would have returned it.
+	Err error
+}
+
+// RunBatch evaluates each of the given inputs in turn, as Run does, and returns their results in the same order. The
+// run slot, the lock of the context and the timer of the run are only acquired once for the whole batch, which saves
+// the overhead of calling Run in a loop. The timeout is the aggregate time budget of the batch, shortened by the
+// remaining budget of the context: once it is exhausted, the remaining inputs are not evaluated and their result is
+// errors.ErrTimeout, which RunBatch then returns too. Each input is evaluated as ephemeral address data together with
+// the persistent address data the context received so far, so that a rule matching an input is not pruned for the
+// subsequent inputs of the batch: each result is the one the input gets on its own, and the batch leaves the state of
+// the context untouched. Rules only involving persistent address data that already matched in the context are still
+// pruned, as they are by Run. Other errors are reported in the BatchResult of the input they occurred for.
+func (context *Context) RunBatch(inputs []map[string]any, timeout time.Duration) ([]BatchResult, error) {
+	results := make([]BatchResult, len(inputs))
+	if len(inputs) == 0 {
+		return results, nil
+	}
+
+	// The matches are handled once the whole batch is over and the context is no longer locked, see SetMatchHandler
+	defer func() {
+		for i := range results {
+			context.handleMatches(results[i].Events)
+		}
+	}()
+
+	// The timer is read once, as Reset and SetBudget can replace it concurrently
+	contextTimer := context.currentTimer()
+
+	// If the context has already timed out, we don't need to run the WAF again
+	if contextTimer.SumExhausted() {
+		return context.timeOutBatch(inputs, results, 0), errors.ErrTimeout
+	}
+
+	if !context.handle.acquireRunSlot() {
+		return nil, errors.ErrBusy
+	}
+	defer context.handle.releaseRunSlot()
+
+	runTimerOptions := []timer.Option{
+		timer.WithComponents(
+			wafEncodeTag,
+			wafDecodeTag,
+			wafDurationTag,
+		),
+	}
+	if timeout > 0 && timeout < contextTimer.SumRemaining() {
+		runTimerOptions = append(runTimerOptions, timer.WithBudget(timeout))
+	}
+
+	runTimer, err := contextTimer.NewNode(wafRunTag, runTimerOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	runTimer.Start()
+	defer func() {
+		spent := runTimer.Stop()
+		stats := runTimer.Stats()
+		context.metrics.add(wafRunTag, spent)
+		context.metrics.merge(stats)
+
+		stats[wafRunTag] = spent
+		context.lastRun.set(stats)
+	}()
+
+	// ddwaf_run cannot run concurrently, so we hold the lock of the context for the whole batch
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	if context.cContext == 0 {
+		return nil, errors.ErrContextClosed
+	}
+
+	for i, input := range inputs {
+		if len(input) == 0 {
+			if context.config.strictInput {
+				results[i].Err = errors.ErrNoInput
+			}
+			continue
+		}
+
+		if runTimer.SumExhausted() {
+			return context.timeOutBatch(inputs, results, i), errors.ErrTimeout
+		}
+
+		results[i].Result, results[i].Err = context.runBatchInput(input, runTimer)
+
+		if isTimeout(results[i].Err) {
+			context.timeoutCount.Inc()
+		}
+		context.lastRunTimedOut.Store(isTimeout(results[i].Err))
+		context.runCounters.record(results[i].Result, results[i].Err)
+		context.handle.runCounters.record(results[i].Result, results[i].Err)
+		context.ruleStats.record(results[i].Events)
+	}
+
+	return results, nil
+}
+
+// runBatchInput evaluates one of the inputs of Context.RunBatch as ephemeral address data, within the budget of the
+// given run timer. The caller is responsible for locking the context appropriately around this call.
+func (context *Context) runBatchInput(input map[string]any, runTimer timer.NodeTimer) (Result, error) {
+	wafEncodeTimer := runTimer.MustLeaf(wafEncodeTag)
+	wafEncodeTimer.Start()
+	encoder := newConfiguredEncoder(wafEncodeTimer, context.config)
+	data := new(bindings.WafObject)
+	_ = encoder.EncodeInto(data, input)
+	wafEncodeTimer.Stop()
+
+	// The ephemeral data is no longer used by libddwaf once ddwaf_run returns, so its memory can be reused right away
+	defer encoder.cgoRefs.release()
+
+	if len(encoder.truncations) > 0 {
+		context.truncations = merge(context.truncations, encoder.truncations)
+	}
+	context.lastTruncations = Truncations{}
+	context.lastTruncations.add(encoder.truncations)
+	context.lastRunInputBytes = encoder.cgoRefs.allocatedBytes
+	context.lastRunDroppedValues = encoder.droppedValues
+
+	if encoder.tooLarge() {
+		return Result{}, encoder.inputTooLargeError()
+	}
+
+	if wafEncodeTimer.Exhausted() || runTimer.SumExhausted() {
+		return Result{}, errors.ErrTimeout
+	}
+
+	if context.config.inputDump != nil {
+		dumpInput(context.config.inputDump, nil, data)
+	}
+
+	context.runSequence++
+	context.lastRunAddresses = runAddresses(nil, input)
+
+	res, err := context.runWaf(nil, data, runTimer.MustLeaf(wafDecodeTag), runTimer.SumRemaining())
+	res.WAFTruncated = encoder.exceedsWafLimits() && wafTruncates(data)
+	runTimer.AddTime(wafDurationTag, res.TimeSpent)
+
+	return res, err
+}
+
+// timeOutBatch sets the error of the results of the non-empty inputs of Context.RunBatch from the given index onwards
+// to errors.ErrTimeout, and counts them as timed out runs, as Run does when the budget is exhausted.
+func (context *Context) timeOutBatch(inputs []map[string]any, results []BatchResult, from int) []BatchResult {
+	for i := from; i < len(inputs); i++ {
+		if len(inputs[i]) == 0 {
+			continue
+		}
+		results[i].Err = errors.ErrTimeout
+		context.timeoutCount.Inc()
+		context.lastRunTimedOut.Store(true)
+		context.runCounters.record(results[i].Result, results[i].Err)
+		context.handle.runCounters.record(results[i].Result, results[i].Err)
+	}
+	return results
+}
+
+// recordPersistentData keeps track of the persistent address data that was provided to the WAF, as needed by
+// Context.Snapshot. The caller is responsible for locking the context appropriately around this call.
+func (context *Context) recordPersistentData(addressData map[string]any) {
+	if len(addressData) == 0 {
+		return
+	}
+
+	if context.persistentData == nil {
+		context.persistentData = make(map[string]any, len(addressData))
+	}
+	for addr, value := range addressData {
+		context.persistentData[addr] = value
+	}
+}
+
+// allPersistentData returns the persistent address data provided to the WAF so far, updated with the given one.
+func (context *Context) allPersistentData(addressData map[string]any) map[string]any {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	if len(context.persistentData) == 0 {
+		return addressData
+	}
+
+	persistentData := make(map[string]any, len(context.persistentData)+len(addressData))
+	for addr, value := range context.persistentData {
+		persistentData[addr] = value
+	}
+	for addr, value := range addressData {
+		persistentData[addr] = value
+	}
+	return persistentData
+}
+
+// resetWafContext replaces the ddwaf_context of this Context with a new one, in which no rule matched yet. The caller
+// is responsible for locking the context appropriately around this call, and for providing the new ddwaf_context with
+// the persistent address data.
+func (context *Context) resetWafContext() error {
+	if context.cContext == 0 {
+		return errors.ErrContextClosed
+	}
+
+	cContext := wafLib.WafContextInit(context.instance.cHandle)
+	if cContext == 0 {
+		return fmt.Errorf("%w: could not create a new WAF context", errors.ErrContextInit)
+	}
+
+	wafLib.WafContextDestroy(context.cContext)
+	context.cContext = cContext
+	context.prunedRuleTypes = nil  // No rule matched in the new ddwaf_context yet
+	context.cgoRefs = cgoRefPool{} // The data referenced by the previous ddwaf_context is no longer needed
+	return nil
+}
+
+// Reset brings this Context back to the state it was in when created, so that it can serve another request without
+// the cost of closing it and creating a new one: its ddwaf_context is replaced by a new one of the current ruleset of
+// the Handle, in which no rule matched yet, so that the rules pruned after matching fire again, its persistent address
+// data is cleared, and its budget is renewed. Its cumulative statistics, such as TotalRuntime, TotalTimeouts, Metrics
+// and Stats, are preserved, unless ResetStats is also called. It returns errors.ErrContextClosed when the context is
+// closed, errors.ErrHandleClosed when its Handle is, and errors.ErrContextInit when the new ddwaf_context could not be
+// created, in which cases the context is left unchanged.
+func (context *Context) Reset() error {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	if context.cContext == 0 {
+		return errors.ErrContextClosed
+	}
+
+	timer, err := timer.NewTreeTimer(timer.WithBudget(context.budget), timer.WithComponents(wafRunTag))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errors.ErrContextInit, err)
+	}
+
+	instance := context.handle.retainInstance()
+	if instance == nil {
+		return errors.ErrHandleClosed
+	}
+	cContext := wafLib.WafContextInit(instance.cHandle)
+	if cContext == 0 {
+		instance.release()
+		return errors.ErrContextInit
+	}
+
+	wafLib.WafContextDestroy(context.cContext)
+	context.instance.release()
+	context.instance = instance
+	context.cContext = cContext
+	context.prunedRuleTypes = nil  // No rule matched in the new ddwaf_context yet
+	context.cgoRefs = cgoRefPool{} // The data referenced by the previous ddwaf_context is no longer needed
+	context.persistentData = nil
+	context.timer = timer
+	return nil
+}
+
+// SetBudget replaces the time budget of this Context with total, which is shared by its subsequent run calls, such as
+// the ones made at the successive phases of a request by a middleware chain, instead of each of them getting a budget
+// of its own: every run call given no timeout of its own, which is always the case of Run and RunWithContext and the
+// case of the run calls given a timeout of 0, draws down from it, and returns errors.ErrTimeout once it is exhausted.
+// The time spent by the run calls made before SetBudget is not counted against total, and TotalRuntime keeps
+// cumulating the time spent by all run calls. The budget also becomes the one renewed by Reset. It returns
+// errors.ErrContextClosed when the context is closed, and an error wrapping errors.ErrContextInit when the budget cannot
+// be used, in which cases the budget of the context is left unchanged.
+func (context *Context) SetBudget(total time.Duration) error {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	if context.cContext == 0 {
+		return errors.ErrContextClosed
+	}
+
+	timer, err := timer.NewTreeTimer(timer.WithBudget(total), timer.WithComponents(wafRunTag))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errors.ErrContextInit, err)
+	}
+
+	context.timer = timer
+	context.budget = total
+	return nil
+}
+
+// currentTimer returns the timer of this Context, which the timers of its run calls are created from.
+func (context *Context) currentTimer() timer.NodeTimer {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	return context.timer
+}
+
+// ResetStats clears the statistics of this Context: its timers, counters, rule statistics and truncations, along with
+// the ones of its most recent run call. The address data and rule matches of the context are left untouched, see Reset.
+// The aggregated metrics of its Handle are not affected.
+func (context *Context) ResetStats() {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	context.metrics.reset()
+	context.lastRun.reset()
+	context.timeoutCount.Store(0)
+	context.lastRunTimedOut.Store(false)
+	context.runCounters.reset()
+	context.ruleStats.reset()
+	context.truncations = nil
+	context.lastTruncations = Truncations{}
+	context.lastRunInputBytes = 0
+	context.lastRunDroppedValues = 0
+	context.lastRunAddresses = nil
+}
+
+// reset brings this Context back to the state of a new Context created from the same Handle with the same options, as
+// needed by ContextPool, and detaches it from its Handle until attach is called: its ddwaf_context is destroyed and its
+// references on the Handle and the ruleset it uses are released, so that the contexts of a pool neither keep the Handle
+// from being closed nor the ruleset replaced by an update from being freed. Its persistent address data, statistics and
+// match handler are cleared, and the budget it was created with is restored, in case SetBudget replaced it. It returns
+// errors.ErrContextClosed when the context is closed.
+func (context *Context) reset() error {
+	context.mutex.Lock()
+	if context.cContext == 0 {
+		context.mutex.Unlock()
+		return errors.ErrContextClosed
+	}
+
+	wafLib.WafContextDestroy(context.cContext)
+	unsafe.KeepAlive(context.cgoRefs) // Keep the Go pointer references until the max of the context
+	instance := context.instance
+	context.instance = nil
+	context.cContext = 0
+	context.prunedRuleTypes = nil
+	context.cgoRefs = cgoRefPool{}
+	context.persistentData = nil
+	context.budget = context.config.budget
+	context.mutex.Unlock()
+
+	instance.release()
+	context.handle.release()
+	context.ResetStats()
+	context.matchHandler.Store(nil)
+	return nil
+}
+
+// attach gives this Context, detached by reset, a new ddwaf_context of the current ruleset of its Handle and a renewed
+// budget, retaining both of them again. It returns errors.ErrHandleClosed when the handle can no longer be used, and an
+// error wrapping errors.ErrContextInit when the ddwaf_context could not be created, in which cases the context remains
+// detached.
+func (context *Context) attach() error {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	timer, err := timer.NewTreeTimer(timer.WithBudget(context.budget), timer.WithComponents(wafRunTag))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errors.ErrContextInit, err)
+	}
+
+	if !context.handle.retain() {
+		return errors.ErrHandleClosed
+	}
+	instance := context.handle.retainInstance()
+	if instance == nil {
+		context.handle.release()
+		return errors.ErrHandleClosed
+	}
+	cContext := wafLib.WafContextInit(instance.cHandle)
+	if cContext == 0 {
+		instance.release()
+		context.handle.release()
+		return errors.ErrContextInit
+	}
+
+	context.instance = instance
+	context.cContext = cContext
+	context.timer = timer
+	return nil
+}
+
+// runAddresses returns the addresses of the given persistent and ephemeral address data.
+func runAddresses(persistent, ephemeral map[string]any) []string {
+	addresses := make([]string, 0, len(persistent)+len(ephemeral))
+	for addr := range persistent {
+		addresses = append(addresses, addr)
+	}
+	for addr := range ephemeral {
+		addresses = append(addresses, addr)
+	}
+	return addresses
+}
+
+// pruneRules records the types of the rules reporting the given events as pruned, unless their match involved the
+// given ephemeral address data, as libddwaf then evaluates them again in later runs. The caller is responsible for
+// locking the context appropriately around this call.
+func (context *Context) pruneRules(events []any, ephemeral map[string]any) {
+	for _, event := range events {
+		eventMap, _ := event.(map[string]any)
+		if len(ephemeral) > 0 && eventInvolves(eventMap, RunAddressData{Ephemeral: ephemeral}) {
+			continue
+		}
+		rule, _ := eventMap["rule"].(map[string]any)
+		tags, _ := rule["tags"].(map[string]any)
+		if typ, _ := tags["type"].(string); typ != "" {
+			if context.prunedRuleTypes == nil {
+				context.prunedRuleTypes = make(map[string]uint64)
+			}
+			context.prunedRuleTypes[typ] = context.runSequence
+		}
+	}
+}
+
+// keepMatchesOf removes the events of the result that do not involve any of the given address data, along with the
+// actions that only they triggered, as needed by WithKeepAllMatches.
+func keepMatchesOf(res *Result, addressData RunAddressData) {
+	var (
+		events  []any
+		actions = make(map[string]struct{})
+	)
+	for _, event := range res.Events {
+		event, _ := event.(map[string]any)
+		if !eventInvolves(event, addressData) {
+			continue
+		}
+		events = append(events, event)
+		rule, _ := event["rule"].(map[string]any)
+		onMatch, _ := rule["on_match"].([]any)
+		for _, action := range onMatch {
+			if action, isString := action.(string); isString {
+				actions[action] = struct{}{}
+			}
+		}
+	}
+
+	if len(events) == len(res.Events) {
+		return
+	}
+	res.Events = events
+
+	var keptActions []string
+	for _, action := range res.Actions {
+		if _, found := actions[action]; found {
+			keptActions = append(keptActions, action)
+		}
+	}
+	res.Actions = keptActions
+}
+
+// orderActions sorts the actions of the result in a stable order, as libddwaf reports them in no particular order: the
+// actions come in the order of the on_match arrays of the rules that matched, the rules being taken in the order of
+// their ids, each action only being kept once, where it first appears. Actions that no on_match array contains, if
+// any, come last in lexical order.
+func orderActions(res *Result) {
+	if len(res.Actions) < 2 {
+		return
+	}
+
+	events := make([]any, len(res.Events))
+	copy(events, res.Events)
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventRuleID(events[i]) < eventRuleID(events[j])
+	})
+
+	reported := make(map[string]bool, len(res.Actions))
+	for _, action := range res.Actions {
+		reported[action] = false
+	}
+
+	ordered := make([]string, 0, len(res.Actions))
+	for _, event := range events {
+		event, _ := event.(map[string]any)
+		rule, _ := event["rule"].(map[string]any)
+		onMatch, _ := rule["on_match"].([]any)
+		for _, action := range onMatch {
+			action, _ := action.(string)
+			if done, found := reported[action]; found && !done {
+				reported[action] = true
+				ordered = append(ordered, action)
+			}
+		}
+	}
+
+	var rest []string
+	for action, done := range reported {
+		if !done {
+			rest = append(rest, action)
+		}
+	}
+	sort.Strings(rest)
+	res.Actions = append(ordered, rest...)
+}
+
+// eventInvolves returns true if one of the parameters of the given event is one of the given addresses.
+func eventInvolves(event map[string]any, addressData RunAddressData) bool {
+	conditions, _ := event["rule_matches"].([]any)
+	for _, condition := range conditions {
+		condition, _ := condition.(map[string]any)
+		parameters, _ := condition["parameters"].([]any)
+		for _, parameter := range parameters {
+			parameter, _ := parameter.(map[string]any)
+			address, _ := parameter["address"].(string)
+			if _, found := addressData.Persistent[address]; found {
+				return true
+			}
+			if _, found := addressData.Ephemeral[address]; found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Snapshot captures the current state of the Context, which is the set of persistent address data it received so
+// far. Rules that matched on this data are considered "already matched" and are not reported again by subsequent
+// calls to Run. The returned ContextState can be used with Restore to roll the Context back to this state, for
+// example in order to evaluate a hypothetical input without permanently consuming matches.
+func (context *Context) Snapshot() ContextState {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	persistentData := make(map[string]any, len(context.persistentData))
+	for addr, value := range context.persistentData {
+		persistentData[addr] = value
+	}
+
+	return ContextState{persistentData: persistentData}
+}
+
+// Restore rolls the Context back to the provided ContextState. Since libddwaf provides no way to roll back a
+// ddwaf_context, this is done by creating a new ddwaf_context from the same Handle and providing it with the
+// persistent address data of the snapshot again, discarding the result. The time spent doing so is not accounted
+// for in the Context's timers and budget. It returns errors.ErrContextClosed when the context is closed,
+// errors.ErrContextInit when the new ddwaf_context could not be created, and the error reported by libddwaf, such as
+// errors.ErrInternal, when it failed to evaluate the persistent address data again, in which cases the context is left
+// unchanged.
+func (context *Context) Restore(state ContextState) error {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	return context.restore(state.persistentData)
+}
+
+// Recover returns the Context to a usable state after a failed run, by replacing its ddwaf_context, which libddwaf may
+// have left in an inconsistent state, with a new one of the same ruleset, provided with the persistent address data the
+// context received so far, as Restore does. The C memory of the encoded address data referenced by the previous
+// ddwaf_context is released, so that a failed run leaves nothing behind. The rules that matched persistent address data
+// so far are still pruned, as the new ddwaf_context evaluates the data again. The errors of a run fall in three classes:
+//   - errors.ErrTimeout, errors.ErrBudgetExhausted, and the errors occurring before libddwaf is called, such as encoding
+//     errors, errors.ErrInputTooLarge, errors.ErrCancelled, errors.ErrBusy, errors.ErrNoInput and
+//     errors.ErrPersistentAddressAlreadySet, leave the context usable as is, although its budget may need to be
+//     renewed with Reset after a timeout; calling Recover after them is harmless;
+//   - errors.ErrInternal, errors.ErrOutOfMemory, errors.ErrInvalidObject and errors.ErrInvalidArgument are reported
+//     by libddwaf once it was given the address data, and the context must be recovered with Recover before running it
+//     again;
+//   - errors.ErrContextClosed and errors.ErrHandleClosed are unrecoverable, and Recover returns
+//     errors.ErrContextClosed when the context is closed.
+//
+// It returns errors.ErrContextInit when the new ddwaf_context could not be created, and the error reported by libddwaf
+// when it failed to evaluate the persistent address data again, in which cases the context is left unchanged. The
+// time spent doing so is not accounted for in the Context's timers and budget.
+func (context *Context) Recover() error {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	return context.restore(context.persistentData)
+}
+
+// restore replaces the ddwaf_context of this Context with a new one provided with the given persistent address data.
+// The caller is responsible for locking the context appropriately around this call.
+func (context *Context) restore(persistentData map[string]any) error {
+	if context.cContext == 0 {
+		return errors.ErrContextClosed
+	}
+
+	// The restored context keeps using the ruleset this context was created with, even if the handle was updated since
+	cContext := wafLib.WafContextInit(context.instance.cHandle)
+	if cContext == 0 {
+		return errors.ErrContextInit
+	}
+
+	encodeTimer, _ := timer.NewTimer(timer.WithUnlimitedBudget())
+	encoder := newConfiguredEncoder(encodeTimer, context.config)
+	if len(persistentData) > 0 {
+		data, _ := encoder.Encode(persistentData)
+
+		result := new(bindings.WafResult)
+		ret := wafLib.WafRun(cContext, data, nil, result, wafTimeout(timer.UnlimitedBudget))
+		wafLib.WafResultFree(result)
+		if ret != bindings.WafOK && ret != bindings.WafMatch {
+			wafLib.WafContextDestroy(cContext)
+			return goRunError(ret)
+		}
+	}
+
+	wafLib.WafContextDestroy(context.cContext)
+	context.cContext = cContext
+	context.prunedRuleTypes = nil // No rule matched in the new ddwaf_context yet
+	context.cgoRefs = encoder.cgoRefs
+	context.persistentData = nil
+	context.recordPersistentData(persistentData)
+
+	return nil
+}
+
 // merge merges two maps of slices into a single map of slices. The resulting map will contain all
 // keys from both a and b, with the corresponding value from a and b concatenated (in this order) in
 // a single slice. The implementation tries to minimize reallocations.
@@ -214,13 +1134,25 @@ func merge[K comparable, V any](a, b map[K][]V) (merged map[K][]V) {
 // is a nil map, but this  behaviour is expected since either persistent or ephemeral addresses are allowed to be null
 // one at a time. In this case, Encode will return nil contrary to Encode which will return a nil wafObject,
 // which is what we need to send to ddwaf_run to signal that the address data is empty.
-func (context *Context) encodeOneAddressType(addressData map[string]any, timer timer.Timer) (*bindings.WafObject, encoder, error) {
-	encoder := newLimitedEncoder(timer)
+// When pooled is true, the data is encoded with encoder.EncodeInto, and must be released once the run is over.
+// previousSize is the size of the address data already encoded for the run, which counts towards WithMaxInputSize.
+func (context *Context) encodeOneAddressType(ctx stdcontext.Context, addressData map[string]any, limits EncoderLimits, pooled bool, previousSize uint64, timer timer.Timer) (*bindings.WafObject, encoder, error) {
+	encoder := newConfiguredEncoder(timer, context.config)
+	encoder.previousSize = previousSize
+	limits.apply(&encoder)
 	if addressData == nil {
 		return nil, encoder, nil
 	}
 
-	data, _ := encoder.Encode(addressData)
+	encoder.done = ctx.Done()
+
+	var data *bindings.WafObject
+	if pooled {
+		data = new(bindings.WafObject)
+		_ = encoder.EncodeInto(data, addressData)
+	} else {
+		data, _ = encoder.Encode(addressData)
+	}
 	if len(encoder.truncations) > 0 {
 		context.mutex.Lock()
 		defer context.mutex.Unlock()
@@ -228,6 +1160,14 @@ func (context *Context) encodeOneAddressType(addressData map[string]any, timer t
 		context.truncations = merge(context.truncations, encoder.truncations)
 	}
 
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, encoder, cancelledError(ctxErr)
+	}
+
+	if encoder.tooLarge() {
+		return nil, encoder, encoder.inputTooLargeError()
+	}
+
 	if timer.Exhausted() {
 		return nil, encoder, errors.ErrTimeout
 	}
@@ -235,26 +1175,49 @@ func (context *Context) encodeOneAddressType(addressData map[string]any, timer t
 	return data, encoder, nil
 }
 
-// run executes the ddwaf_run call with the provided data on this context. The caller is responsible for locking the
+// cancelledError returns the error reported when a run is cancelled by a context.Context returning the given error.
+func cancelledError(ctxErr error) error {
+	return fmt.Errorf("%w: %w", errors.ErrCancelled, ctxErr)
+}
+
+// runWaf executes the ddwaf_run call with the provided data on this context. The caller is responsible for locking the
 // context appropriately around this call.
-func (context *Context) run(persistentData, ephemeralData *bindings.WafObject, wafDecodeTimer timer.Timer, timeBudget time.Duration) (Result, error) {
+func (context *Context) runWaf(persistentData, ephemeralData *bindings.WafObject, wafDecodeTimer timer.Timer, timeBudget time.Duration) (Result, error) {
 	result := new(bindings.WafResult)
 	defer wafLib.WafResultFree(result)
 
-	// The value of the timeout cannot exceed 2^55
-	// cf. https://en.cppreference.com/w/cpp/chrono/duration
-	timeout := uint64(timeBudget.Microseconds()) & 0x008FFFFFFFFFFFFF
-	ret := wafLib.WafRun(context.cContext, persistentData, ephemeralData, result, timeout)
+	ret := wafLib.WafRun(context.cContext, persistentData, ephemeralData, result, wafTimeout(timeBudget))
 
 	wafDecodeTimer.Start()
 	defer wafDecodeTimer.Stop()
 
-	return unwrapWafResult(ret, result)
+	res, err := unwrapWafResult(ret, result)
+	if context.config.monitorOnly {
+		res.Actions = nil
+	}
+	return res, err
+}
+
+// wafTimeout converts the provided time budget into a ddwaf_run timeout value, in microseconds.
+func wafTimeout(timeBudget time.Duration) uint64 {
+	// The value of the timeout cannot exceed 2^55
+	// cf. https://en.cppreference.com/w/cpp/chrono/duration
+	return uint64(timeBudget.Microseconds()) & 0x008FFFFFFFFFFFFF
+}
+
+// isTimeout returns true if err is one of the timeouts of a run, either errors.ErrTimeout when the budget was exhausted
+// before calling libddwaf or errors.ErrBudgetExhausted when libddwaf ran out of time.
+func isTimeout(err error) bool {
+	runErr, ok := err.(errors.RunError)
+	return ok && runErr.IsTimeout()
 }
 
+// unwrapWafResult converts the result of ddwaf_run into a Result. When libddwaf ran out of time, the events and actions
+// of the rules evaluated so far are returned along with errors.ErrBudgetExhausted, and Result.TimedOut is set.
 func unwrapWafResult(ret bindings.WafReturnCode, result *bindings.WafResult) (res Result, err error) {
 	if result.Timeout > 0 {
-		err = errors.ErrTimeout
+		res.TimedOut = true
+		err = errors.ErrBudgetExhausted
 	} else {
 		// Derivatives can be generated even if no security event gets detected, so we decode them as long as the WAF
 		// didn't timeout
@@ -271,17 +1234,20 @@ func unwrapWafResult(ret bindings.WafReturnCode, result *bindings.WafResult) (re
 		return res, goRunError(ret)
 	}
 
-	res.Events, err = decodeArray(&result.Events)
-	if err != nil {
-		return res, err
+	// The error of a timeout is kept, as the events only come from the rules evaluated before running out of time
+	var decodeErr error
+	res.Events, decodeErr = decodeArray(&result.Events)
+	if decodeErr != nil {
+		return res, decodeErr
 	}
 	if size := result.Actions.NbEntries; size > 0 {
 		// using ruleIdArray cause it decodes string array (I think)
-		res.Actions, err = decodeStringArray(&result.Actions)
+		res.Actions, decodeErr = decodeStringArray(&result.Actions)
 		// TODO: use decode array, and eventually genericize the function
-		if err != nil {
-			return res, err
+		if decodeErr != nil {
+			return res, decodeErr
 		}
+		orderActions(&res)
 	}
 
 	return res, err
@@ -298,9 +1264,11 @@ func (context *Context) Close() {
 	wafLib.WafContextDestroy(context.cContext)
 	unsafe.KeepAlive(context.cgoRefs) // Keep the Go pointer references until the max of the context
 	defer context.handle.release()    // Reduce the reference counter of the Handle.
+	defer context.instance.release()  // Reduce the reference counter of the instance the context was created from.
 
 	context.cgoRefs = cgoRefPool{} // The data in context.cgoRefs is no longer needed, explicitly release
 	context.cContext = 0           // Makes it easy to spot use-after-free/double-free issues
+	context.persistentData = nil
 }
 
 // TotalRuntime returns the cumulated WAF runtime across various run calls within the same WAF context.
@@ -310,11 +1278,141 @@ func (context *Context) TotalRuntime() (uint64, uint64) {
 	return uint64(context.metrics.get(wafRunTag)), uint64(context.metrics.get(wafDurationTag))
 }
 
+// LastRunDuration returns the overall time spent in the most recent run call of this context, and the part of it spent
+// in libddwaf itself, unlike TotalRuntime which cumulates them across all run calls. Both are zero until a run call
+// reaches the WAF.
+func (context *Context) LastRunDuration() (overall, internal time.Duration) {
+	return context.lastRun.get(wafRunTag), context.lastRun.get(wafDurationTag)
+}
+
+// LastTruncations returns the number of truncations of each kind that occurred while encoding the address data of the
+// most recent run call of this context, unlike Stats which reports the truncations of all run calls. It is the zero
+// Truncations when no truncation occurred, or when no run call encoded address data yet.
+func (context *Context) LastTruncations() Truncations {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	return context.lastTruncations
+}
+
+// LastRunTimedOut returns true when the most recent run call of this context timed out, either because the budget was
+// exhausted before calling libddwaf or because libddwaf ran out of time evaluating the rules, as reported by
+// Result.TimedOut. This tells an incomplete evaluation that found no match yet apart from a complete evaluation that
+// found no match. It is false until a run call is given address data.
+func (context *Context) LastRunTimedOut() bool {
+	return context.lastRunTimedOut.Load()
+}
+
+// LastRunRulesEvaluated returns the number of rules the most recent run call of this context could evaluate, as
+// libddwaf does not report it: the rules and custom rules libddwaf loaded that use at least one of the addresses the
+// call gave data for, excluding the rules pruned by a previous call, as libddwaf no longer evaluates the rules of a
+// type, as found in their tags, in a context once one of them matched without involving ephemeral address data. With
+// WithKeepAllMatches, no rule is pruned and all the persistent address data of the context counts as given by each
+// call. This explains why later calls of a context usually take less time. The rules are the ones of the ruleset the
+// context runs, which is the one of its Handle when the context was created or last reset, even if the Handle was
+// updated since. It returns 0 before the first run call and after ResetStats.
+func (context *Context) LastRunRulesEvaluated() uint64 {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+
+	addresses := make(map[string]struct{}, len(context.lastRunAddresses))
+	for _, addr := range context.lastRunAddresses {
+		addresses[addr] = struct{}{}
+	}
+
+	if context.instance == nil {
+		// The context is in a ContextPool
+		return 0
+	}
+
+	var evaluated uint64
+	for _, rules := range context.instance.rulesIndex.rules {
+		for _, rule := range rules {
+			if _, found := context.instance.loadedRules[rule.id]; !found {
+				continue
+			}
+			if prunedIn, pruned := context.prunedRuleTypes[rule.typ]; pruned && prunedIn < context.runSequence {
+				continue
+			}
+			for _, addr := range rule.addresses {
+				if _, found := addresses[addr]; found {
+					evaluated++
+					break
+				}
+			}
+		}
+	}
+	return evaluated
+}
+
+// LastRunInputBytes returns the size, in bytes, of the address data of the most recent run call of this context once
+// encoded for the WAF: the size of the WAF objects of the encoded tree, plus the length of the strings and map keys
+// they reference, even though the encoder references the Go strings rather than copying them. This allows correlating
+// large inputs with memory pressure.
+// It is 0 until a run call encodes address data.
+func (context *Context) LastRunInputBytes() uint64 {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	return context.lastRunInputBytes
+}
+
+// LastRunDroppedValues returns the number of values that were dropped while encoding the address data of the most
+// recent run call of this context, because their type or value is not supported, such as functions, channels or
+// invalid map keys, or because they have too many indirections. Such values are skipped silently by the encoder, so a
+// count that is consistently positive hints at instrumentation code gathering address data of the wrong types, which
+// ValidateInput or DryRun can then pinpoint. With RunBatch, it is the count of the last input of the batch that was
+// evaluated. It is 0 until a run call encodes address data.
+func (context *Context) LastRunDroppedValues() int {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	return context.lastRunDroppedValues
+}
+
+// Metrics returns the counters of the Run calls of this context.
+func (context *Context) Metrics() Metrics {
+	return context.runCounters.load()
+}
+
+// FilterAddresses reports which of the addresses of the given address data are used by the ruleset of this context,
+// as listed by Handle.Addresses, and which are not and would be ignored by Run. It does not run the WAF, and is meant
+// to help find misconfigured integrations sending addresses that no rule uses. Both lists are sorted.
+func (context *Context) FilterAddresses(values map[string]any) (used []string, unused []string) {
+	context.mutex.Lock()
+	var known map[string]struct{}
+	if context.cContext != 0 {
+		known = context.instance.addresses
+	}
+	context.mutex.Unlock()
+
+	for addr := range values {
+		if _, found := known[addr]; found {
+			used = append(used, addr)
+		} else {
+			unused = append(unused, addr)
+		}
+	}
+	sort.Strings(used)
+	sort.Strings(unused)
+	return used, unused
+}
+
+// RuleStats returns a snapshot of the number of times each rule matched in this context since it was created, by rule
+// id. It can be called concurrently with Run.
+func (context *Context) RuleStats() map[string]uint64 {
+	return context.ruleStats.copy()
+}
+
 // TotalTimeouts returns the cumulated amount of WAF timeouts across various run calls within the same WAF context.
 func (context *Context) TotalTimeouts() uint64 {
 	return context.timeoutCount.Load()
 }
 
+// TotalRuns returns the cumulated amount of run calls given address data within the same WAF context, including the
+// ones that timed out, so that it can be used along with TotalTimeouts to compute a timeout rate. It is the same as the
+// Runs counter of Metrics.
+func (context *Context) TotalRuns() uint64 {
+	return context.runCounters.runs.Load()
+}
+
 // Stats returns the cumulative time spent in various parts of the WAF, all in nanoseconds
 // and the timeout value used
 func (context *Context) Stats() Stats {
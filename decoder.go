@@ -99,6 +99,7 @@ func decodeDiagnosticsEntry(obj *bindings.WafObject) (*DiagnosticEntry, error) {
 			entry.Error = unsafe.GostringSized(unsafe.Cast[byte](objElem.Value), objElem.NbEntries)
 		case "errors":
 			entry.Errors, err = decodeErrors(objElem)
+			entry.ParsedErrors = parseRuleErrors(entry.Errors)
 		case "failed":
 			entry.Failed, err = decodeStringArray(objElem)
 		case "loaded":
@@ -233,6 +234,7 @@ func decodeMap(obj *bindings.WafObject) (map[string]any, error) {
 	result := make(map[string]any, obj.NbEntries)
 	for i := uint64(0); i < obj.NbEntries; i++ {
 		objElem := unsafe.CastWithOffset[bindings.WafObject](obj.Value, i)
+		// Empty keys are encoded without any ParameterName pointer, and are decoded back to the empty string
 		key := unsafe.GostringSized(unsafe.Cast[byte](objElem.ParameterName), objElem.ParameterNameLength)
 		val, err := decodeObject(objElem)
 		if err != nil {
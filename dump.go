@@ -0,0 +1,73 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package waf
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/DataDog/go-libddwaf/v2/internal/bindings"
+	"github.com/DataDog/go-libddwaf/v2/internal/unsafe"
+)
+
+// inputDump is a single line written to the writer given to WithInputDump.
+type inputDump struct {
+	Persistent any `json:"persistent,omitempty"`
+	Ephemeral  any `json:"ephemeral,omitempty"`
+}
+
+// dumpInput writes the given encoded address data to w as a single JSON line. Errors are ignored, as the dump is only
+// a debugging aid that must not prevent the WAF from running.
+func dumpInput(w io.Writer, persistentData, ephemeralData *bindings.WafObject) {
+	var dump inputDump
+	if persistentData != nil {
+		dump.Persistent = dumpObject(persistentData)
+	}
+	if ephemeralData != nil {
+		dump.Ephemeral = dumpObject(ephemeralData)
+	}
+
+	line, err := json.Marshal(dump)
+	if err != nil {
+		return
+	}
+	_, _ = w.Write(append(line, '\n'))
+}
+
+// dumpObject converts a WAF object into a value that can be marshaled to JSON. Unlike decodeObject, it never fails:
+// invalid objects, which the WAF ignores, are converted to nil, and non-finite floats to their string representation.
+func dumpObject(obj *bindings.WafObject) any {
+	switch obj.Type {
+	case bindings.WafMapType:
+		result := make(map[string]any, obj.NbEntries)
+		for i := uint64(0); i < obj.NbEntries; i++ {
+			objElem := unsafe.CastWithOffset[bindings.WafObject](obj.Value, i)
+			key := unsafe.GostringSized(unsafe.Cast[byte](objElem.ParameterName), objElem.ParameterNameLength)
+			result[key] = dumpObject(objElem)
+		}
+		return result
+	case bindings.WafArrayType:
+		result := make([]any, obj.NbEntries)
+		for i := uint64(0); i < obj.NbEntries; i++ {
+			result[i] = dumpObject(unsafe.CastWithOffset[bindings.WafObject](obj.Value, i))
+		}
+		return result
+	case bindings.WafFloatType:
+		value := unsafe.UintptrToNative[float64](obj.Value)
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return strconv.FormatFloat(value, 'g', -1, 64)
+		}
+		return value
+	default:
+		value, err := decodeObject(obj)
+		if err != nil {
+			return nil
+		}
+		return value
+	}
+}
@@ -7,10 +7,15 @@ package waf
 
 import (
 	"context"
+	"database/sql/driver"
+	"encoding"
+	"encoding/json"
 	"fmt"
 	"github.com/DataDog/go-libddwaf/v2/timer"
 	"math"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
@@ -34,6 +39,57 @@ type encoder struct {
 	// For each TruncationReason, holds the size that is required to avoid truncation for each truncation that happened.
 	truncations map[TruncationReason][]int
 
+	// droppedValues is the number of values that were not encoded because their type or value is not supported.
+	droppedValues int
+
+	// unsupportedValues holds the errors of the first maxUnsupportedValues values that were not encoded because their
+	// type or value is not supported, with their path from the encoded value.
+	unsupportedValues []*errors.UnsupportedValueError
+
+	// jsonMode makes the encoder follow JSON semantics, see WithJSONMode.
+	jsonMode bool
+
+	// nonFiniteFloatPolicy defines how NaN and infinite floats are encoded, see WithNonFiniteFloatPolicy.
+	nonFiniteFloatPolicy NonFiniteFloatPolicy
+
+	// skipUnsupportedTopLevel makes unsupported top-level values be encoded as empty maps, see
+	// WithSkipUnsupportedTopLevel.
+	skipUnsupportedTopLevel bool
+
+	// floatFormat and floatPrecision make finite floats be encoded as strings formatted by strconv.FormatFloat instead
+	// of native floats, when floatFormat is not 0, see WithFloatFormat.
+	floatFormat    byte
+	floatPrecision int
+
+	// jsonTags makes the struct fields left out by encoding/json according to their json tag be left out too, see
+	// WithJSONTags.
+	jsonTags bool
+
+	// nilContainersAsEmpty makes nil maps and slices be encoded as empty containers instead of nulls, see
+	// WithNilContainersAsEmpty.
+	nilContainersAsEmpty bool
+
+	// stringifyNumericKeys makes integer map keys be encoded as their decimal string form instead of being dropped, see
+	// WithStringifiedNumericKeys.
+	stringifyNumericKeys bool
+
+	// sortMapKeys makes the entries of the maps larger than containerMaxSize be encoded in the order of their keys, so
+	// that truncating them keeps a deterministic subset of their entries, see WithSortedMapKeys.
+	sortMapKeys bool
+
+	// done interrupts the encoder when closed, like an exhausted timer. It is nil when the encoder cannot be cancelled.
+	done <-chan struct{}
+
+	// ancestors are the containers being encoded, from the root to the current value, so that a container referencing
+	// one of them, such as a slice containing itself, is detected and not encoded again, see enterContainer.
+	ancestors []containerKey
+
+	// totalMaxSize is the size, as counted by cgoRefs.allocatedBytes, beyond which encoding is aborted, 0 meaning no
+	// limit, see WithMaxInputSize. previousSize is the size of the data already encoded by other encoders of the same
+	// run, which counts towards the limit.
+	totalMaxSize uint64
+	previousSize uint64
+
 	cgoRefs          cgoRefPool
 	containerMaxSize int
 	stringMaxSize    int
@@ -70,6 +126,29 @@ func (reason TruncationReason) String() string {
 	}
 }
 
+// Truncations counts the truncations of each TruncationReason that occurred while encoding the address data of a run,
+// as reported by Context.LastTruncations. A truncated value might hide an attack payload from the WAF rules.
+type Truncations struct {
+	// StringTooLong is the number of strings that were truncated to the maximum string length.
+	StringTooLong int
+	// ContainerTooLarge is the number of containers whose elements beyond the maximum container size were dropped.
+	ContainerTooLarge int
+	// ObjectTooDeep is the number of objects whose values beyond the maximum depth were dropped.
+	ObjectTooDeep int
+}
+
+// add counts the truncations of the given map, as recorded by the encoder.
+func (truncations *Truncations) add(reasons map[TruncationReason][]int) {
+	truncations.StringTooLong += len(reasons[StringTooLong])
+	truncations.ContainerTooLarge += len(reasons[ContainerTooLarge])
+	truncations.ObjectTooDeep += len(reasons[ObjectTooDeep])
+}
+
+// Any returns true if any truncation occurred.
+func (truncations Truncations) Any() bool {
+	return truncations != Truncations{}
+}
+
 const (
 	AppsecFieldTag            = "ddwaf"
 	AppsecFieldTagValueIgnore = "ignore"
@@ -88,6 +167,80 @@ func newLimitedEncoder(timer timer.Timer) encoder {
 	}
 }
 
+// EncoderLimits are the limits the encoder applies to the address data of a single call to Context.RunWithLimits.
+// Values exceeding them are truncated, as reported by Context.Stats. Zero fields fall back to the default limits.
+//
+// Strings are never copied by the encoder, whatever the limits: the wafObjects given to libddwaf point to the bytes of
+// the Go strings themselves, truncated strings included, as they are sliced rather than copied, so that large strings
+// cost no allocation, as BenchmarkEncoder shows. The strings are referenced by the context until the ddwaf_context
+// using them is destroyed, which keeps them from being collected, and the Go garbage collector does not move heap
+// memory, so that they need not be pinned. Go strings being immutable, they cannot be mutated in the meantime either,
+// unless they were built with the unsafe package from byte slices that are later modified, which must be avoided.
+type EncoderLimits struct {
+	MaxContainerDepth int
+	MaxContainerSize  int
+	MaxStringLength   int
+}
+
+// validate returns an error wrapping errors.ErrInvalidLimits if any of the limits is negative.
+func (limits EncoderLimits) validate() error {
+	if limits.MaxContainerDepth < 0 || limits.MaxContainerSize < 0 || limits.MaxStringLength < 0 {
+		return fmt.Errorf("%w: limits cannot be negative: %+v", errors.ErrInvalidLimits, limits)
+	}
+	return nil
+}
+
+// apply sets the non-zero limits on the given encoder.
+func (limits EncoderLimits) apply(encoder *encoder) {
+	if limits.MaxContainerDepth > 0 {
+		encoder.objectMaxDepth = limits.MaxContainerDepth
+	}
+	if limits.MaxContainerSize > 0 {
+		encoder.containerMaxSize = limits.MaxContainerSize
+	}
+	if limits.MaxStringLength > 0 {
+		encoder.stringMaxSize = limits.MaxStringLength
+	}
+}
+
+// interrupted returns true when the encoder must stop encoding, either because its timer is exhausted, because it
+// was cancelled or because the encoded data exceeds its total size limit.
+func (encoder *encoder) interrupted() bool {
+	select {
+	case <-encoder.done:
+		return true
+	default:
+		return encoder.timer.Exhausted() || encoder.tooLarge()
+	}
+}
+
+// tooLarge returns true when the size of the data encoded so far exceeds the total size limit of the encoder.
+func (encoder *encoder) tooLarge() bool {
+	return encoder.totalMaxSize > 0 && encoder.previousSize+encoder.cgoRefs.allocatedBytes > encoder.totalMaxSize
+}
+
+// inputTooLargeError returns the error reported when the encoded data exceeds the total size limit of the encoder.
+func (encoder *encoder) inputTooLargeError() error {
+	return fmt.Errorf("%w: more than %d bytes", errors.ErrInputTooLarge, encoder.totalMaxSize)
+}
+
+// newConfiguredEncoder returns a limited encoder, as returned by newLimitedEncoder, with the encoding options of the
+// given configuration applied.
+func newConfiguredEncoder(timer timer.Timer, cfg config) encoder {
+	encoder := newLimitedEncoder(timer)
+	encoder.jsonMode = cfg.jsonMode
+	encoder.nonFiniteFloatPolicy = cfg.nonFiniteFloatPolicy
+	encoder.skipUnsupportedTopLevel = cfg.skipUnsupportedTopLevel
+	encoder.floatFormat = cfg.floatFormat
+	encoder.floatPrecision = cfg.floatPrecision
+	encoder.totalMaxSize = cfg.maxInputSize
+	encoder.sortMapKeys = cfg.sortMapKeys
+	encoder.jsonTags = cfg.jsonTags
+	encoder.nilContainersAsEmpty = cfg.nilContainersAsEmpty
+	encoder.stringifyNumericKeys = cfg.stringifyNumericKeys
+	return encoder
+}
+
 func newMaxEncoder() encoder {
 	timer, _ := timer.NewTimer(timer.WithUnlimitedBudget())
 	return encoder{
@@ -101,18 +254,41 @@ func newMaxEncoder() encoder {
 // Encode takes a Go value and returns a wafObject pointer and an error.
 // The returned wafObject is the root of the tree of nested wafObjects representing the Go value.
 // The only error case is if the top-level object is "Unusable" which means that the data is nil or a non-data type
-// like a function or a channel.
+// like a function or a channel, in which case the error is an *errors.UnsupportedValueError. Unsupported values nested
+// in the data are skipped instead, and their errors are kept in encoder.unsupportedValues with their path.
 func (encoder *encoder) Encode(data any) (wo *bindings.WafObject, err error) {
-	value := reflect.ValueOf(data)
 	wo = &bindings.WafObject{}
+	err = encoder.encodeRoot(wo, data)
+	return
+}
 
-	err = encoder.encode(value, wo, encoder.objectMaxDepth)
+// EncodeInto is the same as Encode, but encodes data into the given wafObject, and allocates the wafObject arrays of
+// the tree out of a pool of pre-allocated slabs, which considerably reduces the allocations of repeated encodings.
+// The slabs must be given back to the pool with encoder.cgoRefs.release() once libddwaf no longer uses the encoded
+// data, after which neither dst nor the cgoRefs of the encoder can be used anymore.
+func (encoder *encoder) EncodeInto(dst *bindings.WafObject, data any) error {
+	encoder.cgoRefs.pooled = true
+	return encoder.encodeRoot(dst, data)
+}
+
+// encodeRoot encodes data into the given wafObject, which is the root of the tree of nested wafObjects.
+func (encoder *encoder) encodeRoot(wo *bindings.WafObject, data any) error {
+	encoder.cgoRefs.allocatedBytes += wafObjectSize
+	value := reflect.ValueOf(data)
+	err := encoder.encode(value, wo, encoder.objectMaxDepth)
+	if err != nil && encoder.skipsUnsupported(err, encoder.objectMaxDepth) {
+		encoder.cgoRefs.AllocWafArray(wo, bindings.WafMapType, 0)
+		err = nil
+	}
 
 	if len(encoder.truncations[ObjectTooDeep]) != 0 && !encoder.timer.Exhausted() {
 		encoder.measureObjectDepth(value, encoder.timer.Remaining())
 	}
 
-	return
+	if encoder.tooLarge() {
+		return encoder.inputTooLargeError()
+	}
+	return err
 }
 
 // Truncations returns all truncations that happened since the last call to `Truncations()`, and clears the internal
@@ -146,7 +322,10 @@ func isValueNil(value reflect.Value) bool {
 }
 
 func (encoder *encoder) encode(value reflect.Value, obj *bindings.WafObject, depth int) error {
-	if encoder.timer.Exhausted() {
+	if encoder.tooLarge() {
+		return encoder.inputTooLargeError()
+	}
+	if encoder.interrupted() {
 		return errors.ErrTimeout
 	}
 
@@ -154,11 +333,12 @@ func (encoder *encoder) encode(value reflect.Value, obj *bindings.WafObject, dep
 	if (kind == reflect.Interface || kind == reflect.Pointer) && !value.IsNil() {
 		// resolvePointer failed to resolve to something that's not a pointer, it
 		// has indirected too many times...
+		encoder.droppedValues++
 		return errors.ErrTooManyIndirections
 	}
 
 	// Measure-only runs for leaves
-	if obj == nil && kind != reflect.Array && kind != reflect.Slice && kind != reflect.Map && kind != reflect.Struct {
+	if obj == nil && (kind != reflect.Array && kind != reflect.Slice && kind != reflect.Map && kind != reflect.Struct || value.Type() == timeType || marshalsText(value) || isSQLValuer(value)) {
 		// Nothing to do, we were only here to measure object depth!
 		return nil
 	}
@@ -167,26 +347,39 @@ func (encoder *encoder) encode(value reflect.Value, obj *bindings.WafObject, dep
 	// Terminal cases (leaves of the tree)
 	//		Is invalid type: nil interfaces for example, cannot be used to run any reflect method or it's susceptible to panic
 	case !value.IsValid() || kind == reflect.Invalid:
-		return errors.ErrUnsupportedValue
+		if encoder.jsonMode {
+			// nil interfaces are how JSON nulls are decoded
+			encodeNative[uintptr](0, bindings.WafNilType, obj)
+			return nil
+		}
+		return encoder.unsupportedValue(kind)
+	//		Nil maps and slices, as empty containers when the encoder is configured so, see WithNilContainersAsEmpty
+	case encoder.nilContainersAsEmpty && isValueNil(value) && isEmptiableContainer(value.Type()):
+		encoder.encodeEmptyContainer(kind, obj)
+
 	// 		Is nullable type: nil pointers, channels, maps or functions
 	case isValueNil(value):
 		encodeNative[uintptr](0, bindings.WafNilType, obj)
 
-	// 		Booleans
-	case kind == reflect.Bool:
-		encodeNative(unsafe.NativeToUintptr(value.Bool()), bindings.WafBoolType, obj)
+	//		JSON numbers decoded with json.Decoder.UseNumber, as numbers rather than as the strings they are made of
+	case value.Type() == jsonNumberType:
+		encodeJSONNumber(json.Number(value.String()), obj, encoder)
 
-	// 		Numbers
-	case value.CanInt(): // any int type or alias
-		encodeNative(value.Int(), bindings.WafIntType, obj)
-	case value.CanUint(): // any Uint type or alias
-		encodeNative(value.Uint(), bindings.WafUintType, obj)
-	case value.CanFloat(): // any float type or alias
-		encodeNative(unsafe.NativeToUintptr(value.Float()), bindings.WafFloatType, obj)
+	//		Times, as RFC 3339 strings that rules can match, while durations are encoded as their nanoseconds like any int64
+	case kind == reflect.Struct && value.Type() == timeType && value.CanInterface():
+		encoder.encodeString(value.Interface().(time.Time).Format(time.RFC3339Nano), obj)
 
-	//		Strings
-	case kind == reflect.String: // string type
-		encoder.encodeString(value.String(), obj)
+	//		Values implementing encoding.TextMarshaler, such as net.IP, as their canonical text form
+	case marshalsText(value):
+		return encoder.encodeTextMarshaler(value, kind, obj)
+
+	//		Values implementing driver.Valuer, such as sql.NullString, as the value they hold, or null when they hold none
+	case isSQLValuer(value):
+		return encoder.encodeSQLValuer(value, kind, obj, depth)
+
+	// 		Booleans, numbers and strings
+	case isScalarKind(kind):
+		return encoder.encodeScalar(value, kind, obj)
 
 	case (kind == reflect.Array || kind == reflect.Slice) && value.Type().Elem().Kind() == reflect.Uint8:
 		// Byte Arrays are skipped voluntarily because they are often used
@@ -201,21 +394,326 @@ func (encoder *encoder) encode(value reflect.Value, obj *bindings.WafObject, dep
 		encoder.addTruncation(ObjectTooDeep, -1)
 		return errors.ErrMaxDepthExceeded
 
+	//		Maps of strings, such as http.Header, whose entries are encoded without going through reflection
+	case kind == reflect.Map && value.CanInterface() && value.Type().ConvertibleTo(stringMapType):
+		encoder.encodeStringMap(value.Convert(stringMapType).Interface().(map[string]string), obj, depth-1)
+	case kind == reflect.Map && value.CanInterface() && value.Type().ConvertibleTo(stringSliceMapType):
+		encoder.encodeStringSliceMap(value.Convert(stringSliceMapType).Interface().(map[string][]string), obj, depth-1)
+
+	//		Cyclic values are only encoded up to the first repetition of a container, which is dropped
+	case encoder.isAncestor(value, kind):
+		return errors.ErrCyclicValue
+
 	// 		Either an array or a slice of an array
 	case kind == reflect.Array || kind == reflect.Slice:
+		defer encoder.leaveContainer(encoder.enterContainer(value, kind))
 		encoder.encodeArray(value, obj, depth-1)
 	case kind == reflect.Map:
+		defer encoder.leaveContainer(encoder.enterContainer(value, kind))
 		encoder.encodeMap(value, obj, depth-1)
 	case kind == reflect.Struct:
+		defer encoder.leaveContainer(encoder.enterContainer(value, kind))
 		encoder.encodeStruct(value, obj, depth-1)
 
 	default:
-		return errors.ErrUnsupportedValue
+		return encoder.unsupportedValue(kind)
 	}
 
 	return nil
 }
 
+// containerKey identifies a container in memory, as the address of its contents along with its type, as a struct has
+// the same address as its first field, and its length, as a slice has the same address as its sub-slices.
+type containerKey struct {
+	ptr    uintptr
+	typ    reflect.Type
+	length int
+}
+
+// containerKeyOf returns the key of the given container, and false when the container cannot be part of a cycle: a
+// struct or an array that is not addressable, as it was not reached through a pointer, an empty slice, or a container
+// of scalars.
+func containerKeyOf(value reflect.Value, kind reflect.Kind) (containerKey, bool) {
+	switch kind {
+	case reflect.Map:
+		return containerKey{ptr: value.Pointer(), typ: value.Type()}, true
+	case reflect.Slice:
+		if value.Len() == 0 || isScalarKind(value.Type().Elem().Kind()) {
+			return containerKey{}, false
+		}
+		return containerKey{ptr: value.Pointer(), typ: value.Type(), length: value.Len()}, true
+	case reflect.Array, reflect.Struct:
+		if !value.CanAddr() {
+			return containerKey{}, false
+		}
+		return containerKey{ptr: value.UnsafeAddr(), typ: value.Type()}, true
+	default:
+		return containerKey{}, false
+	}
+}
+
+// isAncestor returns true if the given value is one of the containers being encoded, and thus part of a cycle.
+func (encoder *encoder) isAncestor(value reflect.Value, kind reflect.Kind) bool {
+	key, ok := containerKeyOf(value, kind)
+	return ok && containsKey(encoder.ancestors, key)
+}
+
+// containsKey returns true if the given container key is one of the given ancestors.
+func containsKey(ancestors []containerKey, key containerKey) bool {
+	for _, ancestor := range ancestors {
+		if ancestor == key {
+			return true
+		}
+	}
+	return false
+}
+
+// enterContainer records the given container as being encoded until leaveContainer is called with the returned values.
+func (encoder *encoder) enterContainer(value reflect.Value, kind reflect.Kind) (containerKey, bool) {
+	key, ok := containerKeyOf(value, kind)
+	if ok {
+		encoder.ancestors = append(encoder.ancestors, key)
+	}
+	return key, ok
+}
+
+// leaveContainer records the container entered with enterContainer as no longer being encoded.
+func (encoder *encoder) leaveContainer(_ containerKey, entered bool) {
+	if entered {
+		encoder.ancestors = encoder.ancestors[:len(encoder.ancestors)-1]
+	}
+}
+
+// skipsUnsupported returns true if the value whose encoding at the given depth failed with err must be encoded as an
+// empty map instead, as an unsupported top-level value of an encoder with skipUnsupportedTopLevel set. Top-level values
+// are the root value and the values of a root map, encoded at depth objectMaxDepth-1.
+func (encoder *encoder) skipsUnsupported(err error, depth int) bool {
+	_, unsupported := err.(*errors.UnsupportedValueError)
+	return unsupported && encoder.skipUnsupportedTopLevel && depth >= encoder.objectMaxDepth-1
+}
+
+// maxUnsupportedValues is the maximum number of unsupported values an encoder keeps the error of.
+const maxUnsupportedValues = 16
+
+// unsupportedValue counts a value of the given kind as dropped, and returns its error, which has an empty path until
+// the containers of the value prefix it with their keys, see prefixUnsupportedValues.
+func (encoder *encoder) unsupportedValue(kind reflect.Kind) error {
+	encoder.droppedValues++
+	err := &errors.UnsupportedValueError{Kind: kind}
+	if len(encoder.unsupportedValues) < maxUnsupportedValues {
+		encoder.unsupportedValues = append(encoder.unsupportedValues, err)
+	}
+	return err
+}
+
+// prefixUnsupportedValues prefixes the path of the unsupported values found since the from-th one with the given key,
+// as they were found while encoding the element of a container under this key.
+func (encoder *encoder) prefixUnsupportedValues(from int, key string) {
+	for _, err := range encoder.unsupportedValues[from:] {
+		err.Path = append([]string{key}, err.Path...)
+	}
+}
+
+// isScalarKind returns true if values of the given kind are encoded as WAF scalars: booleans, numbers and strings.
+func isScalarKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	default:
+		return false
+	}
+}
+
+// isIntKind returns true if the given kind is one of the signed integer kinds.
+func isIntKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	default:
+		return false
+	}
+}
+
+// isUintKind returns true if the given kind is one of the unsigned integer kinds.
+func isUintKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	default:
+		return false
+	}
+}
+
+// encodeScalar takes a reflect.Value of a scalar kind (as reported by isScalarKind) and encodes it into obj. The only
+// error case is a non-finite float rejected by the NonFiniteFloatPolicy of the encoder.
+func (encoder *encoder) encodeScalar(value reflect.Value, kind reflect.Kind, obj *bindings.WafObject) error {
+	switch {
+	case kind == reflect.Bool:
+		encodeNative(unsafe.NativeToUintptr(value.Bool()), bindings.WafBoolType, obj)
+	case value.CanInt(): // any int type or alias
+		encodeNative(value.Int(), bindings.WafIntType, obj)
+	case value.CanUint(): // any Uint type or alias
+		encodeNative(value.Uint(), bindings.WafUintType, obj)
+	case value.CanFloat(): // any float type or alias
+		return encoder.encodeFloat(value.Float(), value.Type().Bits(), obj)
+	default: // string type or alias
+		encoder.encodeString(value.String(), obj)
+	}
+	return nil
+}
+
+// encodeFloat encodes the given float of the given bit size into obj, formatting it as a string when the encoder has a
+// floatFormat, and applying the NonFiniteFloatPolicy of the encoder to NaN and infinite values.
+func (encoder *encoder) encodeFloat(value float64, bitSize int, obj *bindings.WafObject) error {
+	if !math.IsNaN(value) && !math.IsInf(value, 0) {
+		if encoder.floatFormat != 0 {
+			encoder.encodeString(strconv.FormatFloat(value, encoder.floatFormat, encoder.floatPrecision, bitSize), obj)
+			return nil
+		}
+		encodeNative(unsafe.NativeToUintptr(value), bindings.WafFloatType, obj)
+		return nil
+	}
+
+	switch encoder.nonFiniteFloatPolicy {
+	case EncodeNonFiniteAsNull:
+		encodeNative[uintptr](0, bindings.WafNilType, obj)
+	case EncodeNonFiniteAsString:
+		encoder.encodeString(strconv.FormatFloat(value, 'g', -1, 64), obj)
+	case RejectNonFiniteFloats:
+		return encoder.unsupportedValue(reflect.Float64)
+	default:
+		encodeNative(unsafe.NativeToUintptr(value), bindings.WafFloatType, obj)
+	}
+	return nil
+}
+
+var jsonNumberType = reflect.TypeOf(json.Number(""))
+
+// isEmptiableContainer returns true if the nil values of the given type are encoded as empty containers by encoders
+// configured with WithNilContainersAsEmpty, which is the case of maps and slices other than byte slices.
+func isEmptiableContainer(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Map || typ.Kind() == reflect.Slice && typ.Elem().Kind() != reflect.Uint8
+}
+
+// encodeEmptyContainer encodes an empty WAF map when the given kind is reflect.Map, and an empty WAF array otherwise.
+func (encoder *encoder) encodeEmptyContainer(kind reflect.Kind, obj *bindings.WafObject) {
+	if kind == reflect.Map {
+		encoder.cgoRefs.AllocWafArray(obj, bindings.WafMapType, 0)
+		return
+	}
+	encoder.cgoRefs.AllocWafArray(obj, bindings.WafArrayType, 0)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// isTextMarshalerType returns true if the values of the given type implement encoding.TextMarshaler, either directly or
+// through a pointer receiver, in which case only addressable values can be encoded as their text form.
+func isTextMarshalerType(typ reflect.Type) bool {
+	return implementsEither(typ, textMarshalerType)
+}
+
+// marshalsText returns true if the MarshalText method of the given value, which must be valid, can be used to encode
+// it: its type implements encoding.TextMarshaler, either directly or through a pointer receiver when the value is
+// addressable, and it is not an unexported struct field.
+func marshalsText(value reflect.Value) bool {
+	return canCall(value, textMarshalerType)
+}
+
+// implementsEither returns true if the given type implements the given interface, either directly or through a pointer
+// receiver.
+func implementsEither(typ, iface reflect.Type) bool {
+	return typ.Implements(iface) || reflect.PointerTo(typ).Implements(iface)
+}
+
+// canCall returns true if the methods of the given interface can be called on the given value, which must be valid:
+// its type implements the interface, either directly or through a pointer receiver when the value is addressable, and
+// it is not an unexported struct field.
+func canCall(value reflect.Value, iface reflect.Type) bool {
+	if !value.CanInterface() {
+		return false
+	}
+	typ := value.Type()
+	return typ.Implements(iface) || value.CanAddr() && reflect.PointerTo(typ).Implements(iface)
+}
+
+// encodeTextMarshaler encodes the given value, for which marshalsText is true, as the string returned by its
+// MarshalText method. A MarshalText error makes the value unsupported.
+func (encoder *encoder) encodeTextMarshaler(value reflect.Value, kind reflect.Kind, obj *bindings.WafObject) error {
+	marshaler, isMarshaler := value.Interface().(encoding.TextMarshaler)
+	if !isMarshaler {
+		marshaler = value.Addr().Interface().(encoding.TextMarshaler)
+	}
+	text, err := marshaler.MarshalText()
+	if err != nil {
+		return encoder.unsupportedValue(kind)
+	}
+	encoder.encodeString(string(text), obj)
+	return nil
+}
+
+var sqlValuerType = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+
+// isSQLValuerType returns true if the values of the given type implement driver.Valuer, either directly or through a
+// pointer receiver, as isTextMarshalerType does for encoding.TextMarshaler.
+func isSQLValuerType(typ reflect.Type) bool {
+	return implementsEither(typ, sqlValuerType)
+}
+
+// isSQLValuer returns true if the Value method of the given value, which must be valid, can be used to encode it, as
+// marshalsText does for encoding.TextMarshaler.
+func isSQLValuer(value reflect.Value) bool {
+	return canCall(value, sqlValuerType)
+}
+
+// encodeSQLValuer encodes the given value, for which isSQLValuer is true, as the value returned by its Value method,
+// so that nullable database types, such as sql.NullString or sql.NullInt64, are encoded as the scalar they hold when
+// valid, and as null otherwise. Byte slices are encoded as strings. A Value error makes the value unsupported.
+func (encoder *encoder) encodeSQLValuer(value reflect.Value, kind reflect.Kind, obj *bindings.WafObject, depth int) error {
+	valuer, isValuer := value.Interface().(driver.Valuer)
+	if !isValuer {
+		valuer = value.Addr().Interface().(driver.Valuer)
+	}
+	inner, err := valuer.Value()
+	if err != nil {
+		return encoder.unsupportedValue(kind)
+	}
+
+	switch inner := inner.(type) {
+	case nil:
+		encodeNative[uintptr](0, bindings.WafNilType, obj)
+		return nil
+	case []byte:
+		encoder.encodeString(string(inner), obj)
+		return nil
+	default:
+		return encoder.encode(reflect.ValueOf(inner), obj, depth)
+	}
+}
+
+var (
+	stringMapType      = reflect.TypeOf(map[string]string(nil))
+	stringSliceMapType = reflect.TypeOf(map[string][]string(nil))
+)
+
+// encodeJSONNumber encodes a json.Number as a WAF integer when it is one that fits 64 bits, or as a WAF float otherwise.
+// Numbers that cannot be parsed are encoded as strings, as json.Number is.
+func encodeJSONNumber(number json.Number, obj *bindings.WafObject, encoder *encoder) {
+	if i, err := strconv.ParseInt(string(number), 10, 64); err == nil {
+		encodeNative(i, bindings.WafIntType, obj)
+	} else if u, err := strconv.ParseUint(string(number), 10, 64); err == nil {
+		encodeNative(u, bindings.WafUintType, obj)
+	} else if f, err := number.Float64(); err == nil {
+		_ = encoder.encodeFloat(f, 64, obj)
+	} else {
+		encoder.encodeString(string(number), obj)
+	}
+}
+
 func (encoder *encoder) encodeString(str string, obj *bindings.WafObject) {
 	size := len(str)
 	if size > encoder.stringMaxSize {
@@ -235,7 +733,7 @@ func getFieldNameFromType(field reflect.StructField) (string, bool) {
 
 	// Use the json tag name as field name if present
 	if tag, ok := field.Tag.Lookup("json"); ok {
-		if i := strings.IndexByte(tag, byte(',')); i > 0 {
+		if i := strings.IndexByte(tag, byte(',')); i >= 0 {
 			tag = tag[:i]
 		}
 		if len(tag) > 0 {
@@ -246,6 +744,49 @@ func getFieldNameFromType(field reflect.StructField) (string, bool) {
 	return fieldName, true
 }
 
+// omittedByJSONTag returns true if the given struct field is left out by encoding/json according to its json tag, see
+// WithJSONTags: the field is either always omitted with `json:"-"`, or omitted with the omitempty option when it holds
+// false, 0, a nil pointer or interface, or an empty array, slice, map or string.
+func omittedByJSONTag(field reflect.StructField, value reflect.Value) bool {
+	tag, ok := field.Tag.Lookup("json")
+	if !ok {
+		return false
+	}
+	if tag == "-" {
+		return true
+	}
+
+	_, options, _ := strings.Cut(tag, ",")
+	for options != "" {
+		var option string
+		option, options, _ = strings.Cut(options, ",")
+		if option == "omitempty" {
+			return isEmptyValue(value)
+		}
+	}
+	return false
+}
+
+// isEmptyValue returns true if the given value is empty according to the omitempty option of encoding/json.
+func isEmptyValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return value.Len() == 0
+	case reflect.Bool:
+		return !value.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return value.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return value.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return value.IsNil()
+	default:
+		return false
+	}
+}
+
 // encodeStruct takes a reflect.Value and a wafObject pointer and iterates on the struct field to build
 // a wafObject map of type wafMapType. The specificities are the following:
 // - It will only take the first encoder.containerMaxSize elements of the struct
@@ -253,7 +794,7 @@ func getFieldNameFromType(field reflect.StructField) (string, bool) {
 // - Private fields and also values producing an error at encoding will be skipped
 // - Even if the element values are invalid or null we still keep them to report the field name
 func (encoder *encoder) encodeStruct(value reflect.Value, obj *bindings.WafObject, depth int) {
-	if encoder.timer.Exhausted() {
+	if encoder.interrupted() {
 		return
 	}
 
@@ -268,7 +809,7 @@ func (encoder *encoder) encodeStruct(value reflect.Value, obj *bindings.WafObjec
 
 	objArray := encoder.cgoRefs.AllocWafArray(obj, bindings.WafMapType, uint64(capacity))
 	for i := 0; i < nbFields; i++ {
-		if encoder.timer.Exhausted() {
+		if encoder.interrupted() {
 			return
 		}
 
@@ -284,15 +825,22 @@ func (encoder *encoder) encodeStruct(value reflect.Value, obj *bindings.WafObjec
 			// 		or the field was explicitly set with `ddwaf:ignore`
 			continue
 		}
+		if encoder.jsonTags && omittedByJSONTag(fieldType, value.Field(i)) {
+			continue
+		}
 
 		objElem := &objArray[length]
 		// If the Map key is of unsupported type, skip it
 		encoder.encodeMapKeyFromString(fieldName, objElem)
 
+		unsupported := len(encoder.unsupportedValues)
 		if err := encoder.encode(value.Field(i), objElem, depth); err != nil {
 			// We still need to keep the map key, so we can't discard the full object, instead, we make the value a noop
 			encodeNative[uintptr](0, bindings.WafInvalidType, objElem)
 		}
+		if len(encoder.unsupportedValues) > unsupported {
+			encoder.prefixUnsupportedValues(unsupported, fieldName)
+		}
 
 		length++
 	}
@@ -306,56 +854,212 @@ func (encoder *encoder) encodeStruct(value reflect.Value, obj *bindings.WafObjec
 // - It will only take the first encoder.containerMaxSize elements of the map
 // - Even if the element values are invalid or null we still keep them to report the map key
 func (encoder *encoder) encodeMap(value reflect.Value, obj *bindings.WafObject, depth int) {
-	capacity := value.Len()
+	rangeEntries := func(sorted bool, yield func(key, elem reflect.Value) bool) {
+		if !sorted {
+			for iter := value.MapRange(); iter.Next(); {
+				if !yield(iter.Key(), iter.Value()) {
+					return
+				}
+			}
+			return
+		}
+		keys := value.MapKeys()
+		encoder.sortKeys(keys)
+		for _, key := range keys {
+			if !yield(key, value.MapIndex(key)) {
+				return
+			}
+		}
+	}
+
+	encodeMapEntries(encoder, obj, value.Len(), rangeEntries, func(key, elem reflect.Value, objElem *bindings.WafObject) bool {
+		if err := encoder.encodeMapKey(key, objElem); err != nil {
+			encoder.droppedValues++
+			return false
+		}
+
+		unsupported := len(encoder.unsupportedValues)
+		if err := encoder.encode(elem, objElem, depth); err != nil && encoder.skipsUnsupported(err, depth) {
+			encoder.cgoRefs.AllocWafArray(objElem, bindings.WafMapType, 0)
+		} else if err != nil {
+			// We still need to keep the map key, so we can't discard the full object, instead, we make the value a noop
+			encodeNative[uintptr](0, bindings.WafInvalidType, objElem)
+		}
+		if len(encoder.unsupportedValues) > unsupported {
+			encoder.prefixUnsupportedValues(unsupported, unsafe.GostringSized(unsafe.Cast[byte](objElem.ParameterName), objElem.ParameterNameLength))
+		}
+		return true
+	})
+}
+
+// encodeMapEntries encodes the entries of a map of the given length into obj, as a wafObject map of type wafMapType of
+// at most encoder.containerMaxSize entries, which encodeMap and its fast paths only differ from by how they range over
+// the map and encode its entries. rangeEntries calls yield on the entries of the map, in the order of their keys when
+// sorted is true, until it returns false, and encodeEntry encodes the given entry into objElem, returning false when
+// the entry is dropped.
+func encodeMapEntries[K, V any](encoder *encoder, obj *bindings.WafObject, length int, rangeEntries func(sorted bool, yield func(K, V) bool), encodeEntry func(key K, value V, objElem *bindings.WafObject) bool) {
+	capacity := length
 	if capacity > encoder.containerMaxSize {
 		capacity = encoder.containerMaxSize
 	}
 
 	objArray := encoder.cgoRefs.AllocWafArray(obj, bindings.WafMapType, uint64(capacity))
 
-	length := 0
-	for iter := value.MapRange(); iter.Next(); {
-		if encoder.timer.Exhausted() {
-			return
+	encoded := 0
+	rangeEntries(encoder.sortsMapKeys(length), func(key K, value V) bool {
+		if encoder.interrupted() {
+			return false
 		}
 
-		if length == capacity {
-			encoder.addTruncation(ContainerTooLarge, value.Len())
-			break
+		if encoded == capacity {
+			encoder.addTruncation(ContainerTooLarge, length)
+			return false
 		}
 
-		objElem := &objArray[length]
-		if err := encoder.encodeMapKey(iter.Key(), objElem); err != nil {
-			continue
+		if encodeEntry(key, value, &objArray[encoded]) {
+			encoded++
 		}
+		return true
+	})
 
-		if err := encoder.encode(iter.Value(), objElem, depth); err != nil {
-			// We still need to keep the map key, so we can't discard the full object, instead, we make the value a noop
+	// Fix the size because we skipped map entries
+	obj.NbEntries = uint64(encoded)
+}
+
+// encodeStringKeyedMap encodes the given map of string keys as encodeMap does, without boxing its entries into
+// reflect.Value. Its values are encoded at the given depth by encodeValue, and as in encodeMap, a value failing to be
+// encoded is kept as a noop value to report its key.
+func encodeStringKeyedMap[V any](encoder *encoder, m map[string]V, obj *bindings.WafObject, depth int, encodeValue func(value V, obj *bindings.WafObject, depth int) error) {
+	rangeEntries := func(sorted bool, yield func(key string, value V) bool) {
+		if !sorted {
+			for key, value := range m {
+				if !yield(key, value) {
+					return
+				}
+			}
+			return
+		}
+		for _, key := range sortedStringKeys(m) {
+			if !yield(key, m[key]) {
+				return
+			}
+		}
+	}
+
+	encodeMapEntries(encoder, obj, len(m), rangeEntries, func(key string, value V, objElem *bindings.WafObject) bool {
+		encoder.encodeMapKeyFromString(key, objElem)
+		if err := encodeValue(value, objElem, depth); err != nil {
 			encodeNative[uintptr](0, bindings.WafInvalidType, objElem)
 		}
+		return true
+	})
+}
 
-		length++
+// sortsMapKeys returns true when the entries of a map of the given length must be encoded in the order of their keys,
+// which is only the case when the encoder keeps a deterministic subset of the entries of the maps it truncates, see
+// WithSortedMapKeys, and the map is going to be truncated.
+func (encoder *encoder) sortsMapKeys(length int) bool {
+	return encoder.sortMapKeys && length > encoder.containerMaxSize
+}
+
+// sortKeys sorts the given map keys in ascending order of the strings they are encoded as, invalid keys last.
+func (encoder *encoder) sortKeys(keys []reflect.Value) {
+	type sortedKey struct {
+		key   reflect.Value
+		str   string
+		valid bool
+	}
+	sorted := make([]sortedKey, len(keys))
+	for i, key := range keys {
+		sorted[i].key = key
+		sorted[i].str, sorted[i].valid = encoder.mapKeyString(key)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].valid != sorted[j].valid {
+			return sorted[i].valid
+		}
+		return sorted[i].str < sorted[j].str
+	})
+	for i := range sorted {
+		keys[i] = sorted[i].key
+	}
+}
+
+// sortedStringKeys returns the keys of the given map in ascending order.
+func sortedStringKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// encodeStringMap is the fast path of encodeMap for maps whose type is convertible to map[string]string, such as flat
+// maps of headers. Their keys and values are encoded directly as strings, while the same container size and string
+// length limits apply.
+func (encoder *encoder) encodeStringMap(m map[string]string, obj *bindings.WafObject, depth int) {
+	encodeStringKeyedMap(encoder, m, obj, depth, func(value string, obj *bindings.WafObject, _ int) error {
+		encoder.encodeString(value, obj)
+		return nil
+	})
+}
+
+// encodeStringSliceMap is the fast path of encodeMap for maps whose type is convertible to map[string][]string, such
+// as http.Header or url.Values. Their values are encoded by encodeStringSlice, while the same container size, string
+// length and depth limits apply.
+func (encoder *encoder) encodeStringSliceMap(m map[string][]string, obj *bindings.WafObject, depth int) {
+	encodeStringKeyedMap(encoder, m, obj, depth, encoder.encodeStringSlice)
+}
+
+// encodeStringSlice encodes the given strings at the given depth as encode does with a []string: as a null or an empty
+// array when they are nil, see WithNilContainersAsEmpty, and as an array of strings otherwise, unless the depth is
+// exhausted.
+func (encoder *encoder) encodeStringSlice(values []string, obj *bindings.WafObject, depth int) error {
+	switch {
+	case values == nil && encoder.nilContainersAsEmpty:
+		encoder.encodeEmptyContainer(reflect.Slice, obj)
+	case values == nil:
+		encodeNative[uintptr](0, bindings.WafNilType, obj)
+	case depth <= 0:
+		encoder.addTruncation(ObjectTooDeep, -1)
+		return errors.ErrMaxDepthExceeded
+	default:
+		encoder.encodeStringArray(values, obj)
+	}
+	return nil
+}
+
+// encodeStringArray encodes the given strings as an array, as encodeScalarArray does with a reflect.Value.
+func (encoder *encoder) encodeStringArray(values []string, obj *bindings.WafObject) {
+	capacity := len(values)
+	if capacity > encoder.containerMaxSize {
+		capacity = encoder.containerMaxSize
+	}
+
+	objArray := encoder.cgoRefs.AllocWafArray(obj, bindings.WafArrayType, uint64(capacity))
+	length := 0
+	for ; length < capacity; length++ {
+		if encoder.interrupted() {
+			break
+		}
+		encoder.encodeString(values[length], &objArray[length])
+	}
+
+	if length == capacity && capacity < len(values) {
+		encoder.addTruncation(ContainerTooLarge, len(values))
 	}
 
-	// Fix the size because we skipped map entries
 	obj.NbEntries = uint64(length)
 }
 
 // encodeMapKey takes a reflect.Value and a wafObject and returns a wafObject ready to be considered a map entry. We use
 // the function cgoRefPool.AllocWafMapKey to store the key in the wafObject. But first we need to grab the real
 // underlying value by recursing through the pointer and interface values.
+// Keys of any type whose underlying kind is string, such as `type HeaderName string`, are supported.
 func (encoder *encoder) encodeMapKey(value reflect.Value, obj *bindings.WafObject) error {
-	value, kind := resolvePointer(value)
-
-	var keyStr string
-	switch {
-	case kind == reflect.Invalid:
-		return errors.ErrInvalidMapKey
-	case kind == reflect.String:
-		keyStr = value.String()
-	case value.Type() == reflect.TypeOf([]byte(nil)):
-		keyStr = string(value.Bytes())
-	default:
+	keyStr, ok := encoder.mapKeyString(value)
+	if !ok {
 		return errors.ErrInvalidMapKey
 	}
 
@@ -363,6 +1067,25 @@ func (encoder *encoder) encodeMapKey(value reflect.Value, obj *bindings.WafObjec
 	return nil
 }
 
+// mapKeyString returns the string the given map key is encoded as, and false when the key is not a valid map key.
+// Integer keys are only valid when the encoder stringifies them, see WithStringifiedNumericKeys.
+func (encoder *encoder) mapKeyString(value reflect.Value) (string, bool) {
+	value, kind := resolvePointer(value)
+	switch {
+	case kind == reflect.String:
+		return value.String(), true
+	case kind == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8:
+		// Any byte slice type, including named ones such as json.RawMessage
+		return string(value.Bytes()), true
+	case encoder.stringifyNumericKeys && isIntKind(kind):
+		return strconv.FormatInt(value.Int(), 10), true
+	case encoder.stringifyNumericKeys && isUintKind(kind):
+		return strconv.FormatUint(value.Uint(), 10), true
+	default:
+		return "", false
+	}
+}
+
 // encodeMapKeyFromString takes a string and a wafObject and sets the map key attribute on the wafObject to the supplied
 // string. The key may be truncated if it exceeds the maximum string size allowed by the encoder.
 func (encoder *encoder) encodeMapKeyFromString(keyStr string, obj *bindings.WafObject) {
@@ -380,6 +1103,14 @@ func (encoder *encoder) encodeMapKeyFromString(keyStr string, obj *bindings.WafO
 // - It will only take the first encoder.containerMaxSize elements of the array
 // - Elements producing an error at encoding or null values will be skipped
 func (encoder *encoder) encodeArray(value reflect.Value, obj *bindings.WafObject, depth int) {
+	// json.Number elements are strings that must be encoded as numbers, which the fast path does not do, and so
+	// as are elements implementing encoding.TextMarshaler or driver.Valuer, which must be encoded as their text form or
+	// the value they hold
+	if elemType := value.Type().Elem(); isScalarKind(elemType.Kind()) && elemType != jsonNumberType && !isTextMarshalerType(elemType) && !isSQLValuerType(elemType) {
+		encoder.encodeScalarArray(value, obj, elemType.Kind())
+		return
+	}
+
 	length := value.Len()
 
 	capacity := length
@@ -392,7 +1123,7 @@ func (encoder *encoder) encodeArray(value reflect.Value, obj *bindings.WafObject
 	objArray := encoder.cgoRefs.AllocWafArray(obj, bindings.WafArrayType, uint64(capacity))
 
 	for i := 0; i < length; i++ {
-		if encoder.timer.Exhausted() {
+		if encoder.interrupted() {
 			return
 		}
 		if currIndex == capacity {
@@ -401,13 +1132,19 @@ func (encoder *encoder) encodeArray(value reflect.Value, obj *bindings.WafObject
 		}
 
 		objElem := &objArray[currIndex]
-		if err := encoder.encode(value.Index(i), objElem, depth); err != nil {
+		unsupported := len(encoder.unsupportedValues)
+		err := encoder.encode(value.Index(i), objElem, depth)
+		if len(encoder.unsupportedValues) > unsupported {
+			encoder.prefixUnsupportedValues(unsupported, strconv.Itoa(i))
+		}
+		if err != nil {
 			continue
 		}
 
 		// If the element is null or invalid it has no impact on the waf execution, therefore we can skip its
-		// encoding. In this specific case we just overwrite it at the next loop iteration.
-		if objElem == nil || objElem.IsUnusable() {
+		// encoding. In this specific case we just overwrite it at the next loop iteration. JSON nulls are kept in JSON
+		// mode though, so that arrays keep their JSON length and indexes.
+		if objElem == nil || objElem.IsInvalid() || objElem.IsNil() && !encoder.jsonMode {
 			continue
 		}
 
@@ -418,6 +1155,77 @@ func (encoder *encoder) encodeArray(value reflect.Value, obj *bindings.WafObject
 	obj.NbEntries = uint64(currIndex)
 }
 
+// encodeScalarArray is the fast path of encodeArray for arrays and slices whose elements are of a scalar kind, such
+// as [N]int or []string. Such elements cannot be nil, so they are encoded directly without going through the generic
+// encode method, only skipping the floats rejected by the NonFiniteFloatPolicy of the encoder. The same container size
+// limit applies.
+func (encoder *encoder) encodeScalarArray(value reflect.Value, obj *bindings.WafObject, elemKind reflect.Kind) {
+	length := value.Len()
+
+	capacity := length
+	if capacity > encoder.containerMaxSize {
+		capacity = encoder.containerMaxSize
+	}
+
+	objArray := encoder.cgoRefs.AllocWafArray(obj, bindings.WafArrayType, uint64(capacity))
+	i, currIndex := 0, 0
+	for ; i < length && currIndex < capacity; i++ {
+		if encoder.interrupted() {
+			break
+		}
+
+		unsupported := len(encoder.unsupportedValues)
+		if err := encoder.encodeScalar(value.Index(i), elemKind, &objArray[currIndex]); err != nil {
+			if len(encoder.unsupportedValues) > unsupported {
+				encoder.prefixUnsupportedValues(unsupported, strconv.Itoa(i))
+			}
+			continue
+		}
+		currIndex++
+	}
+
+	if currIndex == capacity && i < length {
+		encoder.addTruncation(ContainerTooLarge, length)
+	}
+
+	obj.NbEntries = uint64(currIndex)
+}
+
+// exceedsWafLimits returns true if the limits of the encoder are larger than the ones libddwaf is configured with, in
+// which case libddwaf may ignore parts of the encoded data, as reported by wafTruncates.
+func (encoder *encoder) exceedsWafLimits() bool {
+	return encoder.stringMaxSize > bindings.WafMaxStringLength ||
+		encoder.containerMaxSize > bindings.WafMaxContainerSize ||
+		encoder.objectMaxDepth > bindings.WafMaxContainerDepth
+}
+
+// wafTruncates returns true if libddwaf would ignore parts of the given WAF object because they exceed the string
+// length, container size or depth limits it is configured with.
+func wafTruncates(obj *bindings.WafObject) bool {
+	return wafTruncatesAt(obj, bindings.WafMaxContainerDepth)
+}
+
+func wafTruncatesAt(obj *bindings.WafObject, depth int) bool {
+	if obj.ParameterNameLength > bindings.WafMaxStringLength {
+		return true
+	}
+
+	switch obj.Type {
+	case bindings.WafStringType:
+		return obj.NbEntries > bindings.WafMaxStringLength
+	case bindings.WafArrayType, bindings.WafMapType:
+		if depth <= 0 || obj.NbEntries > bindings.WafMaxContainerSize {
+			return true
+		}
+		for i := uint64(0); i < obj.NbEntries; i++ {
+			if wafTruncatesAt(unsafe.CastWithOffset[bindings.WafObject](obj.Value, i), depth-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (encoder *encoder) addTruncation(reason TruncationReason, size int) {
 	if encoder.truncations == nil {
 		encoder.truncations = make(map[TruncationReason][]int, 3)
@@ -432,19 +1240,26 @@ func (encoder *encoder) measureObjectDepth(obj reflect.Value, timeout time.Durat
 	ctx, cancelCtx := context.WithTimeout(context.Background(), timeout)
 	defer cancelCtx()
 
-	depth, _ := depthOf(ctx, obj)
+	depth, _ := depthOf(ctx, obj, nil)
 	encoder.truncations[ObjectTooDeep] = []int{depth}
 }
 
 // depthOf returns the depth of the provided object. This is 0 for scalar values,
-// such as strings.
-func depthOf(ctx context.Context, obj reflect.Value) (depth int, err error) {
+// such as strings, and for the containers that are one of the given ancestors,
+// as the encoder stops at the first repetition of a cyclic value.
+func depthOf(ctx context.Context, obj reflect.Value, ancestors []containerKey) (depth int, err error) {
 	if err = ctx.Err(); err != nil {
 		// Timed out, won't go any deeper
 		return 0, err
 	}
 
 	obj, kind := resolvePointer(obj)
+	if key, ok := containerKeyOf(obj, kind); ok {
+		if containsKey(ancestors, key) {
+			return 0, nil
+		}
+		ancestors = append(ancestors, key)
+	}
 
 	//TODO: Remove this once Go 1.21 is the minimum supported version (it adds `builtin.max`)
 	max := func(x, y int) int {
@@ -462,7 +1277,7 @@ func depthOf(ctx context.Context, obj reflect.Value) (depth int, err error) {
 			return 0, nil
 		}
 		for i := 0; i < obj.Len(); i++ {
-			itemDepth, err = depthOf(ctx, obj.Index(i))
+			itemDepth, err = depthOf(ctx, obj.Index(i), ancestors)
 			depth = max(depth, itemDepth)
 			if err != nil {
 				break
@@ -471,7 +1286,7 @@ func depthOf(ctx context.Context, obj reflect.Value) (depth int, err error) {
 		return depth + 1, err
 	case reflect.Map:
 		for iter := obj.MapRange(); iter.Next(); {
-			itemDepth, err = depthOf(ctx, iter.Value())
+			itemDepth, err = depthOf(ctx, iter.Value(), ancestors)
 			depth = max(depth, itemDepth)
 			if err != nil {
 				break
@@ -480,6 +1295,10 @@ func depthOf(ctx context.Context, obj reflect.Value) (depth int, err error) {
 		return depth + 1, err
 	case reflect.Struct:
 		typ := obj.Type()
+		if typ == timeType || marshalsText(obj) || isSQLValuer(obj) {
+			// Times and text marshalers are encoded as strings, and driver.Valuer values as the scalar they hold
+			return 0, nil
+		}
 		for i := 0; i < obj.NumField(); i++ {
 			fieldType := typ.Field(i)
 			_, usable := getFieldNameFromType(fieldType)
@@ -487,7 +1306,7 @@ func depthOf(ctx context.Context, obj reflect.Value) (depth int, err error) {
 				continue
 			}
 
-			itemDepth, err = depthOf(ctx, obj.Field(i))
+			itemDepth, err = depthOf(ctx, obj.Field(i), ancestors)
 			depth = max(depth, itemDepth)
 			if err != nil {
 				break
@@ -9,10 +9,18 @@ package waf
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"fmt"
 	"github.com/DataDog/go-libddwaf/v2/timer"
+	"math"
+	"net"
+	"net/http"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -38,12 +46,26 @@ func wafTest(t *testing.T, obj *bindings.WafObject) {
 	require.NoError(t, err)
 }
 
+// Named types used as map keys
+type (
+	headerName string
+	headerID   int
+	rawKey     []byte
+)
+
 func TestEncodeDecode(t *testing.T) {
 
 	// Nil value as Output as a special meaning: the output should be the same as the input
 	// So we use this value in case we need a real nil output value
 	nilOutput := make(chan any, 1)
 
+	var intArray [100]int
+	intArrayOutput := make([]any, len(intArray))
+	for i := range intArray {
+		intArray[i] = i - 50
+		intArrayOutput[i] = int64(i - 50)
+	}
+
 	for _, tc := range []struct {
 		Name        string
 		Input       any
@@ -100,6 +122,21 @@ func TestEncodeDecode(t *testing.T) {
 			Name:  "slice",
 			Input: []any{true, false, false, true, true, true},
 		},
+		{
+			Name:   "int-array",
+			Input:  intArray,
+			Output: intArrayOutput,
+		},
+		{
+			Name:   "string-array",
+			Input:  [3]string{"1", "2", "3"},
+			Output: []any{"1", "2", "3"},
+		},
+		{
+			Name:   "float-array",
+			Input:  [2]float32{1.5, -2.5},
+			Output: []any{1.5, -2.5},
+		},
 		{
 			Name:  "slice-nested",
 			Input: []any{[]any{true, false}, []any{false, false}, []any{true, true, true}},
@@ -226,6 +263,21 @@ func TestEncodeDecode(t *testing.T) {
 			Name:  "slice",
 			Input: []any{float64(33.12345), "ok", int64(27)},
 		},
+		{
+			Name:   "time",
+			Input:  time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC),
+			Output: "2024-03-01T12:30:00Z",
+		},
+		{
+			Name:   "time-pointer",
+			Input:  &struct{ Date *time.Time }{Date: &[]time.Time{time.Date(2024, time.March, 1, 12, 30, 0, 500, time.FixedZone("", 3600))}[0]},
+			Output: map[string]any{"Date": "2024-03-01T12:30:00.0000005+01:00"},
+		},
+		{
+			Name:   "duration",
+			Input:  map[string]any{"elapsed": 1500 * time.Millisecond},
+			Output: map[string]any{"elapsed": int64(1_500_000_000)},
+		},
 		{
 			Name:   "slice-having-unsupported-values",
 			Input:  []any{float64(33.12345), func() {}, "ok", uint64(27)},
@@ -246,6 +298,21 @@ func TestEncodeDecode(t *testing.T) {
 			Input:  map[any]any{"k1": uint64(1), new(string): "string pointer key", "k2": "2"},
 			Output: map[string]any{"k1": uint64(1), "": "string pointer key", "k2": "2"},
 		},
+		{
+			Name:   "map-with-named-string-keys",
+			Input:  map[headerName]string{"user-agent": "Arachni", "accept": "*/*", "": "empty"},
+			Output: map[string]any{"user-agent": "Arachni", "accept": "*/*", "": "empty"},
+		},
+		{
+			Name:   "map-with-mixed-named-string-keys",
+			Input:  map[any]any{headerName("k1"): uint64(1), "k2": "2", headerID(27): "named int key"},
+			Output: map[string]any{"k1": uint64(1), "k2": "2"},
+		},
+		{
+			Name:   "map-with-indirect-named-byte-slice-key",
+			Input:  map[any]any{&rawKey{'k', '1'}: "named byte slice pointer key"},
+			Output: map[string]any{"k1": "named byte slice pointer key"},
+		},
 		{
 			Name: "struct",
 			Input: struct {
@@ -327,7 +394,7 @@ func TestEncodeDecode(t *testing.T) {
 			t.Run("equal", func(t *testing.T) {
 				if tc.EncodeError != nil {
 					require.Error(t, err, "expected an encoding error when encoding %v", tc.Input)
-					require.Equal(t, tc.EncodeError, err)
+					require.ErrorIs(t, err, tc.EncodeError)
 					return
 				}
 
@@ -352,6 +419,583 @@ func TestEncodeDecode(t *testing.T) {
 	}
 }
 
+func TestEncodeJSONMode(t *testing.T) {
+	const document = `{
+		"float": 1.5,
+		"integer": 42,
+		"big": 18446744073709551615,
+		"negative": -7.25e-3,
+		"null": null,
+		"array": [1, null, "x", {"nested": null}],
+		"string": "value"
+	}`
+
+	encodeDecode := func(t *testing.T, jsonMode bool, value any) any {
+		timer, err := timer.NewTimer(timer.WithUnlimitedBudget())
+		require.NoError(t, err)
+		encoder := newConfiguredEncoder(timer, config{jsonMode: jsonMode})
+		encoded, err := encoder.Encode(value)
+		require.NoError(t, err)
+		decoded, err := decodeObject(encoded)
+		require.NoError(t, err)
+		unsafe.KeepAlive(encoder.cgoRefs)
+		return decoded
+	}
+
+	t.Run("any", func(t *testing.T) {
+		var parsed any
+		require.NoError(t, json.Unmarshal([]byte(document), &parsed))
+
+		require.Equal(t, map[string]any{
+			"float":    1.5,
+			"integer":  float64(42),
+			"big":      float64(18446744073709551615),
+			"negative": -7.25e-3,
+			"null":     nil,
+			"array":    []any{float64(1), nil, "x", map[string]any{"nested": nil}},
+			"string":   "value",
+		}, encodeDecode(t, true, parsed))
+	})
+
+	t.Run("null", func(t *testing.T) {
+		var parsed any
+		require.NoError(t, json.Unmarshal([]byte(`null`), &parsed))
+		require.Nil(t, encodeDecode(t, true, parsed))
+	})
+
+	t.Run("use-number", func(t *testing.T) {
+		decoder := json.NewDecoder(strings.NewReader(document))
+		decoder.UseNumber()
+		var parsed any
+		require.NoError(t, decoder.Decode(&parsed))
+
+		require.Equal(t, map[string]any{
+			"float":    1.5,
+			"integer":  int64(42),
+			"big":      uint64(18446744073709551615),
+			"negative": -7.25e-3,
+			"null":     nil,
+			"array":    []any{int64(1), nil, "x", map[string]any{"nested": nil}},
+			"string":   "value",
+		}, encodeDecode(t, true, parsed))
+	})
+
+	t.Run("default-mode", func(t *testing.T) {
+		var parsed any
+		require.NoError(t, json.Unmarshal([]byte(`{"null": null, "array": [1, null]}`), &parsed))
+
+		// Without JSON mode, null array elements are dropped
+		require.Equal(t, map[string]any{"null": nil, "array": []any{float64(1)}}, encodeDecode(t, false, parsed))
+	})
+}
+
+func TestWafTruncates(t *testing.T) {
+	timer, err := timer.NewTimer(timer.WithUnlimitedBudget())
+	require.NoError(t, err)
+	limited := newLimitedEncoder(timer)
+	require.False(t, limited.exceedsWafLimits())
+	require.True(t, (&encoder{stringMaxSize: bindings.WafMaxStringLength + 1}).exceedsWafLimits())
+
+	nested := any("leaf")
+	for i := 0; i < bindings.WafMaxContainerDepth+1; i++ {
+		nested = []any{nested}
+	}
+
+	for _, tc := range []struct {
+		Name      string
+		Input     any
+		Truncates bool
+	}{
+		{Name: "small", Input: map[string]any{"key": []any{"value", 1}}},
+		{Name: "max-string", Input: strings.Repeat("a", bindings.WafMaxStringLength)},
+		{Name: "long-string", Input: strings.Repeat("a", bindings.WafMaxStringLength+1), Truncates: true},
+		{Name: "long-key", Input: map[string]any{strings.Repeat("k", bindings.WafMaxStringLength+1): 1}, Truncates: true},
+		{Name: "large-array", Input: make([]int, bindings.WafMaxContainerSize+1), Truncates: true},
+		{Name: "nested-large-map", Input: []any{make(map[string]int, 0), map[string]any{"m": largeMap(bindings.WafMaxContainerSize + 1)}}, Truncates: true},
+		{Name: "deep", Input: nested, Truncates: true},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			encoder := newMaxEncoder()
+			encoded, err := encoder.Encode(tc.Input)
+			require.NoError(t, err)
+			require.True(t, encoder.exceedsWafLimits())
+			require.Equal(t, tc.Truncates, wafTruncates(encoded))
+			unsafe.KeepAlive(encoder.cgoRefs)
+		})
+	}
+}
+
+// largeMap returns a map with the given number of entries.
+func largeMap(size int) map[string]int {
+	m := make(map[string]int, size)
+	for i := 0; i < size; i++ {
+		m[strconv.Itoa(i)] = i
+	}
+	return m
+}
+
+func TestEncodeNonFiniteFloats(t *testing.T) {
+	encodeDecode := func(t *testing.T, policy NonFiniteFloatPolicy, value any) (any, error) {
+		timer, err := timer.NewTimer(timer.WithUnlimitedBudget())
+		require.NoError(t, err)
+		encoder := newConfiguredEncoder(timer, config{nonFiniteFloatPolicy: policy})
+		encoded, err := encoder.Encode(value)
+		if err != nil {
+			return nil, err
+		}
+		defer unsafe.KeepAlive(encoder.cgoRefs)
+		return decodeObject(encoded)
+	}
+
+	for _, tc := range []struct {
+		Name   string
+		Value  float64
+		String string
+	}{
+		{Name: "NaN", Value: math.NaN(), String: "NaN"},
+		{Name: "+Inf", Value: math.Inf(1), String: "+Inf"},
+		{Name: "-Inf", Value: math.Inf(-1), String: "-Inf"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Run("float", func(t *testing.T) {
+				decoded, err := encodeDecode(t, EncodeNonFiniteAsFloat, tc.Value)
+				require.NoError(t, err)
+				require.IsType(t, float64(0), decoded)
+				require.Equal(t, tc.String, strconv.FormatFloat(decoded.(float64), 'g', -1, 64))
+			})
+
+			t.Run("null", func(t *testing.T) {
+				decoded, err := encodeDecode(t, EncodeNonFiniteAsNull, map[string]any{"value": tc.Value})
+				require.NoError(t, err)
+				require.Equal(t, map[string]any{"value": nil}, decoded)
+			})
+
+			t.Run("string", func(t *testing.T) {
+				decoded, err := encodeDecode(t, EncodeNonFiniteAsString, []float64{1.5, tc.Value})
+				require.NoError(t, err)
+				require.Equal(t, []any{1.5, tc.String}, decoded)
+			})
+
+			t.Run("reject", func(t *testing.T) {
+				_, err := encodeDecode(t, RejectNonFiniteFloats, tc.Value)
+				require.ErrorIs(t, err, errors.ErrUnsupportedValue)
+
+				// Rejected floats are dropped from arrays, including from the scalar array fast path
+				decoded, err := encodeDecode(t, RejectNonFiniteFloats, []float64{1.5, tc.Value, 2.5})
+				require.NoError(t, err)
+				require.Equal(t, []any{1.5, 2.5}, decoded)
+				decoded, err = encodeDecode(t, RejectNonFiniteFloats, []any{1.5, tc.Value, 2.5})
+				require.NoError(t, err)
+				require.Equal(t, []any{1.5, 2.5}, decoded)
+			})
+		})
+	}
+}
+
+func TestEncodeJSONNumber(t *testing.T) {
+	encodeDecode := func(t *testing.T, value any) any {
+		encoder := newMaxEncoder()
+		encoded, err := encoder.Encode(value)
+		require.NoError(t, err)
+		defer unsafe.KeepAlive(encoder.cgoRefs)
+		decoded, err := decodeObject(encoded)
+		require.NoError(t, err)
+		return decoded
+	}
+
+	for _, tc := range []struct {
+		Name     string
+		Input    json.Number
+		Expected any
+	}{
+		{Name: "integer", Input: "42", Expected: int64(42)},
+		{Name: "negative-integer", Input: "-42", Expected: int64(-42)},
+		{Name: "large-integer", Input: "18446744073709551615", Expected: uint64(18446744073709551615)},
+		{Name: "float", Input: "1.5", Expected: 1.5},
+		{Name: "exponent", Input: "-7.25e-3", Expected: -7.25e-3},
+		{Name: "out-of-range", Input: "1e400", Expected: "1e400"},
+		{Name: "not-a-number", Input: "forty-two", Expected: "forty-two"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			require.Equal(t, tc.Expected, encodeDecode(t, tc.Input))
+		})
+	}
+
+	t.Run("containers", func(t *testing.T) {
+		require.Equal(t, []any{int64(1), 2.5}, encodeDecode(t, []json.Number{"1", "2.5"}))
+		require.Equal(t, map[string]any{"count": int64(3)}, encodeDecode(t, map[string]json.Number{"count": "3"}))
+	})
+}
+
+// textID implements encoding.TextMarshaler with a value receiver.
+type textID int
+
+func (id textID) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("id-%d", id)), nil
+}
+
+// pointerTextID implements encoding.TextMarshaler with a pointer receiver.
+type pointerTextID struct {
+	n int
+}
+
+func (id *pointerTextID) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("ptr-%d", id.n)), nil
+}
+
+// failingText implements encoding.TextMarshaler by always returning an error.
+type failingText string
+
+func (failingText) MarshalText() ([]byte, error) {
+	return nil, fmt.Errorf("cannot marshal")
+}
+
+func TestEncodeTextMarshaler(t *testing.T) {
+	encodeDecode := func(t *testing.T, value any) any {
+		encoder := newMaxEncoder()
+		encoded, err := encoder.Encode(value)
+		require.NoError(t, err)
+		defer unsafe.KeepAlive(encoder.cgoRefs)
+		decoded, err := decodeObject(encoded)
+		require.NoError(t, err)
+		return decoded
+	}
+
+	type request struct {
+		IP      net.IP
+		ID      pointerTextID
+		private textID
+	}
+
+	for _, tc := range []struct {
+		Name     string
+		Input    any
+		Expected any
+	}{
+		{Name: "ipv4", Input: net.ParseIP("192.168.0.1"), Expected: "192.168.0.1"},
+		{Name: "ipv6", Input: net.IPv6loopback, Expected: "::1"},
+		{Name: "custom", Input: textID(7), Expected: "id-7"},
+		{Name: "pointer-receiver", Input: &pointerTextID{n: 3}, Expected: "ptr-3"},
+		{Name: "slice", Input: []textID{1, 2}, Expected: []any{"id-1", "id-2"}},
+		{Name: "map", Input: map[string]any{"ip": net.IPv4(10, 0, 0, 1), "id": textID(4)}, Expected: map[string]any{"ip": "10.0.0.1", "id": "id-4"}},
+		{Name: "struct", Input: &request{IP: net.IPv4(127, 0, 0, 1), ID: pointerTextID{n: 5}, private: 6}, Expected: map[string]any{"IP": "127.0.0.1", "ID": "ptr-5"}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			require.Equal(t, tc.Expected, encodeDecode(t, tc.Input))
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		encoder := newMaxEncoder()
+		_, err := encoder.Encode(failingText("value"))
+		require.ErrorIs(t, err, errors.ErrUnsupportedValue)
+
+		encoder = newMaxEncoder()
+		_, err = encoder.Encode(map[string]any{"failing": failingText("value"), "ok": "value"})
+		require.NoError(t, err)
+		require.Equal(t, 1, encoder.droppedValues)
+	})
+}
+
+// bytesValuer implements driver.Valuer by returning its bytes.
+type bytesValuer string
+
+func (v bytesValuer) Value() (driver.Value, error) {
+	return []byte(v), nil
+}
+
+// failingValuer implements driver.Valuer by always returning an error.
+type failingValuer string
+
+func (failingValuer) Value() (driver.Value, error) {
+	return nil, fmt.Errorf("cannot get value")
+}
+
+func TestEncodeSQLValuer(t *testing.T) {
+	encodeDecode := func(t *testing.T, value any) any {
+		encoder := newMaxEncoder()
+		encoded, err := encoder.Encode(value)
+		require.NoError(t, err)
+		defer unsafe.KeepAlive(encoder.cgoRefs)
+		decoded, err := decodeObject(encoded)
+		require.NoError(t, err)
+		return decoded
+	}
+
+	type row struct {
+		Name  sql.NullString
+		Age   sql.NullInt64
+		Email sql.NullString
+	}
+
+	for _, tc := range []struct {
+		Name     string
+		Input    any
+		Expected any
+	}{
+		{Name: "string", Input: sql.NullString{String: "Arachni", Valid: true}, Expected: "Arachni"},
+		{Name: "null-string", Input: sql.NullString{String: "Arachni"}, Expected: nil},
+		{Name: "int64", Input: sql.NullInt64{Int64: 42, Valid: true}, Expected: int64(42)},
+		{Name: "null-int64", Input: sql.NullInt64{}, Expected: nil},
+		{Name: "bool", Input: sql.NullBool{Bool: true, Valid: true}, Expected: true},
+		{Name: "float64", Input: sql.NullFloat64{Float64: 1.5, Valid: true}, Expected: 1.5},
+		{Name: "time", Input: sql.NullTime{Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Valid: true}, Expected: "2024-01-02T03:04:05Z"},
+		{Name: "bytes", Input: bytesValuer("raw"), Expected: "raw"},
+		{Name: "pointer", Input: &sql.NullString{String: "Arachni", Valid: true}, Expected: "Arachni"},
+		// Null values are absent from arrays, as nil values are
+		{Name: "slice", Input: []sql.NullInt64{{Int64: 1, Valid: true}, {}}, Expected: []any{int64(1)}},
+		{
+			Name:     "struct",
+			Input:    row{Name: sql.NullString{String: "Arachni", Valid: true}, Age: sql.NullInt64{Int64: 7, Valid: true}},
+			Expected: map[string]any{"Name": "Arachni", "Age": int64(7), "Email": nil},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			require.Equal(t, tc.Expected, encodeDecode(t, tc.Input))
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		encoder := newMaxEncoder()
+		_, err := encoder.Encode(failingValuer("value"))
+		require.ErrorIs(t, err, errors.ErrUnsupportedValue)
+	})
+}
+
+func TestEncodeFloatFormat(t *testing.T) {
+	encodeDecode := func(t *testing.T, cfg config, value any) any {
+		timer, err := timer.NewTimer(timer.WithUnlimitedBudget())
+		require.NoError(t, err)
+		encoder := newConfiguredEncoder(timer, cfg)
+		encoded, err := encoder.Encode(value)
+		require.NoError(t, err)
+		defer unsafe.KeepAlive(encoder.cgoRefs)
+		decoded, err := decodeObject(encoded)
+		require.NoError(t, err)
+		return decoded
+	}
+
+	value := []any{33.12345, float32(33.62345), 1e21, json.Number("2.50"), math.Inf(1)}
+
+	t.Run("native", func(t *testing.T) {
+		decoded := encodeDecode(t, defaultConfig(), value)
+		require.Equal(t, []any{33.12345, float64(float32(33.62345)), 1e21, 2.5, math.Inf(1)}, decoded)
+	})
+
+	t.Run("shortest", func(t *testing.T) {
+		decoded := encodeDecode(t, defaultConfig().with([]Option{WithFloatFormat('g', -1), WithJSONMode()}), value)
+		require.Equal(t, []any{"33.12345", "33.62345", "1e+21", "2.5", math.Inf(1)}, decoded)
+	})
+
+	t.Run("fixed", func(t *testing.T) {
+		decoded := encodeDecode(t, defaultConfig().with([]Option{WithFloatFormat('f', 2), WithNonFiniteFloatPolicy(EncodeNonFiniteAsString)}), value)
+		require.Equal(t, []any{"33.12", "33.62", "1000000000000000000000.00", "2.50", "+Inf"}, decoded)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		decoded := encodeDecode(t, defaultConfig().with([]Option{WithFloatFormat('g', -1), WithFloatFormat(0, 0)}), 33.12345)
+		require.Equal(t, 33.12345, decoded)
+	})
+}
+
+func TestEncodeJSONTags(t *testing.T) {
+	encodeDecode := func(t *testing.T, cfg config, value any) any {
+		timer, err := timer.NewTimer(timer.WithUnlimitedBudget())
+		require.NoError(t, err)
+		encoder := newConfiguredEncoder(timer, cfg)
+		encoded, err := encoder.Encode(value)
+		require.NoError(t, err)
+		defer unsafe.KeepAlive(encoder.cgoRefs)
+		decoded, err := decodeObject(encoded)
+		require.NoError(t, err)
+		return decoded
+	}
+
+	type user struct {
+		UserName string   `json:"user_name"`
+		Password string   `json:"-"`
+		Dash     string   `json:"-,"`
+		Email    string   `json:"email,omitempty"`
+		Roles    []string `json:",omitempty"`
+		Admin    bool     `json:"admin,omitempty"`
+		Age      int
+	}
+	value := user{UserName: "Arachni", Password: "secret", Dash: "dash", Age: 42}
+
+	t.Run("default", func(t *testing.T) {
+		decoded := encodeDecode(t, defaultConfig(), value)
+		require.Equal(t, map[string]any{
+			"user_name": "Arachni",
+			"-":         "dash",
+			"email":     "",
+			"Roles":     nil,
+			"admin":     false,
+			"Age":       int64(42),
+		}, decoded)
+	})
+
+	t.Run("json-tags", func(t *testing.T) {
+		decoded := encodeDecode(t, defaultConfig().with([]Option{WithJSONTags()}), value)
+		require.Equal(t, map[string]any{"user_name": "Arachni", "-": "dash", "Age": int64(42)}, decoded)
+
+		decoded = encodeDecode(t, defaultConfig().with([]Option{WithJSONTags()}), user{Email: "a@b.c", Roles: []string{"admin"}, Admin: true})
+		require.Equal(t, map[string]any{
+			"user_name": "",
+			"-":         "",
+			"email":     "a@b.c",
+			"Roles":     []any{"admin"},
+			"admin":     true,
+			"Age":       int64(0),
+		}, decoded)
+	})
+}
+
+func TestEncodeNilContainersAsEmpty(t *testing.T) {
+	encode := func(t *testing.T, cfg config, value any) (*bindings.WafObject, any) {
+		timer, err := timer.NewTimer(timer.WithUnlimitedBudget())
+		require.NoError(t, err)
+		encoder := newConfiguredEncoder(timer, cfg)
+		encoded, err := encoder.Encode(value)
+		require.NoError(t, err)
+		t.Cleanup(func() { unsafe.KeepAlive(encoder.cgoRefs) })
+		decoded, err := decodeObject(encoded)
+		require.NoError(t, err)
+		return encoded, decoded
+	}
+	cfg := defaultConfig().with([]Option{WithNilContainersAsEmpty()})
+
+	t.Run("map", func(t *testing.T) {
+		encoded, decoded := encode(t, cfg, map[string]int(nil))
+		require.Equal(t, bindings.WafMapType, encoded.Type)
+		require.Zero(t, encoded.NbEntries)
+		require.Equal(t, map[string]any{}, decoded)
+	})
+
+	t.Run("slice", func(t *testing.T) {
+		encoded, decoded := encode(t, cfg, []int(nil))
+		require.Equal(t, bindings.WafArrayType, encoded.Type)
+		require.Zero(t, encoded.NbEntries)
+		require.Equal(t, []any{}, decoded)
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		_, decoded := encode(t, cfg, map[string]any{
+			"map":     map[string]any(nil),
+			"slices":  [][]int{nil, {1}},
+			"headers": http.Header{"Accept": nil},
+			"bytes":   []byte(nil),
+			"pointer": (*string)(nil),
+		})
+		require.Equal(t, map[string]any{
+			"map":     map[string]any{},
+			"slices":  []any{[]any{}, []any{int64(1)}},
+			"headers": map[string]any{"Accept": []any{}},
+			"bytes":   nil,
+			"pointer": nil,
+		}, decoded)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		encoded, decoded := encode(t, defaultConfig(), map[string]int(nil))
+		require.Equal(t, bindings.WafNilType, encoded.Type)
+		require.Nil(t, decoded)
+
+		_, decoded = encode(t, defaultConfig(), [][]int{nil, {1}})
+		require.Equal(t, []any{[]any{int64(1)}}, decoded)
+	})
+}
+
+func TestEncodeStringifiedNumericKeys(t *testing.T) {
+	encodeDecode := func(t *testing.T, cfg config, value any) (any, int) {
+		timer, err := timer.NewTimer(timer.WithUnlimitedBudget())
+		require.NoError(t, err)
+		encoder := newConfiguredEncoder(timer, cfg)
+		encoded, err := encoder.Encode(value)
+		require.NoError(t, err)
+		defer unsafe.KeepAlive(encoder.cgoRefs)
+		decoded, err := decodeObject(encoded)
+		require.NoError(t, err)
+		return decoded, encoder.droppedValues
+	}
+	cfg := defaultConfig().with([]Option{WithStringifiedNumericKeys()})
+
+	for _, tc := range []struct {
+		Name     string
+		Input    any
+		Expected any
+	}{
+		{Name: "int", Input: map[int]string{200: "OK", -1: "unknown"}, Expected: map[string]any{"200": "OK", "-1": "unknown"}},
+		{Name: "uint", Input: map[uint16]string{404: "Not Found"}, Expected: map[string]any{"404": "Not Found"}},
+		{Name: "named", Input: map[headerID]int{7: 1}, Expected: map[string]any{"7": int64(1)}},
+		{Name: "mixed", Input: map[any]any{"k1": uint64(1), 27: "int key", 1.5: "float key"}, Expected: map[string]any{"k1": uint64(1), "27": "int key"}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			decoded, _ := encodeDecode(t, cfg, tc.Input)
+			require.Equal(t, tc.Expected, decoded)
+		})
+	}
+
+	t.Run("default", func(t *testing.T) {
+		decoded, dropped := encodeDecode(t, defaultConfig(), map[int]string{200: "OK", 404: "Not Found"})
+		require.Equal(t, map[string]any{}, decoded)
+		require.Equal(t, 2, dropped)
+	})
+}
+
+func TestUnsupportedValueError(t *testing.T) {
+	t.Run("top-level", func(t *testing.T) {
+		encoder := newMaxEncoder()
+		_, err := encoder.Encode(make(chan int))
+		require.ErrorIs(t, err, errors.ErrUnsupportedValue)
+
+		var unsupportedErr *errors.UnsupportedValueError
+		require.ErrorAs(t, err, &unsupportedErr)
+		require.Empty(t, unsupportedErr.Path)
+		require.Equal(t, reflect.Chan, unsupportedErr.Kind)
+		require.Equal(t, []*errors.UnsupportedValueError{unsupportedErr}, encoder.unsupportedValues)
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		type body struct {
+			Items []any `json:"items"`
+		}
+		encoder := newMaxEncoder()
+		encoder.nonFiniteFloatPolicy = RejectNonFiniteFloats
+		_, err := encoder.Encode(map[string]any{
+			"body":   body{Items: []any{"ok", map[string]any{"callback": func() {}}}},
+			"floats": []float64{1, math.NaN()},
+			"ok":     "value",
+		})
+		require.NoError(t, err)
+		require.Equal(t, 2, encoder.droppedValues)
+
+		unsupported := make(map[string]reflect.Kind, len(encoder.unsupportedValues))
+		for _, err := range encoder.unsupportedValues {
+			unsupported[strings.Join(err.Path, "/")] = err.Kind
+		}
+		require.Equal(t, map[string]reflect.Kind{
+			"body/items/1/callback": reflect.Func,
+			"floats/1":              reflect.Float64,
+		}, unsupported)
+		require.EqualError(t, encoder.unsupportedValues[0], fmt.Sprintf("unsupported Go value of kind %s at %q",
+			encoder.unsupportedValues[0].Kind, encoder.unsupportedValues[0].Path))
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		values := make([]any, 100)
+		for i := range values {
+			values[i] = func() {}
+		}
+		encoder := newMaxEncoder()
+		_, err := encoder.Encode(values)
+		require.NoError(t, err)
+		require.Equal(t, 100, encoder.droppedValues)
+		require.Len(t, encoder.unsupportedValues, maxUnsupportedValues)
+		require.Equal(t, []string{"0"}, encoder.unsupportedValues[0].Path)
+		require.Equal(t, reflect.Func, encoder.unsupportedValues[0].Kind)
+	})
+}
+
 func TestEncoderLimits(t *testing.T) {
 	var selfPointer any
 	selfPointer = &selfPointer // This now points to itself!
@@ -456,6 +1100,20 @@ func TestEncoderLimits(t *testing.T) {
 			Output:             []any{uint64(1), uint64(2), uint64(3)},
 			Truncations:        map[TruncationReason][]int{ContainerTooLarge: {5}},
 		},
+		{
+			Name:               "scalar-array-max-length",
+			MaxContainerLength: 3,
+			Input:              [5]uint16{1, 2, 3, 4, 5},
+			Output:             []any{uint64(1), uint64(2), uint64(3)},
+			Truncations:        map[TruncationReason][]int{ContainerTooLarge: {5}},
+		},
+		{
+			Name:            "scalar-array-max-string-length",
+			MaxStringLength: 3,
+			Input:           []string{"123456789", "12"},
+			Output:          []any{"123", "12"},
+			Truncations:     map[TruncationReason][]int{StringTooLong: {9}},
+		},
 		{
 			Name:               "array-max-length-with-invalid",
 			MaxContainerLength: 3,
@@ -551,7 +1209,7 @@ func TestEncoderLimits(t *testing.T) {
 
 			if tc.EncodeError != nil {
 				require.Error(t, err, "expected an encoding error when encoding %v", tc.EncodeError)
-				require.Equal(t, tc.EncodeError, err)
+				require.ErrorIs(t, err, tc.EncodeError)
 				return
 			}
 
@@ -575,6 +1233,222 @@ func TestEncoderLimits(t *testing.T) {
 	}
 }
 
+func TestEncodeStringMaps(t *testing.T) {
+	// genericOf returns the given map with its values boxed into interfaces, which the encoder encodes through the
+	// generic reflection path instead of the fast path of string maps
+	genericOf := func(m any) map[string]any {
+		generic := map[string]any{}
+		iter := reflect.ValueOf(m).MapRange()
+		for iter.Next() {
+			generic[iter.Key().String()] = iter.Value().Interface()
+		}
+		return generic
+	}
+
+	for _, tc := range []struct {
+		Name               string
+		Input              any
+		MaxValueDepth      int
+		MaxContainerLength int
+		MaxStringLength    int
+	}{
+		{Name: "string-map", Input: map[string]string{"content-type": "text/html", "user-agent": "Arachni/v1"}},
+		{Name: "string-slice-map", Input: map[string][]string{"accept": {"text/html", "application/json"}, "empty": {}, "nil": nil}},
+		{Name: "http-header", Input: http.Header{"Accept": {"text/html", "application/json"}, "User-Agent": {"Arachni/v1"}}},
+		{Name: "string-map-string-length", Input: map[string]string{"content-type": "text/html", "user-agent": "Arachni/v1"}, MaxStringLength: 4},
+		{Name: "string-slice-map-string-length", Input: http.Header{"Accept": {"text/html", "application/json"}}, MaxStringLength: 4},
+		{Name: "string-slice-map-container-length", Input: http.Header{"Accept": {"text/html", "application/json", "*/*"}}, MaxContainerLength: 2},
+		{Name: "string-slice-map-depth", Input: http.Header{"Accept": {"text/html"}, "Nil": nil}, MaxValueDepth: 1},
+		{Name: "string-slice-map-depth-empty", Input: http.Header{"Empty": {}, "Nil": nil}, MaxValueDepth: 1},
+		{Name: "string-map-depth", Input: map[string]string{"accept": "text/html"}, MaxValueDepth: 1},
+		{Name: "string-map-too-deep", Input: map[string]string{"accept": "text/html"}, MaxValueDepth: -1},
+		{Name: "string-map-container-length", Input: map[string]string{"a": "1", "b": "2", "c": "3"}, MaxContainerLength: 2},
+		{Name: "string-slice-map-entries", Input: map[string][]string{"a": {"1"}, "b": {"2"}, "c": {"3"}}, MaxContainerLength: 2},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			encode := func(value any) (any, error, map[TruncationReason][]int) {
+				encodeTimer, _ := timer.NewTimer(timer.WithUnlimitedBudget())
+				encoder := newLimitedEncoder(encodeTimer)
+				EncoderLimits{MaxContainerDepth: tc.MaxValueDepth, MaxContainerSize: tc.MaxContainerLength, MaxStringLength: tc.MaxStringLength}.apply(&encoder)
+				if tc.MaxValueDepth < 0 {
+					encoder.objectMaxDepth = 0
+				}
+				defer unsafe.KeepAlive(encoder.cgoRefs)
+
+				encoded := &bindings.WafObject{}
+				if err := encoder.encode(reflect.ValueOf(value), encoded, encoder.objectMaxDepth); err != nil {
+					return nil, err, sortValues(encoder.Truncations())
+				}
+				decoded, err := decodeObject(encoded)
+				return decoded, err, sortValues(encoder.Truncations())
+			}
+
+			fast, fastErr, fastTruncations := encode(tc.Input)
+			generic, genericErr, genericTruncations := encode(genericOf(tc.Input))
+			require.Equal(t, genericErr, fastErr)
+			require.Equal(t, genericTruncations, fastTruncations)
+			if _, truncated := fastTruncations[ContainerTooLarge]; truncated && reflect.ValueOf(tc.Input).Len() > tc.MaxContainerLength {
+				// The entries kept are those iterated first, in no particular order
+				require.Len(t, fast, tc.MaxContainerLength)
+				require.Len(t, generic, tc.MaxContainerLength)
+				return
+			}
+			require.Equal(t, generic, fast)
+		})
+	}
+}
+
+func TestEncodeSortedMapKeys(t *testing.T) {
+	encodeDecode := func(t *testing.T, cfg config, value any) any {
+		encodeTimer, err := timer.NewTimer(timer.WithUnlimitedBudget())
+		require.NoError(t, err)
+		encoder := newConfiguredEncoder(encodeTimer, cfg)
+		EncoderLimits{MaxContainerSize: 3}.apply(&encoder)
+		encoded, err := encoder.Encode(value)
+		require.NoError(t, err)
+		defer unsafe.KeepAlive(encoder.cgoRefs)
+		require.Equal(t, map[TruncationReason][]int{ContainerTooLarge: {5}}, encoder.Truncations())
+		decoded, err := decodeObject(encoded)
+		require.NoError(t, err)
+		return decoded
+	}
+
+	key := func(s string) *string { return &s }
+	for _, tc := range []struct {
+		Name     string
+		Input    any
+		Expected any
+	}{
+		{
+			Name:     "map",
+			Input:    map[string]any{"e": 5, "c": 3, "a": 1, "d": 4, "b": 2},
+			Expected: map[string]any{"a": int64(1), "b": int64(2), "c": int64(3)},
+		},
+		{
+			Name:     "pointer-keys",
+			Input:    map[*string]string{key("e"): "5", key("c"): "3", key("a"): "1", key("d"): "4", key("b"): "2"},
+			Expected: map[string]any{"a": "1", "b": "2", "c": "3"},
+		},
+		{
+			Name:     "invalid-keys-last",
+			Input:    map[any]string{1: "1", 2: "2", "c": "3", "a": "1", "b": "2"},
+			Expected: map[string]any{"a": "1", "b": "2", "c": "3"},
+		},
+		{
+			Name:     "string-map",
+			Input:    map[string]string{"e": "5", "c": "3", "a": "1", "d": "4", "b": "2"},
+			Expected: map[string]any{"a": "1", "b": "2", "c": "3"},
+		},
+		{
+			Name:     "string-slice-map",
+			Input:    http.Header{"E": {"5"}, "C": {"3"}, "A": {"1"}, "D": {"4"}, "B": {"2"}},
+			Expected: map[string]any{"A": []any{"1"}, "B": []any{"2"}, "C": []any{"3"}},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			cfg := defaultConfig().with([]Option{WithSortedMapKeys()})
+			// The same entries are kept whatever the iteration order of the map
+			for i := 0; i < 20; i++ {
+				require.Equal(t, tc.Expected, encodeDecode(t, cfg, tc.Input))
+			}
+		})
+	}
+}
+
+func TestEncodeStringsWithoutCopy(t *testing.T) {
+	encodeTimer, err := timer.NewTimer(timer.WithUnlimitedBudget())
+	require.NoError(t, err)
+	encoder := newConfiguredEncoder(encodeTimer, defaultConfig())
+	EncoderLimits{MaxStringLength: 1024}.apply(&encoder)
+
+	str := strings.Repeat("Arachni", 16*1024/7)
+	encoded, err := encoder.Encode([]any{str, str[:16]})
+	require.NoError(t, err)
+	defer unsafe.KeepAlive(encoder.cgoRefs)
+
+	// Both the truncated and the short strings reference the bytes of the Go string rather than a copy of them
+	data := unsafe.NativeStringUnwrap(str).Data
+	truncated, short := unsafe.CastWithOffset[bindings.WafObject](encoded.Value, 0), unsafe.CastWithOffset[bindings.WafObject](encoded.Value, 1)
+	require.Equal(t, data, truncated.Value)
+	require.Equal(t, uint64(1024), truncated.NbEntries)
+	require.Equal(t, data, short.Value)
+	require.Equal(t, uint64(16), short.NbEntries)
+}
+
+func TestEncodeCyclicValues(t *testing.T) {
+	encodeDecode := func(t *testing.T, encoder *encoder, value any) any {
+		encoded, err := encoder.Encode(value)
+		require.NoError(t, err)
+		defer unsafe.KeepAlive(encoder.cgoRefs)
+		dropInvalidObjects(encoded)
+		decoded, err := decodeObject(encoded)
+		require.NoError(t, err)
+		return decoded
+	}
+	newEncoder := func() *encoder {
+		encoder := newMaxEncoder()
+		return &encoder
+	}
+
+	t.Run("slice", func(t *testing.T) {
+		slice := make([]any, 2)
+		slice[0] = "a"
+		slice[1] = slice // The slice now contains itself
+
+		// The encoding stops at the first repetition, even without depth limit
+		require.Equal(t, []any{"a"}, encodeDecode(t, newEncoder(), slice))
+		require.Equal(t, []any{[]any{"a"}}, encodeDecode(t, newEncoder(), []any{slice}))
+	})
+
+	t.Run("map", func(t *testing.T) {
+		m := map[string]any{"key": "value"}
+		m["self"] = []any{m}
+		require.Equal(t, map[string]any{"key": "value", "self": []any{}}, encodeDecode(t, newEncoder(), m))
+	})
+
+	t.Run("struct-pointer", func(t *testing.T) {
+		type node struct {
+			Name string
+			Next *node
+		}
+		n := &node{Name: "a"}
+		n.Next = &node{Name: "b", Next: n}
+		require.Equal(t, map[string]any{"Name": "a", "Next": map[string]any{"Name": "b"}}, encodeDecode(t, newEncoder(), n))
+	})
+
+	t.Run("shared-values", func(t *testing.T) {
+		// Values referenced more than once without forming a cycle are encoded every time
+		shared := []any{"x"}
+		sharedMap := map[string]any{"k": "v"}
+		require.Equal(t, []any{[]any{"x"}, []any{"x"}, map[string]any{"k": "v"}, map[string]any{"k": "v"}},
+			encodeDecode(t, newEncoder(), []any{shared, shared, sharedMap, sharedMap}))
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		slice := make([]any, 1)
+		slice[0] = slice
+		encodeTimer, _ := timer.NewTimer(timer.WithUnlimitedBudget())
+		encoder := newLimitedEncoder(encodeTimer)
+		require.Equal(t, []any{}, encodeDecode(t, &encoder, slice))
+		require.Empty(t, encoder.Truncations())
+	})
+
+	t.Run("deep-branch", func(t *testing.T) {
+		// The depth of the deep branch is measured in spite of the cycle, which adds no depth, even with an unlimited budget
+		slice := make([]any, 1)
+		slice[0] = slice
+		deep := any("leaf")
+		for i := 0; i < bindings.WafMaxContainerDepth+5; i++ {
+			deep = []any{deep}
+		}
+
+		encodeTimer, _ := timer.NewTimer(timer.WithUnlimitedBudget())
+		encoder := newLimitedEncoder(encodeTimer)
+		encodeDecode(t, &encoder, map[string]any{"a": slice, "b": deep})
+		require.Equal(t, map[TruncationReason][]int{ObjectTooDeep: {bindings.WafMaxContainerDepth + 6}}, encoder.Truncations())
+	})
+}
+
 type typeTree struct {
 	_type    bindings.WafObjectType
 	children []typeTree
@@ -762,7 +1636,7 @@ func TestEncoderTypeTree(t *testing.T) {
 		t.Run(tc.Name+"/assert", func(t *testing.T) {
 			if tc.Error != nil {
 				require.Error(t, err, "expected an encoding error when encoding %v", tc.Input)
-				require.Equal(t, tc.Error, err)
+				require.ErrorIs(t, err, tc.Error)
 				return
 			}
 
@@ -825,6 +1699,74 @@ func TestDecoder(t *testing.T) {
 		unsafe.KeepAlive(e.cgoRefs.arrayRefs)
 		unsafe.KeepAlive(e.cgoRefs.stringRefs)
 	})
+
+	t.Run("EmptyMapKey", func(t *testing.T) {
+		for _, tc := range []struct {
+			Name     string
+			Input    any
+			Expected map[string]any
+		}{
+			{
+				Name:     "single",
+				Input:    map[string]int{"": 1},
+				Expected: map[string]any{"": int64(1)},
+			},
+			{
+				Name:     "with-other-keys",
+				Input:    map[string]int{"": 1, "key": 2},
+				Expected: map[string]any{"": int64(1), "key": int64(2)},
+			},
+			{
+				Name:     "nested",
+				Input:    map[string]any{"": map[string]int{"": 1}},
+				Expected: map[string]any{"": map[string]any{"": int64(1)}},
+			},
+		} {
+			t.Run(tc.Name, func(t *testing.T) {
+				e := newMaxEncoder()
+				encoded, err := e.Encode(tc.Input)
+				require.NoError(t, err)
+
+				decoded, err := decodeMap(encoded)
+				require.NoError(t, err)
+				require.Equal(t, tc.Expected, decoded)
+				unsafe.KeepAlive(e.cgoRefs)
+			})
+		}
+	})
+}
+
+func TestEncodeInto(t *testing.T) {
+	large := map[string]any{
+		"items": []any{
+			map[string]any{"a": "1", "b": []any{"x", "y"}},
+			map[string]any{"c": int64(2), "d": map[string]any{"e": true}},
+		},
+	}
+	small := map[string]any{"f": []any{"z"}}
+
+	for _, value := range []map[string]any{large, small, large} {
+		expected := newMaxEncoder()
+		expectedObj, err := expected.Encode(value)
+		require.NoError(t, err)
+		expectedValue, err := decodeObject(expectedObj)
+		require.NoError(t, err)
+
+		// The slabs released by the previous iterations are reused, and must not leak into the encoded value
+		encoder := newMaxEncoder()
+		var obj bindings.WafObject
+		require.NoError(t, encoder.EncodeInto(&obj, value))
+		require.Empty(t, encoder.cgoRefs.arrayRefs)
+		require.NotEmpty(t, encoder.cgoRefs.slabs)
+
+		decoded, err := decodeObject(&obj)
+		require.NoError(t, err)
+		require.Equal(t, expectedValue, decoded)
+		require.Equal(t, value, decoded)
+
+		encoder.cgoRefs.release()
+		require.Empty(t, encoder.cgoRefs.slabs)
+	}
 }
 
 func TestResolvePointer(t *testing.T) {
@@ -856,8 +1798,66 @@ func TestDepthOf(t *testing.T) {
 		obj := selfReferencing{Array: make([]any, 1)}
 		obj.Array[0] = &obj // Obj now has a field that indirectly references itself
 
-		depth, err := depthOf(ctx, reflect.ValueOf(obj))
-		require.Greater(t, depth, 0)
-		require.ErrorIs(t, err, context.DeadlineExceeded)
+		// The measure stops at the first repetition of the slice, which adds no depth
+		depth, err := depthOf(ctx, reflect.ValueOf(obj), nil)
+		require.NoError(t, err)
+		require.Equal(t, 3, depth)
 	})
+
+	t.Run("counts times as leaves", func(t *testing.T) {
+		depth, err := depthOf(context.Background(), reflect.ValueOf([]any{map[string]any{"date": time.Now()}}), nil)
+		require.NoError(t, err)
+		require.Equal(t, 2, depth)
+	})
+}
+
+func BenchmarkEncodeScalarArray(b *testing.B) {
+	var ints [100]int
+	var boxed [100]any
+	for i := range ints {
+		ints[i] = i
+		boxed[i] = i
+	}
+
+	for name, data := range map[string]any{"scalar": ints, "interface": boxed} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				encoder := newMaxEncoder()
+				if _, err := encoder.Encode(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeStringMap(b *testing.B) {
+	headers := http.Header{}
+	flat := map[string]string{}
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("x-header-%d", i)
+		headers[name] = []string{"value", strconv.Itoa(i)}
+		flat[name] = strconv.Itoa(i)
+	}
+	boxedHeaders := map[string]any{}
+	for name, values := range headers {
+		boxedHeaders[name] = []any{values[0], values[1]}
+	}
+	boxedFlat := map[string]any{}
+	for name, value := range flat {
+		boxedFlat[name] = value
+	}
+
+	for name, data := range map[string]any{"string-map": flat, "interface-map": boxedFlat, "string-slice-map": headers, "interface-slice-map": boxedHeaders} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				encoder := newMaxEncoder()
+				if _, err := encoder.Encode(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
 }
@@ -6,10 +6,23 @@
 package errors
 
 import (
+	"errors"
 	"fmt"
 	"runtime"
 )
 
+var (
+	// ErrUnsupportedTarget is wrapped by the errors of waf.Health explaining why the WAF is disabled on the current
+	// target, such as UnsupportedOSArchError or ManuallyDisabledError, which are expected on such targets.
+	ErrUnsupportedTarget = errors.New("the WAF is not supported on this target")
+	// ErrLibraryLoad is wrapped by the errors of waf.Load and waf.Health when libddwaf could not be loaded on a
+	// supported target, which is unexpected.
+	ErrLibraryLoad = errors.New("could not load libddwaf")
+	// ErrLibraryUnavailable is ErrLibraryLoad, under the name of the error of waf.NewHandle and the other functions of
+	// the waf package needing libddwaf when it could not be loaded, so that either name can be used with errors.Is.
+	ErrLibraryUnavailable = ErrLibraryLoad
+)
+
 // UnsupportedOSArchError is a wrapper error type helping to handle the error
 // case of trying to execute this package when the OS or architecture is not supported.
 type UnsupportedOSArchError struct {
@@ -8,6 +8,7 @@ package errors
 import (
 	"errors"
 	"fmt"
+	"reflect"
 )
 
 // Encoder/Decoder errors
@@ -18,12 +19,59 @@ var (
 	ErrNilObjectPtr        = errors.New("nil WAF object pointer")
 	ErrInvalidObjectType   = errors.New("invalid type encountered when decoding")
 	ErrTooManyIndirections = errors.New("too many indirections")
+	ErrInvalidLimits       = errors.New("invalid encoder limits")
+	ErrCyclicValue         = errors.New("cyclic value")
+	ErrInputTooLarge       = errors.New("input too large")
 )
 
+// Context errors
+var (
+	ErrContextClosed               = errors.New("the WAF context is closed")
+	ErrPersistentAddressAlreadySet = errors.New("persistent address already set")
+	ErrBusy                        = errors.New("too many concurrent WAF runs")
+	ErrCancelled                   = errors.New("the WAF run was cancelled")
+	ErrContextInit                 = errors.New("could not create the WAF context")
+	ErrNoInput                     = errors.New("no address data to run the WAF on")
+)
+
+// Handle errors
+var (
+	ErrHandleClosed       = errors.New("the WAF handle is closed")
+	ErrRulesetNotRetained = errors.New("the WAF handle does not keep its ruleset")
+)
+
+// UnsupportedValueError is the error of a Go value that cannot be encoded into a WAF object, such as a channel or a
+// function. It matches ErrUnsupportedValue with errors.Is.
+type UnsupportedValueError struct {
+	// The map keys, struct field names and slice indices leading to the value from the encoded value, which is empty
+	// when the encoded value itself is not supported.
+	Path []string
+	// The kind of the value that is not supported.
+	Kind reflect.Kind
+}
+
+// Error returns the string representation of the UnsupportedValueError.
+func (e *UnsupportedValueError) Error() string {
+	if len(e.Path) == 0 {
+		return fmt.Sprintf("%s of kind %s", ErrUnsupportedValue, e.Kind)
+	}
+	return fmt.Sprintf("%s of kind %s at %q", ErrUnsupportedValue, e.Kind, e.Path)
+}
+
+// Is returns true if target is ErrUnsupportedValue. It is used by errors.Is.
+func (e *UnsupportedValueError) Is(target error) bool {
+	return target == ErrUnsupportedValue
+}
+
 // RunError the WAF can return when running it.
 type RunError int
 
 // Errors the WAF can return when running it.
+//
+// ErrTimeout is returned when a run is short-circuited before calling libddwaf because its time budget is already
+// exhausted, zero or negative, while ErrBudgetExhausted is returned when libddwaf itself reports it ran out of time
+// while evaluating the rules, in which case it may have partially evaluated them. ErrBudgetExhausted matches ErrTimeout
+// with errors.Is, so that errors.Is(err, ErrTimeout) holds for both, and both are timeouts according to IsTimeout.
 const (
 	ErrInternal RunError = iota + 1
 	ErrInvalidObject
@@ -31,6 +79,7 @@ const (
 	ErrTimeout
 	ErrOutOfMemory
 	ErrEmptyRuleAddresses
+	ErrBudgetExhausted
 )
 
 // Error returns the string representation of the RunError.
@@ -48,11 +97,35 @@ func (e RunError) Error() string {
 		return "out of memory"
 	case ErrEmptyRuleAddresses:
 		return "empty rule addresses"
+	case ErrBudgetExhausted:
+		return "waf time budget exhausted"
 	default:
 		return fmt.Sprintf("unknown waf error %d", e)
 	}
 }
 
+// IsTimeout returns true if the error is a timeout of the WAF, which may not happen again with a larger time budget.
+func (e RunError) IsTimeout() bool {
+	return e == ErrTimeout || e == ErrBudgetExhausted
+}
+
+// Is returns true if the error is ErrBudgetExhausted and target is ErrTimeout, as libddwaf running out of time is a
+// particular timeout. It is used by errors.Is.
+func (e RunError) Is(target error) bool {
+	return e == ErrBudgetExhausted && target == ErrTimeout
+}
+
+// IsInputError returns true if the error is caused by the data provided to the WAF, which is the caller's fault and
+// will happen again with the same data.
+func (e RunError) IsInputError() bool {
+	return e == ErrInvalidObject || e == ErrInvalidArgument
+}
+
+// IsInternal returns true if the error is a failure of the WAF itself, unrelated to the data provided to it.
+func (e RunError) IsInternal() bool {
+	return e == ErrInternal || e == ErrOutOfMemory
+}
+
 // PanicError is an error type wrapping a recovered panic value that happened
 // during a function call. Such error must be considered unrecoverable and be
 // used to try to gracefully abort. Keeping using this package after such an
@@ -75,3 +148,23 @@ func (e *PanicError) Unwrap() error {
 func (e *PanicError) Error() string {
 	return fmt.Sprintf("panic while executing %s: %#+v", e.In, e.Err)
 }
+
+// ErrMalformedRuleset is the error of a ruleset given as a JSON document that is not valid JSON, such as the ones given
+// to NewHandleFromBytes or NewHandleFromReader. This is distinct from a valid JSON document that is not a valid
+// ruleset, see RulesetStructureError.
+var ErrMalformedRuleset = errors.New("the WAF ruleset is not valid JSON")
+
+// RulesetStructureError is returned when the WAF could not be instantiated with a ruleset whose structure is invalid,
+// such as a field having an unexpected type or not being supported by libddwaf. This is distinct from a ruleset that
+// is well-formed but whose rules are semantically invalid, which libddwaf reports in its diagnostics.
+type RulesetStructureError struct {
+	// The JSON path of the offending field, e.g. `$.rules[0].conditions`.
+	Path string
+	// The description of what is wrong with the field.
+	Reason string
+}
+
+// Error returns the error string representation.
+func (e *RulesetStructureError) Error() string {
+	return fmt.Sprintf("invalid ruleset structure at %s: %s", e.Path, e.Reason)
+}
@@ -0,0 +1,51 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package waf
+
+import (
+	"runtime"
+
+	"github.com/DataDog/go-libddwaf/v2/internal/log"
+)
+
+// trackHandleLeak sets a finalizer on the given Handle, closing it if it is garbage collected without having been
+// closed. Such leaks are reported as warnings, which go to the callback set with SetLogCallback, if any.
+func trackHandleLeak(handle *Handle) *Handle {
+	runtime.SetFinalizer(handle, finalizeHandle)
+	return handle
+}
+
+// finalizeHandle closes the given garbage collected Handle if it was not closed. Contexts retain their Handle, which is
+// therefore only garbage collected once they are all closed or finalized.
+func finalizeHandle(handle *Handle) {
+	if handle.refCounter.Load() <= 0 {
+		return
+	}
+
+	log.Log(log.LevelWarning, "go-libddwaf: a WAF Handle was garbage collected without being closed, its C memory was leaking")
+	handle.Close()
+}
+
+// trackContextLeak sets a finalizer on the given Context, closing it if it is garbage collected without having been
+// closed.
+func trackContextLeak(context *Context) *Context {
+	runtime.SetFinalizer(context, finalizeContext)
+	return context
+}
+
+// finalizeContext closes the given garbage collected Context if it was not closed. The contexts left in a ContextPool
+// were reset, which closed their ddwaf_context, and are not reported.
+func finalizeContext(context *Context) {
+	context.mutex.Lock()
+	closed := context.cContext == 0
+	context.mutex.Unlock()
+	if closed {
+		return
+	}
+
+	log.Log(log.LevelWarning, "go-libddwaf: a WAF Context was garbage collected without being closed, its C memory was leaking")
+	context.Close()
+}
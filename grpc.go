@@ -0,0 +1,25 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package waf
+
+import "github.com/DataDog/go-libddwaf/v2/internal/bindings"
+
+// GRPCServerRequestMessageAddress is the address of the messages received by gRPC servers. Decoded protobuf messages
+// can be converted into address data with EncodeProtoMessage, of the separate github.com/DataDog/go-libddwaf/v2/proto
+// module, which keys their fields by their protobuf names.
+const GRPCServerRequestMessageAddress = "grpc.server.request.message"
+
+// RawGRPCMessage returns the address data of a gRPC message given its raw protobuf wire bytes, as a fallback for when
+// the type of the message is unknown and it cannot be unmarshalled. The bytes are provided to the WAF as a single
+// string, so that rules using regular expressions can still scan it. Only the first bytes of the message are kept, up
+// to the maximum string length the WAF inspects. The returned map can be used as either the persistent or ephemeral
+// data of RunAddressData, the latter being the usual case of gRPC streaming.
+func RawGRPCMessage(message []byte) map[string]any {
+	if len(message) > bindings.WafMaxStringLength {
+		message = message[:bindings.WafMaxStringLength]
+	}
+	return map[string]any{GRPCServerRequestMessageAddress: string(message)}
+}
@@ -6,12 +6,21 @@
 package waf
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
 
 	wafErrors "github.com/DataDog/go-libddwaf/v2/errors"
 	"github.com/DataDog/go-libddwaf/v2/internal/bindings"
 	"github.com/DataDog/go-libddwaf/v2/internal/unsafe"
+	"github.com/DataDog/go-libddwaf/v2/timer"
 
 	"go.uber.org/atomic"
 )
@@ -33,14 +42,54 @@ type Handle struct {
 	// block the request handlers for the time of the security rules update.
 	refCounter *atomic.Int32
 
-	// Instance of the WAF
-	cHandle bindings.WafHandle
+	// Instance of the WAF, replaced by UpdateRuleset. Contexts hold a reference to the instance they were created from.
+	instance *wafInstance
+	// instanceMutex protects instance, diagnostics, rulesIndex and ruleset, which are replaced together by
+	// UpdateRuleset
+	instanceMutex sync.RWMutex
+	// updateMutex serializes the calls to UpdateRuleset
+	updateMutex sync.Mutex
+
+	// rulesIndex holds information about the rules of the ruleset
+	rulesIndex rulesIndex
+
+	// ruleset is the encoded ruleset of the handle, used to create clones of the handle, which is empty unless the
+	// handle was created with WithClonableRuleset
+	ruleset encodedRuleset
+
+	// config is the configuration of this handle, as set by the options it was created with, and inherited by the
+	// contexts created from it
+	config config
+
+	// runSlots limits the number of concurrent Context.Run calls across the handle, see WithMaxConcurrentRuns. It is
+	// nil when the number of concurrent runs is not limited.
+	runSlots chan struct{}
+	// reloadCallbacks are the callbacks registered with OnReload, called when the handle is updated into a new one
+	reloadCallbacks []func(old, new *Diagnostics)
+	// reloadMutex protects the use of reloadCallbacks
+	reloadMutex sync.Mutex
+
+	// keyObfuscatorRegex and valueObfuscatorRegex are the patterns of the sensitive data obfuscator the handle was
+	// created with, see ObfuscatorConfig
+	keyObfuscatorRegex   string
+	valueObfuscatorRegex string
+	// runCounters are the counters of the Run calls of all the contexts created from the handle
+	runCounters runCounters
+	// cacheKey is the key of the handle in the cache of NewCachedHandle, empty when the handle is not cached
+	cacheKey string
 }
 
 // NewHandle creates and returns a new instance of the WAF with the given security rules and configuration
-// of the sensitive data obfuscator. The returned handle is nil in case of an error.
+// of the sensitive data obfuscator. The returned handle is nil in case of an error, which is a *RuleLoadError telling
+// why when the rules could not be loaded, such as none of them being valid.
 // Rules-related metrics, including errors, are accessible with the `RulesetInfo()` method.
 func NewHandle(rules any, keyObfuscatorRegex string, valueObfuscatorRegex string) (*Handle, error) {
+	return NewHandleWithOptions(rules, keyObfuscatorRegex, valueObfuscatorRegex)
+}
+
+// NewHandleWithOptions is the same as NewHandle, with the handle configured with the given options. Options that
+// apply to contexts are used as the defaults of the contexts created from the returned handle.
+func NewHandleWithOptions(rules any, keyObfuscatorRegex string, valueObfuscatorRegex string, options ...Option) (*Handle, error) {
 	// The order of action is the following:
 	// - Open the ddwaf C library
 	// - Encode the security rules as a ddwaf_object
@@ -55,13 +104,196 @@ func NewHandle(rules any, keyObfuscatorRegex string, valueObfuscatorRegex string
 		// loaded libddwaf in order to use it
 	}
 
+	return newHandleFromValue(newMaxEncoder(), rules, keyObfuscatorRegex, valueObfuscatorRegex, defaultConfig().with(options))
+}
+
+// NewHandleFromReader is the same as NewHandle, given the security rules as a JSON document read from r, such as the
+// body of a response streamed from a remote configuration service, which the caller need not buffer. The document is
+// decoded with a json.Decoder, keeping its numbers as json.Number values encoded as numbers. An error
+// wrapping errors.ErrMalformedRuleset is returned when the document is not valid JSON, which is distinct from the
+// errors of a valid JSON document that is not a valid ruleset. The ruleset is validated the same way as NewHandle does.
+func NewHandleFromReader(r io.Reader, keyObfuscatorRegex string, valueObfuscatorRegex string) (*Handle, error) {
+	if ok, err := Load(); !ok {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+
+	var rules any
+	if err := decoder.Decode(&rules); err != nil {
+		return nil, malformedRulesetError(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after the top-level value")
+		}
+		return nil, malformedRulesetError(err)
+	}
+
 	encoder := newMaxEncoder()
+	encoder.jsonMode = true
+	return newHandleFromValue(encoder, rules, keyObfuscatorRegex, valueObfuscatorRegex, defaultConfig())
+}
+
+// malformedRulesetError returns the RuleLoadError of a ruleset that is not valid JSON because of the given error.
+func malformedRulesetError(err error) error {
+	return &RuleLoadError{Reason: RuleLoadMalformedJSON, Err: fmt.Errorf("%w: %w", wafErrors.ErrMalformedRuleset, err)}
+}
+
+// NewHandleFromMultiple is the same as NewHandle, given several rulesets that are merged into one, such as base rules,
+// custom rules and processors loaded from different files. The array sections of the rulesets, such as rules and
+// processors, are concatenated in order, while the other sections, such as version and metadata, are taken from the
+// last ruleset defining them. Rules having the same id in the rules or custom_rules sections are only kept once, with
+// the definition of the last ruleset defining them, and their ids are reported in Diagnostics.DuplicateRules.
+func NewHandleFromMultiple(rules []any, keyObfuscatorRegex string, valueObfuscatorRegex string) (*Handle, error) {
+	if ok, err := Load(); !ok {
+		return nil, err
+	}
+
+	merged, duplicates, err := mergeRulesets(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := newHandleFromValue(newMaxEncoder(), merged, keyObfuscatorRegex, valueObfuscatorRegex, defaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	handle.diagnostics.DuplicateRules = duplicates
+	return handle, nil
+}
+
+// handleCache holds the handles shared by NewCachedHandle, keyed by the hash of their ruleset and obfuscator
+// configuration, until they are closed by all their users.
+var handleCache = struct {
+	sync.Mutex
+	handles map[string]*Handle
+}{handles: map[string]*Handle{}}
+
+// NewCachedHandle is the same as NewHandle, except that the handles created with identical rules and obfuscator
+// configuration are shared, such as when several modules of a program independently load the same rules file, so that
+// the ruleset is only parsed and kept in memory once. The rules are identified by the SHA-256 hash of their canonical
+// JSON representation, whose map keys are sorted, along with the obfuscator configuration. Each call returning a
+// handle holds a reference to it, which must be released with Close: the handle is only freed once every user has
+// closed it, after which a new handle is created by the next call. As the handle is shared, it must not be updated
+// in place with UpdateRuleset, as that would affect the other users, while Update and UpdateRulesData return new
+// handles, which are not cached. The rules are loaded without blocking the calls for other rules, so that concurrent
+// first calls with the same rules may each load them, in which case only one of the handles is kept and shared.
+func NewCachedHandle(rules any, keyObfuscatorRegex string, valueObfuscatorRegex string) (*Handle, error) {
+	canonical, err := json.Marshal(rules)
+	if err != nil {
+		return nil, fmt.Errorf("could not hash the WAF ruleset: %w", err)
+	}
+	hash := sha256.New()
+	for _, part := range [][]byte{canonical, []byte(keyObfuscatorRegex), []byte(valueObfuscatorRegex)} {
+		// The length prefixes keep the parts from being confused with one another
+		_ = binary.Write(hash, binary.LittleEndian, uint64(len(part)))
+		hash.Write(part)
+	}
+	key := hex.EncodeToString(hash.Sum(nil))
+
+	if handle := cachedHandle(key); handle != nil {
+		return handle, nil
+	}
+
+	// The handle is created without holding the lock of the cache, as this can take a while with large rulesets
+	handle, err := NewHandle(rules, keyObfuscatorRegex, valueObfuscatorRegex)
+	if err != nil {
+		return nil, err
+	}
+	if cached := cacheHandle(key, handle); cached != handle {
+		// Another call cached a handle of the same rules in the meantime, which is shared instead
+		handle.Close()
+		return cached, nil
+	}
+	return handle, nil
+}
+
+// cachedHandle returns the handle cached with the given key by NewCachedHandle, holding a new reference to it, or nil
+// if there is none.
+func cachedHandle(key string) *Handle {
+	handleCache.Lock()
+	defer handleCache.Unlock()
+
+	// A cached handle whose reference counter already reached 0 is being freed, and is replaced by a new one
+	if handle, found := handleCache.handles[key]; found && handle.retain() {
+		return handle
+	}
+	return nil
+}
+
+// cacheHandle caches the given new handle with the given key and returns it, unless another handle was cached with
+// this key in the meantime, which is then returned instead, holding a new reference to it.
+func cacheHandle(key string, handle *Handle) *Handle {
+	handleCache.Lock()
+	defer handleCache.Unlock()
+
+	if cached, found := handleCache.handles[key]; found && cached.retain() {
+		return cached
+	}
+	handle.cacheKey = key
+	handleCache.handles[key] = handle
+	return handle
+}
+
+// uncache removes this handle from the cache of NewCachedHandle, unless it was already replaced by a new handle.
+func (handle *Handle) uncache() {
+	handleCache.Lock()
+	defer handleCache.Unlock()
+	if handleCache.handles[handle.cacheKey] == handle {
+		delete(handleCache.handles, handle.cacheKey)
+	}
+}
+
+// newHandleFromValue creates a new handle from the given Go value of the security rules, encoded with the given
+// encoder.
+func newHandleFromValue(encoder encoder, rules any, keyObfuscatorRegex string, valueObfuscatorRegex string, handleConfig config) (*Handle, error) {
 	obj, err := encoder.Encode(rules)
 	if err != nil {
 		return nil, fmt.Errorf("could not encode the WAF ruleset into a WAF object: %w", err)
 	}
 
-	config := newConfig(&encoder.cgoRefs, keyObfuscatorRegex, valueObfuscatorRegex)
+	// The Go references are needed until libddwaf is done with them, and to inspect the ruleset afterwards
+	defer unsafe.KeepAlive(&encoder.cgoRefs)
+
+	excludeRules(obj, handleConfig.disabledRules)
+	var ruleset encodedRuleset
+	if handleConfig.clonableRuleset {
+		ruleset = newEncodedRuleset(obj, &encoder.cgoRefs)
+	}
+	return newHandle(obj, ruleset, keyObfuscatorRegex, valueObfuscatorRegex, handleConfig)
+}
+
+// NewHandleFromBytes is the same as NewHandle, given the security rules as a JSON document. The document is parsed
+// straight into the WAF objects given to libddwaf, which is faster and allocates less than unmarshalling it into Go
+// values first. An error wrapping errors.ErrMalformedRuleset is returned when the document is not valid JSON, when its
+// strings are not valid UTF-8, or when its containers are nested deeper than encoding/json allows. The ruleset is
+// validated the same way as NewHandle does.
+func NewHandleFromBytes(jsonRules []byte, keyObfuscatorRegex string, valueObfuscatorRegex string) (*Handle, error) {
+	if ok, err := Load(); !ok {
+		return nil, err
+	}
+
+	cgoRefs := new(cgoRefPool)
+	obj, err := parseJSON(jsonRules, cgoRefs)
+	if err != nil {
+		return nil, malformedRulesetError(err)
+	}
+
+	// The Go references are needed until libddwaf is done with them, and to inspect the ruleset afterwards
+	defer unsafe.KeepAlive(cgoRefs)
+
+	return newHandle(obj, encodedRuleset{}, keyObfuscatorRegex, valueObfuscatorRegex, defaultConfig())
+}
+
+// newHandle creates a new handle from the given encoded ruleset, whose Go references must be kept alive by the
+// caller during the call.
+func newHandle(obj *bindings.WafObject, ruleset encodedRuleset, keyObfuscatorRegex string, valueObfuscatorRegex string, handleConfig config) (*Handle, error) {
+	var cgoRefs cgoRefPool
+	defer unsafe.KeepAlive(&cgoRefs)
+
+	config := newConfig(&cgoRefs, keyObfuscatorRegex, valueObfuscatorRegex)
 	diagnosticsWafObj := new(bindings.WafObject)
 	defer wafLib.WafObjectFree(diagnosticsWafObj)
 
@@ -77,14 +309,31 @@ func NewHandle(rules any, keyObfuscatorRegex string, valueObfuscatorRegex string
 
 	if cHandle == 0 {
 		// WAF Failed initialization, report the best possible error...
-		if diags != nil && diagsErr == nil {
+		if diagsErr != nil {
+			diags = nil
+		}
+		if diags != nil {
 			// We were able to parse out some diagnostics from the WAF!
-			err = diags.TopLevelError()
-			if err != nil {
-				return nil, fmt.Errorf("could not instantiate the WAF: %w", err)
+			if err := diags.TopLevelError(); err != nil {
+				return nil, &RuleLoadError{Reason: RuleLoadInvalidStructure, Diagnostics: diags, Err: fmt.Errorf("could not instantiate the WAF: %w", err)}
 			}
 		}
-		return nil, errors.New("could not instantiate the WAF")
+		// ... or explain it by none of its rules being loaded, along with the parts of the ruleset libddwaf ignored...
+		warnings, structureErr := checkRulesetStructure(obj)
+		if diags != nil {
+			if stats, _ := loadStats(*diags); stats.Loaded == 0 {
+				err := fmt.Errorf("could not instantiate the WAF: no rule could be loaded (%s)", loadSummary(*diags))
+				if len(warnings) > 0 {
+					err = fmt.Errorf("%w: %w", err, errors.Join(warnings...))
+				}
+				return nil, &RuleLoadError{Reason: RuleLoadNoValidRule, Diagnostics: diags, Err: err}
+			}
+		}
+		// ... or by a structural problem of the ruleset, if any
+		if structureErr != nil {
+			return nil, &RuleLoadError{Reason: RuleLoadInvalidStructure, Diagnostics: diags, Err: fmt.Errorf("could not instantiate the WAF: %w", structureErr)}
+		}
+		return nil, &RuleLoadError{Reason: RuleLoadFailed, Diagnostics: diags, Err: errors.New("could not instantiate the WAF")}
 	}
 
 	// The WAF successfully initialized at this stage...
@@ -93,23 +342,327 @@ func NewHandle(rules any, keyObfuscatorRegex string, valueObfuscatorRegex string
 		return nil, fmt.Errorf("could not decode the WAF diagnostics: %w", diagsErr)
 	}
 
-	unsafe.KeepAlive(encoder.cgoRefs)
+	rulesIndex := newRulesIndex(obj)
 
-	return &Handle{
-		cHandle:     cHandle,
+	var runSlots chan struct{}
+	if handleConfig.maxConcurrentRuns > 0 {
+		runSlots = make(chan struct{}, handleConfig.maxConcurrentRuns)
+	}
+
+	return trackHandleLeak(&Handle{
+		instance:    newWafInstance(cHandle, rulesIndex, diags),
 		refCounter:  atomic.NewInt32(1), // We count the handle itself in the counter
 		diagnostics: *diags,
-	}, nil
+		rulesIndex:  rulesIndex,
+		ruleset:     ruleset,
+		config:      handleConfig,
+		runSlots:    runSlots,
+
+		keyObfuscatorRegex:   keyObfuscatorRegex,
+		valueObfuscatorRegex: valueObfuscatorRegex,
+	}), nil
+}
+
+// CloneWithObfuscators creates a new handle with the same ruleset and options as this one, but with the given
+// configuration of the sensitive data obfuscator. libddwaf binds the obfuscator to its ddwaf_handle when creating it,
+// so the clone gets its own ddwaf_handle, created from the ruleset this handle keeps in its encoded form: the ruleset
+// does not need to be encoded again, but libddwaf still needs to parse it. Handles only keep their encoded ruleset
+// when created with the WithClonableRuleset option, and errors.ErrRulesetNotRetained is returned otherwise. The encoded
+// ruleset is shared by the handle and its clones, and remains available until all of them are closed. Closing either
+// handle does not affect the other, and the clone does not inherit the callbacks registered with OnReload.
+func (handle *Handle) CloneWithObfuscators(keyObfuscatorRegex string, valueObfuscatorRegex string) (*Handle, error) {
+	handle.instanceMutex.RLock()
+	ruleset := handle.ruleset
+	closed := handle.instance == nil
+	handle.instanceMutex.RUnlock()
+	if closed {
+		return nil, fmt.Errorf("could not clone the WAF handle: %w", wafErrors.ErrHandleClosed)
+	}
+	if !handle.config.clonableRuleset {
+		return nil, fmt.Errorf("could not clone the WAF handle: %w", wafErrors.ErrRulesetNotRetained)
+	}
+
+	obj, cgoRefs := ruleset.build()
+	defer unsafe.KeepAlive(&cgoRefs)
+
+	return newHandle(obj, ruleset, keyObfuscatorRegex, valueObfuscatorRegex, handle.config)
+}
+
+// ObfuscatorConfig returns the regular expressions of the sensitive data obfuscator this handle was created with, as
+// given to NewHandle or CloneWithObfuscators, an empty string meaning the corresponding obfuscation is off. They are
+// kept by the handles it is updated into.
+func (handle *Handle) ObfuscatorConfig() (keyRegex string, valueRegex string) {
+	return handle.keyObfuscatorRegex, handle.valueObfuscatorRegex
 }
 
 // Diagnostics returns the rules initialization metrics for the current WAF handle
 func (handle *Handle) Diagnostics() Diagnostics {
+	handle.instanceMutex.RLock()
+	defer handle.instanceMutex.RUnlock()
 	return handle.diagnostics
 }
 
-// Addresses returns the list of addresses the WAF rule is expecting.
+// Version returns the version of libddwaf, as returned by the package-level Version function, along with the version
+// of the ruleset of this handle, as declared in its metadata.rules_version field and reported in Diagnostics.Version.
+// The ruleset version is empty when the ruleset does not declare one.
+func (handle *Handle) Version() (libVersion string, rulesetVersion string) {
+	return Version(), handle.Diagnostics().Version
+}
+
+// RuleIDs returns the sorted identifiers of the rules and custom rules of this handle that libddwaf loaded without
+// error, as reported by Diagnostics, or nil if none did. Rules that failed to load are reported by Diagnostics instead.
+func (handle *Handle) RuleIDs() []string {
+	diags := handle.Diagnostics()
+
+	var ids []string
+	for _, entry := range []*DiagnosticEntry{diags.Rules, diags.CustomRules} {
+		if entry != nil {
+			ids = append(ids, entry.Loaded...)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// LoadStats returns the number of rules and custom rules libddwaf loaded and failed to load, along with the number of
+// rules in error for each category of error and the version of the ruleset, as reported by Diagnostics.
+func (handle *Handle) LoadStats() LoadStats {
+	stats, _ := loadStats(handle.Diagnostics())
+	return stats
+}
+
+// LoadSummary returns a human-readable, one-line summary of the loading of the rules and custom rules of the ruleset,
+// as reported by Diagnostics, such as "loaded 1, failed 3: 2 missing key 'tags', 1 missing key 'name'; version 1.2.7",
+// meant for startup logs. The errors are listed with the number of rules they affect, by decreasing number of rules.
+func (handle *Handle) LoadSummary() string {
+	return loadSummary(handle.Diagnostics())
+}
+
+// Addresses returns the list of addresses the WAF rule is expecting. The list is built once when the ruleset is loaded,
+// and the same slice is returned by every call until the ruleset is updated, so that it can be called on hot paths and
+// safely retained. It is shared and must therefore not be modified. It returns nil once the handle is closed.
 func (handle *Handle) Addresses() []string {
-	return wafLib.WafKnownAddresses(handle.cHandle)
+	handle.instanceMutex.RLock()
+	defer handle.instanceMutex.RUnlock()
+
+	if handle.instance == nil {
+		return nil
+	}
+	return handle.instance.addressList
+}
+
+// AddressSet returns the set of the addresses listed by Addresses, for constant-time lookups such as deciding which
+// data to gather for a request. Like the list, the set is built once when the ruleset is loaded, shared by every call
+// until the ruleset is updated, and must not be modified. It returns nil once the handle is closed.
+func (handle *Handle) AddressSet() map[string]struct{} {
+	handle.instanceMutex.RLock()
+	defer handle.instanceMutex.RUnlock()
+
+	if handle.instance == nil {
+		return nil
+	}
+	return handle.instance.addresses
+}
+
+// defaultActions are the identifiers of the actions libddwaf defines even when the ruleset has no actions section.
+var defaultActions = []string{"block", "stack_trace", "extract_schema"}
+
+// DefinedActions returns the sorted identifiers of the actions Context.Run can report in Result.Actions with the
+// ruleset of this handle: the actions defined by the actions section of the ruleset, the actions libddwaf defines by
+// default, such as "block", and the actions the loaded rules list in their on_match field, which libddwaf reports even
+// when they are defined nowhere. It allows checking that all of them are handled when the handle is created rather than
+// when a request matches. It returns nil once the handle is closed.
+func (handle *Handle) DefinedActions() []string {
+	handle.instanceMutex.RLock()
+	defer handle.instanceMutex.RUnlock()
+
+	if handle.instance == nil {
+		return nil
+	}
+
+	loaded := make(map[string]struct{})
+	for _, entry := range []*DiagnosticEntry{handle.diagnostics.Rules, handle.diagnostics.CustomRules} {
+		if entry == nil {
+			continue
+		}
+		for _, id := range entry.Loaded {
+			loaded[id] = struct{}{}
+		}
+	}
+
+	set := make(map[string]struct{}, len(defaultActions)+len(handle.rulesIndex.actionIDs))
+	for _, ids := range [][]string{defaultActions, handle.rulesIndex.actionIDs} {
+		for _, id := range ids {
+			set[id] = struct{}{}
+		}
+	}
+	for _, rules := range handle.rulesIndex.rules {
+		for _, rule := range rules {
+			if _, found := loaded[rule.id]; !found {
+				continue
+			}
+			for _, id := range rule.actions {
+				set[id] = struct{}{}
+			}
+		}
+	}
+
+	actions := make([]string, 0, len(set))
+	for id := range set {
+		actions = append(actions, id)
+	}
+	sort.Strings(actions)
+	return actions
+}
+
+// RuleDetail describes a rule of a ruleset, as reported by Handle.RuleDetails.
+type RuleDetail struct {
+	// Name is the name of the rule.
+	Name string
+	// Tags are the tags of the rule having string values, such as its "type" and "category".
+	Tags map[string]string
+	// Operators are the distinct operators of the conditions of the rule, such as "match_regex" or "phrase_match", in
+	// the order of the conditions.
+	Operators []string
+}
+
+// RuleDetails returns the details of the rules of the ruleset of this handle that libddwaf loaded, by rule id, such as
+// the operators of their conditions, so that reports like which rules depend on which operators can be built. They are
+// extracted from the ruleset the handle was created with, as last updated, and rules defined in both the rules and
+// custom_rules sections are reported with the details of the custom rule. It returns nil once the handle is closed.
+func (handle *Handle) RuleDetails() map[string]RuleDetail {
+	handle.instanceMutex.RLock()
+	defer handle.instanceMutex.RUnlock()
+
+	if handle.instance == nil {
+		return nil
+	}
+
+	loaded := make(map[string]struct{})
+	for _, entry := range []*DiagnosticEntry{handle.diagnostics.Rules, handle.diagnostics.CustomRules} {
+		if entry == nil {
+			continue
+		}
+		for _, id := range entry.Loaded {
+			loaded[id] = struct{}{}
+		}
+	}
+
+	details := make(map[string]RuleDetail, len(loaded))
+	for _, section := range rulesetSections {
+		for _, rule := range handle.rulesIndex.rules[section] {
+			if _, found := loaded[rule.id]; !found {
+				continue
+			}
+			// The tags and operators are copied so that the caller cannot alter the ones of the handle
+			detail := RuleDetail{Name: rule.name, Tags: make(map[string]string, len(rule.tags))}
+			for key, value := range rule.tags {
+				detail.Tags[key] = value
+			}
+			detail.Operators = append(detail.Operators, rule.operators...)
+			details[rule.id] = detail
+		}
+	}
+	return details
+}
+
+// AddressInfo describes an input of the rules of a ruleset: an address, along with the key path the rules inspect
+// inside of its value. An empty KeyPath means the whole value of the address is inspected.
+type AddressInfo struct {
+	// Name is the address, such as "server.request.headers.no_cookies".
+	Name string
+	// KeyPath is the path of keys leading to the part of the address value the rules inspect, if any.
+	KeyPath []string
+}
+
+// key returns a string uniquely identifying the address and key path pair.
+func (info AddressInfo) key() string {
+	return info.Name + "\x00" + strings.Join(info.KeyPath, "\x00")
+}
+
+// AddressInfo returns the distinct inputs of the rules of the ruleset, sorted by address then key path. Unlike
+// Addresses, which flattens them into address names, it keeps the key paths of the rule conditions, so that only the
+// nested fields the rules need can be gathered. An address used both with and without a key path is listed once per
+// key path. Addresses the WAF expects that no rule condition uses, such as processor inputs, are listed without key
+// path. It returns nil once the handle is closed.
+func (handle *Handle) AddressInfo() []AddressInfo {
+	handle.instanceMutex.RLock()
+	defer handle.instanceMutex.RUnlock()
+
+	if handle.instance == nil {
+		return nil
+	}
+
+	var infos []AddressInfo
+	seen := make(map[string]struct{})
+	named := make(map[string]struct{})
+	for _, rules := range handle.rulesIndex.rules {
+		for _, rule := range rules {
+			for _, input := range rule.inputs {
+				if _, known := handle.instance.addresses[input.Name]; !known {
+					continue // Input of a rule libddwaf failed to load
+				}
+				if _, dup := seen[input.key()]; dup {
+					continue
+				}
+				seen[input.key()] = struct{}{}
+				named[input.Name] = struct{}{}
+				infos = append(infos, input)
+			}
+		}
+	}
+	for _, addr := range handle.instance.addressList {
+		if _, found := named[addr]; !found {
+			infos = append(infos, AddressInfo{Name: addr})
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Name != infos[j].Name {
+			return infos[i].Name < infos[j].Name
+		}
+		return strings.Join(infos[i].KeyPath, "\x00") < strings.Join(infos[j].KeyPath, "\x00")
+	})
+	return infos
+}
+
+// UsesAddress returns true if at least one rule of this handle uses the given address, so that the encoding of costly
+// values, such as request bodies, can be skipped when no rule would evaluate them. The set of addresses is computed
+// when the ruleset is loaded, so that this is a map lookup. It returns false once the handle is closed.
+func (handle *Handle) UsesAddress(addr string) bool {
+	handle.instanceMutex.RLock()
+	defer handle.instanceMutex.RUnlock()
+
+	if handle.instance == nil {
+		return false
+	}
+	_, found := handle.instance.addresses[addr]
+	return found
+}
+
+// EstimateCost returns a rough, unitless estimate of the cost of running the WAF on the given address values, which
+// can be compared between inputs to decide whether running the WAF is worth it. It combines the number of WAF objects
+// each value encodes to with the number of rules using its address, so that values of addresses no rule uses cost
+// nothing. The estimate requires encoding the values and is therefore about as costly as the encoding step of a run.
+func (handle *Handle) EstimateCost(values map[string]any) int {
+	encodeTimer, _ := timer.NewTimer(timer.WithUnlimitedBudget())
+	encoder := newConfiguredEncoder(encodeTimer, handle.config)
+	handle.instanceMutex.RLock()
+	rulesIndex := handle.rulesIndex
+	handle.instanceMutex.RUnlock()
+	cost := 0
+	for addr, value := range values {
+		rules := rulesIndex.rulesPerAddress[addr]
+		if rules == 0 {
+			continue
+		}
+		obj, err := encoder.Encode(value)
+		if err != nil {
+			continue
+		}
+		cost += countObjects(obj) * rules
+	}
+	return cost
 }
 
 // Update the ruleset of a WAF instance into a new handle on its own
@@ -121,24 +674,167 @@ func (handle *Handle) Update(newRules any) (*Handle, error) {
 		return nil, fmt.Errorf("could not encode the WAF ruleset into a WAF object: %w", err)
 	}
 
-	diagnosticsWafObj := new(bindings.WafObject)
+	return handle.update(obj, &encoder.cgoRefs)
+}
 
-	cHandle := wafLib.WafUpdate(handle.cHandle, obj, diagnosticsWafObj)
-	unsafe.KeepAlive(encoder.cgoRefs)
-	if cHandle == 0 {
-		return nil, errors.New("could not update the WAF instance")
+// update creates a new handle from this one updated with the given encoded ruleset, whose Go references are held by
+// cgoRefs.
+func (handle *Handle) update(obj *bindings.WafObject, cgoRefs *cgoRefPool) (*Handle, error) {
+	// The Go references are also needed to build the rules index once libddwaf is done with them
+	defer unsafe.KeepAlive(cgoRefs)
+
+	excludeRules(obj, handle.config.disabledRules)
+	cHandle, diags, err := handle.updateInstance(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	handle.instanceMutex.RLock()
+	oldDiags := handle.diagnostics
+	rulesIndex := handle.rulesIndex.update(obj)
+	ruleset := handle.ruleset
+	handle.instanceMutex.RUnlock()
+	if handle.config.clonableRuleset {
+		ruleset = ruleset.update(obj, cgoRefs)
 	}
 
+	reloadCallbacks := handle.copyReloadCallbacks()
+	newHandle := trackHandleLeak(&Handle{
+		instance:        newWafInstance(cHandle, rulesIndex, diags),
+		refCounter:      atomic.NewInt32(1), // We count the handle itself in the counter
+		diagnostics:     *diags,
+		rulesIndex:      rulesIndex,
+		ruleset:         ruleset,
+		config:          handle.config,
+		runSlots:        handle.runSlots, // The limit applies to the handle and the ones it is updated into, together
+		reloadCallbacks: reloadCallbacks,
+
+		// libddwaf keeps the obfuscator configuration of the ddwaf_handle being updated
+		keyObfuscatorRegex:   handle.keyObfuscatorRegex,
+		valueObfuscatorRegex: handle.valueObfuscatorRegex,
+	})
+
+	for _, callback := range reloadCallbacks {
+		callback(&oldDiags, diags)
+	}
+
+	return newHandle, nil
+}
+
+// UpdateRuleset updates the ruleset of this handle in place, as opposed to Update which creates a new handle. The
+// contexts created after the update use the new ruleset, while the contexts created before keep using the previous
+// one until they are closed, so that in-flight requests are not disrupted.
+// Each ruleset lives in its own ddwaf_handle, which is reference-counted by this handle and by the contexts created
+// from it: the ddwaf_handle of the previous ruleset is destroyed once the last context using it is closed, and the
+// one of the current ruleset is destroyed when this handle is closed. The callbacks registered with OnReload are
+// called before returning, and concurrent calls to UpdateRuleset are applied one after the other.
+func (handle *Handle) UpdateRuleset(rules any) error {
+	encoder := newMaxEncoder()
+	obj, err := encoder.Encode(rules)
+	if err != nil {
+		return fmt.Errorf("could not encode the WAF ruleset into a WAF object: %w", err)
+	}
+
+	// The Go references are also needed to build the rules index once libddwaf is done with them
+	defer unsafe.KeepAlive(&encoder.cgoRefs)
+
+	handle.updateMutex.Lock()
+	defer handle.updateMutex.Unlock()
+
+	excludeRules(obj, handle.config.disabledRules)
+	cHandle, diags, err := handle.updateInstance(obj)
+	if err != nil {
+		return err
+	}
+
+	// updateMutex keeps other calls to UpdateRuleset from replacing the rules index and ruleset in the meantime, but
+	// Close can still clear them, so they are read with instanceMutex held
+	handle.instanceMutex.RLock()
+	rulesIndex := handle.rulesIndex.update(obj)
+	ruleset := handle.ruleset
+	handle.instanceMutex.RUnlock()
+	if handle.config.clonableRuleset {
+		ruleset = ruleset.update(obj, &encoder.cgoRefs)
+	}
+
+	handle.instanceMutex.Lock()
+	oldInstance, oldDiags := handle.instance, handle.diagnostics
+	if oldInstance == nil {
+		// The handle was closed in the meantime
+		handle.instanceMutex.Unlock()
+		wafLib.WafDestroy(cHandle)
+		return fmt.Errorf("could not update the WAF instance: %w", wafErrors.ErrHandleClosed)
+	}
+	handle.instance = newWafInstance(cHandle, rulesIndex, diags)
+	handle.diagnostics = *diags
+	handle.rulesIndex = rulesIndex
+	handle.ruleset = ruleset
+	handle.instanceMutex.Unlock()
+
+	// The previous instance is destroyed right away unless some contexts still use it
+	oldInstance.release()
+
+	for _, callback := range handle.copyReloadCallbacks() {
+		callback(&oldDiags, diags)
+	}
+
+	return nil
+}
+
+// updateInstance creates a new ddwaf_handle from the current instance of this handle updated with the given encoded
+// ruleset, and returns it along with its diagnostics.
+func (handle *Handle) updateInstance(obj *bindings.WafObject) (bindings.WafHandle, *Diagnostics, error) {
+	instance := handle.retainInstance()
+	if instance == nil {
+		return 0, nil, fmt.Errorf("could not update the WAF instance: %w", wafErrors.ErrHandleClosed)
+	}
+	defer instance.release()
+
+	diagnosticsWafObj := new(bindings.WafObject)
 	defer wafLib.WafObjectFree(diagnosticsWafObj)
 
-	if err != nil { // Something is very wrong
-		return nil, fmt.Errorf("could not decode the WAF ruleset errors: %w", err)
+	cHandle := wafLib.WafUpdate(instance.cHandle, obj, diagnosticsWafObj)
+	if cHandle == 0 {
+		return 0, nil, errors.New("could not update the WAF instance")
 	}
 
-	return &Handle{
-		cHandle:    cHandle,
-		refCounter: atomic.NewInt32(1), // We count the handle itself in the counter
-	}, nil
+	diags := &Diagnostics{}
+	if !diagnosticsWafObj.IsInvalid() {
+		var err error
+		diags, err = decodeDiagnostics(diagnosticsWafObj)
+		if err != nil { // Something is very wrong
+			wafLib.WafDestroy(cHandle)
+			return 0, nil, fmt.Errorf("could not decode the WAF diagnostics: %w", err)
+		}
+	}
+
+	return cHandle, diags, nil
+}
+
+// copyReloadCallbacks returns a copy of the callbacks registered with OnReload.
+func (handle *Handle) copyReloadCallbacks() []func(old, new *Diagnostics) {
+	handle.reloadMutex.Lock()
+	defer handle.reloadMutex.Unlock()
+
+	reloadCallbacks := make([]func(old, new *Diagnostics), len(handle.reloadCallbacks))
+	copy(reloadCallbacks, handle.reloadCallbacks)
+	return reloadCallbacks
+}
+
+// AggregateMetrics returns the counters of the Context.Run calls of all the contexts created from this handle, updated
+// on each run. They are not carried over to the handles this handle is updated into.
+func (handle *Handle) AggregateMetrics() Metrics {
+	return handle.runCounters.load()
+}
+
+// OnReload registers a callback called after each successful Update or UpdateRuleset of the handle, with the
+// diagnostics of the previous and of the new ruleset. Callbacks are inherited by the new handle created by Update, so
+// that they keep being called as the ruleset gets updated over time. They are called synchronously, before Update or
+// UpdateRuleset returns.
+func (handle *Handle) OnReload(callback func(old, new *Diagnostics)) {
+	handle.reloadMutex.Lock()
+	defer handle.reloadMutex.Unlock()
+	handle.reloadCallbacks = append(handle.reloadCallbacks, callback)
 }
 
 // Close puts the handle in termination state, when all the contexts are closed the handle will be destroyed
@@ -149,9 +845,31 @@ func (handle *Handle) Close() {
 		return
 	}
 
-	wafLib.WafDestroy(handle.cHandle)
+	if handle.cacheKey != "" {
+		handle.uncache()
+	}
+
+	handle.instanceMutex.Lock()
+	instance := handle.instance
 	handle.diagnostics = Diagnostics{} // Data in diagnostics may no longer be valid (e.g: strings from libddwaf)
-	handle.cHandle = 0                 // Makes it easy to spot use-after-free/double-free issues
+	handle.instance = nil              // Makes it easy to spot use-after-free/double-free issues
+	handle.ruleset = encodedRuleset{}  // The encoded ruleset may still be used by clones of this handle
+	handle.instanceMutex.Unlock()
+
+	instance.release()
+}
+
+// retainInstance returns the current instance of this Handle with its reference counter incremented, or nil if the
+// Handle is closed. Calls to retainInstance() returning an instance must be balanced with calls to its release().
+func (handle *Handle) retainInstance() *wafInstance {
+	handle.instanceMutex.RLock()
+	defer handle.instanceMutex.RUnlock()
+
+	// The Handle holds a reference to its current instance, so that it cannot have been released yet
+	if handle.instance == nil || !handle.instance.retain() {
+		return nil
+	}
+	return handle.instance
 }
 
 // retain increments the reference counter of this Handle. Returns true if the
@@ -167,22 +885,48 @@ func (handle *Handle) release() {
 	handle.Close()
 }
 
+// acquireRunSlot reserves one of the concurrent run slots of this Handle, returning false if they are all in use.
+// Calls to acquireRunSlot() returning true must be balanced with calls to releaseRunSlot().
+func (handle *Handle) acquireRunSlot() bool {
+	if handle.runSlots == nil {
+		return true
+	}
+	select {
+	case handle.runSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseRunSlot frees a run slot previously reserved by acquireRunSlot.
+func (handle *Handle) releaseRunSlot() {
+	if handle.runSlots != nil {
+		<-handle.runSlots
+	}
+}
+
 // addRefCounter adds x to Handle.refCounter. The return valid indicates whether the refCounter reached 0 as part of
 // this call or not, which can be used to perform "only-once" activities:
 // - result > 0    => the Handle is still usable
 // - result == 0   => the handle is no longer usable, ref counter reached 0 as part of this call
 // - result == -1  => the handle is no longer usable, ref counter was already 0 previously
 func (handle *Handle) addRefCounter(x int32) int32 {
+	return addRefCounter(handle.refCounter, x)
+}
+
+// addRefCounter adds x to the given reference counter, see Handle.addRefCounter.
+func addRefCounter(refCounter *atomic.Int32, x int32) int32 {
 	// We use a CAS loop to avoid setting the refCounter to a negative value.
 	for {
-		current := handle.refCounter.Load()
+		current := refCounter.Load()
 		if current <= 0 {
 			// The object had already been released
 			return -1
 		}
 
 		next := current + x
-		if swapped := handle.refCounter.CompareAndSwap(current, next); swapped {
+		if swapped := refCounter.CompareAndSwap(current, next); swapped {
 			if next < 0 {
 				// TODO(romain.marcadier): somehow signal unexpected behavior to the
 				// caller (panic? error?). We currently clamp to 0 in order to avoid
@@ -195,6 +939,63 @@ func (handle *Handle) addRefCounter(x int32) int32 {
 	}
 }
 
+// wafInstance is a ddwaf_handle along with its reference counter. A Handle holds a reference to its current instance,
+// and each Context holds a reference to the instance it was created from, so that the ddwaf_handle is only destroyed
+// once neither the Handle nor any of these contexts use it anymore, even if the Handle was updated in the meantime.
+type wafInstance struct {
+	cHandle    bindings.WafHandle
+	refCounter *atomic.Int32
+	// addressList is the list of addresses the rules of the instance use, as returned by ddwaf_known_addresses, and
+	// addresses is the same list as a set
+	addressList []string
+	addresses   map[string]struct{}
+	// rulesIndex is the rules index of the ruleset of the instance, and loadedRules the set of the identifiers of the
+	// rules and custom rules libddwaf loaded from it, as its contexts keep running it once the Handle was updated
+	rulesIndex  rulesIndex
+	loadedRules map[string]struct{}
+}
+
+func newWafInstance(cHandle bindings.WafHandle, rulesIndex rulesIndex, diags *Diagnostics) *wafInstance {
+	known := wafLib.WafKnownAddresses(cHandle)
+	addresses := make(map[string]struct{}, len(known))
+	for _, addr := range known {
+		addresses[addr] = struct{}{}
+	}
+
+	loadedRules := make(map[string]struct{})
+	for _, entry := range []*DiagnosticEntry{diags.Rules, diags.CustomRules} {
+		if entry == nil {
+			continue
+		}
+		for _, id := range entry.Loaded {
+			loadedRules[id] = struct{}{}
+		}
+	}
+
+	return &wafInstance{
+		cHandle:     cHandle,
+		refCounter:  atomic.NewInt32(1), // We count the owning Handle in the counter
+		addressList: known,
+		addresses:   addresses,
+		rulesIndex:  rulesIndex,
+		loadedRules: loadedRules,
+	}
+}
+
+// retain increments the reference counter of this instance. Returns true if the instance is still valid.
+func (instance *wafInstance) retain() bool {
+	return addRefCounter(instance.refCounter, 1) > 0
+}
+
+// release decrements the reference counter of this instance, destroying its ddwaf_handle when it reaches 0.
+func (instance *wafInstance) release() {
+	if addRefCounter(instance.refCounter, -1) != 0 {
+		return
+	}
+	wafLib.WafDestroy(instance.cHandle)
+	instance.cHandle = 0 // Makes it easy to spot use-after-free/double-free issues
+}
+
 func newConfig(cgoRefs *cgoRefPool, keyObfuscatorRegex string, valueObfuscatorRegex string) *bindings.WafConfig {
 	config := new(bindings.WafConfig)
 	*config = bindings.WafConfig{
@@ -213,6 +1014,9 @@ func newConfig(cgoRefs *cgoRefPool, keyObfuscatorRegex string, valueObfuscatorRe
 	return config
 }
 
+// goRunError converts the error return codes of ddwaf_run into errors. libddwaf reports running out of time through the
+// timeout field of the result rather than through a return code, which unwrapWafResult converts into
+// errors.ErrBudgetExhausted.
 func goRunError(rc bindings.WafReturnCode) error {
 	switch rc {
 	case bindings.WafErrInternal:
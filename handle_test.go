@@ -8,10 +8,21 @@
 package waf
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DataDog/go-libddwaf/v2/errors"
+	"github.com/DataDog/go-libddwaf/v2/internal/log"
 
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
 )
 
 func TestNewHandle(t *testing.T) {
@@ -67,6 +78,11 @@ func TestNewHandle(t *testing.T) {
 		wafDiags := waf.Diagnostics()
 		require.Contains(t, wafDiags.Rules.Failed, ruleId)
 		require.Contains(t, wafDiags.Rules.Errors[fmt.Sprintf("unknown matcher: %s", newOperator)], ruleId)
+		require.Contains(t, wafDiags.Rules.ParsedErrors, RuleError{
+			Code:    ErrUnknownOperator,
+			Message: fmt.Sprintf("unknown matcher: %s", newOperator),
+			RuleIDs: []string{ruleId},
+		})
 	})
 
 	t.Run("does not return error on partially invalid input", func(t *testing.T) {
@@ -96,6 +112,549 @@ func TestNewHandle(t *testing.T) {
 
 }
 
+func TestNewHandleFromBytes(t *testing.T) {
+	if supported, err := Health(); !supported || err != nil {
+		t.Skip("target is not supported by the WAF")
+		return
+	}
+
+	t.Run("valid-rule", func(t *testing.T) {
+		jsonRules, err := json.Marshal(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+		require.NoError(t, err)
+
+		waf, err := NewHandleFromBytes(jsonRules, "", "")
+		require.NoError(t, err)
+		defer waf.Close()
+		require.Equal(t, []string{"ua0-600-12x"}, waf.Diagnostics().Rules.Loaded)
+
+		wafCtx := NewContext(waf)
+		defer wafCtx.Close()
+		res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}, time.Second)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+	})
+
+	t.Run("invalid-json", func(t *testing.T) {
+		waf, err := NewHandleFromBytes([]byte(`{"version": "2.1", "rules": [}`), "", "")
+		require.Error(t, err)
+		require.Nil(t, waf)
+		require.Contains(t, err.Error(), "offset 29")
+		require.ErrorIs(t, err, errors.ErrMalformedRuleset)
+
+		var loadErr *RuleLoadError
+		require.ErrorAs(t, err, &loadErr)
+		require.Equal(t, RuleLoadMalformedJSON, loadErr.Reason)
+		require.Nil(t, loadErr.Diagnostics)
+	})
+
+	t.Run("invalid-rule", func(t *testing.T) {
+		waf, err := NewHandleFromBytes([]byte(malformedRule), "", "")
+		require.Error(t, err)
+		require.Nil(t, waf)
+
+		var structErr *errors.RulesetStructureError
+		require.ErrorAs(t, err, &structErr)
+		require.Equal(t, "$.events", structErr.Path)
+	})
+
+	t.Run("same-objects", func(t *testing.T) {
+		for _, doc := range []string{
+			`{"version": "2.2", "metadata": {"rules_version": "1.0"}, "rules": []}`,
+			`[1, -2, 18446744073709551615, 1e400, 1.5, -0.25e-3, true, false, null, "", {}, []]`,
+			`{"escaped \"key\"": "a\\b\/c\n\té😀\u0000", "": ["\ud800", "plain"]}`,
+			`  {"nested": [[[{"a": [{}]}]]]}  `,
+		} {
+			var parsed any
+			decoder := json.NewDecoder(strings.NewReader(doc))
+			decoder.UseNumber()
+			require.NoError(t, decoder.Decode(&parsed))
+
+			encoder := newMaxEncoder()
+			encoder.jsonMode = true
+			expected, err := encoder.Encode(parsed)
+			require.NoError(t, err)
+			expectedValue, err := decodeObject(expected)
+			require.NoError(t, err)
+
+			var cgoRefs cgoRefPool
+			obj, err := parseJSON([]byte(doc), &cgoRefs)
+			require.NoError(t, err, doc)
+			value, err := decodeObject(obj)
+			require.NoError(t, err)
+			require.Equal(t, expectedValue, value, doc)
+		}
+	})
+
+	t.Run("malformed-json", func(t *testing.T) {
+		for _, doc := range []string{
+			``,
+			`{`,
+			`{"a" 1}`,
+			`{"a": 1,}`,
+			`[1 2]`,
+			`"unterminated`,
+			`"bad \x escape"`,
+			`"bad \u12 escape"`,
+			"\"control \x01 character\"",
+			`01x`,
+			`01`,
+			`-01`,
+			`[00]`,
+			`{"a": 012}`,
+			`-`,
+			`1.`,
+			`1e`,
+			`tru`,
+			`{} {}`,
+		} {
+			var cgoRefs cgoRefPool
+			_, err := parseJSON([]byte(doc), &cgoRefs)
+			require.Error(t, err, doc)
+			require.Error(t, json.Unmarshal([]byte(doc), new(any)), doc)
+		}
+	})
+
+	t.Run("invalid-utf8", func(t *testing.T) {
+		// Unlike encoding/json, which replaces them, invalid UTF-8 sequences are rejected
+		for _, doc := range []string{
+			"\"\xff\"",
+			"\"truncated \xc3\"",
+			"{\"\xed\xa0\x80\": 1}",
+			"\"escaped \\n then \xff\"",
+		} {
+			var cgoRefs cgoRefPool
+			_, err := parseJSON([]byte(doc), &cgoRefs)
+			require.Error(t, err, doc)
+			require.Contains(t, err.Error(), "invalid UTF-8", doc)
+		}
+	})
+
+	t.Run("max-depth", func(t *testing.T) {
+		var cgoRefs cgoRefPool
+		_, err := parseJSON([]byte(strings.Repeat("[", jsonMaxDepth)+strings.Repeat("]", jsonMaxDepth)), &cgoRefs)
+		require.NoError(t, err)
+
+		deep := []byte(strings.Repeat(`{"a":[`, jsonMaxDepth))
+		_, err = parseJSON(deep, &cgoRefs)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "exceeded max depth")
+		require.Error(t, json.Unmarshal(deep, new(any)))
+
+		waf, err := NewHandleFromBytes(deep, "", "")
+		require.Nil(t, waf)
+		require.ErrorIs(t, err, errors.ErrMalformedRuleset)
+	})
+}
+
+// FuzzParseJSON checks that parseJSON accepts the same documents as encoding/json, except for the ones holding invalid
+// UTF-8, which it rejects.
+func FuzzParseJSON(f *testing.F) {
+	for _, doc := range []string{
+		`{"version": "2.2", "rules": [{"id": "a", "conditions": []}]}`,
+		`[1, -2, 0, -0, 0.5, 18446744073709551615, 1e400, true, false, null]`,
+		`{"escaped \"key\"": "a\\b\/c\n\té😀\u0000\ud800"}`,
+		`01`,
+		`[1,]`,
+		"\"\xff\"",
+		`[[[[[[[[[[]]]]]]]]]]`,
+	} {
+		f.Add([]byte(doc))
+	}
+
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		var cgoRefs cgoRefPool
+		_, err := parseJSON(doc, &cgoRefs)
+		if valid := json.Valid(doc) && utf8.Valid(doc); valid != (err == nil) {
+			t.Fatalf("parseJSON(%q) returned %v while json.Valid returned %t", doc, err, valid)
+		}
+	})
+}
+
+func BenchmarkNewHandleFromBytes(b *testing.B) {
+	if supported, err := Health(); !supported || err != nil {
+		b.Skip("target is not supported by the WAF")
+		return
+	}
+
+	rules := makeValidRuleset()
+	rule := rules["rules"].([]map[string]any)[0]
+	generated := make([]any, 1_000)
+	for i := range generated {
+		generated[i] = map[string]any{
+			"id":         fmt.Sprintf("generated-%d", i),
+			"name":       fmt.Sprintf("Generated rule #%d", i),
+			"tags":       rule["tags"],
+			"conditions": rule["conditions"],
+		}
+	}
+	rules["rules"] = generated
+	jsonRules, err := json.Marshal(rules)
+	require.NoError(b, err)
+
+	b.Run("unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			var parsed any
+			if err := json.Unmarshal(jsonRules, &parsed); err != nil {
+				b.Fatal(err)
+			}
+			waf, err := NewHandle(parsed, "", "")
+			if err != nil {
+				b.Fatal(err)
+			}
+			waf.Close()
+		}
+	})
+
+	b.Run("bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			waf, err := NewHandleFromBytes(jsonRules, "", "")
+			if err != nil {
+				b.Fatal(err)
+			}
+			waf.Close()
+		}
+	})
+}
+
+func TestNewHandleFromReader(t *testing.T) {
+	if supported, err := Health(); !supported || err != nil {
+		t.Skip("target is not supported by the WAF")
+		return
+	}
+
+	t.Run("valid-rule", func(t *testing.T) {
+		jsonRules, err := json.Marshal(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+		require.NoError(t, err)
+
+		waf, err := NewHandleFromReader(bytes.NewReader(jsonRules), "", "")
+		require.NoError(t, err)
+		defer waf.Close()
+		require.Equal(t, []string{"ua0-600-12x"}, waf.Diagnostics().Rules.Loaded)
+
+		wafCtx := NewContext(waf)
+		defer wafCtx.Close()
+		res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}, time.Second)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+	})
+
+	t.Run("invalid-json", func(t *testing.T) {
+		for _, doc := range []string{
+			``,
+			`{"version": "2.1", "rules": [}`,
+			`{} {}`,
+			`{} x`,
+		} {
+			waf, err := NewHandleFromReader(strings.NewReader(doc), "", "")
+			require.Nil(t, waf, doc)
+			require.ErrorIs(t, err, errors.ErrMalformedRuleset, doc)
+		}
+	})
+
+	t.Run("invalid-rule", func(t *testing.T) {
+		waf, err := NewHandleFromReader(strings.NewReader(malformedRule), "", "")
+		require.Error(t, err)
+		require.Nil(t, waf)
+		require.NotErrorIs(t, err, errors.ErrMalformedRuleset)
+
+		var structErr *errors.RulesetStructureError
+		require.ErrorAs(t, err, &structErr)
+		require.Equal(t, "$.events", structErr.Path)
+	})
+}
+
+func TestNewHandleFromMultiple(t *testing.T) {
+	if supported, err := Health(); !supported || err != nil {
+		t.Skip("target is not supported by the WAF")
+		return
+	}
+
+	base := newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil)
+	custom := newArachniTestRule([]ruleInput{{Address: "my.other.input"}}, nil)
+	custom["rules"].([]any)[0].(map[string]any)["id"] = "custom-001"
+	// libddwaf only reports one match per rule type in a given run
+	custom["rules"].([]any)[0].(map[string]any)["tags"] = map[string]any{"type": "xss", "category": "attack_attempt"}
+
+	t.Run("merged", func(t *testing.T) {
+		waf, err := NewHandleFromMultiple([]any{base, custom}, "", "")
+		require.NoError(t, err)
+		defer waf.Close()
+		require.Equal(t, []string{"custom-001", "ua0-600-12x"}, waf.RuleIDs())
+		require.Empty(t, waf.Diagnostics().DuplicateRules)
+
+		wafCtx := NewContext(waf)
+		defer wafCtx.Close()
+		res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "Arachni", "my.other.input": "Arachni"}}, time.Second)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 2)
+	})
+
+	t.Run("duplicates", func(t *testing.T) {
+		override := newArachniTestRule([]ruleInput{{Address: "my.other.input"}}, nil)
+
+		waf, err := NewHandleFromMultiple([]any{base, override}, "", "")
+		require.NoError(t, err)
+		defer waf.Close()
+		require.Equal(t, []string{"ua0-600-12x"}, waf.RuleIDs())
+		require.Equal(t, []string{"ua0-600-12x"}, waf.Diagnostics().DuplicateRules)
+
+		// The last definition of the rule wins
+		wafCtx := NewContext(waf)
+		defer wafCtx.Close()
+		res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}, time.Second)
+		require.NoError(t, err)
+		require.Empty(t, res.Events)
+		res, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.other.input": "Arachni"}}, time.Second)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+	})
+
+	t.Run("not-a-map", func(t *testing.T) {
+		waf, err := NewHandleFromMultiple([]any{base, []any{}}, "", "")
+		require.Error(t, err)
+		require.Nil(t, waf)
+		require.Contains(t, err.Error(), "ruleset 1")
+	})
+}
+
+func TestNewCachedHandle(t *testing.T) {
+	first, err := NewCachedHandle(makeValidRuleset(), "key", "value")
+	require.NoError(t, err)
+	// The rules are hashed by value, so that identical rules decoded separately share the same handle
+	second, err := NewCachedHandle(makeValidRuleset(), "key", "value")
+	require.NoError(t, err)
+	require.Same(t, first, second)
+
+	// Another obfuscator configuration gets its own handle
+	other, err := NewCachedHandle(makeValidRuleset(), "key", "")
+	require.NoError(t, err)
+	require.NotSame(t, first, other)
+	other.Close()
+
+	// The handle remains usable until its last user closes it
+	first.Close()
+	wafCtx := NewContext(second)
+	require.NotNil(t, wafCtx)
+	wafCtx.Close()
+
+	second.Close()
+	require.Nil(t, NewContext(second))
+
+	// A new handle is created once the shared one was freed
+	third, err := NewCachedHandle(makeValidRuleset(), "key", "value")
+	require.NoError(t, err)
+	defer third.Close()
+	require.NotSame(t, first, third)
+	require.NotNil(t, third.Addresses())
+
+	_, err = NewCachedHandle(map[string]any{"rules": make(chan int)}, "", "")
+	require.Error(t, err)
+
+	t.Run("concurrent", func(t *testing.T) {
+		// The concurrent first calls share a single handle, the other ones they created being closed
+		var (
+			wg      sync.WaitGroup
+			handles = make([]*Handle, 8)
+			errs    = make([]error, len(handles))
+		)
+		for i := range handles {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				handles[i], errs[i] = NewCachedHandle(makeValidRuleset(), "", "concurrent")
+			}(i)
+		}
+		wg.Wait()
+
+		for i, handle := range handles {
+			require.NoError(t, errs[i])
+			require.Same(t, handles[0], handle)
+		}
+		require.Equal(t, int32(len(handles)), handles[0].refCounter.Load())
+		for _, handle := range handles {
+			handle.Close()
+		}
+		require.Nil(t, cachedHandle(handles[0].cacheKey))
+	})
+}
+
+func TestLeakFinalizers(t *testing.T) {
+	if log.CallbackFunctionPointer() == 0 {
+		t.Skip("libddwaf cannot call Go functions on this target")
+	}
+
+	logged := make(chan string, 16)
+	defer func() { require.NoError(t, SetLogCallback(nil)) }()
+	require.NoError(t, SetLogCallback(func(level LogLevel, message string) {
+		if level != LogLevelWarning || !strings.HasPrefix(message, "go-libddwaf:") {
+			return
+		}
+		select {
+		case logged <- message:
+		default:
+		}
+	}))
+
+	// The handle and context are created by a function so that no reference to them remains on the stack
+	leak := func() *atomic.Int32 {
+		waf, err := NewHandle(makeValidRuleset(), "", "")
+		require.NoError(t, err)
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		return waf.instance.refCounter
+	}
+	instanceRefCounter := leak()
+
+	// The context is finalized first, as it references the handle which can only be finalized by a later cycle
+	for i := 0; i < 100 && instanceRefCounter.Load() > 0; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	require.Zero(t, instanceRefCounter.Load(), "the finalizers should have released the WAF instance")
+
+	var messages []string
+	for len(logged) > 0 {
+		messages = append(messages, <-logged)
+	}
+	require.Contains(t, strings.Join(messages, "\n"), "WAF Handle was garbage collected without being closed")
+	require.Contains(t, strings.Join(messages, "\n"), "WAF Context was garbage collected without being closed")
+}
+
+func TestEstimateCost(t *testing.T) {
+	if supported, err := Health(); !supported || err != nil {
+		t.Skip("target is not supported by the WAF")
+		return
+	}
+
+	waf, err := NewHandle(makeValidRuleset(), "", "")
+	require.NoError(t, err)
+	require.NotNil(t, waf)
+	defer waf.Close()
+
+	tiny := waf.EstimateCost(map[string]any{"http.client_ip": "1.2.3.4"})
+	require.Positive(t, tiny)
+
+	ips := make([]string, 100)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.0.0.%d", i)
+	}
+	large := waf.EstimateCost(map[string]any{"http.client_ip": ips})
+	require.Greater(t, large, tiny)
+
+	t.Run("unused-address", func(t *testing.T) {
+		require.Zero(t, waf.EstimateCost(map[string]any{"server.request.body": ips}))
+	})
+
+	t.Run("updated-handle", func(t *testing.T) {
+		updated, err := waf.Update(map[string]any{
+			"rules_data": []map[string]any{},
+		})
+		require.NoError(t, err)
+		defer updated.Close()
+		require.Equal(t, tiny, updated.EstimateCost(map[string]any{"http.client_ip": "1.2.3.4"}))
+	})
+}
+
+func TestUpdateRulesData(t *testing.T) {
+	if supported, err := Health(); !supported || err != nil {
+		t.Skip("target is not supported by the WAF")
+		return
+	}
+
+	waf, err := NewHandle(makeValidRuleset(), "", "")
+	require.NoError(t, err)
+	defer waf.Close()
+
+	run := func(t *testing.T, handle *Handle, ip string) Result {
+		wafCtx := NewContext(handle)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+		res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"http.client_ip": ip}}, 0)
+		require.NoError(t, err)
+		return res
+	}
+
+	require.Empty(t, run(t, waf, "1.2.3.4").Events)
+
+	updated, err := waf.UpdateRulesData([]RuleData{{
+		ID:   "blocked_ips",
+		Type: "ip_with_expiration",
+		Data: []RuleDataEntry{
+			{Value: "1.2.3.4"},
+			{Value: "5.6.7.8", Expiration: 1}, // Expired a long time ago
+		},
+	}})
+	require.NoError(t, err)
+	defer updated.Close()
+
+	res := run(t, updated, "1.2.3.4")
+	require.Len(t, res.Events, 1)
+	require.Equal(t, []string{"block"}, res.Actions)
+	require.Empty(t, run(t, updated, "5.6.7.8").Events)
+	require.Empty(t, run(t, updated, "9.9.9.9").Events)
+}
+
+func BenchmarkUpdateRulesData(b *testing.B) {
+	if supported, err := Health(); !supported || err != nil {
+		b.Skip("target is not supported by the WAF")
+		return
+	}
+
+	waf, err := NewHandle(makeValidRuleset(), "", "")
+	require.NoError(b, err)
+	defer waf.Close()
+
+	data := RuleData{ID: "blocked_ips", Type: "ip_with_expiration", Data: make([]RuleDataEntry, 10_000)}
+	for i := range data.Data {
+		data.Data[i] = RuleDataEntry{Value: fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)}
+	}
+
+	b.Run("typed", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			updated, err := waf.UpdateRulesData([]RuleData{data})
+			if err != nil {
+				b.Fatal(err)
+			}
+			updated.Close()
+		}
+	})
+
+	b.Run("json", func(b *testing.B) {
+		type jsonEntry struct {
+			Value      string `json:"value"`
+			Expiration uint64 `json:"expiration"`
+		}
+		type jsonData struct {
+			ID   string      `json:"id"`
+			Type string      `json:"type"`
+			Data []jsonEntry `json:"data"`
+		}
+		entries := make([]jsonEntry, len(data.Data))
+		for i, entry := range data.Data {
+			entries[i] = jsonEntry{Value: entry.Value, Expiration: entry.Expiration}
+		}
+		rulesData := map[string]any{"rules_data": []jsonData{{ID: data.ID, Type: data.Type, Data: entries}}}
+
+		for n := 0; n < b.N; n++ {
+			buf, err := json.Marshal(rulesData)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var parsed any
+			if err := json.Unmarshal(buf, &parsed); err != nil {
+				b.Fatal(err)
+			}
+			updated, err := waf.Update(parsed)
+			if err != nil {
+				b.Fatal(err)
+			}
+			updated.Close()
+		}
+	})
+}
+
 // makeValidRuleset returns a "valid" ruleset that is expected to cleanly parse and load into the WAF.
 func makeValidRuleset() map[string]any {
 	return map[string]any{
@@ -0,0 +1,36 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package waf
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HTTPServerRequestHeadersNoCookiesAddress is the address of the headers of the requests received by HTTP servers,
+// without their cookies.
+const HTTPServerRequestHeadersNoCookiesAddress = "server.request.headers.no_cookies"
+
+// EncodeHTTPHeaders returns the given HTTP headers in the form the rules using the
+// HTTPServerRequestHeadersNoCookiesAddress address expect: header names are lowercased and each header is mapped to a
+// single string, its values being joined with ", " as multiple values of a header are combined in HTTP. The Cookie
+// header is left out, as cookies are provided through their own address. Headers having the same lowercased name, which
+// only happens when h was not filled using its canonicalizing methods, are combined in the same way.
+func EncodeHTTPHeaders(h http.Header) map[string]any {
+	headers := make(map[string]any, len(h))
+	for name, values := range h {
+		name = strings.ToLower(name)
+		if name == "cookie" || len(values) == 0 {
+			continue
+		}
+		value := strings.Join(values, ", ")
+		if previous, found := headers[name]; found {
+			value = previous.(string) + ", " + value
+		}
+		headers[name] = value
+	}
+	return headers
+}
@@ -0,0 +1,196 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package waf
+
+import (
+	"fmt"
+
+	"github.com/DataDog/go-libddwaf/v2/errors"
+	"github.com/DataDog/go-libddwaf/v2/internal/bindings"
+	"github.com/DataDog/go-libddwaf/v2/internal/unsafe"
+	"github.com/DataDog/go-libddwaf/v2/timer"
+)
+
+// InputReport describes how address data is encoded before being sent to the WAF, as returned by ValidateInput.
+type InputReport struct {
+	// Truncations provides details about truncations that occurred while encoding the address data, in the same
+	// format as Stats.Truncations.
+	Truncations map[TruncationReason][]int
+	// DroppedValues is the number of values that were not encoded because their type is not supported, such as
+	// channels or functions, or because they are map entries whose key is not a string.
+	DroppedValues int
+	// UnsupportedValues describes the first values counted in DroppedValues because their type or value is not
+	// supported, with the map keys, struct field names and slice indices leading to them from the address data.
+	UnsupportedValues []*errors.UnsupportedValueError
+	// Objects is the total number of WAF objects the address data is encoded into.
+	Objects int
+	// Size is the total size, in bytes, of the strings and map keys of the encoded address data.
+	Size int
+}
+
+// ValidateInput encodes the given address data the same way Context.Run does, and reports what was truncated or
+// dropped along the way. It does not use libddwaf, allowing instrumentation code to check its address data on any
+// platform, including those where the WAF is not supported. The Options it uses are WithBudget, which limits the time
+// spent encoding, the encoder options WithJSONMode, WithNonFiniteFloatPolicy, WithFloatFormat,
+// WithSkipUnsupportedTopLevel, WithSortedMapKeys, WithJSONTags, WithNilContainersAsEmpty and
+// WithStringifiedNumericKeys, and WithMaxInputSize. errors.ErrTimeout is returned when the budget is exceeded, and an
+// error wrapping errors.ErrInputTooLarge when the maximum input size is.
+func ValidateInput(values map[string]any, opts ...Option) (*InputReport, error) {
+	cfg := defaultConfig().with(opts)
+	encodeTimer, err := timer.NewTimer(timer.WithBudget(cfg.budget))
+	if err != nil {
+		return nil, err
+	}
+
+	encoder := newConfiguredEncoder(encodeTimer, cfg)
+	encodeTimer.Start()
+	obj, _ := encoder.Encode(values)
+	if encodeTimer.Exhausted() {
+		return nil, errors.ErrTimeout
+	}
+	if encoder.tooLarge() {
+		return nil, encoder.inputTooLargeError()
+	}
+
+	report := &InputReport{
+		Truncations:       encoder.Truncations(),
+		DroppedValues:     encoder.droppedValues,
+		UnsupportedValues: encoder.unsupportedValues,
+	}
+	report.measure(obj)
+
+	return report, nil
+}
+
+// EncodeToGo encodes the given value the same way Context.Run encodes address data, and decodes the result back into a
+// Go value. The result is the canonical representation of what the WAF receives: integers become int64 or uint64,
+// structs and maps become map[string]any, arrays and slices become []any, values that cannot be encoded are dropped,
+// and the encoder limits are applied. It allows integrations to test their shaping of address data without a WAF, on
+// any platform. The Options it uses are the same as the ones of ValidateInput, and errors.ErrTimeout is returned when
+// the budget is exceeded, and an error wrapping errors.ErrInputTooLarge when the maximum input size is.
+func EncodeToGo(v any, opts ...Option) (any, error) {
+	cfg := defaultConfig().with(opts)
+	encodeTimer, err := timer.NewTimer(timer.WithBudget(cfg.budget))
+	if err != nil {
+		return nil, err
+	}
+
+	encoder := newConfiguredEncoder(encodeTimer, cfg)
+	encodeTimer.Start()
+	obj, err := encoder.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	if encodeTimer.Exhausted() {
+		return nil, errors.ErrTimeout
+	}
+	if encoder.tooLarge() {
+		return nil, encoder.inputTooLargeError()
+	}
+
+	// The Go references are needed until the value is decoded
+	defer unsafe.KeepAlive(&encoder.cgoRefs)
+
+	dropInvalidObjects(obj)
+	return decodeObject(obj)
+}
+
+// Object is an opaque handle on the WAF representation of a Go value, as returned by EncodeValue, which tooling such as
+// golden-file tests can decode back with DecodeValue. The WAF representation lives in Go memory referenced by the
+// Object, which must be released with Free once it is no longer needed, after which it can no longer be decoded.
+type Object struct {
+	obj         *bindings.WafObject
+	cgoRefs     cgoRefPool
+	truncations map[TruncationReason][]int
+}
+
+// EncodeValue encodes the given value into its WAF representation, the same way Context.Run encodes address data, but
+// with the given limits instead of the default ones. Zero fields of limits fall back to the default limits, and an
+// error wrapping errors.ErrInvalidLimits is returned if any of them is negative. Values that cannot be encoded are
+// dropped, as libddwaf ignores them, and an *errors.UnsupportedValueError is returned when v itself cannot be encoded.
+// See EncodeToGo to directly get the decoded Go value instead.
+func EncodeValue(v any, limits EncoderLimits) (*Object, error) {
+	if err := limits.validate(); err != nil {
+		return nil, err
+	}
+
+	encodeTimer, err := timer.NewTimer(timer.WithUnlimitedBudget())
+	if err != nil {
+		return nil, err
+	}
+
+	encoder := newLimitedEncoder(encodeTimer)
+	limits.apply(&encoder)
+	obj, err := encoder.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dropInvalidObjects(obj)
+	return &Object{obj: obj, cgoRefs: encoder.cgoRefs, truncations: encoder.Truncations()}, nil
+}
+
+// Truncations returns the truncations that occurred while encoding the value of the Object, in the same format as
+// Stats.Truncations.
+func (object *Object) Truncations() map[TruncationReason][]int {
+	return object.truncations
+}
+
+// Free releases the WAF representation of the value of the Object, which can no longer be decoded afterwards. It is
+// safe to call more than once.
+func (object *Object) Free() {
+	object.obj = nil
+	object.cgoRefs = cgoRefPool{}
+}
+
+// DecodeValue decodes the given Object back into a Go value, as EncodeToGo does: integers are decoded as int64 or
+// uint64, and not as the strings older versions of libddwaf represented them with, floats as float64, maps and
+// structs as map[string]any and arrays and slices as []any. An error wrapping errors.ErrNilObjectPtr is returned when
+// the Object is nil or was freed.
+func DecodeValue(object *Object) (any, error) {
+	if object == nil || object.obj == nil {
+		return nil, fmt.Errorf("%w: the object is nil or was freed", errors.ErrNilObjectPtr)
+	}
+
+	// The Go references are needed until the value is decoded
+	defer unsafe.KeepAlive(&object.cgoRefs)
+	return decodeObject(object.obj)
+}
+
+// dropInvalidObjects removes the invalid objects from the containers of the tree rooted at obj, which the encoder
+// keeps in maps for the entries whose value could not be encoded, and which libddwaf ignores.
+func dropInvalidObjects(obj *bindings.WafObject) {
+	if obj.Type != bindings.WafArrayType && obj.Type != bindings.WafMapType {
+		return
+	}
+
+	length := uint64(0)
+	for i := uint64(0); i < obj.NbEntries; i++ {
+		objElem := unsafe.CastWithOffset[bindings.WafObject](obj.Value, i)
+		if objElem.IsInvalid() {
+			continue
+		}
+		dropInvalidObjects(objElem)
+		*unsafe.CastWithOffset[bindings.WafObject](obj.Value, length) = *objElem
+		length++
+	}
+	obj.NbEntries = length
+}
+
+// measure adds the WAF objects in the tree rooted at obj, and the size of their strings and map keys, to the report.
+func (report *InputReport) measure(obj *bindings.WafObject) {
+	report.Objects++
+	report.Size += int(obj.ParameterNameLength)
+
+	switch obj.Type {
+	case bindings.WafStringType:
+		report.Size += int(obj.NbEntries)
+	case bindings.WafArrayType, bindings.WafMapType:
+		for i := uint64(0); i < obj.NbEntries; i++ {
+			report.measure(unsafe.CastWithOffset[bindings.WafObject](obj.Value, i))
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package waf
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/go-libddwaf/v2/errors"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateInput(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		report, err := ValidateInput(map[string]any{
+			"server.request.query": map[string][]string{"q": {"value"}},
+		})
+		require.NoError(t, err)
+		require.Empty(t, report.Truncations)
+		require.Zero(t, report.DroppedValues)
+		// The address map, the query map, the "q" array and its string
+		require.Equal(t, 4, report.Objects)
+		require.Equal(t, len("server.request.query")+len("q")+len("value"), report.Size)
+	})
+
+	t.Run("dropped-channel", func(t *testing.T) {
+		report, err := ValidateInput(map[string]any{
+			"server.request.body": map[string]any{
+				"channel": make(chan int),
+				"value":   "ok",
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, report.DroppedValues)
+		require.Len(t, report.UnsupportedValues, 1)
+		require.Equal(t, []string{"server.request.body", "channel"}, report.UnsupportedValues[0].Path)
+		require.Equal(t, reflect.Chan, report.UnsupportedValues[0].Kind)
+	})
+
+	t.Run("truncations", func(t *testing.T) {
+		report, err := ValidateInput(map[string]any{
+			"server.request.body": strings.Repeat("a", 5000),
+		})
+		require.NoError(t, err)
+		require.Equal(t, map[TruncationReason][]int{StringTooLong: {5000}}, report.Truncations)
+		require.Zero(t, report.DroppedValues)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		_, err := ValidateInput(map[string]any{"server.request.body": "value"}, WithBudget(time.Nanosecond))
+		require.ErrorIs(t, err, errors.ErrTimeout)
+	})
+
+	t.Run("encoder-options", func(t *testing.T) {
+		// The encoder options apply as they do to Context.Run
+		report, err := ValidateInput(map[string]any{"server.request.body": map[int]string{1: "value"}}, WithStringifiedNumericKeys())
+		require.NoError(t, err)
+		require.Zero(t, report.DroppedValues)
+		require.Equal(t, len("server.request.body")+len("1")+len("value"), report.Size)
+
+		_, err = ValidateInput(map[string]any{"server.request.body": strings.Repeat("a", 1000)}, WithMaxInputSize(100))
+		require.ErrorIs(t, err, errors.ErrInputTooLarge)
+	})
+}
+
+func TestEncodeToGo(t *testing.T) {
+	t.Run("float", func(t *testing.T) {
+		value, err := EncodeToGo(33.5)
+		require.NoError(t, err)
+		require.Equal(t, 33.5, value)
+	})
+
+	t.Run("shaping", func(t *testing.T) {
+		type body struct {
+			Name    string
+			Count   int
+			Tags    []string
+			private string
+		}
+		value, err := EncodeToGo(map[string]any{
+			"body":    body{Name: "name", Count: 3, Tags: []string{"a", "b"}, private: "hidden"},
+			"channel": make(chan int),
+			"long":    strings.Repeat("a", 5000),
+		})
+		require.NoError(t, err)
+		require.Equal(t, map[string]any{
+			"body": map[string]any{"Name": "name", "Count": int64(3), "Tags": []any{"a", "b"}},
+			"long": strings.Repeat("a", 4096),
+		}, value)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := EncodeToGo(make(chan int))
+		require.ErrorIs(t, err, errors.ErrUnsupportedValue)
+	})
+
+	t.Run("skip-unsupported-top-level", func(t *testing.T) {
+		value, err := EncodeToGo(make(chan int), WithSkipUnsupportedTopLevel())
+		require.NoError(t, err)
+		require.Equal(t, map[string]any{}, value)
+
+		value, err = EncodeToGo(map[string]any{
+			"channel": make(chan int),
+			"nested":  map[string]any{"func": func() {}},
+			"slice":   []any{"a", make(chan int)},
+		}, WithSkipUnsupportedTopLevel())
+		require.NoError(t, err)
+		require.Equal(t, map[string]any{
+			"channel": map[string]any{},
+			"nested":  map[string]any{},
+			"slice":   []any{"a"},
+		}, value)
+	})
+
+	t.Run("options", func(t *testing.T) {
+		value, err := EncodeToGo(nil, WithJSONMode())
+		require.NoError(t, err)
+		require.Nil(t, value)
+	})
+}
+
+func TestEncodeValue(t *testing.T) {
+	t.Run("round-trip", func(t *testing.T) {
+		for _, tc := range []struct {
+			Name     string
+			Input    any
+			Expected any
+		}{
+			{Name: "empty-errors", Input: map[string][]string{}, Expected: map[string]any{}},
+			{Name: "nil-entry", Input: map[string][]string{"afasdfafs": nil}, Expected: map[string]any{"afasdfafs": nil}},
+			{
+				Name:     "filled-entries",
+				Input:    map[string][]string{"afasdfafs": {"rule1", "rule2"}, "sfdsafdsa": {"rule3"}},
+				Expected: map[string]any{"afasdfafs": []any{"rule1", "rule2"}, "sfdsafdsa": []any{"rule3"}},
+			},
+			{Name: "ints", Input: []any{1, int8(-2), uint16(3)}, Expected: []any{int64(1), int64(-2), uint64(3)}},
+			{Name: "empty-key", Input: map[string]any{"": map[string]int{"": 1}}, Expected: map[string]any{"": map[string]any{"": int64(1)}}},
+			{Name: "unsupported-values", Input: map[string]any{"channel": make(chan int), "key": "value"}, Expected: map[string]any{"key": "value"}},
+		} {
+			t.Run(tc.Name, func(t *testing.T) {
+				object, err := EncodeValue(tc.Input, EncoderLimits{})
+				require.NoError(t, err)
+				defer object.Free()
+
+				value, err := DecodeValue(object)
+				require.NoError(t, err)
+				require.Equal(t, tc.Expected, value)
+				require.Empty(t, object.Truncations())
+			})
+		}
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		object, err := EncodeValue([]any{"abcdef", []any{"nested"}}, EncoderLimits{MaxContainerDepth: 1, MaxStringLength: 3})
+		require.NoError(t, err)
+		defer object.Free()
+
+		value, err := DecodeValue(object)
+		require.NoError(t, err)
+		require.Equal(t, []any{"abc"}, value)
+		require.Equal(t, []int{6}, object.Truncations()[StringTooLong])
+		require.NotEmpty(t, object.Truncations()[ObjectTooDeep])
+
+		_, err = EncodeValue("value", EncoderLimits{MaxStringLength: -1})
+		require.ErrorIs(t, err, errors.ErrInvalidLimits)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := EncodeValue(make(chan int), EncoderLimits{})
+		require.ErrorIs(t, err, errors.ErrUnsupportedValue)
+	})
+
+	t.Run("freed", func(t *testing.T) {
+		object, err := EncodeValue("value", EncoderLimits{})
+		require.NoError(t, err)
+		object.Free()
+		object.Free()
+
+		_, err = DecodeValue(object)
+		require.ErrorIs(t, err, errors.ErrNilObjectPtr)
+		_, err = DecodeValue(nil)
+		require.ErrorIs(t, err, errors.ErrNilObjectPtr)
+	})
+}
+
+func TestEncodeHTTPHeaders(t *testing.T) {
+	t.Run("multi-valued", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("Content-Type", "text/html")
+		h.Add("Accept", "text/html")
+		h.Add("Accept", "application/json")
+		h.Add("X-Forwarded-For", "1.2.3.4")
+		h.Add("X-Forwarded-For", "5.6.7.8")
+		require.Equal(t, map[string]any{
+			"content-type":    "text/html",
+			"accept":          "text/html, application/json",
+			"x-forwarded-for": "1.2.3.4, 5.6.7.8",
+		}, EncodeHTTPHeaders(h))
+	})
+
+	t.Run("cookie", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("User-Agent", "Arachni/v1")
+		h.Add("Cookie", "session=1234")
+		h.Add("Cookie", "theme=dark")
+		h["cookie"] = []string{"raw=1"}
+		require.Equal(t, map[string]any{"user-agent": "Arachni/v1"}, EncodeHTTPHeaders(h))
+	})
+
+	t.Run("non-canonical", func(t *testing.T) {
+		h := http.Header{"X-Custom": {"a"}, "x-custom": {"b"}, "X-Empty": {}}
+		headers := EncodeHTTPHeaders(h)
+		require.Len(t, headers, 1)
+		require.ElementsMatch(t, []string{"a", "b"}, strings.Split(headers["x-custom"].(string), ", "))
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		require.Empty(t, EncodeHTTPHeaders(nil))
+	})
+}
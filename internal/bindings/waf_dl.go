@@ -37,6 +37,7 @@ type wafSymbols struct {
 	objectFree     uintptr
 	resultFree     uintptr
 	run            uintptr
+	setLogCb       uintptr
 }
 
 // newWafDl loads the libddwaf shared library and resolves all tge relevant symbols.
@@ -90,12 +91,7 @@ func NewWafDl() (dl *WafDl, err error) {
 	}
 
 	if val := os.Getenv(log.EnvVarLogLevel); val != "" {
-		setLogSym, symErr := purego.Dlsym(handle, "ddwaf_set_log_cb")
-		if symErr != nil {
-			return
-		}
-		logLevel := log.LevelNamed(val)
-		dl.syscall(setLogSym, log.CallbackFunctionPointer(), uintptr(logLevel))
+		dl.WafSetLogCb(log.CallbackFunctionPointer(), log.LevelNamed(val))
 	}
 
 	return
@@ -184,6 +180,12 @@ func (waf *WafDl) WafRun(context WafContext, persistentData, ephemeralData *WafO
 	return rc
 }
 
+// WafSetLogCb registers the given C function pointer as the callback receiving the messages libddwaf logs at the given
+// level or above. It returns false if libddwaf rejected the callback.
+func (waf *WafDl) WafSetLogCb(cb uintptr, minLevel log.Level) bool {
+	return byte(waf.syscall(waf.setLogCb, cb, uintptr(minLevel))) != 0
+}
+
 func (waf *WafDl) Handle() uintptr {
 	return waf.handle
 }
@@ -233,6 +235,9 @@ func resolveWafSymbols(handle uintptr) (symbols wafSymbols, err error) {
 	if symbols.run, err = purego.Dlsym(handle, "ddwaf_run"); err != nil {
 		return
 	}
+	if symbols.setLogCb, err = purego.Dlsym(handle, "ddwaf_set_log_cb"); err != nil {
+		return
+	}
 
 	return
 }
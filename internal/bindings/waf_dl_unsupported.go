@@ -8,6 +8,8 @@
 
 package bindings
 
+import "github.com/DataDog/go-libddwaf/v2/internal/log"
+
 type WafDl struct{}
 
 func NewWafDl() (dl *WafDl, err error) {
@@ -49,3 +51,7 @@ func (waf *WafDl) WafObjectFree(obj *WafObject) {
 func (waf *WafDl) WafRun(context WafContext, persistentData, ephemeralData *WafObject, result *WafResult, timeout uint64) WafReturnCode {
 	return WafErrInternal
 }
+
+func (waf *WafDl) WafSetLogCb(cb uintptr, minLevel log.Level) bool {
+	return false
+}
@@ -11,6 +11,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 // Level replicates the definition of `DDWAF_LOG_LEVEL` from `ddwaf.h`.
@@ -67,7 +68,42 @@ func (l Level) String() string {
 
 var filter *regexp.Regexp
 
+// Callback receives the messages logged by libddwaf instead of the standard logger, see SetCallback.
+type Callback func(level Level, message string)
+
+var (
+	callbackMutex sync.RWMutex
+	callback      Callback
+)
+
+// SetCallback makes the messages logged by libddwaf go to the given callback instead of the standard logger. A nil
+// callback restores the standard logger.
+func SetCallback(cb Callback) {
+	callbackMutex.Lock()
+	defer callbackMutex.Unlock()
+	callback = cb
+}
+
+// forwardMessage calls the given callback with the given message, recovering from its panics as they must not unwind
+// through the C frames of libddwaf.
+func forwardMessage(cb Callback, level Level, message string) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("[ERROR] go-libddwaf: recovered from a panic in the libddwaf log callback: %v", err)
+		}
+	}()
+	cb(level, message)
+}
+
 func logMessage(level Level, function, file string, line uint, message string) {
+	callbackMutex.RLock()
+	cb := callback
+	callbackMutex.RUnlock()
+	if cb != nil {
+		forwardMessage(cb, level, message)
+		return
+	}
+
 	entry := fmt.Sprintf("[%s] libddwaf @ %s:%d (%s): %s", level, file, line, function, message)
 
 	if filter != nil && !filter.MatchString(entry) {
@@ -77,15 +113,39 @@ func logMessage(level Level, function, file string, line uint, message string) {
 	log.Println(entry)
 }
 
+// Log logs a message of go-libddwaf itself, as opposed to the ones of libddwaf, to the callback set with SetCallback,
+// or to the standard logger when no callback is set and the DD_APPSEC_WAF_LOG_LEVEL environment variable enables the
+// level of the message.
+func Log(level Level, message string) {
+	callbackMutex.RLock()
+	cb := callback
+	callbackMutex.RUnlock()
+	if cb != nil {
+		forwardMessage(cb, level, message)
+		return
+	}
+
+	if level < minLevel {
+		return
+	}
+	log.Printf("[%s] %s", level, message)
+}
+
 const EnvVarLogLevel = "DD_APPSEC_WAF_LOG_LEVEL"
 
+// minLevel is the level of the messages of go-libddwaf itself that go to the standard logger when no callback is set,
+// as configured by the DD_APPSEC_WAF_LOG_LEVEL environment variable.
+var minLevel = LevelOff
+
 func init() {
 	const envVarFilter = "DD_APPSEC_WAF_LOG_FILTER"
 
-	if val := os.Getenv(EnvVarLogLevel); val == "" {
+	val := os.Getenv(EnvVarLogLevel)
+	if val == "" {
 		// No log level configured, don't even attempt parsing the regexp.
 		return
 	}
+	minLevel = LevelNamed(val)
 
 	if val := os.Getenv(envVarFilter); val != "" {
 		var err error
@@ -0,0 +1,419 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package waf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/DataDog/go-libddwaf/v2/internal/bindings"
+	"github.com/DataDog/go-libddwaf/v2/internal/unsafe"
+)
+
+// jsonMaxDepth is the maximum nesting depth of the containers of the JSON documents parsed by parseJSON, which is the
+// one encoding/json enforces, so that deeply nested documents are rejected rather than exhausting the stack.
+const jsonMaxDepth = 10000
+
+// jsonParser parses JSON documents straight into wafObjects, without building an intermediate Go value. The strings of
+// the wafObjects reference the memory of the document whenever they contain no escape sequence, so that parsing
+// allocates little more than the wafObject arrays.
+type jsonParser struct {
+	// data is the JSON document, whose memory is referenced by the wafObjects
+	data string
+	// pos is the offset of the next byte to parse in data
+	pos int
+	// cgoRefs holds the Go references of the wafObjects
+	cgoRefs *cgoRefPool
+	// stack holds the elements of the containers being parsed, until their size is known
+	stack []bindings.WafObject
+	// depth is the number of containers being parsed
+	depth int
+}
+
+// parseJSON parses the given JSON document into a wafObject, whose Go references are stored into cgoRefs.
+func parseJSON(data []byte, cgoRefs *cgoRefPool) (*bindings.WafObject, error) {
+	doc := string(data)
+	cgoRefs.stringRefs = append(cgoRefs.stringRefs, doc)
+
+	parser := jsonParser{data: doc, cgoRefs: cgoRefs}
+	obj := new(bindings.WafObject)
+	parser.skipSpaces()
+	if err := parser.parseValue(obj); err != nil {
+		return nil, err
+	}
+	parser.skipSpaces()
+	if parser.pos != len(parser.data) {
+		return nil, parser.errorf("unexpected data after the top-level value")
+	}
+
+	return obj, nil
+}
+
+func (parser *jsonParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("invalid JSON at offset %d: %s", parser.pos, fmt.Sprintf(format, args...))
+}
+
+func (parser *jsonParser) skipSpaces() {
+	for parser.pos < len(parser.data) {
+		switch parser.data[parser.pos] {
+		case ' ', '\t', '\n', '\r':
+			parser.pos++
+		default:
+			return
+		}
+	}
+}
+
+// parseValue parses the JSON value at the current position into obj, leaving its ParameterName untouched.
+func (parser *jsonParser) parseValue(obj *bindings.WafObject) error {
+	if parser.pos >= len(parser.data) {
+		return parser.errorf("unexpected end of data")
+	}
+
+	switch c := parser.data[parser.pos]; {
+	case c == '{' || c == '[':
+		if parser.depth == jsonMaxDepth {
+			return parser.errorf("exceeded max depth %d", jsonMaxDepth)
+		}
+		parser.depth++
+		defer func() { parser.depth-- }()
+		if c == '{' {
+			return parser.parseObject(obj)
+		}
+		return parser.parseArray(obj)
+	case c == '"':
+		str, err := parser.parseString()
+		if err != nil {
+			return err
+		}
+		setWafString(obj, str)
+		return nil
+	case c == '-' || c >= '0' && c <= '9':
+		return parser.parseNumber(obj)
+	case strings.HasPrefix(parser.data[parser.pos:], "true"):
+		parser.pos += len("true")
+		encodeNative(unsafe.NativeToUintptr(true), bindings.WafBoolType, obj)
+		return nil
+	case strings.HasPrefix(parser.data[parser.pos:], "false"):
+		parser.pos += len("false")
+		encodeNative(unsafe.NativeToUintptr(false), bindings.WafBoolType, obj)
+		return nil
+	case strings.HasPrefix(parser.data[parser.pos:], "null"):
+		parser.pos += len("null")
+		encodeNative[uintptr](0, bindings.WafNilType, obj)
+		return nil
+	default:
+		return parser.errorf("unexpected character %q", c)
+	}
+}
+
+func (parser *jsonParser) parseObject(obj *bindings.WafObject) error {
+	parser.pos++ // '{'
+	start := len(parser.stack)
+
+	parser.skipSpaces()
+	if parser.pos < len(parser.data) && parser.data[parser.pos] == '}' {
+		parser.pos++
+		return parser.popContainer(obj, bindings.WafMapType, start)
+	}
+
+	for {
+		parser.skipSpaces()
+		if parser.pos >= len(parser.data) || parser.data[parser.pos] != '"' {
+			return parser.errorf("expected an object key")
+		}
+		key, err := parser.parseString()
+		if err != nil {
+			return err
+		}
+
+		parser.skipSpaces()
+		if parser.pos >= len(parser.data) || parser.data[parser.pos] != ':' {
+			return parser.errorf("expected ':' after an object key")
+		}
+		parser.pos++
+		parser.skipSpaces()
+
+		var elem bindings.WafObject
+		if len(key) > 0 {
+			stringHeader := unsafe.NativeStringUnwrap(key)
+			elem.ParameterName = stringHeader.Data
+			elem.ParameterNameLength = uint64(stringHeader.Len)
+		}
+		if err := parser.parseValue(&elem); err != nil {
+			return err
+		}
+		parser.stack = append(parser.stack, elem)
+
+		if done, err := parser.parseSeparator('}'); err != nil || done {
+			if err != nil {
+				return err
+			}
+			return parser.popContainer(obj, bindings.WafMapType, start)
+		}
+	}
+}
+
+func (parser *jsonParser) parseArray(obj *bindings.WafObject) error {
+	parser.pos++ // '['
+	start := len(parser.stack)
+
+	parser.skipSpaces()
+	if parser.pos < len(parser.data) && parser.data[parser.pos] == ']' {
+		parser.pos++
+		return parser.popContainer(obj, bindings.WafArrayType, start)
+	}
+
+	for {
+		parser.skipSpaces()
+		var elem bindings.WafObject
+		if err := parser.parseValue(&elem); err != nil {
+			return err
+		}
+		parser.stack = append(parser.stack, elem)
+
+		if done, err := parser.parseSeparator(']'); err != nil || done {
+			if err != nil {
+				return err
+			}
+			return parser.popContainer(obj, bindings.WafArrayType, start)
+		}
+	}
+}
+
+// parseSeparator parses the separator following a container element, returning true at the end of the container.
+func (parser *jsonParser) parseSeparator(end byte) (bool, error) {
+	parser.skipSpaces()
+	if parser.pos >= len(parser.data) {
+		return false, parser.errorf("unexpected end of data")
+	}
+
+	switch parser.data[parser.pos] {
+	case ',':
+		parser.pos++
+		return false, nil
+	case end:
+		parser.pos++
+		return true, nil
+	default:
+		return false, parser.errorf("expected ',' or %q", end)
+	}
+}
+
+// popContainer makes obj a container of the given type holding the elements of the stack from start onwards, which are
+// removed from the stack.
+func (parser *jsonParser) popContainer(obj *bindings.WafObject, typ bindings.WafObjectType, start int) error {
+	elems := parser.stack[start:]
+	goArray := parser.cgoRefs.AllocWafArray(obj, typ, uint64(len(elems)))
+	copy(goArray, elems)
+	parser.stack = parser.stack[:start]
+	return nil
+}
+
+// parseString parses the JSON string at the current position. The returned string references the document unless it
+// contains escape sequences.
+func (parser *jsonParser) parseString() (string, error) {
+	parser.pos++ // '"'
+	start := parser.pos
+	for parser.pos < len(parser.data) {
+		switch c := parser.data[parser.pos]; {
+		case c == '"':
+			str := parser.data[start:parser.pos]
+			parser.pos++
+			return str, nil
+		case c == '\\':
+			return parser.parseEscapedString(start)
+		case c < 0x20:
+			return "", parser.errorf("invalid control character in string")
+		case c >= utf8.RuneSelf:
+			if _, err := parser.skipRune(); err != nil {
+				return "", err
+			}
+		default:
+			parser.pos++
+		}
+	}
+	return "", parser.errorf("unterminated string")
+}
+
+// skipRune skips the multi-byte UTF-8 character at the current position, returning it as a string, or an error if it
+// is not valid UTF-8.
+func (parser *jsonParser) skipRune() (string, error) {
+	r, size := utf8.DecodeRuneInString(parser.data[parser.pos:])
+	if r == utf8.RuneError && size <= 1 {
+		return "", parser.errorf("invalid UTF-8 in string")
+	}
+	parser.pos += size
+	return parser.data[parser.pos-size : parser.pos], nil
+}
+
+// parseEscapedString parses the rest of a JSON string starting at start, whose escape sequences must be decoded.
+func (parser *jsonParser) parseEscapedString(start int) (string, error) {
+	var builder strings.Builder
+	builder.WriteString(parser.data[start:parser.pos])
+
+	for parser.pos < len(parser.data) {
+		c := parser.data[parser.pos]
+		switch {
+		case c == '"':
+			parser.pos++
+			str := builder.String()
+			parser.cgoRefs.stringRefs = append(parser.cgoRefs.stringRefs, str)
+			return str, nil
+		case c < 0x20:
+			return "", parser.errorf("invalid control character in string")
+		case c >= utf8.RuneSelf:
+			char, err := parser.skipRune()
+			if err != nil {
+				return "", err
+			}
+			builder.WriteString(char)
+			continue
+		case c != '\\':
+			builder.WriteByte(c)
+			parser.pos++
+			continue
+		}
+
+		if parser.pos+1 >= len(parser.data) {
+			break
+		}
+		escape := parser.data[parser.pos+1]
+		parser.pos += 2
+		switch escape {
+		case '"', '\\', '/':
+			builder.WriteByte(escape)
+		case 'b':
+			builder.WriteByte('\b')
+		case 'f':
+			builder.WriteByte('\f')
+		case 'n':
+			builder.WriteByte('\n')
+		case 'r':
+			builder.WriteByte('\r')
+		case 't':
+			builder.WriteByte('\t')
+		case 'u':
+			r, err := parser.parseUnicodeEscape()
+			if err != nil {
+				return "", err
+			}
+			if utf16.IsSurrogate(r) {
+				// The second half of a surrogate pair must follow, otherwise the character is invalid
+				r2 := utf8.RuneError
+				if strings.HasPrefix(parser.data[parser.pos:], `\u`) {
+					parser.pos += 2
+					if r2, err = parser.parseUnicodeEscape(); err != nil {
+						return "", err
+					}
+				}
+				if r = utf16.DecodeRune(r, r2); r == utf8.RuneError && r2 != utf8.RuneError {
+					builder.WriteRune(utf8.RuneError)
+					r = r2
+				}
+			}
+			builder.WriteRune(r)
+		default:
+			return "", parser.errorf("invalid escape sequence %q", escape)
+		}
+	}
+	return "", parser.errorf("unterminated string")
+}
+
+// parseUnicodeEscape parses the 4 hexadecimal digits of a \u escape sequence.
+func (parser *jsonParser) parseUnicodeEscape() (rune, error) {
+	if parser.pos+4 > len(parser.data) {
+		return 0, parser.errorf("invalid unicode escape sequence")
+	}
+	code, err := strconv.ParseUint(parser.data[parser.pos:parser.pos+4], 16, 16)
+	if err != nil {
+		return 0, parser.errorf("invalid unicode escape sequence")
+	}
+	parser.pos += 4
+	return rune(code), nil
+}
+
+// parseNumber parses the JSON number at the current position into an integer when it is one that fits 64 bits, or
+// into a float otherwise, like the encoder does with json.Number values.
+func (parser *jsonParser) parseNumber(obj *bindings.WafObject) error {
+	start := parser.pos
+	isInteger := true
+
+	if parser.data[parser.pos] == '-' {
+		parser.pos++
+	}
+	switch {
+	case parser.pos < len(parser.data) && parser.data[parser.pos] == '0':
+		// Leading zeros are not allowed, so that a zero is the whole integer part, and any digit after it is unexpected
+		parser.pos++
+	case !parser.skipDigits():
+		return parser.errorf("invalid number")
+	}
+	if parser.pos < len(parser.data) && parser.data[parser.pos] == '.' {
+		isInteger = false
+		parser.pos++
+		if !parser.skipDigits() {
+			return parser.errorf("invalid number")
+		}
+	}
+	if parser.pos < len(parser.data) && (parser.data[parser.pos] == 'e' || parser.data[parser.pos] == 'E') {
+		isInteger = false
+		parser.pos++
+		if parser.pos < len(parser.data) && (parser.data[parser.pos] == '+' || parser.data[parser.pos] == '-') {
+			parser.pos++
+		}
+		if !parser.skipDigits() {
+			return parser.errorf("invalid number")
+		}
+	}
+
+	number := parser.data[start:parser.pos]
+	if isInteger {
+		if i, err := strconv.ParseInt(number, 10, 64); err == nil {
+			encodeNative(i, bindings.WafIntType, obj)
+			return nil
+		}
+		if u, err := strconv.ParseUint(number, 10, 64); err == nil {
+			encodeNative(u, bindings.WafUintType, obj)
+			return nil
+		}
+	}
+
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		// Out of range numbers are kept as strings, as WithJSONMode does
+		setWafString(obj, number)
+		return nil
+	}
+	encodeNative(unsafe.NativeToUintptr(f), bindings.WafFloatType, obj)
+	return nil
+}
+
+// skipDigits skips the decimal digits at the current position, returning false if there are none.
+func (parser *jsonParser) skipDigits() bool {
+	start := parser.pos
+	for parser.pos < len(parser.data) && parser.data[parser.pos] >= '0' && parser.data[parser.pos] <= '9' {
+		parser.pos++
+	}
+	return parser.pos > start
+}
+
+// setWafString makes obj a string referencing the memory of str, which the caller must keep alive.
+func setWafString(obj *bindings.WafObject, str string) {
+	obj.Type = bindings.WafStringType
+	if len(str) == 0 {
+		obj.Value = 0
+		obj.NbEntries = 0
+		return
+	}
+
+	stringHeader := unsafe.NativeStringUnwrap(str)
+	obj.Value = stringHeader.Data
+	obj.NbEntries = uint64(stringHeader.Len)
+}
@@ -0,0 +1,65 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package waf
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/DataDog/go-libddwaf/v2/internal/log"
+)
+
+// LogLevel is the level of a message logged by libddwaf.
+type LogLevel = log.Level
+
+const (
+	LogLevelTrace   = log.LevelTrace
+	LogLevelDebug   = log.LevelDebug
+	LogLevelInfo    = log.LevelInfo
+	LogLevelWarning = log.LevelWarning
+	LogLevelError   = log.LevelError
+)
+
+// logCallbackMutex serializes the registrations of log callbacks, whose state is shared with libddwaf.
+var logCallbackMutex sync.Mutex
+
+// SetLogCallback makes the diagnostic messages libddwaf logs at the debug level or above go to fn, such as the reasons
+// why some rules could not be loaded, instead of the standard logger they go to when the DD_APPSEC_WAF_LOG_LEVEL
+// environment variable is set. A nil fn restores the logging configured by this environment variable, if any. fn is
+// called synchronously by libddwaf, so it must be fast and must not call into this package: panics are recovered, as
+// they cannot unwind through libddwaf. An error is returned when libddwaf cannot be loaded, or when it cannot call Go
+// functions, which is the case on linux without cgo. fn also receives the warnings of this package, such as the ones
+// about the Handles and Contexts garbage collected without being closed, which otherwise go to the standard logger when
+// DD_APPSEC_WAF_LOG_LEVEL enables warnings.
+func SetLogCallback(fn func(level LogLevel, message string)) error {
+	if ok, err := Load(); !ok {
+		return err
+	}
+
+	callbackPointer := log.CallbackFunctionPointer()
+	if callbackPointer == 0 {
+		return errors.New("libddwaf log callbacks are not supported on this target")
+	}
+
+	logCallbackMutex.Lock()
+	defer logCallbackMutex.Unlock()
+
+	minLevel := LogLevelDebug
+	if fn == nil {
+		minLevel = log.LevelOff
+		if val := os.Getenv(log.EnvVarLogLevel); val != "" {
+			minLevel = log.LevelNamed(val)
+		}
+	}
+
+	log.SetCallback(fn)
+	if !wafLib.WafSetLogCb(callbackPointer, minLevel) {
+		log.SetCallback(nil)
+		return errors.New("libddwaf rejected the log callback")
+	}
+	return nil
+}
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"go.uber.org/atomic"
 )
 
 // Stats stores the metrics collected by the WAF.
@@ -24,6 +26,101 @@ type Stats struct {
 	Truncations map[TruncationReason][]int
 }
 
+// Metrics are counters of the Context.Run calls of a Context, as returned by Context.Metrics, or of all the contexts
+// of a Handle, as returned by Handle.AggregateMetrics.
+type Metrics struct {
+	// Runs is the number of Context.Run calls given address data.
+	Runs uint64
+	// Matches is the number of runs that resulted in at least one event.
+	Matches uint64
+	// Timeouts is the number of runs that returned errors.ErrTimeout or errors.ErrBudgetExhausted.
+	Timeouts uint64
+	// Runtime is the cumulated time the WAF self-reported as spent processing the runs.
+	Runtime time.Duration
+}
+
+// runCounters accumulates Metrics in a lock-less way.
+type runCounters struct {
+	runs     atomic.Uint64
+	matches  atomic.Uint64
+	timeouts atomic.Uint64
+	runtime  atomic.Duration
+}
+
+// record accounts for a Context.Run call that returned the given result and error.
+func (counters *runCounters) record(res Result, err error) {
+	counters.runs.Inc()
+	if res.HasEvents() {
+		counters.matches.Inc()
+	}
+	if isTimeout(err) {
+		counters.timeouts.Inc()
+	}
+	counters.runtime.Add(res.TimeSpent)
+}
+
+// load returns the current value of the counters.
+func (counters *runCounters) load() Metrics {
+	return Metrics{
+		Runs:     counters.runs.Load(),
+		Matches:  counters.matches.Load(),
+		Timeouts: counters.timeouts.Load(),
+		Runtime:  counters.runtime.Load(),
+	}
+}
+
+// reset sets all the counters back to zero.
+func (counters *runCounters) reset() {
+	counters.runs.Store(0)
+	counters.matches.Store(0)
+	counters.timeouts.Store(0)
+	counters.runtime.Store(0)
+}
+
+// ruleStats counts the matches of each rule, see Context.RuleStats.
+type ruleStats struct {
+	counts map[string]uint64
+	mutex  sync.RWMutex
+}
+
+// record accounts for the matches of the rules reporting the given events.
+func (stats *ruleStats) record(events []any) {
+	if len(events) == 0 {
+		return
+	}
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	if stats.counts == nil {
+		stats.counts = make(map[string]uint64, len(events))
+	}
+
+	for _, event := range events {
+		if id := eventRuleID(event); id != "" {
+			stats.counts[id]++
+		}
+	}
+}
+
+// copy returns a snapshot of the match counts.
+func (stats *ruleStats) copy() map[string]uint64 {
+	stats.mutex.RLock()
+	defer stats.mutex.RUnlock()
+
+	copy := make(map[string]uint64, len(stats.counts))
+	for id, count := range stats.counts {
+		copy[id] = count
+	}
+	return copy
+}
+
+// reset forgets all the matches counted so far.
+func (stats *ruleStats) reset() {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.counts = nil
+}
+
 const (
 	wafEncodeTag     = "_dd.appsec.waf.encode"
 	wafRunTag        = "_dd.appsec.waf.duration_ext"
@@ -53,6 +150,15 @@ type metricsStore struct {
 	mutex sync.RWMutex
 }
 
+// reset forgets all the durations stored so far.
+func (metrics *metricsStore) reset() {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	for key := range metrics.data {
+		delete(metrics.data, key)
+	}
+}
+
 func (metrics *metricsStore) add(key string, duration time.Duration) {
 	metrics.mutex.Lock()
 	defer metrics.mutex.Unlock()
@@ -63,6 +169,13 @@ func (metrics *metricsStore) add(key string, duration time.Duration) {
 	metrics.data[key] += duration
 }
 
+// set replaces the current metrics with the given ones
+func (metrics *metricsStore) set(data map[string]time.Duration) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.data = data
+}
+
 func (metrics *metricsStore) get(key string) time.Duration {
 	metrics.mutex.RLock()
 	defer metrics.mutex.RUnlock()
@@ -0,0 +1,294 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package waf
+
+import (
+	"io"
+	"time"
+
+	"github.com/DataDog/go-libddwaf/v2/timer"
+)
+
+// Option is a configuration option for the WAF. Please read the documentation of each option to see what it
+// applies to.
+type Option func(*config)
+
+// config is the configuration of a Handle or a Context. It can be created through the use of options.
+type config struct {
+	// budget is the time budget of the Context, shared by all its Run calls
+	budget time.Duration
+	// persistentAddressPolicy defines what happens when a persistent address is provided more than once
+	persistentAddressPolicy PersistentAddressPolicy
+	// maxConcurrentRuns is the maximum number of concurrent Context.Run calls across a Handle, 0 meaning unlimited
+	maxConcurrentRuns int
+	// inputDump is the writer the address data of each Context.Run call is dumped to, if any
+	inputDump io.Writer
+	// jsonMode makes the encoder follow JSON semantics, see WithJSONMode
+	jsonMode bool
+	// nonFiniteFloatPolicy defines how NaN and infinite floats are encoded
+	nonFiniteFloatPolicy NonFiniteFloatPolicy
+	// keepAllMatches makes rules report their matches on every Context.Run call, see WithKeepAllMatches
+	keepAllMatches bool
+	// skipUnsupportedTopLevel makes the encoder encode unsupported top-level values as empty maps, see
+	// WithSkipUnsupportedTopLevel
+	skipUnsupportedTopLevel bool
+	// floatFormat and floatPrecision make floats be encoded as formatted strings, see WithFloatFormat
+	floatFormat    byte
+	floatPrecision int
+	// disabledRules are the identifiers of the rules excluded from the ruleset of a Handle, see WithDisabledRules
+	disabledRules map[string]struct{}
+	// monitorOnly makes runs report no actions, see WithMonitorOnly
+	monitorOnly bool
+	// strictInput makes runs without address data return errors.ErrNoInput, see WithStrictInput
+	strictInput bool
+	// maxInputSize is the maximum encoded size, in bytes, of the address data of a run, 0 meaning unlimited, see
+	// WithMaxInputSize
+	maxInputSize uint64
+	// sortMapKeys makes truncated maps keep a deterministic subset of their entries, see WithSortedMapKeys
+	sortMapKeys bool
+	// jsonTags makes struct fields be left out according to their json tag, as encoding/json does, see WithJSONTags
+	jsonTags bool
+	// nilContainersAsEmpty makes nil maps and slices be encoded as empty containers, see WithNilContainersAsEmpty
+	nilContainersAsEmpty bool
+	// stringifyNumericKeys makes integer map keys be encoded as strings, see WithStringifiedNumericKeys
+	stringifyNumericKeys bool
+	// clonableRuleset makes a Handle keep a copy of its encoded ruleset, see WithClonableRuleset
+	clonableRuleset bool
+}
+
+// defaultConfig returns the configuration used when no Option is provided.
+func defaultConfig() config {
+	return config{
+		budget: timer.UnlimitedBudget,
+	}
+}
+
+// with returns a copy of the configuration with the given options applied.
+func (cfg config) with(options []Option) config {
+	for _, option := range options {
+		option(&cfg)
+	}
+	return cfg
+}
+
+// WithBudget is an Option that sets the time budget of a Context, shared by all its Run calls.
+func WithBudget(budget time.Duration) Option {
+	return func(c *config) {
+		c.budget = budget
+	}
+}
+
+// PersistentAddressPolicy defines how a Context behaves when Context.Run is given a persistent address that was
+// already provided by a previous call.
+type PersistentAddressPolicy uint8
+
+const (
+	// ReplacePersistentAddress replaces the previous value of the address with the new one, which is then evaluated
+	// by the rules using it. This is the default policy.
+	ReplacePersistentAddress PersistentAddressPolicy = iota
+	// RejectPersistentAddress makes Context.Run return an error wrapping errors.ErrPersistentAddressAlreadySet
+	// without evaluating any of the provided address data.
+	RejectPersistentAddress
+)
+
+// WithPersistentAddressPolicy is an Option that sets the PersistentAddressPolicy of a Context.
+func WithPersistentAddressPolicy(policy PersistentAddressPolicy) Option {
+	return func(c *config) {
+		c.persistentAddressPolicy = policy
+	}
+}
+
+// WithMaxConcurrentRuns is an Option that limits the number of Context.Run calls that can be in flight at the same
+// time across all the contexts of a Handle, and of the handles it is updated into. Once the limit is reached,
+// Context.Run returns errors.ErrBusy without running the WAF, providing backpressure under traffic spikes. A limit of
+// 0 or less means no limit, which is the default. It only applies to NewHandleWithOptions.
+func WithMaxConcurrentRuns(max int) Option {
+	return func(c *config) {
+		c.maxConcurrentRuns = max
+	}
+}
+
+// WithInputDump is an Option that makes each Context.Run call write the address data it evaluates to w, as a single
+// JSON line with the "persistent" and "ephemeral" address data. The data is dumped as it was encoded for the WAF, after
+// truncations and without the values that could not be encoded, right before being evaluated. Writing errors are
+// ignored. When set on a Handle, w is shared by all its contexts and must then be safe for concurrent use.
+func WithInputDump(w io.Writer) Option {
+	return func(c *config) {
+		c.inputDump = w
+	}
+}
+
+// WithJSONMode is an Option that makes address data be encoded following JSON semantics, for values that were decoded
+// from JSON into the standard `any` tree of maps, slices, float64, string, bool and nil values. In this mode, nil
+// values are always encoded as nulls, while they are otherwise dropped from arrays and rejected as top-level values.
+// Floats are encoded as native floats, and json.Number values, as decoded when using json.Decoder.UseNumber, as
+// numbers instead of strings, in any mode.
+func WithJSONMode() Option {
+	return func(c *config) {
+		c.jsonMode = true
+	}
+}
+
+// NonFiniteFloatPolicy defines how NaN and infinite floats are encoded, as they have no JSON representation.
+type NonFiniteFloatPolicy uint8
+
+const (
+	// EncodeNonFiniteAsFloat encodes NaN and infinite floats as native floats, leaving their interpretation to
+	// libddwaf. This is the default policy.
+	EncodeNonFiniteAsFloat NonFiniteFloatPolicy = iota
+	// EncodeNonFiniteAsNull encodes NaN and infinite floats as nulls.
+	EncodeNonFiniteAsNull
+	// EncodeNonFiniteAsString encodes NaN and infinite floats as the strings "NaN", "+Inf" and "-Inf".
+	EncodeNonFiniteAsString
+	// RejectNonFiniteFloats does not encode NaN and infinite floats, as any other unsupported Go value.
+	RejectNonFiniteFloats
+)
+
+// WithNonFiniteFloatPolicy is an Option that sets the NonFiniteFloatPolicy used when encoding address data.
+func WithNonFiniteFloatPolicy(policy NonFiniteFloatPolicy) Option {
+	return func(c *config) {
+		c.nonFiniteFloatPolicy = policy
+	}
+}
+
+// WithFloatFormat is an Option that makes finite floats be encoded as strings formatted by strconv.FormatFloat with the
+// given format and precision, such as 'f' and 2 for amounts or 'g' and -1 for the shortest representation keeping all
+// their decimals, instead of native floats, which is the default. This allows rules matching strings, such as regular
+// expressions, to match floats. The format must be one of those supported by strconv.FormatFloat, and a format of 0
+// restores the default. NaN and infinite floats are still encoded according to the NonFiniteFloatPolicy.
+func WithFloatFormat(format byte, precision int) Option {
+	return func(c *config) {
+		c.floatFormat = format
+		c.floatPrecision = precision
+	}
+}
+
+// WithStringifiedNumericKeys is an Option that makes the integer keys of maps, such as the status codes of a
+// map[int]string, be encoded as their decimal string form, such as "404", as WAF map keys must be strings. Without it,
+// which is the default, the entries of such keys are dropped, as are the ones of other keys that are not strings.
+func WithStringifiedNumericKeys() Option {
+	return func(c *config) {
+		c.stringifyNumericKeys = true
+	}
+}
+
+// WithNilContainersAsEmpty is an Option that makes nil maps be encoded as empty WAF maps, and nil slices as empty WAF
+// arrays, instead of nulls, which is the default, the same way nil pointers are. This is useful when rules expect
+// containers at some key paths, as a nil map or slice is then indistinguishable from an empty one, as they are in Go.
+// Nil maps and slices are thus no longer dropped from arrays, which nulls are outside of JSON mode. Nil byte slices,
+// which are skipped when not nil, are still encoded as nulls.
+func WithNilContainersAsEmpty() Option {
+	return func(c *config) {
+		c.nilContainersAsEmpty = true
+	}
+}
+
+// WithJSONTags is an Option that makes structs be encoded following the json tags of their fields, as encoding/json
+// does, so that rules written against the JSON representation of address data match its Go structs too. Fields are
+// always keyed by the name of their json tag, when they have one, and by their Go name otherwise. With this option,
+// fields tagged `json:"-"` are also left out, as are fields tagged with the omitempty option holding an empty value,
+// such as false, 0, a nil pointer or an empty string or slice. Without it, such fields are encoded, the former being
+// keyed by "-".
+func WithJSONTags() Option {
+	return func(c *config) {
+		c.jsonTags = true
+	}
+}
+
+// WithSortedMapKeys is an Option that makes the maps having more entries than the container size limit of the encoder be
+// encoded in the ascending order of their keys, so that truncating them always keeps the same subset of their entries,
+// namely the ones with the smallest keys, instead of the random subset resulting from the randomized iteration order of
+// Go maps. This makes the security decisions taken on truncated address data reproducible, at the cost of sorting the
+// keys of such maps. Maps that are not truncated are encoded as usual, in no particular order.
+func WithSortedMapKeys() Option {
+	return func(c *config) {
+		c.sortMapKeys = true
+	}
+}
+
+// WithSkipUnsupportedTopLevel is an Option that makes unsupported top-level values, such as channels or functions, be
+// encoded as empty maps instead of being rejected. Top-level values are the value given to EncodeToGo, and the values of
+// a top-level map, such as the value of each address given to Context.Run. Without this option, an unsupported
+// top-level value makes EncodeToGo fail, and an unsupported address value is dropped, as are unsupported values
+// nested deeper in any mode. Such values are still counted in InputReport.DroppedValues.
+func WithSkipUnsupportedTopLevel() Option {
+	return func(c *config) {
+		c.skipUnsupportedTopLevel = true
+	}
+}
+
+// WithKeepAllMatches is an Option that makes the rules of a Context report their matches on every call to Context.Run
+// where they match, while libddwaf otherwise only reports the first match of each rule in a given Context. This is
+// done by evaluating each call in a new ddwaf_context, provided with all the persistent address data of the Context so
+// far, and then only keeping the events involving the address data of the call, along with their actions. As a
+// consequence, each call evaluates the persistent address data of all the previous calls again, which is accounted
+// for in the Context's timers, TotalRuntime and budget.
+func WithKeepAllMatches() Option {
+	return func(c *config) {
+		c.keepAllMatches = true
+	}
+}
+
+// WithDisabledRules is an Option that excludes the rules with the given identifiers from the ruleset of a Handle, such
+// as rules producing false positives in a given application, without editing the ruleset. The rules are removed from
+// the rules and custom_rules sections of the ruleset before it is given to libddwaf, so that they are neither loaded
+// nor reported by Handle.RuleIDs and Handle.Diagnostics. This also applies to the rulesets the Handle is updated with.
+// It only applies to handles, as contexts use the rules of the handle they are created from.
+func WithDisabledRules(ids ...string) Option {
+	return func(c *config) {
+		disabledRules := make(map[string]struct{}, len(c.disabledRules)+len(ids))
+		for id := range c.disabledRules {
+			disabledRules[id] = struct{}{}
+		}
+		for _, id := range ids {
+			disabledRules[id] = struct{}{}
+		}
+		c.disabledRules = disabledRules
+	}
+}
+
+// WithClonableRuleset is an Option that makes a Handle keep a copy of its encoded ruleset, as needed by
+// Handle.CloneWithObfuscators, along with the handles it is updated into and its clones. The copy lives as long as the
+// handles using it, which is why handles do not keep it unless they are created with this option. It only applies to
+// handles, such as the ones created with NewHandleWithOptions.
+func WithClonableRuleset() Option {
+	return func(c *config) {
+		c.clonableRuleset = true
+	}
+}
+
+// WithMonitorOnly is an Option that makes Context.Run and the other run methods report the events of the rules that
+// matched without any of their actions, as if none of the rules had on_match actions, so that a ruleset with blocking
+// or redirecting rules can be rolled out without taking any action while its matches are still reported for logging.
+// When set on a Handle, it applies to all its contexts.
+func WithMonitorOnly() Option {
+	return func(c *config) {
+		c.monitorOnly = true
+	}
+}
+
+// WithMaxInputSize is an Option that limits the total size, in bytes, of the address data encoded for a single
+// Context.Run call, persistent and ephemeral address data included, which is otherwise only bounded by the limits on
+// each string and container. The size is that of the WAF objects and strings allocated for libddwaf, as reported by
+// Context.LastRunInputBytes. Encoding is aborted as soon as the limit is exceeded, and the run then returns an error
+// wrapping errors.ErrInputTooLarge without evaluating any of the address data. A size of 0, the default, means no
+// limit. When set on a Handle, it applies to all its contexts.
+func WithMaxInputSize(size uint64) Option {
+	return func(c *config) {
+		c.maxInputSize = size
+	}
+}
+
+// WithStrictInput is an Option that makes Context.Run, and the other run methods of a Context, return
+// errors.ErrNoInput when given no address data, i.e. when both the persistent and ephemeral address data are nil or
+// empty, rather than silently doing nothing, as such calls usually reveal that the address data was not gathered. The
+// same goes for the empty inputs given to Context.RunBatch, whose BatchResult then holds the error. Such calls are not
+// counted as runs. When set on a Handle, it applies to all its contexts.
+func WithStrictInput() Option {
+	return func(c *config) {
+		c.strictInput = true
+	}
+}
@@ -0,0 +1,62 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package waf
+
+import (
+	"sync"
+)
+
+// ContextPool is a pool of the contexts of a Handle, for servers handling many requests, which can then reuse the Go
+// memory of the contexts of previous requests instead of allocating new ones. Each request must still use its own
+// Context, taken with Get and given back with Put once the request is over.
+//
+// The contexts in the pool hold no reference on the Handle, nor on its ruleset: their ddwaf_context is destroyed by
+// Put, and Get creates a new one of the current ruleset of the Handle, so that the pool neither keeps the Handle from
+// being freed once closed, nor the ruleset replaced by Handle.UpdateRuleset from being freed once its last context in
+// use is closed.
+type ContextPool struct {
+	handle  *Handle
+	options []Option
+	pool    sync.Pool
+}
+
+// NewContextPool returns a new pool of contexts of the given handle, which are created with the given options.
+func NewContextPool(handle *Handle, options ...Option) *ContextPool {
+	return &ContextPool{handle: handle, options: options}
+}
+
+// Get returns a context of the pool, or a new one if the pool is empty. The returned context is in the same state as
+// a new one. A nil value is returned when the handle can no longer be used or the WAF context couldn't be created.
+func (pool *ContextPool) Get() *Context {
+	if context, _ := pool.pool.Get().(*Context); context != nil {
+		if context.attach() != nil {
+			return nil
+		}
+		return context
+	}
+	return NewContextWithOptions(pool.handle, pool.options...)
+}
+
+// Put resets the given context of this pool and gives it back to the pool, so that it is safe to reuse. The context
+// must no longer be used by the caller, and must not be closed. Resetting a context destroys its ddwaf_context and
+// releases its references on the handle, until Get gives it a new ddwaf_context of the current ruleset of the handle,
+// in which no rule matched yet, so that the rules already matched by the context are no longer pruned. Its persistent
+// address data is forgotten, and its budget, timers, metrics, rule stats and truncations start over. Closed contexts
+// and contexts of other handles are not put back in the pool, the latter being closed instead.
+func (pool *ContextPool) Put(context *Context) {
+	if context == nil {
+		return
+	}
+	if context.handle != pool.handle {
+		context.Close()
+		return
+	}
+	if context.reset() != nil {
+		// The context was already closed
+		return
+	}
+	pool.pool.Put(context)
+}
@@ -0,0 +1,14 @@
+module github.com/DataDog/go-libddwaf/v2/proto
+
+go 1.20
+
+require (
+	github.com/stretchr/testify v1.8.4
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,161 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// Package proto converts protobuf messages into address data for the WAF, such as the messages received by gRPC
+// servers, provided under the "grpc.server.request.message" address. It is a separate module so that users of the WAF
+// not using protobuf do not depend on google.golang.org/protobuf.
+package proto
+
+import (
+	"time"
+
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// EncodeProtoMessage converts the given protobuf message into the map of its populated fields, keyed by their protobuf
+// field names, as the rules expect, rather than by the names of the fields of the generated Go struct, whose internal
+// fields the WAF encoder would otherwise see. The values of the fields are converted as follows:
+//   - scalars are kept as Go scalars, integers being widened to int64 or uint64 and floats to float64;
+//   - bytes are converted to strings, so that rules can scan them, as the WAF encoder skips byte slices;
+//   - enums are converted to the names of their values, or to their numbers when unknown;
+//   - messages are converted to nested maps, repeated fields to slices and map fields to maps keyed by the string
+//     form of their keys;
+//   - the well-known wrapper types are converted to the value they wrap, google.protobuf.Timestamp to an RFC 3339
+//     string, google.protobuf.Duration to a duration string such as "1.5s", google.protobuf.Struct, Value and
+//     ListValue to the JSON-like values they represent, and google.protobuf.Any to its unpacked message when its type
+//     is registered, or to a map holding its "@type" otherwise.
+//
+// Unknown fields are ignored. A nil message, or a message without populated fields, results in an empty map.
+func EncodeProtoMessage(msg gproto.Message) map[string]any {
+	if msg == nil {
+		return map[string]any{}
+	}
+	return encodeFields(msg.ProtoReflect())
+}
+
+// encodeFields converts the populated fields of the given message into a map keyed by field name.
+func encodeFields(msg protoreflect.Message) map[string]any {
+	fields := make(map[string]any, msg.Descriptor().Fields().Len())
+	if !msg.IsValid() {
+		return fields
+	}
+	msg.Range(func(fd protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		fields[fd.TextName()] = encodeField(fd, value)
+		return true
+	})
+	return fields
+}
+
+// encodeField converts the value of the given field, which can be a list, a map or a single value.
+func encodeField(fd protoreflect.FieldDescriptor, value protoreflect.Value) any {
+	switch {
+	case fd.IsList():
+		list := value.List()
+		values := make([]any, list.Len())
+		for i := range values {
+			values[i] = encodeValue(fd, list.Get(i))
+		}
+		return values
+	case fd.IsMap():
+		entries := make(map[string]any, value.Map().Len())
+		value.Map().Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+			entries[key.String()] = encodeValue(fd.MapValue(), value)
+			return true
+		})
+		return entries
+	default:
+		return encodeValue(fd, value)
+	}
+}
+
+// encodeValue converts a single value of the given field, or of the values of the given map field.
+func encodeValue(fd protoreflect.FieldDescriptor, value protoreflect.Value) any {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return value.Bool()
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return value.Int()
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return value.Uint()
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return value.Float()
+	case protoreflect.StringKind:
+		return value.String()
+	case protoreflect.BytesKind:
+		return string(value.Bytes())
+	case protoreflect.EnumKind:
+		if enum := fd.Enum().Values().ByNumber(value.Enum()); enum != nil {
+			return string(enum.Name())
+		}
+		return int64(value.Enum())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return encodeMessage(value.Message())
+	default:
+		return nil
+	}
+}
+
+// encodeMessage converts the given message, unwrapping the well-known types into the values they represent.
+func encodeMessage(msg protoreflect.Message) any {
+	desc := msg.Descriptor()
+	if desc.FullName().Parent() != "google.protobuf" {
+		return encodeFields(msg)
+	}
+
+	switch desc.Name() {
+	case "DoubleValue", "FloatValue", "Int64Value", "UInt64Value", "Int32Value", "UInt32Value", "BoolValue",
+		"StringValue", "BytesValue":
+		fd := desc.Fields().ByName("value")
+		return encodeValue(fd, msg.Get(fd))
+	case "Timestamp":
+		seconds, nanos := secondsAndNanos(msg)
+		return time.Unix(seconds, nanos).UTC().Format(time.RFC3339Nano)
+	case "Duration":
+		seconds, nanos := secondsAndNanos(msg)
+		return (time.Duration(seconds)*time.Second + time.Duration(nanos)).String()
+	case "Struct":
+		fd := desc.Fields().ByName("fields")
+		return encodeField(fd, msg.Get(fd))
+	case "ListValue":
+		fd := desc.Fields().ByName("values")
+		return encodeField(fd, msg.Get(fd))
+	case "Value":
+		fd := msg.WhichOneof(desc.Oneofs().ByName("kind"))
+		if fd == nil || fd.Name() == "null_value" {
+			return nil
+		}
+		return encodeValue(fd, msg.Get(fd))
+	case "Any":
+		return encodeAny(msg)
+	default:
+		return encodeFields(msg)
+	}
+}
+
+// secondsAndNanos returns the seconds and nanos fields of a google.protobuf.Timestamp or google.protobuf.Duration.
+func secondsAndNanos(msg protoreflect.Message) (int64, int64) {
+	fields := msg.Descriptor().Fields()
+	return msg.Get(fields.ByName("seconds")).Int(), msg.Get(fields.ByName("nanos")).Int()
+}
+
+// encodeAny converts the message packed in the given google.protobuf.Any, or returns its type URL when the type of the
+// message is not registered or the message cannot be unmarshalled.
+func encodeAny(msg protoreflect.Message) any {
+	fields := msg.Descriptor().Fields()
+	url := msg.Get(fields.ByName("type_url")).String()
+	typ, err := protoregistry.GlobalTypes.FindMessageByURL(url)
+	if err != nil {
+		return map[string]any{"@type": url}
+	}
+
+	packed := typ.New()
+	if err := gproto.Unmarshal(msg.Get(fields.ByName("value")).Bytes(), packed.Interface()); err != nil {
+		return map[string]any{"@type": url}
+	}
+	return encodeMessage(packed)
+}
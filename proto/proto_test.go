@@ -0,0 +1,102 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package proto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/typepb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestEncodeProtoMessage(t *testing.T) {
+	t.Run("fields", func(t *testing.T) {
+		msg := &descriptorpb.FieldDescriptorProto{
+			Name:     gproto.String("user_agent"),
+			Number:   gproto.Int32(3),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+			Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+			JsonName: gproto.String("userAgent"),
+			Options:  &descriptorpb.FieldOptions{Deprecated: gproto.Bool(true)},
+		}
+		require.Equal(t, map[string]any{
+			"name":      "user_agent",
+			"number":    int64(3),
+			"label":     "LABEL_REPEATED",
+			"type":      "TYPE_STRING",
+			"json_name": "userAgent",
+			"options":   map[string]any{"deprecated": true},
+		}, EncodeProtoMessage(msg))
+	})
+
+	t.Run("repeated", func(t *testing.T) {
+		msg := &descriptorpb.FileDescriptorProto{
+			Name:       gproto.String("request.proto"),
+			Dependency: []string{"a.proto", "b.proto"},
+			MessageType: []*descriptorpb.DescriptorProto{
+				{Name: gproto.String("Request")},
+				{Name: gproto.String("Response")},
+			},
+		}
+		require.Equal(t, map[string]any{
+			"name":         "request.proto",
+			"dependency":   []any{"a.proto", "b.proto"},
+			"message_type": []any{map[string]any{"name": "Request"}, map[string]any{"name": "Response"}},
+		}, EncodeProtoMessage(msg))
+	})
+
+	t.Run("well-known-types", func(t *testing.T) {
+		packed := func(msg gproto.Message) *anypb.Any {
+			value, err := anypb.New(msg)
+			require.NoError(t, err)
+			return value
+		}
+		for _, tc := range []struct {
+			Name     string
+			Value    *anypb.Any
+			Expected any
+		}{
+			{Name: "string", Value: packed(wrapperspb.String("Arachni")), Expected: "Arachni"},
+			{Name: "bytes", Value: packed(wrapperspb.Bytes([]byte("raw"))), Expected: "raw"},
+			{Name: "int", Value: packed(wrapperspb.Int32(-7)), Expected: int64(-7)},
+			{Name: "timestamp", Value: packed(timestamppb.New(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))), Expected: "2024-01-02T03:04:05Z"},
+			{Name: "duration", Value: packed(durationpb.New(1500 * time.Millisecond)), Expected: "1.5s"},
+			{Name: "unknown-type", Value: &anypb.Any{TypeUrl: "type.googleapis.com/unknown.Type"}, Expected: map[string]any{"@type": "type.googleapis.com/unknown.Type"}},
+		} {
+			t.Run(tc.Name, func(t *testing.T) {
+				msg := &typepb.Option{Name: "option", Value: tc.Value}
+				require.Equal(t, map[string]any{"name": "option", "value": tc.Expected}, EncodeProtoMessage(msg))
+			})
+		}
+
+		t.Run("struct", func(t *testing.T) {
+			value, err := structpb.NewValue(map[string]any{
+				"user-agent": "Arachni",
+				"ids":        []any{1.0, "two", nil, true},
+			})
+			require.NoError(t, err)
+			msg := &typepb.Option{Name: "option", Value: packed(value)}
+			require.Equal(t, map[string]any{
+				"name":  "option",
+				"value": map[string]any{"user-agent": "Arachni", "ids": []any{1.0, "two", nil, true}},
+			}, EncodeProtoMessage(msg))
+		})
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		require.Equal(t, map[string]any{}, EncodeProtoMessage(nil))
+		require.Equal(t, map[string]any{}, EncodeProtoMessage((*descriptorpb.FieldDescriptorProto)(nil)))
+		require.Equal(t, map[string]any{}, EncodeProtoMessage(&descriptorpb.FieldDescriptorProto{}))
+	})
+}
@@ -0,0 +1,275 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package waf
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// RuleMatch is a rule that matched during a run, as returned by Context.RunDecoded.
+type RuleMatch struct {
+	// RuleID is the identifier of the rule.
+	RuleID string
+	// RuleName is the name of the rule.
+	RuleName string
+	// Parameters are the address data that matched the conditions of the rule.
+	Parameters []MatchParameter
+}
+
+// MatchParameter is a piece of address data that matched a rule condition.
+type MatchParameter struct {
+	// Address is the address the matching data was provided with.
+	Address string
+	// KeyPath is the path to the matching data in the address data, made of map keys (strings) and array indexes.
+	KeyPath []any
+	// Value is the matching data.
+	Value any
+	// Highlight are the parts of the matching data that matched the condition.
+	Highlight []string
+}
+
+// RunDecoded runs the WAF like Run, and returns the rules that matched as RuleMatch values along with the actions
+// to take, instead of the raw events of the Result. Events not having the expected format are ignored.
+func (context *Context) RunDecoded(addressData RunAddressData) ([]RuleMatch, []string, error) {
+	res, err := context.Run(addressData, 0)
+	return ruleMatches(res.Events), res.Actions, err
+}
+
+// Action is an action to take as the result of a run, as returned by Context.RunActions.
+type Action struct {
+	// ID is the identifier of the action, as found in the on_match arrays of the rules.
+	ID string
+	// Parameters are the parameters of the action, as defined in the actions section of the ruleset, such as the
+	// status code and location of a redirection. It is nil for actions without parameters, including the actions
+	// libddwaf defines by default when the ruleset does not.
+	Parameters map[string]any
+}
+
+// RunActions runs the WAF like RunWithLimits with the default limits, and returns the actions to take along with their
+// parameters, in the order of Result.Actions, so that they can be executed without looking them up in the ruleset.
+// The parameters come from the ruleset of the handle the context was created from, as last updated.
+func (context *Context) RunActions(addressData RunAddressData, timeout time.Duration) (Result, []Action, error) {
+	res, err := context.RunWithLimits(addressData, EncoderLimits{}, timeout)
+	if len(res.Actions) == 0 {
+		return res, nil, err
+	}
+
+	context.handle.instanceMutex.RLock()
+	parameters := context.handle.rulesIndex.actionParameters
+	context.handle.instanceMutex.RUnlock()
+
+	actions := make([]Action, len(res.Actions))
+	for i, id := range res.Actions {
+		actions[i] = Action{ID: id}
+		if params, found := parameters[id]; found {
+			// The parameters are copied so that the caller cannot alter the ones of the handle
+			actions[i].Parameters = make(map[string]any, len(params))
+			for key, value := range params {
+				actions[i].Parameters[key] = value
+			}
+		}
+	}
+	return res, actions, err
+}
+
+// RunWithDerivatives runs the WAF like RunWithLimits with the default limits, and returns the derivatives of the run
+// along with its result, such as the schemas extracted by the processors of the ruleset for API security. The
+// derivatives are never nil: runs producing none, including runs with libddwaf versions or rulesets that do not
+// generate derivatives, return an empty map. They are the same as Result.Derivatives otherwise.
+func (context *Context) RunWithDerivatives(addressData RunAddressData, timeout time.Duration) (Result, map[string]any, error) {
+	res, err := context.RunWithLimits(addressData, EncoderLimits{}, timeout)
+	if res.Derivatives == nil {
+		return res, map[string]any{}, err
+	}
+	return res, res.Derivatives, err
+}
+
+// blockingActions are the identifiers of the actions that make Context.RunDecision report the request as blocked.
+var blockingActions = map[string]struct{}{
+	"block":         {},
+	"block_request": {},
+}
+
+// RunDecision runs the WAF like RunWithLimits with the default limits, and returns whether the request must be blocked
+// along with the events of the run marshaled as a JSON array, nil when there are none, and the actions to take. The
+// request must be blocked when any of the actions is a blocking action, namely "block" or "block_request", so that
+// integrations do not need to look for them by themselves. Other actions, such as redirections, are left to the
+// caller. As with Run, the result of a timed out run is returned along with the error.
+func (context *Context) RunDecision(addressData RunAddressData, timeout time.Duration) (blocked bool, matches []byte, actions []string, err error) {
+	res, err := context.RunWithLimits(addressData, EncoderLimits{}, timeout)
+	if len(res.Events) > 0 {
+		var marshalErr error
+		if matches, marshalErr = json.Marshal(res.Events); marshalErr != nil && err == nil {
+			err = marshalErr
+		}
+	}
+
+	for _, action := range res.Actions {
+		if _, found := blockingActions[action]; found {
+			blocked = true
+			break
+		}
+	}
+	return blocked, matches, res.Actions, err
+}
+
+// RunTo runs the WAF like RunWithLimits with the default limits, given the values as persistent address data, and
+// writes the events of the run to matchesOut as a JSON array followed by a newline, as json.Encoder writes it, instead
+// of returning them, so that large matches can be streamed to a logger without being marshaled into a byte slice
+// first. The JSON array is the same as the matches returned by RunDecision. Nothing is written to matchesOut when the
+// run reports no event. The actions to take are returned, and the error of the run, if any, takes precedence over the
+// error of writing to matchesOut. As with Run, the events of a timed out run are written along with the error.
+func (context *Context) RunTo(values map[string]any, timeout time.Duration, matchesOut io.Writer) (actions []string, err error) {
+	res, err := context.RunWithLimits(RunAddressData{Persistent: values}, EncoderLimits{}, timeout)
+	if len(res.Events) > 0 {
+		if writeErr := json.NewEncoder(matchesOut).Encode(res.Events); writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}
+	return res.Actions, err
+}
+
+// ruleMatches converts the events of a Result into RuleMatch values.
+func ruleMatches(events []any) []RuleMatch {
+	if len(events) == 0 {
+		return nil
+	}
+
+	matches := make([]RuleMatch, 0, len(events))
+	for _, event := range events {
+		event, isMap := event.(map[string]any)
+		if !isMap {
+			continue
+		}
+		rule, _ := event["rule"].(map[string]any)
+		match := RuleMatch{}
+		match.RuleID, _ = rule["id"].(string)
+		match.RuleName, _ = rule["name"].(string)
+
+		conditions, _ := event["rule_matches"].([]any)
+		for _, condition := range conditions {
+			condition, _ := condition.(map[string]any)
+			parameters, _ := condition["parameters"].([]any)
+			for _, parameter := range parameters {
+				parameter, _ := parameter.(map[string]any)
+				param := MatchParameter{Value: parameter["value"]}
+				param.Address, _ = parameter["address"].(string)
+				param.KeyPath, _ = parameter["key_path"].([]any)
+				highlights, _ := parameter["highlight"].([]any)
+				for _, highlight := range highlights {
+					if highlight, isString := highlight.(string); isString {
+						param.Highlight = append(param.Highlight, highlight)
+					}
+				}
+				match.Parameters = append(match.Parameters, param)
+			}
+		}
+
+		matches = append(matches, match)
+	}
+	return matches
+}
+
+// SetMatchHandler sets a function called with each match of the runs of this context, in addition to the events of
+// the returned Result, so that matches can be streamed as they happen, such as to a SIEM. A nil function removes the
+// handler. The function is called synchronously, in the goroutine of the run, once per event of the Result, after the
+// run is over and the context is unlocked, so that the function can safely run the context again, although the
+// matches of such runs are handled too and must not lead to an endless recursion. With RunBatch, it is called once
+// the whole batch is over, for the matches of each input in turn. Events that cannot be parsed into a Match are not
+// handled.
+func (context *Context) SetMatchHandler(fn func(Match)) {
+	if fn == nil {
+		context.matchHandler.Store(nil)
+		return
+	}
+	context.matchHandler.Store(&fn)
+}
+
+// handleMatches calls the match handler of the context, if any, with each of the given events.
+func (context *Context) handleMatches(events []any) {
+	handler := context.matchHandler.Load()
+	if handler == nil || len(events) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(events)
+	if err != nil {
+		return
+	}
+	matches, err := ParseMatches(data)
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		(*handler)(match)
+	}
+}
+
+// Match is a rule match as parsed by ParseMatches.
+type Match struct {
+	// RuleID is the identifier of the rule.
+	RuleID string
+	// Tags are the tags of the rule, such as its "type" and "category".
+	Tags map[string]string
+	// Matches are the conditions of the rule that matched.
+	Matches []Condition
+}
+
+// Condition is a rule condition that matched, as parsed by ParseMatches.
+type Condition struct {
+	// Operator is the operator of the condition, such as "match_regex".
+	Operator string
+	// Operand is the value the operator was applied with, such as the regular expression of "match_regex".
+	Operand string
+	// HighlightedValue is the part of the address data that matched the condition.
+	HighlightedValue string
+}
+
+// jsonEvent is the JSON layout of the events reported by libddwaf.
+type jsonEvent struct {
+	Rule struct {
+		ID   string            `json:"id"`
+		Tags map[string]string `json:"tags"`
+	} `json:"rule"`
+	RuleMatches []struct {
+		Operator      string `json:"operator"`
+		OperatorValue string `json:"operator_value"`
+		Parameters    []struct {
+			Highlight []string `json:"highlight"`
+		} `json:"parameters"`
+	} `json:"rule_matches"`
+}
+
+// ParseMatches parses the JSON representation of the events of a Result, as obtained with json.Marshal, into Match
+// values. This provides a stable Go API over the JSON layout of the events reported by libddwaf.
+func ParseMatches(events []byte) ([]Match, error) {
+	var parsed []jsonEvent
+	if err := json.Unmarshal(events, &parsed); err != nil {
+		return nil, err
+	}
+
+	matches := make([]Match, len(parsed))
+	for i, event := range parsed {
+		matches[i] = Match{
+			RuleID:  event.Rule.ID,
+			Tags:    event.Rule.Tags,
+			Matches: make([]Condition, len(event.RuleMatches)),
+		}
+		for j, ruleMatch := range event.RuleMatches {
+			condition := Condition{Operator: ruleMatch.Operator, Operand: ruleMatch.OperatorValue}
+			for _, parameter := range ruleMatch.Parameters {
+				if len(parameter.Highlight) > 0 {
+					condition.HighlightedValue = parameter.Highlight[0]
+					break
+				}
+			}
+			matches[i].Matches[j] = condition
+		}
+	}
+	return matches, nil
+}
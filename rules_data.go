@@ -0,0 +1,65 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package waf
+
+import (
+	"github.com/DataDog/go-libddwaf/v2/internal/bindings"
+)
+
+// RuleData is a set of data used by the rules of a ruleset, such as a list of IP addresses to block, as found in the
+// `rules_data` section of a ruleset.
+type RuleData struct {
+	// ID is the identifier the rules use to refer to this data.
+	ID string
+	// Type is the type of the data, such as "ip_with_expiration" or "data_with_expiration".
+	Type string
+	// Data is the list of entries of the data set.
+	Data []RuleDataEntry
+}
+
+// RuleDataEntry is a single entry of a RuleData.
+type RuleDataEntry struct {
+	// Value is the value of the entry, such as an IP address.
+	Value string
+	// Expiration is the UNIX timestamp, in seconds, after which the entry is ignored. 0 means the entry never expires.
+	Expiration uint64
+}
+
+// UpdateRulesData is the same as Update with a ruleset only having a `rules_data` section, replacing the data of the
+// rules with the given one. The WAF objects are built directly from the given data, without going through the
+// reflection-based encoder, which makes frequent updates of large data sets, such as IP blocklists, cheaper.
+func (handle *Handle) UpdateRulesData(data []RuleData) (*Handle, error) {
+	var cgoRefs cgoRefPool
+	return handle.update(encodeRulesData(&cgoRefs, data), &cgoRefs)
+}
+
+// encodeRulesData returns the WAF object of a ruleset only having a `rules_data` section with the given data.
+func encodeRulesData(cgoRefs *cgoRefPool, data []RuleData) *bindings.WafObject {
+	root := new(bindings.WafObject)
+	sections := cgoRefs.AllocWafArray(root, bindings.WafMapType, 1)
+	cgoRefs.AllocWafMapKey(&sections[0], "rules_data")
+
+	ruleData := cgoRefs.AllocWafArray(&sections[0], bindings.WafArrayType, uint64(len(data)))
+	for i, datum := range data {
+		fields := cgoRefs.AllocWafArray(&ruleData[i], bindings.WafMapType, 3)
+		cgoRefs.AllocWafMapKey(&fields[0], "id")
+		cgoRefs.AllocWafString(&fields[0], datum.ID)
+		cgoRefs.AllocWafMapKey(&fields[1], "type")
+		cgoRefs.AllocWafString(&fields[1], datum.Type)
+		cgoRefs.AllocWafMapKey(&fields[2], "data")
+
+		entries := cgoRefs.AllocWafArray(&fields[2], bindings.WafArrayType, uint64(len(datum.Data)))
+		for j, entry := range datum.Data {
+			entryFields := cgoRefs.AllocWafArray(&entries[j], bindings.WafMapType, 2)
+			cgoRefs.AllocWafMapKey(&entryFields[0], "value")
+			cgoRefs.AllocWafString(&entryFields[0], entry.Value)
+			cgoRefs.AllocWafMapKey(&entryFields[1], "expiration")
+			encodeNative(entry.Expiration, bindings.WafUintType, &entryFields[1])
+		}
+	}
+
+	return root
+}
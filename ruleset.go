@@ -0,0 +1,574 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package waf
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/DataDog/go-libddwaf/v2/errors"
+	"github.com/DataDog/go-libddwaf/v2/internal/bindings"
+	"github.com/DataDog/go-libddwaf/v2/internal/unsafe"
+)
+
+// rulesetSections are the sections of a ruleset that define rules.
+var rulesetSections = []string{"rules", "custom_rules"}
+
+// rulesIndex holds information about the rules of a ruleset that libddwaf does not provide, extracted from the
+// encoded ruleset the Handle was created with.
+type rulesIndex struct {
+	// rules are the rules of each section of the ruleset
+	rules map[string][]indexedRule
+	// rulesPerAddress is the number of rules using each address as an input
+	rulesPerAddress map[string]int
+	// actionParameters are the parameters of the actions defined by the actions section of the ruleset, by action id
+	actionParameters map[string]map[string]any
+	// actionIDs are the identifiers of the actions defined by the actions section of the ruleset
+	actionIDs []string
+}
+
+// indexedRule is the information kept about a single rule of the ruleset.
+type indexedRule struct {
+	id        string
+	name      string
+	addresses []string
+	// inputs are the distinct inputs of the conditions of the rule, with their key paths
+	inputs []AddressInfo
+	// actions are the identifiers of the actions the rule reports when it matches, from its on_match field
+	actions []string
+	// typ is the type of the rule, from its tags, as libddwaf stops evaluating the rules of a type once one of them
+	// matched in a context
+	typ string
+	// tags are the tags of the rule having string values
+	tags map[string]string
+	// operators are the distinct operators of the conditions of the rule
+	operators []string
+}
+
+// newRulesIndex builds the rulesIndex of the given encoded ruleset.
+func newRulesIndex(ruleset *bindings.WafObject) rulesIndex {
+	return rulesIndex{}.update(ruleset)
+}
+
+// update returns a copy of the index where the rule sections present in the given encoded ruleset replace the
+// existing ones, matching how libddwaf applies ruleset updates. This is a best-effort process: the ruleset is
+// validated by libddwaf, not here, so parts of the ruleset having an unexpected format are ignored.
+func (index rulesIndex) update(ruleset *bindings.WafObject) rulesIndex {
+	updated := rulesIndex{
+		rules:            make(map[string][]indexedRule, len(rulesetSections)),
+		rulesPerAddress:  make(map[string]int),
+		actionParameters: index.actionParameters,
+		actionIDs:        index.actionIDs,
+	}
+	for section, rules := range index.rules {
+		updated.rules[section] = rules
+	}
+
+	if obj := rulesetSectionObject(ruleset, "actions"); obj != nil {
+		updated.actionParameters = decodeActionParameters(obj)
+		updated.actionIDs = decodeActionIDs(obj)
+	}
+
+	// Only the rule sections are decoded, as other sections, such as rules_data, can be large
+	for section, obj := range rulesetSectionObjects(ruleset) {
+		if decoded, err := decodeObject(obj); err == nil {
+			rules, isArray := decoded.([]any)
+			if !isArray {
+				continue
+			}
+			indexed := make([]indexedRule, 0, len(rules))
+			for _, rule := range rules {
+				rule, _ := rule.(map[string]any)
+				id, _ := rule["id"].(string)
+				name, _ := rule["name"].(string)
+				tags, _ := rule["tags"].(map[string]any)
+				typ, _ := tags["type"].(string)
+				indexed = append(indexed, indexedRule{
+					id:        id,
+					name:      name,
+					addresses: ruleAddresses(rule),
+					inputs:    ruleInputs(rule),
+					actions:   ruleActions(rule),
+					typ:       typ,
+					tags:      ruleTags(tags),
+					operators: ruleOperators(rule),
+				})
+			}
+			updated.rules[section] = indexed
+		}
+	}
+
+	for _, rules := range updated.rules {
+		for _, rule := range rules {
+			for _, addr := range rule.addresses {
+				updated.rulesPerAddress[addr]++
+			}
+		}
+	}
+
+	return updated
+}
+
+// decodeActionParameters decodes the parameters of the actions of the given encoded actions section, by action id.
+// Actions without parameters are not included.
+func decodeActionParameters(obj *bindings.WafObject) map[string]map[string]any {
+	decoded, err := decodeObject(obj)
+	if err != nil {
+		return nil
+	}
+	actions, _ := decoded.([]any)
+
+	parameters := make(map[string]map[string]any, len(actions))
+	for _, action := range actions {
+		action, _ := action.(map[string]any)
+		id, _ := action["id"].(string)
+		if params, _ := action["parameters"].(map[string]any); id != "" && len(params) > 0 {
+			parameters[id] = params
+		}
+	}
+	return parameters
+}
+
+// decodeActionIDs decodes the identifiers of the actions of the given encoded actions section.
+func decodeActionIDs(obj *bindings.WafObject) []string {
+	decoded, err := decodeObject(obj)
+	if err != nil {
+		return nil
+	}
+	actions, _ := decoded.([]any)
+
+	ids := make([]string, 0, len(actions))
+	for _, action := range actions {
+		action, _ := action.(map[string]any)
+		if id, _ := action["id"].(string); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// rulesetSectionObject returns the encoded section of the given encoded ruleset with the given name, or nil if there
+// is none.
+func rulesetSectionObject(ruleset *bindings.WafObject, name string) *bindings.WafObject {
+	if !ruleset.IsMap() {
+		return nil
+	}
+
+	for i := uint64(0); i < ruleset.NbEntries; i++ {
+		objElem := unsafe.CastWithOffset[bindings.WafObject](ruleset.Value, i)
+		if unsafe.GostringSized(unsafe.Cast[byte](objElem.ParameterName), objElem.ParameterNameLength) == name {
+			return objElem
+		}
+	}
+	return nil
+}
+
+// rulesetSectionObjects returns the encoded rule sections of the given encoded ruleset, by section name.
+func rulesetSectionObjects(ruleset *bindings.WafObject) map[string]*bindings.WafObject {
+	sections := make(map[string]*bindings.WafObject, len(rulesetSections))
+	if !ruleset.IsMap() {
+		return sections
+	}
+
+	for i := uint64(0); i < ruleset.NbEntries; i++ {
+		objElem := unsafe.CastWithOffset[bindings.WafObject](ruleset.Value, i)
+		key := unsafe.GostringSized(unsafe.Cast[byte](objElem.ParameterName), objElem.ParameterNameLength)
+		for _, section := range rulesetSections {
+			if key == section {
+				sections[section] = objElem
+			}
+		}
+	}
+	return sections
+}
+
+// excludeRules removes the rules with the given identifiers from the rule sections of the given encoded ruleset, as
+// needed by WithDisabledRules. The arrays of the sections are compacted in place, so this must be done before the
+// encoded ruleset is used in any other way.
+func excludeRules(ruleset *bindings.WafObject, ids map[string]struct{}) {
+	if len(ids) == 0 {
+		return
+	}
+
+	for _, section := range rulesetSectionObjects(ruleset) {
+		if !section.IsArray() {
+			continue
+		}
+		kept := uint64(0)
+		for i := uint64(0); i < section.NbEntries; i++ {
+			rule := unsafe.CastWithOffset[bindings.WafObject](section.Value, i)
+			if _, disabled := ids[encodedRuleID(rule)]; disabled {
+				continue
+			}
+			if kept != i {
+				*unsafe.CastWithOffset[bindings.WafObject](section.Value, kept) = *rule
+			}
+			kept++
+		}
+		section.NbEntries = kept
+	}
+}
+
+// encodedRuleID returns the identifier of the given encoded rule, or an empty string if it has none.
+func encodedRuleID(rule *bindings.WafObject) string {
+	if !rule.IsMap() {
+		return ""
+	}
+
+	for i := uint64(0); i < rule.NbEntries; i++ {
+		objElem := unsafe.CastWithOffset[bindings.WafObject](rule.Value, i)
+		key := unsafe.GostringSized(unsafe.Cast[byte](objElem.ParameterName), objElem.ParameterNameLength)
+		if key == "id" && objElem.Type == bindings.WafStringType {
+			return unsafe.GostringSized(unsafe.Cast[byte](objElem.Value), objElem.NbEntries)
+		}
+	}
+	return ""
+}
+
+// mergeRulesets merges the given rulesets into one, as needed by NewHandleFromMultiple, and returns it along with the
+// sorted ids of the rules defined more than once.
+func mergeRulesets(rulesets []any) (map[string]any, []string, error) {
+	merged := make(map[string]any)
+	for i, ruleset := range rulesets {
+		encoder := newMaxEncoder()
+		obj, err := encoder.Encode(ruleset)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not encode the WAF ruleset %d into a WAF object: %w", i, err)
+		}
+		decoded, err := decodeObject(obj)
+		unsafe.KeepAlive(&encoder.cgoRefs)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not decode the WAF ruleset %d: %w", i, err)
+		}
+		fields, isMap := decoded.(map[string]any)
+		if !isMap {
+			return nil, nil, fmt.Errorf("could not merge the WAF ruleset %d: expected a map, got %T", i, decoded)
+		}
+
+		for field, value := range fields {
+			existing, existingIsArray := merged[field].([]any)
+			values, isArray := value.([]any)
+			if existingIsArray && isArray {
+				value = append(existing, values...)
+			}
+			merged[field] = value
+		}
+	}
+
+	duplicated := make(map[string]struct{})
+	for _, section := range rulesetSections {
+		if rules, isArray := merged[section].([]any); isArray {
+			var sectionDuplicates []string
+			merged[section], sectionDuplicates = dedupRules(rules)
+			for _, id := range sectionDuplicates {
+				duplicated[id] = struct{}{}
+			}
+		}
+	}
+
+	var duplicates []string
+	for id := range duplicated {
+		duplicates = append(duplicates, id)
+	}
+	sort.Strings(duplicates)
+
+	return merged, duplicates, nil
+}
+
+// dedupRules only keeps the last of the given rules having a given id, and returns the kept rules in order along with
+// the ids of the rules that were dropped, once per dropped rule.
+func dedupRules(rules []any) ([]any, []string) {
+	last := make(map[string]int, len(rules))
+	var duplicates []string
+	for i, rule := range rules {
+		rule, _ := rule.(map[string]any)
+		id, _ := rule["id"].(string)
+		if id == "" {
+			continue
+		}
+		if _, found := last[id]; found {
+			duplicates = append(duplicates, id)
+		}
+		last[id] = i
+	}
+	if len(duplicates) == 0 {
+		return rules, nil
+	}
+
+	deduped := make([]any, 0, len(rules)-len(duplicates))
+	for i, rule := range rules {
+		ruleMap, _ := rule.(map[string]any)
+		id, _ := ruleMap["id"].(string)
+		if lastIndex, found := last[id]; found && lastIndex != i {
+			continue
+		}
+		deduped = append(deduped, rule)
+	}
+	return deduped, duplicates
+}
+
+// ruleAddresses returns the distinct addresses used as inputs by the conditions of the given rule.
+func ruleAddresses(rule map[string]any) []string {
+	var addresses []string
+	seen := make(map[string]struct{})
+	conditions, _ := rule["conditions"].([]any)
+	for _, condition := range conditions {
+		condition, _ := condition.(map[string]any)
+		parameters, _ := condition["parameters"].(map[string]any)
+		inputs, _ := parameters["inputs"].([]any)
+		for _, input := range inputs {
+			input, _ := input.(map[string]any)
+			addr, ok := input["address"].(string)
+			if _, dup := seen[addr]; !ok || dup {
+				continue
+			}
+			seen[addr] = struct{}{}
+			addresses = append(addresses, addr)
+		}
+	}
+	return addresses
+}
+
+// ruleActions returns the identifiers of the actions listed in the on_match field of the given rule.
+func ruleActions(rule map[string]any) []string {
+	onMatch, _ := rule["on_match"].([]any)
+	actions := make([]string, 0, len(onMatch))
+	for _, action := range onMatch {
+		if id, _ := action.(string); id != "" {
+			actions = append(actions, id)
+		}
+	}
+	return actions
+}
+
+// ruleTags returns the given tags of a rule having string values.
+func ruleTags(tags map[string]any) map[string]string {
+	stringTags := make(map[string]string, len(tags))
+	for key, value := range tags {
+		if value, isString := value.(string); isString {
+			stringTags[key] = value
+		}
+	}
+	return stringTags
+}
+
+// ruleOperators returns the distinct operators of the conditions of the given rule, in the order of the conditions.
+func ruleOperators(rule map[string]any) []string {
+	var operators []string
+	seen := make(map[string]struct{})
+	conditions, _ := rule["conditions"].([]any)
+	for _, condition := range conditions {
+		condition, _ := condition.(map[string]any)
+		operator, ok := condition["operator"].(string)
+		if _, dup := seen[operator]; !ok || dup {
+			continue
+		}
+		seen[operator] = struct{}{}
+		operators = append(operators, operator)
+	}
+	return operators
+}
+
+// ruleInputs returns the distinct inputs of the conditions of the given rule, as pairs of address and key path. Key
+// path elements that are not strings, such as array indexes, are formatted as strings.
+func ruleInputs(rule map[string]any) []AddressInfo {
+	var inputs []AddressInfo
+	seen := make(map[string]struct{})
+	conditions, _ := rule["conditions"].([]any)
+	for _, condition := range conditions {
+		condition, _ := condition.(map[string]any)
+		parameters, _ := condition["parameters"].(map[string]any)
+		entries, _ := parameters["inputs"].([]any)
+		for _, entry := range entries {
+			entry, _ := entry.(map[string]any)
+			addr, ok := entry["address"].(string)
+			if !ok {
+				continue
+			}
+			input := AddressInfo{Name: addr}
+			keyPath, _ := entry["key_path"].([]any)
+			for _, key := range keyPath {
+				input.KeyPath = append(input.KeyPath, fmt.Sprint(key))
+			}
+			if _, dup := seen[input.key()]; dup {
+				continue
+			}
+			seen[input.key()] = struct{}{}
+			inputs = append(inputs, input)
+		}
+	}
+	return inputs
+}
+
+// rulesetFieldKinds are the top-level fields of a ruleset supported by libddwaf, along with the kind of value they
+// are expected to hold.
+var rulesetFieldKinds = map[string]string{
+	"version":        "string",
+	"metadata":       "map",
+	"rules":          "array",
+	"custom_rules":   "array",
+	"exclusions":     "array",
+	"rules_data":     "array",
+	"rules_override": "array",
+	"processors":     "array",
+	"scanners":       "array",
+	"actions":        "array",
+}
+
+// checkRulesetStructure looks for structural problems in the given encoded ruleset, and returns a
+// *errors.RulesetStructureError describing the first one found, in field order. It also returns warnings about the parts
+// of the ruleset libddwaf ignores or only reports as failed rules, such as unsupported top-level fields and rules whose
+// conditions are not an array, which may explain why no rule could be loaded. It is only meant to explain why libddwaf
+// rejected a ruleset, as libddwaf remains the only judge of whether a ruleset is valid.
+func checkRulesetStructure(ruleset *bindings.WafObject) (warnings []error, err error) {
+	decoded, err := decodeObject(ruleset)
+	if err != nil {
+		return nil, nil
+	}
+	root, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, &errors.RulesetStructureError{Path: "$", Reason: "expected map"}
+	}
+
+	fields := make([]string, 0, len(root))
+	for field := range root {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		path := "$." + field
+		expected, known := rulesetFieldKinds[field]
+		if !known {
+			warnings = append(warnings, &errors.RulesetStructureError{Path: path, Reason: "unsupported field"})
+			continue
+		}
+		if kind := objectKind(root[field]); kind != expected {
+			return warnings, &errors.RulesetStructureError{Path: path, Reason: fmt.Sprintf("expected %s, got %s", expected, kind)}
+		}
+	}
+
+	for _, section := range rulesetSections {
+		rules, _ := root[section].([]any)
+		for i, rule := range rules {
+			path := fmt.Sprintf("$.%s[%d]", section, i)
+			rule, ok := rule.(map[string]any)
+			if !ok {
+				warnings = append(warnings, &errors.RulesetStructureError{Path: path, Reason: "expected map"})
+				continue
+			}
+			if kind := objectKind(rule["conditions"]); kind != "array" {
+				warnings = append(warnings, &errors.RulesetStructureError{Path: path + ".conditions", Reason: "expected array, got " + kind})
+			}
+		}
+	}
+
+	return warnings, nil
+}
+
+// objectKind returns the kind of WAF object a decoded value comes from.
+func objectKind(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "map"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	default:
+		return "number"
+	}
+}
+
+// countObjects returns the number of WAF objects in the tree rooted at obj, including obj itself.
+func countObjects(obj *bindings.WafObject) int {
+	count := 1
+	if obj.IsArray() || obj.IsMap() {
+		for i := uint64(0); i < obj.NbEntries; i++ {
+			count += countObjects(unsafe.CastWithOffset[bindings.WafObject](obj.Value, i))
+		}
+	}
+	return count
+}
+
+// encodedRuleset is the encoded ruleset of a Handle created with WithClonableRuleset, kept by top-level section so that
+// it can be updated the same way libddwaf updates its ruleset, and used again to create new ddwaf_handles, see
+// Handle.CloneWithObfuscators. Each section is a copy holding Go references of its own, so that the sections replaced
+// by an update do not keep the memory of the ruleset they came from alive. Sections are immutable and shared by the
+// handles cloned or updated from one another, and the Go references of each section are kept alive for as long as a
+// handle uses it.
+type encodedRuleset struct {
+	sections map[string]encodedSection
+}
+
+// encodedSection is a top-level entry of an encoded ruleset, along with the Go references of its wafObjects.
+type encodedSection struct {
+	obj     bindings.WafObject
+	cgoRefs *cgoRefPool
+}
+
+func newEncodedRuleset(ruleset *bindings.WafObject, cgoRefs *cgoRefPool) encodedRuleset {
+	return encodedRuleset{}.update(ruleset, cgoRefs)
+}
+
+// update returns a copy of the ruleset where the sections present in the given ruleset update, whose Go references
+// are held by cgoRefs, replace the previous ones, which is how libddwaf applies ruleset updates.
+func (ruleset encodedRuleset) update(update *bindings.WafObject, cgoRefs *cgoRefPool) encodedRuleset {
+	sections := make(map[string]encodedSection, len(ruleset.sections))
+	for key, section := range ruleset.sections {
+		sections[key] = section
+	}
+
+	if update.IsMap() {
+		for i := uint64(0); i < update.NbEntries; i++ {
+			objElem := unsafe.CastWithOffset[bindings.WafObject](update.Value, i)
+			key := unsafe.GostringSized(unsafe.Cast[byte](objElem.ParameterName), objElem.ParameterNameLength)
+			sections[key] = copySection(key, objElem, cgoRefs)
+		}
+	}
+
+	return encodedRuleset{sections: sections}
+}
+
+// copySection returns a copy of the given section of an encoded ruleset, under the given key, whose wafObjects and
+// strings are held by Go references of its own. The section keeps sharing the given Go references of the ruleset it
+// comes from in the unexpected case where it cannot be decoded.
+func copySection(key string, obj *bindings.WafObject, cgoRefs *cgoRefPool) encodedSection {
+	value, err := decodeObject(obj)
+	if err != nil {
+		return encodedSection{obj: *obj, cgoRefs: cgoRefs}
+	}
+
+	encoder := newMaxEncoder()
+	copied, err := encoder.Encode(value)
+	if err != nil {
+		return encodedSection{obj: *obj, cgoRefs: cgoRefs}
+	}
+	encoder.cgoRefs.AllocWafMapKey(copied, key)
+	return encodedSection{obj: *copied, cgoRefs: &encoder.cgoRefs}
+}
+
+// build returns the ruleset as a single wafObject, along with the Go references of its top-level map. The Go
+// references of its sections are held by the ruleset, which must be kept alive for as long as the wafObject is used.
+func (ruleset encodedRuleset) build() (*bindings.WafObject, cgoRefPool) {
+	keys := make([]string, 0, len(ruleset.sections))
+	for key := range ruleset.sections {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var cgoRefs cgoRefPool
+	obj := new(bindings.WafObject)
+	entries := cgoRefs.AllocWafArray(obj, bindings.WafMapType, uint64(len(keys)))
+	for i, key := range keys {
+		entries[i] = ruleset.sections[key].obj
+	}
+	return obj, cgoRefs
+}
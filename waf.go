@@ -6,8 +6,12 @@
 package waf
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	wafErrors "github.com/DataDog/go-libddwaf/v2/errors"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,15 +26,20 @@ import (
 const ErrTimeout = wafErrors.ErrTimeout
 
 // Diagnostics stores the information - provided by the WAF - about WAF rules initialization.
+// It can be marshaled to JSON, e.g. to be sent to a telemetry backend, with the same keys as the
+// sections of the ruleset, the entries of the sections that were not reported being omitted.
 type Diagnostics struct {
-	Rules          *DiagnosticEntry
-	CustomRules    *DiagnosticEntry
-	Exclusions     *DiagnosticEntry
-	RulesOverrides *DiagnosticEntry
-	RulesData      *DiagnosticEntry
-	Processors     *DiagnosticEntry
-	Scanners       *DiagnosticEntry
-	Version        string
+	Rules          *DiagnosticEntry `json:"rules,omitempty"`
+	CustomRules    *DiagnosticEntry `json:"custom_rules,omitempty"`
+	Exclusions     *DiagnosticEntry `json:"exclusions,omitempty"`
+	RulesOverrides *DiagnosticEntry `json:"rules_override,omitempty"`
+	RulesData      *DiagnosticEntry `json:"rules_data,omitempty"`
+	Processors     *DiagnosticEntry `json:"processors,omitempty"`
+	Scanners       *DiagnosticEntry `json:"scanners,omitempty"`
+	Version        string           `json:"version"`
+	// DuplicateRules are the sorted ids of the rules defined by several of the rulesets given to
+	// NewHandleFromMultiple, of which only the last definition was kept.
+	DuplicateRules []string `json:"duplicate_rules,omitempty"`
 }
 
 // TopLevelErrors returns the list of top-level errors reported by the WAF on any of the Diagnostics
@@ -63,11 +72,267 @@ func (d *Diagnostics) TopLevelError() error {
 // DiagnosticEntry stores the information - provided by the WAF - about loaded and failed rules
 // for a specific entry in the WAF ruleset
 type DiagnosticEntry struct {
-	Addresses *DiagnosticAddresses
-	Errors    map[string][]string // Item-level errors (map of error message to entity identifiers or index:#)
-	Error     string              // If the entire entry was in error (e.g: invalid format)
-	Loaded    []string            // Successfully loaded entity identifiers (or index:#)
-	Failed    []string            // Failed entity identifiers (or index:#)
+	Addresses *DiagnosticAddresses `json:"addresses,omitempty"`
+	Errors    map[string][]string  `json:"errors"`          // Item-level errors (map of error message to entity identifiers or index:#)
+	Error     string               `json:"error,omitempty"` // If the entire entry was in error (e.g: invalid format)
+	Loaded    []string             `json:"loaded"`          // Successfully loaded entity identifiers (or index:#)
+	Failed    []string             `json:"failed"`          // Failed entity identifiers (or index:#)
+	// ParsedErrors holds the same item-level errors as Errors, categorized and in a deterministic order
+	ParsedErrors []RuleError `json:"-"`
+}
+
+// MarshalJSON returns the JSON representation of the entry, whose schema does not depend on what the WAF reported:
+// "loaded", "failed" and the addresses are always arrays and "errors" is always an object, even when empty. The keys of "errors" are
+// sorted, as are the identifiers of each of its errors, so that the same diagnostics always produce the same JSON.
+// ParsedErrors is omitted, as it holds the same errors as "errors".
+func (entry DiagnosticEntry) MarshalJSON() ([]byte, error) {
+	type plainEntry DiagnosticEntry
+	plain := plainEntry(entry)
+
+	if plain.Loaded == nil {
+		plain.Loaded = []string{}
+	}
+	if plain.Failed == nil {
+		plain.Failed = []string{}
+	}
+	if entry.Addresses != nil {
+		addresses := *entry.Addresses
+		if addresses.Required == nil {
+			addresses.Required = []string{}
+		}
+		if addresses.Optional == nil {
+			addresses.Optional = []string{}
+		}
+		plain.Addresses = &addresses
+	}
+
+	// encoding/json already sorts the keys of maps, but not the identifiers of each error
+	plain.Errors = make(map[string][]string, len(entry.Errors))
+	for message, ids := range entry.Errors {
+		sortedIDs := make([]string, len(ids))
+		copy(sortedIDs, ids)
+		sort.Strings(sortedIDs)
+		plain.Errors[message] = sortedIDs
+	}
+
+	return json.Marshal(plain)
+}
+
+// RuleErrorCode is the category of an item-level error reported by the WAF about a ruleset, as inferred from its
+// message.
+type RuleErrorCode int
+
+const (
+	// ErrUnclassified is the code of the errors not matching any of the other codes.
+	ErrUnclassified RuleErrorCode = iota
+	// ErrMissingKey is the code of the errors about a required key missing, e.g. "missing key 'tags'".
+	ErrMissingKey
+	// ErrInvalidType is the code of the errors about a value of the wrong type.
+	ErrInvalidType
+	// ErrUnknownOperator is the code of the errors about a condition operator unknown to the WAF.
+	ErrUnknownOperator
+	// ErrInvalidTransformer is the code of the errors about an unknown or invalid transformer.
+	ErrInvalidTransformer
+	// ErrInvalidRegex is the code of the errors about a regular expression that cannot be compiled.
+	ErrInvalidRegex
+	// ErrDuplicateID is the code of the errors about an identifier used by more than one item.
+	ErrDuplicateID
+	// ErrEmptyValue is the code of the errors about an empty value where one is required, such as an empty address.
+	ErrEmptyValue
+)
+
+// ruleErrorPrefixes maps the prefixes of the error messages of the WAF to their code.
+var ruleErrorPrefixes = []struct {
+	prefix string
+	code   RuleErrorCode
+}{
+	{"missing key", ErrMissingKey},
+	{"invalid type", ErrInvalidType},
+	{"bad cast", ErrInvalidType},
+	{"unknown matcher", ErrUnknownOperator},
+	{"unknown operator", ErrUnknownOperator},
+	{"invalid transformer", ErrInvalidTransformer},
+	{"invalid regular expression", ErrInvalidRegex},
+	{"duplicate", ErrDuplicateID},
+	{"empty", ErrEmptyValue},
+}
+
+func (code RuleErrorCode) String() string {
+	switch code {
+	case ErrMissingKey:
+		return "missing-key"
+	case ErrInvalidType:
+		return "invalid-type"
+	case ErrUnknownOperator:
+		return "unknown-operator"
+	case ErrInvalidTransformer:
+		return "invalid-transformer"
+	case ErrInvalidRegex:
+		return "invalid-regex"
+	case ErrDuplicateID:
+		return "duplicate-id"
+	case ErrEmptyValue:
+		return "empty-value"
+	default:
+		return "unclassified"
+	}
+}
+
+// RuleError is an item-level error reported by the WAF about a ruleset, as found in DiagnosticEntry.ParsedErrors.
+type RuleError struct {
+	Code    RuleErrorCode
+	Message string   // The error message, as reported by the WAF
+	RuleIDs []string // The identifiers of the items in error, sorted lexicographically
+}
+
+// parseRuleErrors returns the given item-level errors as a list of RuleError sorted by message.
+func parseRuleErrors(errs map[string][]string) []RuleError {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	parsed := make([]RuleError, 0, len(errs))
+	for message, ids := range errs {
+		ruleIDs := make([]string, len(ids))
+		copy(ruleIDs, ids)
+		sort.Strings(ruleIDs)
+		parsed = append(parsed, RuleError{Code: ruleErrorCode(message), Message: message, RuleIDs: ruleIDs})
+	}
+	sort.Slice(parsed, func(i, j int) bool { return parsed[i].Message < parsed[j].Message })
+
+	return parsed
+}
+
+// ruleErrorCode returns the code of the given error message of the WAF.
+func ruleErrorCode(message string) RuleErrorCode {
+	for _, candidate := range ruleErrorPrefixes {
+		if strings.HasPrefix(message, candidate.prefix) {
+			return candidate.code
+		}
+	}
+	return ErrUnclassified
+}
+
+// LoadStats summarizes the loading of the rules and custom rules of a ruleset, as returned by Handle.LoadStats.
+type LoadStats struct {
+	// Loaded is the number of rules libddwaf loaded.
+	Loaded int
+	// Failed is the number of rules libddwaf failed to load.
+	Failed int
+	// Errors is the number of rules in error for each category of error.
+	Errors map[RuleErrorCode]int
+	// Version is the version of the ruleset, if any.
+	Version string
+}
+
+// loadStats returns the LoadStats of the given diagnostics, along with the number of rules in error for each error
+// message.
+func loadStats(diags Diagnostics) (LoadStats, map[string]int) {
+	stats := LoadStats{Errors: make(map[RuleErrorCode]int), Version: diags.Version}
+	messages := make(map[string]int)
+	for _, entry := range []*DiagnosticEntry{diags.Rules, diags.CustomRules} {
+		if entry == nil {
+			continue
+		}
+		stats.Loaded += len(entry.Loaded)
+		stats.Failed += len(entry.Failed)
+		for message, ids := range entry.Errors {
+			stats.Errors[ruleErrorCode(message)] += len(ids)
+			messages[message] += len(ids)
+		}
+	}
+	return stats, messages
+}
+
+// RuleLoadReason is the reason why a ruleset could not be loaded, as reported by RuleLoadError.
+type RuleLoadReason int
+
+const (
+	// RuleLoadFailed is the reason of the failures not matching any of the other reasons.
+	RuleLoadFailed RuleLoadReason = iota
+	// RuleLoadMalformedJSON is the reason of a ruleset given as a JSON document that is not valid JSON, such as the
+	// ones given to NewHandleFromBytes or NewHandleFromReader, in which case the error wraps errors.ErrMalformedRuleset.
+	RuleLoadMalformedJSON
+	// RuleLoadInvalidStructure is the reason of a ruleset whose structure is invalid, such as a field having an
+	// unexpected type, in which case the error wraps an errors.RulesetStructureError or the errors libddwaf reported
+	// for whole entries of the Diagnostics.
+	RuleLoadInvalidStructure
+	// RuleLoadNoValidRule is the reason of a well-formed ruleset of which libddwaf could not load anything, such as
+	// when all its rules failed to load, whose identifiers and errors are then reported by the Diagnostics. The error
+	// also wraps an errors.RulesetStructureError for each part of the ruleset libddwaf ignored or rejected, such as an
+	// unsupported top-level field, as they may explain why.
+	RuleLoadNoValidRule
+)
+
+func (reason RuleLoadReason) String() string {
+	switch reason {
+	case RuleLoadMalformedJSON:
+		return "malformed-json"
+	case RuleLoadInvalidStructure:
+		return "invalid-structure"
+	case RuleLoadNoValidRule:
+		return "no-valid-rule"
+	default:
+		return "failed"
+	}
+}
+
+// RuleLoadError is the error returned when a handle could not be created from a ruleset, such as by NewHandle. It
+// tells why with its Reason, along with the Diagnostics libddwaf reported, if any, so that the identifiers of the rules
+// that failed to load and their errors can be found. The underlying error, such as an errors.RulesetStructureError,
+// can still be found with errors.Is and errors.As.
+type RuleLoadError struct {
+	// Reason is why the ruleset could not be loaded.
+	Reason RuleLoadReason
+	// Diagnostics are the diagnostics libddwaf reported about the ruleset, or nil when it reported none, such as when
+	// the ruleset is not valid JSON.
+	Diagnostics *Diagnostics
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns the error string representation, which is the one of the underlying error.
+func (e *RuleLoadError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error. It is used by errors.Is and errors.As.
+func (e *RuleLoadError) Unwrap() error {
+	return e.Err
+}
+
+// loadSummary formats the given diagnostics as a one-line summary, such as
+// "loaded 1, failed 3: 2 missing key 'tags', 1 missing key 'name'; version 1.2.7", the errors being listed by
+// decreasing number of rules in error.
+func loadSummary(diags Diagnostics) string {
+	stats, messages := loadStats(diags)
+
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "loaded %d, failed %d", stats.Loaded, stats.Failed)
+	if len(messages) > 0 {
+		sorted := make([]string, 0, len(messages))
+		for message := range messages {
+			sorted = append(sorted, message)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if messages[sorted[i]] != messages[sorted[j]] {
+				return messages[sorted[i]] > messages[sorted[j]]
+			}
+			return sorted[i] < sorted[j]
+		})
+		for i, message := range sorted {
+			if i == 0 {
+				summary.WriteString(": ")
+			} else {
+				summary.WriteString(", ")
+			}
+			fmt.Fprintf(&summary, "%d %s", messages[message], message)
+		}
+	}
+	if stats.Version != "" {
+		fmt.Fprintf(&summary, "; version %s", stats.Version)
+	}
+	return summary.String()
 }
 
 // DiagnosticAddresses stores the information - provided by the WAF - about the known addresses and
@@ -75,8 +340,8 @@ type DiagnosticEntry struct {
 // used by WAF exclusion filters may be required or (rarely) optional. Addresses used by WAF
 // processors may be required or optional.
 type DiagnosticAddresses struct {
-	Required []string
-	Optional []string
+	Required []string `json:"required"`
+	Optional []string `json:"optional"`
 }
 
 // Result stores the multiple values returned by a call to ddwaf_run
@@ -90,11 +355,24 @@ type Result struct {
 	Derivatives map[string]any
 
 	// Actions is the set of actions the WAF decided on when evaluating rules
-	// against the provided address data.
+	// against the provided address data. They come in the order of the on_match
+	// arrays of the rules that matched, the rules being taken in the order of
+	// their ids, and each action is only reported once.
 	Actions []string
 
 	// TimeSpent is the time the WAF self-reported as spent processing the call to ddwaf_run
 	TimeSpent time.Duration
+
+	// WAFTruncated is true when libddwaf ignored parts of the address data because they exceed its own limits on
+	// string length, container size or depth. This is distinct from the truncations done by the encoder, reported by
+	// Context.Stats: libddwaf doesn't report what it ignores, so this is detected by checking the encoded address data
+	// against the limits libddwaf is configured with, which only happens when the encoder limits are larger.
+	WAFTruncated bool
+
+	// TimedOut is true when libddwaf ran out of time before evaluating all the rules, in which case the run returns
+	// errors.ErrBudgetExhausted along with the events and actions of the rules evaluated so far: a timed out run
+	// without events did not find a match yet, unlike a complete run without events.
+	TimedOut bool
 }
 
 // Globally dlopen() libddwaf only once because several dlopens (eg. in tests)
@@ -105,6 +383,8 @@ var (
 	// libddwaf's dlopen error if any
 	wafLoadErr  error
 	openWafOnce sync.Once
+	// newWafDl opens libddwaf's dynamic library, which tests replace in order to simulate a library failing to load
+	newWafDl = bindings.NewWafDl
 )
 
 // Load loads libddwaf's dynamic library. The dynamic library is opened only
@@ -119,20 +399,40 @@ var (
 // libddwaf is usable but some non-critical errors happened, such as failures
 // to remove temporary files. It is safe to continue using libddwaf in such
 // case.
+// When libddwaf cannot be loaded on a supported target, the returned error
+// wraps both errors.ErrLibraryLoad and the error of the dynamic loader, and so
+// does the error of every function of this package needing libddwaf, such as
+// NewHandle, allowing servers to keep running without the WAF rather than
+// crashing. errors.ErrLibraryUnavailable is the same error as
+// errors.ErrLibraryLoad.
 func Load() (ok bool, err error) {
-	if ok, err = Health(); !ok {
-		return false, err
+	if !targetSupported() {
+		return Health()
 	}
 
+	loadWaf()
+	return wafLib != nil, wafLoadErr
+}
+
+// targetSupported returns true when the WAF is supported on the current target and was not manually disabled, in which
+// case libddwaf can be loaded.
+func targetSupported() bool {
+	return len(support.WafSupportErrors()) == 0 && support.WafManuallyDisabledError() == nil
+}
+
+// loadWaf opens libddwaf's dynamic library the first time it is called, and keeps the result of doing so in wafLib and
+// wafLoadErr.
+func loadWaf() {
 	openWafOnce.Do(func() {
-		wafLib, wafLoadErr = bindings.NewWafDl()
+		wafLib, wafLoadErr = newWafDl()
 		if wafLoadErr != nil {
+			if wafLib == nil {
+				wafLoadErr = fmt.Errorf("%w: %w", wafErrors.ErrLibraryLoad, wafLoadErr)
+			}
 			return
 		}
 		wafVersion = wafLib.WafGetVersion()
 	})
-
-	return wafLib != nil, wafLoadErr
 }
 
 var wafVersion string
@@ -145,6 +445,77 @@ func Version() string {
 	return wafVersion
 }
 
+// LibraryBuildInfo describes the build of libddwaf in use, as returned by BuildInfo.
+type LibraryBuildInfo struct {
+	// Version is the version of libddwaf, as returned by Version.
+	Version string
+	// MaxContainerDepth, MaxContainerSize and MaxStringLength are the default limits libddwaf is built with, beyond
+	// which it ignores parts of the address data, see Result.WAFTruncated.
+	MaxContainerDepth int
+	MaxContainerSize  int
+	MaxStringLength   int
+	// Operators are the names of the rule condition operators supported by libddwaf, such as "match_regex", sorted.
+	Operators []string
+}
+
+// operatorProbes are the conditions of the rules used by BuildInfo to find out which operators libddwaf supports, keyed
+// by operator name, each with the parameters the operator requires. libddwaf provides no way to list its operators, so
+// only the operators known to this package can be reported.
+var operatorProbes = map[string]map[string]any{
+	"match_regex":  {"regex": "^probe$"},
+	"phrase_match": {"list": []any{"probe"}},
+	"exact_match":  {"list": []any{"probe"}},
+	"ip_match":     {"list": []any{"127.0.0.1"}},
+	"is_xss":       {},
+	"is_sqli":      {},
+	"equals":       {"type": "string", "value": "probe"},
+}
+
+// BuildInfo returns the build configuration of libddwaf, so that programs can check at startup that their rules only
+// use operators libddwaf supports. As libddwaf only reports its version, the operators are found out by loading a
+// ruleset made of one rule per operator known to this package into a temporary Handle, and keeping the operators whose
+// rule was loaded, which makes BuildInfo about as costly as NewHandle. The error of Load is returned when libddwaf
+// cannot be loaded.
+func BuildInfo() (LibraryBuildInfo, error) {
+	if ok, err := Load(); !ok {
+		return LibraryBuildInfo{}, err
+	}
+
+	rules := make([]any, 0, len(operatorProbes))
+	for operator, parameters := range operatorProbes {
+		params := map[string]any{"inputs": []any{map[string]any{"address": "waf.build_info.input"}}}
+		for key, value := range parameters {
+			params[key] = value
+		}
+		rules = append(rules, map[string]any{
+			"id":         operator,
+			"name":       operator,
+			"tags":       map[string]any{"type": "build_info", "category": "build_info"},
+			"conditions": []any{map[string]any{"operator": operator, "parameters": params}},
+		})
+	}
+
+	handle, err := NewHandle(map[string]any{"version": "2.1", "rules": rules}, "", "")
+	if err != nil {
+		return LibraryBuildInfo{}, fmt.Errorf("could not probe the operators of libddwaf: %w", err)
+	}
+	defer handle.Close()
+
+	var operators []string
+	if diags := handle.Diagnostics(); diags.Rules != nil {
+		operators = append(operators, diags.Rules.Loaded...)
+	}
+	sort.Strings(operators)
+
+	return LibraryBuildInfo{
+		Version:           wafVersion,
+		MaxContainerDepth: bindings.WafMaxContainerDepth,
+		MaxContainerSize:  bindings.WafMaxContainerSize,
+		MaxStringLength:   bindings.WafMaxStringLength,
+		Operators:         operators,
+	}, nil
+}
+
 // HasEvents return true if the result holds at least 1 event
 func (r *Result) HasEvents() bool {
 	return len(r.Events) > 0
@@ -160,6 +531,37 @@ func (r *Result) HasActions() bool {
 	return len(r.Actions) > 0
 }
 
+// Sorted returns a copy of the result with its events sorted by rule id, and its actions sorted lexically, so that
+// results can be compared or logged in a way that doesn't depend on the order libddwaf reports them in. Events having
+// the same rule id keep their relative order. The events themselves are not copied.
+func (r *Result) Sorted() Result {
+	sorted := *r
+
+	if r.Events != nil {
+		sorted.Events = make([]any, len(r.Events))
+		copy(sorted.Events, r.Events)
+		sort.SliceStable(sorted.Events, func(i, j int) bool {
+			return eventRuleID(sorted.Events[i]) < eventRuleID(sorted.Events[j])
+		})
+	}
+
+	if r.Actions != nil {
+		sorted.Actions = make([]string, len(r.Actions))
+		copy(sorted.Actions, r.Actions)
+		sort.Strings(sorted.Actions)
+	}
+
+	return sorted
+}
+
+// eventRuleID returns the id of the rule that generated the given event, or an empty string if not found.
+func eventRuleID(event any) string {
+	eventMap, _ := event.(map[string]any)
+	rule, _ := eventMap["rule"].(map[string]any)
+	id, _ := rule["id"].(string)
+	return id
+}
+
 // SupportsTarget returns true and a nil error when the target host environment
 // is supported by this package and can be further used.
 // Otherwise, it returns false along with an error detailing why.
@@ -171,25 +573,87 @@ func SupportsTarget() (bool, error) {
 // Health returns true if the waf is usable, false otherwise. At the same time it can return an error
 // if the waf is not usable, but the error is not blocking if true is returned, otherwise it is.
 // The following conditions are checked:
-// - The Waf library has been loaded successfully (you need to call `Load()` first for this case to be taken into account)
+// - The Waf library has been loaded successfully, which Health attempts on supported targets when not done yet
 // - The Waf library has not been manually disabled with the `datadog.no_waf` go build tag
 // - The Waf library is not in an unsupported OS/Arch
 // - The Waf library is not in an unsupported Go version
+// The errors of the last three conditions wrap errors.ErrUnsupportedTarget, as the WAF is expected to be disabled on
+// such targets, while a failure to load the library on a supported target wraps errors.ErrLibraryLoad. They can be
+// told apart with errors.Is, and the underlying errors such as errors.UnsupportedOSArchError with errors.As.
 func Health() (bool, error) {
+	if targetSupported() {
+		loadWaf()
+	}
+
 	var err *multierror.Error
 	if wafLoadErr != nil {
 		err = multierror.Append(err, wafLoadErr)
 	}
 
 	wafSupportErrors := support.WafSupportErrors()
-	if len(wafSupportErrors) > 0 {
-		err = multierror.Append(err, wafSupportErrors...)
+	for _, supportErr := range wafSupportErrors {
+		err = multierror.Append(err, fmt.Errorf("%w: %w", wafErrors.ErrUnsupportedTarget, supportErr))
 	}
 
 	wafManuallyDisabledErr := support.WafManuallyDisabledError()
 	if wafManuallyDisabledErr != nil {
-		err = multierror.Append(err, wafManuallyDisabledErr)
+		err = multierror.Append(err, fmt.Errorf("%w: %w", wafErrors.ErrUnsupportedTarget, wafManuallyDisabledErr))
 	}
 
 	return (wafLib != nil || wafLoadErr == nil) && len(wafSupportErrors) == 0 && wafManuallyDisabledErr == nil, err.ErrorOrNil()
 }
+
+// selfTestAddress is the address used by the self-test ruleset.
+const selfTestAddress = "waf.self_test.input"
+
+// selfTestRuleset is a trivial ruleset with a single rule, used by SelfTest.
+var selfTestRuleset = map[string]any{
+	"version": "2.1",
+	"rules": []any{
+		map[string]any{
+			"id":   "self-test-001",
+			"name": "go-libddwaf self-test",
+			"tags": map[string]any{
+				"type":     "self_test",
+				"category": "self_test",
+			},
+			"conditions": []any{
+				map[string]any{
+					"operator": "match_regex",
+					"parameters": map[string]any{
+						"inputs": []any{map[string]any{"address": selfTestAddress}},
+						"regex":  "^go-libddwaf-self-test$",
+					},
+				},
+			},
+		},
+	},
+}
+
+// SelfTest exercises the whole encode -> run -> decode pipeline of the WAF, as opposed to Health which only checks
+// whether libddwaf can be loaded. It creates a Handle with a trivial ruleset, runs it against an input known to
+// match, and checks the match is reported. All resources are released before returning. A nil error is returned
+// when the WAF is fully functional, which makes it suitable for readiness probes.
+func SelfTest() error {
+	handle, err := NewHandle(selfTestRuleset, "", "")
+	if err != nil {
+		return fmt.Errorf("could not instantiate the self-test WAF handle: %w", err)
+	}
+	defer handle.Close()
+
+	context := NewContext(handle)
+	if context == nil {
+		return errors.New("could not instantiate the self-test WAF context")
+	}
+	defer context.Close()
+
+	res, err := context.Run(RunAddressData{Persistent: map[string]any{selfTestAddress: "go-libddwaf-self-test"}}, 0)
+	if err != nil {
+		return fmt.Errorf("the self-test WAF run failed: %w", err)
+	}
+	if !res.HasEvents() {
+		return errors.New("the self-test WAF run did not report the expected match")
+	}
+
+	return nil
+}
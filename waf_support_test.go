@@ -38,13 +38,19 @@ func TestSupport(t *testing.T) {
 		errors = append(errors, support.WafManuallyDisabledError())
 	}
 
-	ok, _ := Health()
+	ok, healthErr := Health()
 	require.Equal(t, *wafSupportedFlag, ok, "WAF support should match the value of the `waf-supported` flag in the CI")
+	require.NotErrorIs(t, healthErr, wafErrors.ErrLibraryLoad, "The WAF library should load on supported targets")
 
 	if *wafSupportedFlag {
 		require.Empty(t, errors, "No errors should be returned when the WAF is supported")
+		require.NotErrorIs(t, healthErr, wafErrors.ErrUnsupportedTarget, "The target is marked as supported but Health reported it as unsupported")
 	} else {
 		require.NotEmpty(t, errors, "Errors should be returned when the WAF is not supported")
+		require.ErrorIs(t, healthErr, wafErrors.ErrUnsupportedTarget, "Health should report the target as unsupported")
+		for _, err := range errors {
+			require.ErrorIs(t, healthErr, err, "Health should wrap every support error")
+		}
 	}
 
 	for _, err := range errors {
@@ -9,11 +9,13 @@ package waf
 
 import (
 	"bytes"
+	"context"
 	_ "embed"
 	"encoding/json"
 	"fmt"
 	"github.com/DataDog/go-libddwaf/v2/timer"
 	"math/rand"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
@@ -26,7 +28,10 @@ import (
 
 	"github.com/DataDog/go-libddwaf/v2/internal/bindings"
 	"github.com/DataDog/go-libddwaf/v2/internal/lib"
+	"github.com/DataDog/go-libddwaf/v2/internal/log"
+	"github.com/DataDog/go-libddwaf/v2/internal/unsafe"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
 )
 
 func init() {
@@ -55,6 +60,71 @@ func TestHealth(t *testing.T) {
 	supported, err := Health()
 	require.True(t, supported)
 	require.NoError(t, err)
+
+	ok, err := Load()
+	require.True(t, ok)
+	require.NotErrorIs(t, err, errors.ErrLibraryLoad)
+	require.NotErrorIs(t, err, errors.ErrUnsupportedTarget)
+}
+
+func TestLibraryLoadFailure(t *testing.T) {
+	// Simulate libddwaf failing to load in a new process, and restore the loaded library afterwards
+	loadedLib, loadedErr, loader := wafLib, wafLoadErr, newWafDl
+	defer func() {
+		wafLib, wafLoadErr, newWafDl = loadedLib, loadedErr, loader
+	}()
+	dlopenErr := fmt.Errorf("libddwaf.so: cannot open shared object file")
+	wafLib, wafLoadErr, openWafOnce = nil, nil, sync.Once{}
+	newWafDl = func() (*bindings.WafDl, error) {
+		return nil, dlopenErr
+	}
+
+	supported, err := Health()
+	require.False(t, supported)
+	require.ErrorIs(t, err, errors.ErrLibraryLoad)
+	require.ErrorIs(t, err, dlopenErr)
+	require.NotErrorIs(t, err, errors.ErrUnsupportedTarget)
+
+	ok, err := Load()
+	require.False(t, ok)
+	require.ErrorIs(t, err, errors.ErrLibraryLoad)
+	require.ErrorIs(t, err, dlopenErr)
+
+	waf, err := NewHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil), "", "")
+	require.Nil(t, waf)
+	require.ErrorIs(t, err, errors.ErrLibraryLoad)
+	require.ErrorIs(t, err, errors.ErrLibraryUnavailable)
+	require.ErrorIs(t, err, dlopenErr)
+
+	_, err = NewHandleFromBytes([]byte(`{"version": "2.1", "rules": []}`), "", "")
+	require.ErrorIs(t, err, errors.ErrLibraryLoad)
+
+	require.ErrorIs(t, SetLogCallback(nil), errors.ErrLibraryLoad)
+	require.ErrorIs(t, SelfTest(), errors.ErrLibraryLoad)
+}
+
+func TestBuildInfo(t *testing.T) {
+	info, err := BuildInfo()
+	require.NoError(t, err)
+	require.Equal(t, Version(), info.Version)
+	require.Regexp(t, `^[0-9]+\.[0-9]+\.[0-9]+`, info.Version)
+	require.Equal(t, bindings.WafMaxContainerDepth, info.MaxContainerDepth)
+	require.Equal(t, bindings.WafMaxContainerSize, info.MaxContainerSize)
+	require.Equal(t, bindings.WafMaxStringLength, info.MaxStringLength)
+
+	require.NotEmpty(t, info.Operators)
+	require.True(t, sort.StringsAreSorted(info.Operators))
+	require.Contains(t, info.Operators, "match_regex")
+	require.Contains(t, info.Operators, "phrase_match")
+	for _, operator := range info.Operators {
+		require.Contains(t, operatorProbes, operator)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	require.NoError(t, SelfTest())
+	// The self-test can be run repeatedly
+	require.NoError(t, SelfTest())
 }
 
 func TestVersion(t *testing.T) {
@@ -251,6 +321,72 @@ func TestNewWAF(t *testing.T) {
 		waf, err := newDefaultHandle(parsed)
 		require.Error(t, err)
 		require.Nil(t, waf)
+
+		var structErr *errors.RulesetStructureError
+		require.ErrorAs(t, err, &structErr)
+		require.Equal(t, "$.events", structErr.Path)
+		require.Contains(t, err.Error(), "events")
+
+		// The unsupported events field is ignored by libddwaf, which then has no rule to load
+		var loadErr *RuleLoadError
+		require.ErrorAs(t, err, &loadErr)
+		require.Equal(t, RuleLoadNoValidRule, loadErr.Reason)
+	})
+
+	t.Run("no-valid-rule", func(t *testing.T) {
+		rule := newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil)
+		delete(rule["rules"].([]any)[0].(map[string]any), "tags")
+
+		waf, err := newDefaultHandle(rule)
+		require.Error(t, err)
+		require.Nil(t, waf)
+
+		var loadErr *RuleLoadError
+		require.ErrorAs(t, err, &loadErr)
+		require.Equal(t, RuleLoadNoValidRule, loadErr.Reason)
+		require.NotNil(t, loadErr.Diagnostics)
+		require.Equal(t, []string{"ua0-600-12x"}, loadErr.Diagnostics.Rules.Failed)
+		require.Equal(t, map[string][]string{"missing key 'tags'": {"ua0-600-12x"}}, loadErr.Diagnostics.Rules.Errors)
+		require.NotErrorIs(t, err, errors.ErrMalformedRuleset)
+		require.Contains(t, err.Error(), "no rule could be loaded")
+	})
+
+	t.Run("invalid-rule-field-type", func(t *testing.T) {
+		rule := newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil)
+		rule["rules"].([]any)[0].(map[string]any)["conditions"] = "not an array"
+
+		waf, err := newDefaultHandle(rule)
+		require.Error(t, err)
+		require.Nil(t, waf)
+
+		var structErr *errors.RulesetStructureError
+		require.ErrorAs(t, err, &structErr)
+		require.Equal(t, "$.rules[0].conditions", structErr.Path)
+
+		var loadErr *RuleLoadError
+		require.ErrorAs(t, err, &loadErr)
+		require.Equal(t, RuleLoadNoValidRule, loadErr.Reason)
+	})
+
+	t.Run("unsupported-field", func(t *testing.T) {
+		rule := newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil)
+		rule["unsupported"] = map[string]any{}
+		delete(rule["rules"].([]any)[0].(map[string]any), "tags")
+
+		waf, err := newDefaultHandle(rule)
+		require.Error(t, err)
+		require.Nil(t, waf)
+
+		// The unsupported field does not hide that no rule could be loaded, but is still reported
+		var loadErr *RuleLoadError
+		require.ErrorAs(t, err, &loadErr)
+		require.Equal(t, RuleLoadNoValidRule, loadErr.Reason)
+		require.Equal(t, []string{"ua0-600-12x"}, loadErr.Diagnostics.Rules.Failed)
+
+		var structErr *errors.RulesetStructureError
+		require.ErrorAs(t, err, &structErr)
+		require.Equal(t, "$.unsupported", structErr.Path)
+		require.Contains(t, err.Error(), "no rule could be loaded")
 	})
 }
 
@@ -431,6 +567,70 @@ func TestTimeout(t *testing.T) {
 
 		require.Equal(t, errors.ErrTimeout, err)
 	})
+
+	t.Run("shared-budget", func(t *testing.T) {
+		context := NewContext(waf)
+		require.NotNil(t, context)
+
+		// The runs made before the budget is set are not counted against it
+		_, err := context.Run(RunAddressData{Ephemeral: largeValue}, 0)
+		require.NoError(t, err)
+
+		require.NoError(t, context.SetBudget(time.Millisecond))
+
+		// The headers phase fits in the budget...
+		_, err = context.Run(RunAddressData{Ephemeral: normalValue}, 0)
+		require.NoError(t, err)
+
+		// ... but the body phase exhausts what is left of it
+		_, err = context.RunWithLimits(RunAddressData{Ephemeral: largeValue}, EncoderLimits{}, 0)
+		require.Equal(t, errors.ErrTimeout, err)
+
+		_, err = context.Run(RunAddressData{Ephemeral: normalValue}, 0)
+		require.Equal(t, errors.ErrTimeout, err)
+
+		overall, _ := context.TotalRuntime()
+		require.GreaterOrEqual(t, time.Duration(overall), time.Millisecond)
+
+		// A new budget can be set for the next request
+		require.NoError(t, context.SetBudget(time.Hour))
+		res, err := context.Run(RunAddressData{Ephemeral: normalValue}, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+
+		context.Close()
+		require.ErrorIs(t, context.SetBudget(time.Hour), errors.ErrContextClosed)
+	})
+
+	t.Run("concurrent-set-budget", func(t *testing.T) {
+		context := NewContext(waf)
+		require.NotNil(t, context)
+		defer context.Close()
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 200)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					_, err := context.Run(RunAddressData{Ephemeral: normalValue}, 0)
+					if err != nil && err != errors.ErrTimeout {
+						errs <- err
+					}
+				}
+			}()
+		}
+		for i := 0; i < 50; i++ {
+			require.NoError(t, context.SetBudget(time.Hour))
+			require.NoError(t, context.Reset())
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+	})
 }
 
 func TestMatching(t *testing.T) {
@@ -499,6 +699,141 @@ func TestMatching(t *testing.T) {
 	require.Nil(t, NewContext(waf))
 }
 
+func TestStrictInput(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContextWithOptions(waf, WithStrictInput())
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	for _, tc := range []struct {
+		Name  string
+		Input RunAddressData
+	}{
+		{Name: "nil", Input: RunAddressData{}},
+		{Name: "empty", Input: RunAddressData{Persistent: map[string]any{}, Ephemeral: map[string]any{}}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			res, err := wafCtx.Run(tc.Input, 0)
+			require.ErrorIs(t, err, errors.ErrNoInput)
+			require.Nil(t, res.Events)
+
+			_, err = wafCtx.RunEphemeral(tc.Input.Persistent, tc.Input.Ephemeral, 0)
+			require.ErrorIs(t, err, errors.ErrNoInput)
+
+			// Even past the deadline, as there is nothing to time out
+			_, err = wafCtx.RunDeadline(tc.Input, time.Now().Add(time.Second))
+			require.ErrorIs(t, err, errors.ErrNoInput)
+			_, err = wafCtx.RunDeadline(tc.Input, time.Now().Add(-time.Second))
+			require.ErrorIs(t, err, errors.ErrNoInput)
+		})
+	}
+
+	t.Run("batch", func(t *testing.T) {
+		results, err := wafCtx.RunBatch([]map[string]any{nil, {"my.input": "Arachni"}, {}}, 0)
+		require.NoError(t, err)
+		require.ErrorIs(t, results[0].Err, errors.ErrNoInput)
+		require.NoError(t, results[1].Err)
+		require.True(t, results[1].HasEvents())
+		require.ErrorIs(t, results[2].Err, errors.ErrNoInput)
+	})
+
+	// Calls without address data are not counted as runs, nor as timeouts
+	require.Equal(t, uint64(1), wafCtx.TotalRuns())
+	require.Zero(t, wafCtx.TotalTimeouts())
+
+	// Non-strict contexts still ignore them
+	lenient := NewContext(waf)
+	require.NotNil(t, lenient)
+	defer lenient.Close()
+	_, err = lenient.Run(RunAddressData{}, 0)
+	require.NoError(t, err)
+	_, err = lenient.RunDeadline(RunAddressData{}, time.Now())
+	require.NoError(t, err)
+}
+
+func TestDryRun(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	values := map[string]any{"my.input": "Arachni"}
+	require.NoError(t, wafCtx.DryRun(values))
+
+	err = wafCtx.DryRun(map[string]any{"my.input": map[string]any{"callback": func() {}}})
+	require.ErrorIs(t, err, errors.ErrUnsupportedValue)
+	var unsupported *errors.UnsupportedValueError
+	require.ErrorAs(t, err, &unsupported)
+	require.Equal(t, []string{"my.input", "callback"}, unsupported.Path)
+	require.Equal(t, reflect.Func, unsupported.Kind)
+
+	// Nothing was evaluated, so the rule can still match
+	require.Zero(t, wafCtx.TotalRuns())
+	res, err := wafCtx.Run(RunAddressData{Persistent: values}, 0)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+}
+
+func TestEncodePreview(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	long := strings.Repeat("a", bindings.WafMaxStringLength+10)
+	preview, err := wafCtx.EncodePreview(map[string]any{
+		"my.input": map[string]any{
+			"long":     long,
+			"callback": func() {},
+			"agent":    "Arachni",
+		},
+	})
+	require.NoError(t, err)
+
+	var decoded map[string]map[string]any
+	require.NoError(t, json.Unmarshal(preview, &decoded))
+	// The string is truncated and the unsupported value dropped, as libddwaf would see them
+	require.Equal(t, map[string]any{"long": long[:bindings.WafMaxStringLength], "agent": "Arachni"}, decoded["my.input"])
+
+	// Unsupported address values are dropped too
+	preview, err = wafCtx.EncodePreview(map[string]any{"my.input": make(chan int)})
+	require.NoError(t, err)
+	require.JSONEq(t, `{}`, string(preview))
+
+	// Nothing was evaluated, so the rule can still match
+	require.Zero(t, wafCtx.TotalRuns())
+	res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}, 0)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+}
+
+func TestNewContextWithError(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+
+	wafCtx, err := NewContextWithError(waf, WithBudget(time.Second))
+	require.NoError(t, err)
+	require.NotNil(t, wafCtx)
+	wafCtx.Close()
+
+	waf.Close()
+	wafCtx, err = NewContextWithError(waf)
+	require.ErrorIs(t, err, errors.ErrHandleClosed)
+	require.Nil(t, wafCtx)
+
+	_, err = waf.CloneWithObfuscators("", "")
+	require.ErrorIs(t, err, errors.ErrHandleClosed)
+}
+
 func TestMatchingEphemeralAndPersistent(t *testing.T) {
 	// This test validates the WAF behavior when a given address is provided both as ephemeral and persistent.
 	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
@@ -543,168 +878,1744 @@ func TestMatchingEphemeralAndPersistent(t *testing.T) {
 	require.Empty(t, res.Events)
 }
 
-func TestMatchingEphemeral(t *testing.T) {
-	const (
-		input1 = "my.input.1"
-		input2 = "my.input.2"
-	)
+func TestPersistentAddressPolicy(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
 
-	waf, err := newDefaultHandle(newArachniTestRulePair(ruleInput{Address: input1}, ruleInput{Address: input2}))
+	t.Run("replace", func(t *testing.T) {
+		wafCtx := NewContextWithOptions(waf, WithPersistentAddressPolicy(ReplacePersistentAddress))
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "go client"}}, time.Second)
+		require.NoError(t, err)
+		require.Empty(t, res.Events)
+
+		// The new value replaces the previous one and gets evaluated
+		res, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}, time.Second)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		wafCtx := NewContextWithOptions(waf, WithPersistentAddressPolicy(RejectPersistentAddress))
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "go client"}}, time.Second)
+		require.NoError(t, err)
+		require.Empty(t, res.Events)
+
+		res, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}, time.Second)
+		require.ErrorIs(t, err, errors.ErrPersistentAddressAlreadySet)
+		require.Empty(t, res.Events)
+	})
+}
+
+func TestMaxConcurrentRuns(t *testing.T) {
+	const maxRuns = 2
+
+	waf, err := NewHandleWithOptions(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil), "", "", WithMaxConcurrentRuns(maxRuns))
 	require.NoError(t, err)
-	require.NotNil(t, waf)
+	defer waf.Close()
 
-	addrs := waf.Addresses()
-	sort.Strings(addrs)
-	require.Equal(t, []string{input1, input2}, addrs)
+	t.Run("busy", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
 
-	wafCtx := NewContext(waf)
-	require.NotNil(t, wafCtx)
+		for i := 0; i < maxRuns; i++ {
+			require.True(t, waf.acquireRunSlot())
+		}
 
-	// Not matching because the address value doesn't match the rule
-	runAddresses := RunAddressData{
-		Ephemeral: map[string]interface{}{
-			input1: "go client",
-		},
-		Persistent: map[string]interface{}{
-			input2: "go client",
-		},
+		_, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}, time.Second)
+		require.ErrorIs(t, err, errors.ErrBusy)
+
+		waf.releaseRunSlot()
+		res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}, time.Second)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+		waf.releaseRunSlot()
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		// The input dump is written by each run right before calling libddwaf, while it holds its run slot, so that the
+		// dumps in flight are runs in flight
+		inFlight := &inFlightWriter{delay: 100 * time.Microsecond}
+		var (
+			wg   sync.WaitGroup
+			errs = make(chan error, 8*maxRuns)
+		)
+
+		value := strings.Repeat("go client ", 100)
+		for g := 0; g < 8*maxRuns; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					wafCtx := NewContextWithOptions(waf, WithInputDump(inFlight))
+					if wafCtx == nil {
+						errs <- errors.ErrContextInit
+						return
+					}
+					_, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": value}}, time.Second)
+					wafCtx.Close()
+					if err != nil && err != errors.ErrBusy {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+		require.NotZero(t, inFlight.peak.Load())
+		require.LessOrEqual(t, inFlight.peak.Load(), int32(maxRuns))
+		require.Zero(t, len(waf.runSlots))
+	})
+}
+
+// inFlightWriter is an io.Writer counting the concurrent calls to Write, which last at least delay, and recording the
+// highest count reached.
+type inFlightWriter struct {
+	delay    time.Duration
+	inFlight atomic.Int32
+	peak     atomic.Int32
+}
+
+func (w *inFlightWriter) Write(p []byte) (int, error) {
+	count := w.inFlight.Inc()
+	defer w.inFlight.Dec()
+	for {
+		peak := w.peak.Load()
+		if count <= peak || w.peak.CompareAndSwap(peak, count) {
+			break
+		}
 	}
-	res, err := wafCtx.Run(runAddresses, time.Second)
-	require.NoError(t, err)
-	require.Nil(t, res.Events)
-	require.Nil(t, res.Actions)
+	time.Sleep(w.delay)
+	return len(p), nil
+}
 
-	// Not matching because the address is not used by the rule
-	runAddresses = RunAddressData{
-		Ephemeral: map[string]interface{}{
-			"server.request.uri.raw": "something",
-		},
-		Persistent: map[string]interface{}{
-			"server.request.body.raw": "something",
-		},
+func TestOnReload(t *testing.T) {
+	withVersion := func(version string) map[string]any {
+		rules := newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil)
+		rules["metadata"] = map[string]any{"rules_version": version}
+		return rules
 	}
-	res, err = wafCtx.Run(runAddresses, time.Second)
+
+	waf, err := newDefaultHandle(withVersion("1.0.0"))
 	require.NoError(t, err)
-	require.Nil(t, res.Events)
-	require.Nil(t, res.Actions)
+	defer waf.Close()
+	require.Equal(t, "1.0.0", waf.Diagnostics().Version)
 
-	// Not matching due to a timeout
-	runAddresses = RunAddressData{
-		Ephemeral: map[string]interface{}{
-			input1: "Arachni-1",
-		},
-		Persistent: map[string]interface{}{
-			input2: "Arachni-2",
-		},
-	}
+	var calls [][2]string
+	waf.OnReload(func(old, new *Diagnostics) {
+		calls = append(calls, [2]string{old.Version, new.Version})
+	})
 
-	// Matching
-	// Note a WAF rule with ephemeral addresses may match more than once!
-	res, err = wafCtx.Run(runAddresses, time.Second)
+	waf2, err := waf.Update(withVersion("1.0.1"))
 	require.NoError(t, err)
-	require.Len(t, res.Events, 2) // 1 ephemeral, 1 persistent [!!Only if the rules have a different tags.type value!!]
-	require.Nil(t, res.Actions)
+	defer waf2.Close()
+	require.Equal(t, "1.0.1", waf2.Diagnostics().Version)
+	require.Equal(t, [][2]string{{"1.0.0", "1.0.1"}}, calls)
 
-	// Ephemeral address should still match, persistent shouldn't anymore
-	res, err = wafCtx.Run(runAddresses, time.Second)
+	// The callback is inherited by the updated handle
+	waf3, err := waf2.Update(withVersion("1.0.2"))
 	require.NoError(t, err)
-	require.Len(t, res.Events, 1) // 1 ephemeral
-	require.Nil(t, res.Actions)
+	defer waf3.Close()
+	require.Equal(t, [][2]string{{"1.0.0", "1.0.1"}, {"1.0.1", "1.0.2"}}, calls)
 
-	wafCtx.Close()
-	waf.Close()
-	// Using the WAF instance after it was closed leads to a nil WAF context
-	require.Nil(t, NewContext(waf))
+	t.Run("failed-update", func(t *testing.T) {
+		_, err := waf3.Update(map[string]any{"rules": []any{}})
+		require.Error(t, err)
+		require.Len(t, calls, 2)
+	})
 }
 
-func TestMatchingEphemeralOnly(t *testing.T) {
-	const (
-		input1 = "my.input.1"
-		input2 = "my.input.2"
-	)
-
-	waf, err := newDefaultHandle(newArachniTestRulePair(ruleInput{Address: input1}, ruleInput{Address: input2}))
+func TestInputDump(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
 	require.NoError(t, err)
-	require.NotNil(t, waf)
+	defer waf.Close()
 
-	addrs := waf.Addresses()
-	sort.Strings(addrs)
+	var dump bytes.Buffer
+	wafCtx := NewContextWithOptions(waf, WithInputDump(&dump))
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	res, err := wafCtx.Run(RunAddressData{
+		Persistent: map[string]any{"my.input": "Arachni/" + strings.Repeat("a", bindings.WafMaxStringLength)},
+		Ephemeral:  map[string]any{"my.other.input": map[string]any{"key": []any{1, true, nil, make(chan int)}}},
+	}, time.Second)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+	// The long string was truncated by the encoder, not libddwaf
+	require.False(t, res.WAFTruncated)
+
+	_, err = wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.other.input": 1.5}}, time.Second)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(dump.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+
+	var first map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	require.Equal(t, map[string]any{
+		"persistent": map[string]any{
+			"my.input": ("Arachni/" + strings.Repeat("a", bindings.WafMaxStringLength))[:bindings.WafMaxStringLength],
+		},
+		"ephemeral": map[string]any{
+			"my.other.input": map[string]any{"key": []any{float64(1), true}},
+		},
+	}, first)
+
+	require.JSONEq(t, `{"ephemeral":{"my.other.input":1.5}}`, lines[1])
+}
+
+func TestAggregateMetrics(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	var sum Metrics
+	for i, inputs := range [][]string{
+		{"Arachni", "go client"},
+		{"go client"},
+		{"Arachni", "Arachni", "curl"},
+	} {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+
+		for _, input := range inputs {
+			_, err := wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": input}}, time.Second)
+			require.NoError(t, err)
+		}
+
+		metrics := wafCtx.Metrics()
+		require.Equal(t, uint64(len(inputs)), metrics.Runs, "context %d", i)
+		sum.Runs += metrics.Runs
+		sum.Matches += metrics.Matches
+		sum.Timeouts += metrics.Timeouts
+		sum.Runtime += metrics.Runtime
+		wafCtx.Close()
+	}
+
+	require.Equal(t, Metrics{Runs: 6, Matches: 3, Runtime: sum.Runtime}, sum)
+	require.Equal(t, sum, waf.AggregateMetrics())
+}
+
+func TestRuleStats(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRulePair(ruleInput{Address: "my.input1"}, ruleInput{Address: "my.input2"}))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	require.Empty(t, wafCtx.RuleStats())
+
+	for _, input := range []map[string]any{
+		{"my.input1": "Arachni-1"},
+		{"my.input1": "go client"},
+		{"my.input1": "Arachni-1", "my.input2": "Arachni-2"},
+	} {
+		_, err := wafCtx.Run(RunAddressData{Ephemeral: input}, 0)
+		require.NoError(t, err)
+	}
+
+	stats := wafCtx.RuleStats()
+	require.Equal(t, map[string]uint64{"ua0-600-12x-A": 2, "ua0-600-12x-B": 1}, stats)
+
+	// The returned map is a snapshot
+	stats["ua0-600-12x-A"] = 0
+	require.Equal(t, uint64(2), wafCtx.RuleStats()["ua0-600-12x-A"])
+
+	// The stats are specific to each context
+	otherCtx := NewContext(waf)
+	require.NotNil(t, otherCtx)
+	defer otherCtx.Close()
+	require.Empty(t, otherCtx.RuleStats())
+}
+
+func TestRunWithContext(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	addressData := RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}
+
+	t.Run("background", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, err := wafCtx.RunWithContext(context.Background(), addressData)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		res, err := wafCtx.RunWithContext(ctx, addressData)
+		require.ErrorIs(t, err, errors.ErrCancelled)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Empty(t, res.Events)
+		require.Zero(t, wafCtx.TotalTimeouts())
+
+		// The context remains usable
+		res, err = wafCtx.RunWithContext(context.Background(), addressData)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+	})
+
+	t.Run("deadline-exceeded", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+
+		_, err := wafCtx.RunWithContext(ctx, addressData)
+		require.ErrorIs(t, err, errors.ErrCancelled)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Zero(t, wafCtx.TotalTimeouts())
+	})
+
+	t.Run("budget-first", func(t *testing.T) {
+		wafCtx := NewContextWithBudget(waf, time.Nanosecond)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		_, err := wafCtx.RunWithContext(ctx, addressData)
+		require.Equal(t, errors.ErrTimeout, err)
+		require.Equal(t, uint64(1), wafCtx.TotalTimeouts())
+	})
+}
+
+func TestRunWithLimits(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	t.Run("defaults", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, err := wafCtx.RunWithLimits(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, EncoderLimits{}, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+		require.Empty(t, wafCtx.Stats().Truncations)
+	})
+
+	t.Run("smaller", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		addressData := RunAddressData{Ephemeral: map[string]any{"my.input": []string{"Firefox", "Arachni"}}}
+		res, err := wafCtx.RunWithLimits(addressData, EncoderLimits{MaxContainerSize: 1}, 0)
+		require.NoError(t, err)
+		require.Empty(t, res.Events)
+		require.Equal(t, map[TruncationReason][]int{ContainerTooLarge: {2}}, wafCtx.Stats().Truncations)
+
+		// The limits only apply to the call they are provided to
+		res, err = wafCtx.Run(addressData, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+	})
+
+	t.Run("larger", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		value := strings.Repeat("a", bindings.WafMaxStringLength+1)
+		res, err := wafCtx.RunWithLimits(RunAddressData{Ephemeral: map[string]any{"my.input": value}}, EncoderLimits{MaxStringLength: 2 * bindings.WafMaxStringLength}, 0)
+		require.NoError(t, err)
+		require.True(t, res.WAFTruncated)
+		require.Empty(t, wafCtx.Stats().Truncations)
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		_, err := wafCtx.RunWithLimits(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, EncoderLimits{MaxContainerSize: -1}, 0)
+		require.ErrorIs(t, err, errors.ErrInvalidLimits)
+		require.Zero(t, wafCtx.Metrics().Runs)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		_, err := wafCtx.RunWithLimits(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, EncoderLimits{}, time.Nanosecond)
+		require.Equal(t, errors.ErrTimeout, err)
+
+		// The timeout only applies to the call it is provided to
+		res, err := wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+	})
+}
+
+func TestRunDeadline(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	values := RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}
+
+	t.Run("future", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, err := wafCtx.RunDeadline(values, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+		require.Zero(t, wafCtx.TotalTimeouts())
+	})
+
+	t.Run("past", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, err := wafCtx.RunDeadline(values, time.Now().Add(-time.Second))
+		require.Equal(t, errors.ErrTimeout, err)
+		require.Empty(t, res.Events)
+		require.Equal(t, uint64(1), wafCtx.TotalTimeouts())
+		require.Equal(t, uint64(1), wafCtx.TotalRuns())
+		// libddwaf was not called
+		overall, internal := wafCtx.LastRunDuration()
+		require.Zero(t, overall)
+		require.Zero(t, internal)
+
+		// The deadline only applies to the call it is provided to
+		res, err = wafCtx.Run(values, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+		require.Equal(t, uint64(1), wafCtx.TotalTimeouts())
+	})
+}
+
+func TestRawGRPCMessage(t *testing.T) {
+	rules := map[string]any{
+		"version": "2.1",
+		"rules": []any{
+			map[string]any{
+				"id":   "grpc-001",
+				"name": "gRPC message scan",
+				"tags": map[string]any{"type": "security_scanner", "category": "attack_attempt"},
+				"conditions": []any{
+					map[string]any{
+						"operator": "match_regex",
+						"parameters": map[string]any{
+							"inputs": []any{map[string]any{"address": GRPCServerRequestMessageAddress}},
+							"regex":  "Arachni",
+						},
+					},
+				},
+			},
+		},
+	}
+	waf, err := newDefaultHandle(rules)
+	require.NoError(t, err)
+	defer waf.Close()
+
+	// Protobuf wire bytes of a message with a string field #1 and a varint field #2
+	message := append([]byte{0x0a, 0x07}, "Arachni"...)
+	message = append(message, 0x10, 0x96, 0x01)
+
+	t.Run("match", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, err := wafCtx.Run(RunAddressData{Ephemeral: RawGRPCMessage(message)}, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+	})
+
+	t.Run("capped", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		long := append(make([]byte, bindings.WafMaxStringLength), message...)
+		data := RawGRPCMessage(long)
+		require.Len(t, data[GRPCServerRequestMessageAddress], bindings.WafMaxStringLength)
+
+		res, err := wafCtx.Run(RunAddressData{Ephemeral: data}, 0)
+		require.NoError(t, err)
+		require.Empty(t, res.Events)
+		require.Empty(t, wafCtx.Stats().Truncations)
+	})
+}
+
+func TestRunDecoded(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, []string{"block"}))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	matches, actions, err := wafCtx.RunDecoded(RunAddressData{Ephemeral: map[string]any{"my.input": "go client"}})
+	require.NoError(t, err)
+	require.Nil(t, matches)
+	require.Nil(t, actions)
+
+	matches, actions, err = wafCtx.RunDecoded(RunAddressData{Ephemeral: map[string]any{"my.input": map[string]any{"user-agent": "Arachni/v1"}}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"block"}, actions)
+	require.Equal(t, []RuleMatch{{
+		RuleID:   "ua0-600-12x",
+		RuleName: "Arachni",
+		Parameters: []MatchParameter{{
+			Address:   "my.input",
+			KeyPath:   []any{"user-agent"},
+			Value:     "Arachni/v1",
+			Highlight: []string{"Arachni"},
+		}},
+	}}, matches)
+}
+
+func TestParseMatches(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "Arachni/v1"}}, time.Second)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+
+	events, err := json.Marshal(res.Events)
+	require.NoError(t, err)
+
+	matches, err := ParseMatches(events)
+	require.NoError(t, err)
+	require.Equal(t, []Match{{
+		RuleID: "ua0-600-12x",
+		Tags:   map[string]string{"type": "security_scanner", "category": "attack_attempt"},
+		Matches: []Condition{{
+			Operator:         "match_regex",
+			Operand:          "^Arachni",
+			HighlightedValue: "Arachni",
+		}},
+	}}, matches)
+
+	t.Run("no-events", func(t *testing.T) {
+		matches, err := ParseMatches([]byte(`[]`))
+		require.NoError(t, err)
+		require.Empty(t, matches)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseMatches([]byte(`{"rule": "not an array"}`))
+		require.Error(t, err)
+	})
+}
+
+func TestMatchingEphemeral(t *testing.T) {
+	const (
+		input1 = "my.input.1"
+		input2 = "my.input.2"
+	)
+
+	waf, err := newDefaultHandle(newArachniTestRulePair(ruleInput{Address: input1}, ruleInput{Address: input2}))
+	require.NoError(t, err)
+	require.NotNil(t, waf)
+
+	addrs := waf.Addresses()
+	sort.Strings(addrs)
 	require.Equal(t, []string{input1, input2}, addrs)
 
-	wafCtx := NewContext(waf)
-	require.NotNil(t, wafCtx)
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+
+	// Not matching because the address value doesn't match the rule
+	runAddresses := RunAddressData{
+		Ephemeral: map[string]interface{}{
+			input1: "go client",
+		},
+		Persistent: map[string]interface{}{
+			input2: "go client",
+		},
+	}
+	res, err := wafCtx.Run(runAddresses, time.Second)
+	require.NoError(t, err)
+	require.Nil(t, res.Events)
+	require.Nil(t, res.Actions)
+
+	// Not matching because the address is not used by the rule
+	runAddresses = RunAddressData{
+		Ephemeral: map[string]interface{}{
+			"server.request.uri.raw": "something",
+		},
+		Persistent: map[string]interface{}{
+			"server.request.body.raw": "something",
+		},
+	}
+	res, err = wafCtx.Run(runAddresses, time.Second)
+	require.NoError(t, err)
+	require.Nil(t, res.Events)
+	require.Nil(t, res.Actions)
+
+	// Not matching due to a timeout
+	runAddresses = RunAddressData{
+		Ephemeral: map[string]interface{}{
+			input1: "Arachni-1",
+		},
+		Persistent: map[string]interface{}{
+			input2: "Arachni-2",
+		},
+	}
+
+	// Matching
+	// Note a WAF rule with ephemeral addresses may match more than once!
+	res, err = wafCtx.Run(runAddresses, time.Second)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 2) // 1 ephemeral, 1 persistent [!!Only if the rules have a different tags.type value!!]
+	require.Nil(t, res.Actions)
+
+	// Ephemeral address should still match, persistent shouldn't anymore
+	res, err = wafCtx.Run(runAddresses, time.Second)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1) // 1 ephemeral
+	require.Nil(t, res.Actions)
+
+	wafCtx.Close()
+	waf.Close()
+	// Using the WAF instance after it was closed leads to a nil WAF context
+	require.Nil(t, NewContext(waf))
+}
+
+func TestMatchingEphemeralOnly(t *testing.T) {
+	const (
+		input1 = "my.input.1"
+		input2 = "my.input.2"
+	)
+
+	waf, err := newDefaultHandle(newArachniTestRulePair(ruleInput{Address: input1}, ruleInput{Address: input2}))
+	require.NoError(t, err)
+	require.NotNil(t, waf)
+
+	addrs := waf.Addresses()
+	sort.Strings(addrs)
+	require.Equal(t, []string{input1, input2}, addrs)
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+
+	// Not matching because the address value doesn't match the rule
+	runAddresses := RunAddressData{
+		Ephemeral: map[string]interface{}{
+			input1: "go client",
+		},
+	}
+	res, err := wafCtx.Run(runAddresses, time.Second)
+	require.NoError(t, err)
+	require.Nil(t, res.Events)
+	require.Nil(t, res.Actions)
+
+	// Not matching because the address is not used by the rule
+	runAddresses = RunAddressData{
+		Ephemeral: map[string]interface{}{
+			"server.request.uri.raw": "something",
+		},
+	}
+	res, err = wafCtx.Run(runAddresses, time.Second)
+	require.NoError(t, err)
+	require.Nil(t, res.Events)
+	require.Nil(t, res.Actions)
+
+	// Not matching due to a timeout
+	runAddresses = RunAddressData{
+		Ephemeral: map[string]interface{}{
+			input1: "Arachni-1",
+		},
+	}
+
+	// Matching
+	res, err = wafCtx.Run(runAddresses, time.Second)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1) // 1 ephemeral
+	require.Nil(t, res.Actions)
+
+	wafCtx.Close()
+	waf.Close()
+	// Using the WAF instance after it was closed leads to a nil WAF context
+	require.Nil(t, NewContext(waf))
+}
+
+func TestRunEphemeral(t *testing.T) {
+	condition := func(addr string) map[string]any {
+		return map[string]any{
+			"operator": "match_regex",
+			"parameters": map[string]any{
+				"inputs": []any{map[string]any{"address": addr}},
+				"regex":  "^Arachni",
+			},
+		}
+	}
+	waf, err := newDefaultHandle(map[string]any{
+		"version": "2.1",
+		"rules": []any{
+			map[string]any{
+				"id":         "header-and-body",
+				"name":       "Arachni in the headers and body",
+				"tags":       map[string]any{"type": "security_scanner", "category": "attack_attempt"},
+				"conditions": []any{condition("my.header"), condition("my.body")},
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	// The persistent header alone doesn't match
+	res, err := wafCtx.RunEphemeral(map[string]any{"my.header": "Arachni"}, nil, 0)
+	require.NoError(t, err)
+	require.Empty(t, res.Events)
+
+	// The ephemeral body completes the match with the header of the previous call
+	res, err = wafCtx.RunEphemeral(nil, map[string]any{"my.body": "Arachni"}, 0)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+
+	// The body is not retained
+	res, err = wafCtx.RunEphemeral(nil, map[string]any{"my.body": "go client"}, 0)
+	require.NoError(t, err)
+	require.Empty(t, res.Events)
+
+	// Matches involving ephemeral data are reported every time
+	res, err = wafCtx.RunEphemeral(nil, map[string]any{"my.body": "Arachni"}, 0)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+}
+
+func TestRunSingle(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, []string{"block"}))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	for _, value := range []any{"go client", "Arachni", map[string]any{"user-agent": []string{"Arachni/v2"}}} {
+		mapCtx := NewContext(waf)
+		require.NotNil(t, mapCtx)
+		defer mapCtx.Close()
+		singleCtx := NewContext(waf)
+		require.NotNil(t, singleCtx)
+		defer singleCtx.Close()
+
+		// Running the same value twice shows the value is ephemeral, as the rule matches again
+		for i := 0; i < 2; i++ {
+			expected, err := mapCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": value}}, 0)
+			require.NoError(t, err)
+			res, err := singleCtx.RunSingle("my.input", value, time.Second)
+			require.NoError(t, err)
+
+			require.Equal(t, expected.Events, res.Events)
+			require.Equal(t, expected.Actions, res.Actions)
+			require.Equal(t, mapCtx.LastRunInputBytes(), singleCtx.LastRunInputBytes())
+		}
+		require.Equal(t, mapCtx.Metrics().Matches, singleCtx.Metrics().Matches)
+	}
+}
+
+func TestMatchHandler(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContextWithOptions(waf, WithMaxConcurrentRuns(1))
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	var matches []Match
+	wafCtx.SetMatchHandler(func(match Match) {
+		matches = append(matches, match)
+		// Running the context again from the handler must not deadlock
+		_, err := wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "go client"}}, 0)
+		require.NoError(t, err)
+	})
+
+	_, err = wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "go client"}}, 0)
+	require.NoError(t, err)
+	require.Empty(t, matches)
+
+	res, err := wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, 0)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+	require.Len(t, matches, 1)
+	require.Equal(t, "ua0-600-12x", matches[0].RuleID)
+
+	results, err := wafCtx.RunBatch([]map[string]any{
+		{"my.input": "Arachni"},
+		{"my.input": "go client"},
+		{"my.input": "Arachni/v2"},
+	}, 0)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	require.Len(t, matches, 3)
+
+	wafCtx.SetMatchHandler(nil)
+	_, err = wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, 0)
+	require.NoError(t, err)
+	require.Len(t, matches, 3)
+}
+
+func TestRunBatch(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, []string{"block"}))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	inputs := []map[string]any{
+		{"my.input": "Arachni"},
+		{"my.input": "go client"},
+		nil,
+		{"my.input": "Arachni"},
+	}
+
+	t.Run("results", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		results, err := wafCtx.RunBatch(inputs, time.Second)
+		require.NoError(t, err)
+		require.Len(t, results, len(inputs))
+
+		// The rule matching the first input is not pruned for the last one
+		for _, i := range []int{0, 3} {
+			require.NoError(t, results[i].Err)
+			require.Len(t, results[i].Events, 1)
+			require.Equal(t, []string{"block"}, results[i].Actions)
+		}
+		require.NoError(t, results[1].Err)
+		require.Empty(t, results[1].Events)
+		require.Equal(t, BatchResult{}, results[2])
+
+		require.Equal(t, uint64(3), wafCtx.TotalRuns())
+		require.Equal(t, uint64(2), wafCtx.RuleStats()["ua0-600-12x"])
+
+		// The batch left the context untouched
+		res, err := wafCtx.Run(RunAddressData{Persistent: inputs[0]}, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		results, err := wafCtx.RunBatch(inputs, time.Nanosecond)
+		require.Equal(t, errors.ErrTimeout, err)
+		require.Len(t, results, len(inputs))
+		for _, i := range []int{0, 1, 3} {
+			require.Equal(t, errors.ErrTimeout, results[i].Err)
+		}
+		require.NoError(t, results[2].Err)
+		require.Equal(t, uint64(3), wafCtx.TotalTimeouts())
+	})
+
+	t.Run("closed-context", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		wafCtx.Close()
+
+		_, err := wafCtx.RunBatch(inputs, time.Second)
+		require.Equal(t, errors.ErrContextClosed, err)
+	})
+}
+
+func TestContextPool(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	pool := NewContextPool(waf, WithBudget(time.Second))
+	values := RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}
+
+	wafCtx := pool.Get()
+	require.NotNil(t, wafCtx)
+	res, err := wafCtx.Run(values, 0)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+	pool.Put(wafCtx)
+
+	t.Run("reset", func(t *testing.T) {
+		// The pooled context holds no reference on the handle until it is taken out of the pool again
+		require.Equal(t, int32(1), waf.refCounter.Load())
+		require.Zero(t, wafCtx.TotalRuns())
+		require.Empty(t, wafCtx.RuleStats())
+		require.Empty(t, wafCtx.Snapshot().persistentData)
+
+		// The rule is no longer pruned once the context is reset
+		require.NoError(t, wafCtx.attach())
+		require.Equal(t, time.Second, wafCtx.timer.SumRemaining())
+		res, err := wafCtx.Run(values, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+		pool.Put(wafCtx)
+	})
+
+	t.Run("set-budget", func(t *testing.T) {
+		// The budget the context was created with is restored, while Reset keeps the one of SetBudget
+		require.NoError(t, wafCtx.attach())
+		require.NoError(t, wafCtx.SetBudget(time.Minute))
+		require.NoError(t, wafCtx.Reset())
+		require.Equal(t, time.Minute, wafCtx.timer.SumRemaining())
+
+		pool.Put(wafCtx)
+		require.NoError(t, wafCtx.attach())
+		require.Equal(t, time.Second, wafCtx.timer.SumRemaining())
+		pool.Put(wafCtx)
+	})
+
+	t.Run("updated-handle", func(t *testing.T) {
+		pooled := pool.Get()
+		require.NotNil(t, pooled)
+		previous := pooled.instance
+		pool.Put(pooled)
+
+		// The previous ruleset is no longer used by the pooled context, and is freed by the update
+		require.NoError(t, waf.UpdateRuleset(newArachniTestRule([]ruleInput{{Address: "my.other.input"}}, nil)))
+		require.Zero(t, previous.refCounter.Load())
+
+		// The context taken out of the pool again uses the current ruleset of the handle
+		require.NoError(t, pooled.attach())
+		defer pooled.Close()
+		res, err := pooled.Run(RunAddressData{Persistent: map[string]any{"my.other.input": "Arachni"}}, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+	})
+
+	t.Run("closed-context", func(t *testing.T) {
+		closed := NewContext(waf)
+		require.NotNil(t, closed)
+		closed.Close()
+
+		pool.Put(closed)
+		require.Equal(t, int32(1), waf.refCounter.Load())
+	})
+
+	t.Run("closed-handle", func(t *testing.T) {
+		waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+		require.NoError(t, err)
+		pool := NewContextPool(waf)
+
+		wafCtx := pool.Get()
+		require.NotNil(t, wafCtx)
+		pool.Put(wafCtx)
+
+		// The pooled context does not keep the handle from being freed, and can no longer be used
+		waf.Close()
+		require.Zero(t, waf.refCounter.Load())
+		require.Nil(t, waf.instance)
+		require.Equal(t, errors.ErrHandleClosed, wafCtx.attach())
+		require.Nil(t, pool.Get())
+	})
+}
+
+func TestContextReset(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	values := RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}
+	res, err := wafCtx.Run(values, 0)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+
+	// The rule already matched in this context
+	res, err = wafCtx.Run(values, 0)
+	require.NoError(t, err)
+	require.Empty(t, res.Events)
+
+	require.NoError(t, wafCtx.Reset())
+	require.Empty(t, wafCtx.Snapshot().persistentData)
+
+	// The pruned rule fires again after the reset, while the statistics are preserved
+	res, err = wafCtx.Run(values, 0)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+	require.Equal(t, uint64(3), wafCtx.TotalRuns())
+	require.Equal(t, uint64(2), wafCtx.Metrics().Matches)
+	runtime, _ := wafCtx.TotalRuntime()
+	require.NotZero(t, runtime)
+
+	wafCtx.ResetStats()
+	require.Zero(t, wafCtx.TotalRuns())
+	require.Zero(t, wafCtx.TotalTimeouts())
+	require.Empty(t, wafCtx.RuleStats())
+	runtime, _ = wafCtx.TotalRuntime()
+	require.Zero(t, runtime)
+	// The statistics are reset without resetting the rule matches
+	res, err = wafCtx.Run(values, 0)
+	require.NoError(t, err)
+	require.Empty(t, res.Events)
+
+	t.Run("closed", func(t *testing.T) {
+		closed := NewContext(waf)
+		require.NotNil(t, closed)
+		closed.Close()
+		require.ErrorIs(t, closed.Reset(), errors.ErrContextClosed)
+	})
+}
+
+func TestLastRunInputBytes(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+	require.Zero(t, wafCtx.LastRunInputBytes())
+
+	objectSize := uint64(reflect.TypeOf(bindings.WafObject{}).Size())
+
+	_, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "go client"}}, 0)
+	require.NoError(t, err)
+	// The root map and its single entry, with its key and string value
+	small := wafCtx.LastRunInputBytes()
+	require.Equal(t, 2*objectSize+uint64(len("my.input")+len("go client")), small)
+
+	large := map[string]any{"my.input": strings.Repeat("a", 4000), "my.other": []string{"a", "b", "c"}}
+	_, err = wafCtx.Run(RunAddressData{Ephemeral: large}, 0)
+	require.NoError(t, err)
+	require.Equal(t, 6*objectSize+uint64(len("my.input")+4000+len("my.other")+3), wafCtx.LastRunInputBytes())
+	require.Greater(t, wafCtx.LastRunInputBytes(), small)
+
+	wafCtx.ResetStats()
+	require.Zero(t, wafCtx.LastRunInputBytes())
+}
+
+func TestLastRunRulesEvaluated(t *testing.T) {
+	ruleset := newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil)
+	for _, rule := range []struct{ id, typ, address string }{
+		{"nessus-rule", "security_scanner", "my.input"},
+		{"other-rule", "attack_tool", "my.other.input"},
+	} {
+		ruleset["rules"] = append(ruleset["rules"].([]any), map[string]any{
+			"id":   rule.id,
+			"name": rule.id,
+			"tags": map[string]any{"type": rule.typ, "category": "attack_attempt"},
+			"conditions": []any{map[string]any{
+				"operator": "match_regex",
+				"parameters": map[string]any{
+					"inputs": []any{map[string]any{"address": rule.address}},
+					"regex":  "^Nessus",
+				},
+			}},
+		})
+	}
+	waf, err := newDefaultHandle(ruleset)
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+	require.Zero(t, wafCtx.LastRunRulesEvaluated())
+
+	// Matches with ephemeral address data do not prune the rules
+	res, err := wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, 0)
+	require.NoError(t, err)
+	require.True(t, res.HasEvents())
+	require.Equal(t, uint64(2), wafCtx.LastRunRulesEvaluated())
+
+	res, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}, 0)
+	require.NoError(t, err)
+	require.True(t, res.HasEvents())
+	require.Equal(t, uint64(2), wafCtx.LastRunRulesEvaluated())
+
+	// The rules of the type of the rule that matched are no longer evaluated
+	res, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "Nessus"}}, 0)
+	require.NoError(t, err)
+	require.False(t, res.HasEvents())
+	require.Zero(t, wafCtx.LastRunRulesEvaluated())
+
+	_, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "go client", "my.other.input": "go client"}}, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), wafCtx.LastRunRulesEvaluated())
+
+	wafCtx.ResetStats()
+	require.Zero(t, wafCtx.LastRunRulesEvaluated())
+
+	require.NoError(t, wafCtx.Reset())
+	_, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "go client", "my.other.input": "go client"}}, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), wafCtx.LastRunRulesEvaluated())
+
+	// The context keeps counting the rules of the ruleset it runs once the handle is updated, until it is reset
+	require.NoError(t, waf.UpdateRuleset(newArachniTestRule([]ruleInput{{Address: "my.new.input"}}, nil)))
+	_, err = wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "go client", "my.other.input": "go client"}}, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), wafCtx.LastRunRulesEvaluated())
+
+	require.NoError(t, wafCtx.Reset())
+	_, err = wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "go client", "my.new.input": "go client"}}, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), wafCtx.LastRunRulesEvaluated())
+}
+
+func TestLastRunDroppedValues(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+	require.Zero(t, wafCtx.LastRunDroppedValues())
+
+	input := map[string]any{"callback": func() {}, "events": make(chan int), "user-agent": "Arachni"}
+	res, err := wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": input}}, 0)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+	require.Equal(t, 2, wafCtx.LastRunDroppedValues())
+
+	_, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "go client"}}, 0)
+	require.NoError(t, err)
+	require.Zero(t, wafCtx.LastRunDroppedValues())
+
+	_, err = wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": []any{func() {}}}}, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, wafCtx.LastRunDroppedValues())
+
+	wafCtx.ResetStats()
+	require.Zero(t, wafCtx.LastRunDroppedValues())
+}
+
+func TestMaxInputSize(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}, {Address: "my.other"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	large := make(map[string]any, 5000)
+	for i := 0; i < 5000; i++ {
+		large[fmt.Sprintf("field-%d", i)] = []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	}
+	// limited is the size of the input encoded before the limit was exceeded
+	var limited uint64
+
+	t.Run("below-limit", func(t *testing.T) {
+		wafCtx := NewContextWithOptions(waf, WithMaxInputSize(2048))
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, err := wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, 0)
+		require.NoError(t, err)
+		require.True(t, res.HasEvents())
+	})
+
+	t.Run("above-limit", func(t *testing.T) {
+		wafCtx := NewContextWithOptions(waf, WithMaxInputSize(2048))
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, err := wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni", "my.other": large}}, 0)
+		require.ErrorIs(t, err, errors.ErrInputTooLarge)
+		require.False(t, res.HasEvents())
+		require.False(t, wafCtx.LastRunTimedOut())
+		// Encoding stops at the first value encoded past the limit, unlike without limit
+		limited = wafCtx.LastRunInputBytes()
+		require.Greater(t, limited, uint64(2048))
+
+		_, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.other": large}}, 0)
+		require.ErrorIs(t, err, errors.ErrInputTooLarge)
+	})
+
+	t.Run("cumulative", func(t *testing.T) {
+		wafCtx := NewContextWithOptions(waf, WithMaxInputSize(2048))
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		half := map[string]any{"my.input": strings.Repeat("a", 1500)}
+		_, err := wafCtx.Run(RunAddressData{Persistent: half}, 0)
+		require.NoError(t, err)
+		_, err = wafCtx.Run(RunAddressData{Persistent: half, Ephemeral: map[string]any{"my.other": strings.Repeat("b", 1500)}}, 0)
+		require.ErrorIs(t, err, errors.ErrInputTooLarge)
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		_, err := wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.other": large}}, 0)
+		require.NoError(t, err)
+		require.Greater(t, wafCtx.LastRunInputBytes(), 4*limited)
+	})
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	values := map[string]any{"my.input": "Arachni"}
+
+	t.Run("restores-matches", func(t *testing.T) {
+		state := wafCtx.Snapshot()
+
+		res, err := wafCtx.Run(RunAddressData{Persistent: values}, time.Second)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+
+		// The rule already matched in this context
+		res, err = wafCtx.Run(RunAddressData{Persistent: values}, time.Second)
+		require.NoError(t, err)
+		require.Empty(t, res.Events)
+
+		require.NoError(t, wafCtx.Restore(state))
+
+		// The rule can match again after restoring the state from before the match
+		res, err = wafCtx.Run(RunAddressData{Persistent: values}, time.Second)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+	})
+
+	t.Run("restores-persistent-data", func(t *testing.T) {
+		// The snapshot holds the persistent data that already matched, which a context rejecting persistent addresses
+		// provided more than once then received
+		state := wafCtx.Snapshot()
+		strict := NewContextWithOptions(waf, WithPersistentAddressPolicy(RejectPersistentAddress))
+		require.NotNil(t, strict)
+		defer strict.Close()
+		require.NoError(t, strict.Restore(state))
+		_, err := strict.Run(RunAddressData{Persistent: values}, time.Second)
+		require.ErrorIs(t, err, errors.ErrPersistentAddressAlreadySet)
+
+		require.NoError(t, wafCtx.Restore(state))
+
+		// The rule already matched in the restored state
+		res, err := wafCtx.Run(RunAddressData{Persistent: values}, time.Second)
+		require.NoError(t, err)
+		require.Empty(t, res.Events)
+	})
+
+	t.Run("closed-context", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		state := wafCtx.Snapshot()
+		wafCtx.Close()
+
+		require.Equal(t, errors.ErrContextClosed, wafCtx.Restore(state))
+	})
+
+	t.Run("replay-variants", func(t *testing.T) {
+		waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.headers"}, {Address: "my.body"}}, nil))
+		require.NoError(t, err)
+		defer waf.Close()
+
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		headers := map[string]any{"my.headers": map[string][]string{"content-type": {"text/plain"}}}
+		_, err = wafCtx.Run(RunAddressData{Persistent: headers}, time.Second)
+		require.NoError(t, err)
+		baseline := wafCtx.Snapshot()
+
+		for _, variant := range []struct {
+			Body    string
+			Matches bool
+		}{
+			{Body: "Arachni", Matches: true},
+			{Body: "Mozilla", Matches: false},
+			// Without restoring the baseline, the rule would no longer match as it already did
+			{Body: "Arachni", Matches: true},
+		} {
+			require.NoError(t, wafCtx.Restore(baseline))
+			res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.body": variant.Body}}, time.Second)
+			require.NoError(t, err)
+			require.Equal(t, variant.Matches, res.HasEvents(), variant.Body)
+		}
+
+		// The snapshot outlives the context it was taken from
+		other := NewContextWithOptions(waf, WithPersistentAddressPolicy(RejectPersistentAddress))
+		require.NotNil(t, other)
+		defer other.Close()
+		wafCtx.Close()
+		require.NoError(t, other.Restore(baseline))
+		_, err = other.Run(RunAddressData{Persistent: headers}, time.Second)
+		require.ErrorIs(t, err, errors.ErrPersistentAddressAlreadySet)
+		res, err := other.Run(RunAddressData{Persistent: map[string]any{"my.body": "Arachni"}}, time.Second)
+		require.NoError(t, err)
+		require.True(t, res.HasEvents())
+	})
+}
+
+func TestRecover(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}, {Address: "my.other"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	large := make(map[string]any, 1000)
+	for i := 0; i < 1000; i++ {
+		large[fmt.Sprintf("field-%d", i)] = strings.Repeat("a", 64)
+	}
+
+	t.Run("after-encoding-failure", func(t *testing.T) {
+		wafCtx := NewContextWithOptions(waf, WithMaxInputSize(2048))
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		persistent := map[string]any{"my.input": "Mozilla"}
+		res, err := wafCtx.Run(RunAddressData{Persistent: persistent}, 0)
+		require.NoError(t, err)
+		require.Empty(t, res.Events)
+
+		_, err = wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.other": large}}, 0)
+		require.ErrorIs(t, err, errors.ErrInputTooLarge)
+
+		require.NoError(t, wafCtx.Recover())
+		require.Equal(t, persistent, wafCtx.Snapshot().persistentData)
+
+		res, err = wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.other": "Arachni"}}, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+	})
+
+	t.Run("keeps-matches", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+
+		require.NoError(t, wafCtx.Recover())
+
+		// The persistent data is evaluated again by the new ddwaf_context, so the rule is still pruned
+		res, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.other": "Arachni"}}, 0)
+		require.NoError(t, err)
+		require.Empty(t, res.Events)
+	})
+
+	t.Run("closed-context", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		wafCtx.Close()
+
+		require.Equal(t, errors.ErrContextClosed, wafCtx.Recover())
+	})
+}
+
+func TestKeepAllMatches(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, []string{"block"}))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	addressData := RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}
+
+	t.Run("default", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, err := wafCtx.Run(addressData, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+
+		// The rule already matched in this context
+		res, err = wafCtx.Run(addressData, 0)
+		require.NoError(t, err)
+		require.Empty(t, res.Events)
+	})
+
+	t.Run("keep-all-matches", func(t *testing.T) {
+		wafCtx := NewContextWithOptions(waf, WithKeepAllMatches())
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, err := wafCtx.Run(addressData, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+		require.Equal(t, []string{"block"}, res.Actions)
+		_, firstRuntime := wafCtx.TotalRuntime()
+
+		res, err = wafCtx.Run(addressData, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+		require.Equal(t, []string{"block"}, res.Actions)
+		_, secondRuntime := wafCtx.TotalRuntime()
+		require.Greater(t, secondRuntime, firstRuntime)
+
+		// The match on the address data of the previous calls is not reported again
+		res, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.other": "Arachni"}}, 0)
+		require.NoError(t, err)
+		require.Empty(t, res.Events)
+		require.Empty(t, res.Actions)
+
+		res, err = wafCtx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+		require.Equal(t, 4, int(wafCtx.Metrics().Runs))
+		require.Equal(t, 3, int(wafCtx.Metrics().Matches))
+	})
+}
+
+func TestActions(t *testing.T) {
+	testActions := func(expectedActions []string) func(t *testing.T) {
+		return func(t *testing.T) {
+
+			waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, expectedActions))
+			require.NoError(t, err)
+			require.NotNil(t, waf)
+			defer waf.Close()
+
+			wafCtx := NewContext(waf)
+			require.NotNil(t, wafCtx)
+			defer wafCtx.Close()
+
+			// Not matching because the address value doesn't match the rule
+			values := map[string]interface{}{
+				"my.input": "Arachni",
+			}
+			ephemeral := map[string]interface{}{
+				"my.other.input": map[string]bool{"safe": true},
+			}
+			res, err := wafCtx.Run(RunAddressData{Persistent: values, Ephemeral: ephemeral}, time.Second)
+			require.NoError(t, err)
+			require.NotEmpty(t, res.Events)
+			require.Equal(t, expectedActions, res.Actions)
+		}
+	}
+
+	t.Run("single", testActions([]string{"block"}))
+	t.Run("multiple-actions", testActions([]string{"action 1", "action 2", "action 3"}))
+	t.Run("on-match-order", testActions([]string{"redirect", "block", "monitor", "action 0"}))
+
+	t.Run("multiple-rules", func(t *testing.T) {
+		ruleset := newArachniTestRulePair(ruleInput{Address: "my.input.1"}, ruleInput{Address: "my.input.2"})
+		rules := ruleset["rules"].([]any)
+		rules[0].(map[string]any)["on_match"] = []any{"redirect", "monitor"}
+		rules[1].(map[string]any)["on_match"] = []any{"block", "redirect"}
+
+		waf, err := newDefaultHandle(ruleset)
+		require.NoError(t, err)
+		defer waf.Close()
+
+		for i := 0; i < 10; i++ {
+			wafCtx := NewContext(waf)
+			require.NotNil(t, wafCtx)
+
+			res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{
+				"my.input.2": "Arachni-2",
+				"my.input.1": "Arachni-1",
+			}}, time.Second)
+			wafCtx.Close()
+			require.NoError(t, err)
+			require.Len(t, res.Events, 2)
+			// The actions of ua0-600-12x-A come first, each action being only reported once
+			require.Equal(t, []string{"redirect", "monitor", "block"}, res.Actions)
+		}
+	})
+}
+
+func TestRunActions(t *testing.T) {
+	ruleset := newArachniTestRule([]ruleInput{{Address: "my.input"}}, []string{"redirect-denied", "block"})
+	ruleset["actions"] = []any{
+		map[string]any{
+			"id":         "redirect-denied",
+			"type":       "redirect_request",
+			"parameters": map[string]any{"status_code": 302, "location": "/denied"},
+		},
+	}
+	waf, err := newDefaultHandle(ruleset)
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	res, actions, err := wafCtx.RunActions(RunAddressData{Persistent: map[string]any{"my.input": "go client"}}, time.Second)
+	require.NoError(t, err)
+	require.Empty(t, res.Events)
+	require.Nil(t, actions)
+
+	res, actions, err = wafCtx.RunActions(RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}, time.Second)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+	require.Equal(t, []string{"redirect-denied", "block"}, res.Actions)
+	require.Equal(t, []Action{
+		{ID: "redirect-denied", Parameters: map[string]any{"status_code": int64(302), "location": "/denied"}},
+		{ID: "block"},
+	}, actions)
+}
+
+func TestRunWithDerivatives(t *testing.T) {
+	t.Run("none", func(t *testing.T) {
+		waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+		require.NoError(t, err)
+		defer waf.Close()
+
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, derivatives, err := wafCtx.RunWithDerivatives(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, time.Second)
+		require.NoError(t, err)
+		require.True(t, res.HasEvents())
+		require.NotNil(t, derivatives)
+		require.Empty(t, derivatives)
+	})
+
+	t.Run("schema", func(t *testing.T) {
+		ruleset := newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil)
+		ruleset["processors"] = []any{
+			map[string]any{
+				"id":        "extract-body-schema",
+				"generator": "extract_schema",
+				"parameters": map[string]any{
+					"mappings": []any{
+						map[string]any{"inputs": []any{map[string]any{"address": "my.body"}}, "output": "_dd.appsec.s.req.body"},
+					},
+				},
+				"evaluate": false,
+				"output":   true,
+			},
+		}
+		waf, err := newDefaultHandle(ruleset)
+		require.NoError(t, err)
+		defer waf.Close()
+
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
 
-	// Not matching because the address value doesn't match the rule
-	runAddresses := RunAddressData{
-		Ephemeral: map[string]interface{}{
-			input1: "go client",
+		res, derivatives, err := wafCtx.RunWithDerivatives(RunAddressData{Ephemeral: map[string]any{"my.body": map[string]any{"name": "value"}}}, time.Second)
+		require.NoError(t, err)
+		require.False(t, res.HasEvents())
+		require.Contains(t, derivatives, "_dd.appsec.s.req.body")
+		require.Equal(t, res.Derivatives, derivatives)
+	})
+}
+
+func TestDefinedActions(t *testing.T) {
+	ruleset := newArachniTestRule([]ruleInput{{Address: "my.input"}}, []string{"redirect-denied", "undefined-action"})
+	ruleset["actions"] = []any{
+		map[string]any{
+			"id":         "redirect-denied",
+			"type":       "redirect_request",
+			"parameters": map[string]any{"status_code": 302, "location": "/denied"},
 		},
+		map[string]any{"id": "unused-monitor", "type": "monitor"},
 	}
-	res, err := wafCtx.Run(runAddresses, time.Second)
+	waf, err := newDefaultHandle(ruleset)
 	require.NoError(t, err)
-	require.Nil(t, res.Events)
-	require.Nil(t, res.Actions)
 
-	// Not matching because the address is not used by the rule
-	runAddresses = RunAddressData{
-		Ephemeral: map[string]interface{}{
-			"server.request.uri.raw": "something",
-		},
-	}
-	res, err = wafCtx.Run(runAddresses, time.Second)
+	require.Equal(t, []string{"block", "extract_schema", "redirect-denied", "stack_trace", "undefined-action", "unused-monitor"}, waf.DefinedActions())
+
+	waf.Close()
+	require.Nil(t, waf.DefinedActions())
+
+	waf, err = newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
 	require.NoError(t, err)
-	require.Nil(t, res.Events)
-	require.Nil(t, res.Actions)
+	defer waf.Close()
+	require.Equal(t, []string{"block", "extract_schema", "stack_trace"}, waf.DefinedActions())
+}
 
-	// Not matching due to a timeout
-	runAddresses = RunAddressData{
-		Ephemeral: map[string]interface{}{
-			input1: "Arachni-1",
-		},
+func TestRunDecision(t *testing.T) {
+	for _, tc := range []struct {
+		Name    string
+		Actions []string
+		Blocked bool
+	}{
+		{Name: "block", Actions: []string{"block"}, Blocked: true},
+		{Name: "block-request", Actions: []string{"monitor", "block_request"}, Blocked: true},
+		{Name: "non-blocking", Actions: []string{"monitor", "redirect"}},
+		{Name: "no-actions"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			ruleset := newArachniTestRule([]ruleInput{{Address: "my.input"}}, tc.Actions)
+			ruleset["actions"] = []any{
+				map[string]any{"id": "block_request", "type": "block_request", "parameters": map[string]any{"status_code": 403}},
+				map[string]any{"id": "redirect", "type": "redirect_request", "parameters": map[string]any{"status_code": 302, "location": "/"}},
+				map[string]any{"id": "monitor", "type": "monitor", "parameters": map[string]any{}},
+			}
+			waf, err := newDefaultHandle(ruleset)
+			require.NoError(t, err)
+			defer waf.Close()
+
+			wafCtx := NewContext(waf)
+			require.NotNil(t, wafCtx)
+			defer wafCtx.Close()
+
+			blocked, matches, actions, err := wafCtx.RunDecision(RunAddressData{Ephemeral: map[string]any{"my.input": "go client"}}, time.Second)
+			require.NoError(t, err)
+			require.False(t, blocked)
+			require.Nil(t, matches)
+			require.Empty(t, actions)
+
+			blocked, matches, actions, err = wafCtx.RunDecision(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, time.Second)
+			require.NoError(t, err)
+			require.Equal(t, tc.Blocked, blocked)
+			require.Equal(t, tc.Actions, actions)
+			var events []any
+			require.NoError(t, json.Unmarshal(matches, &events))
+			require.Len(t, events, 1)
+			require.Equal(t, "ua0-600-12x", eventRuleID(events[0]))
+		})
 	}
+}
 
-	// Matching
-	res, err = wafCtx.Run(runAddresses, time.Second)
+func TestRunTo(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, []string{"block"}))
 	require.NoError(t, err)
-	require.Len(t, res.Events, 1) // 1 ephemeral
-	require.Nil(t, res.Actions)
+	defer waf.Close()
 
-	wafCtx.Close()
-	waf.Close()
-	// Using the WAF instance after it was closed leads to a nil WAF context
-	require.Nil(t, NewContext(waf))
+	values := map[string]any{"my.input": "Arachni"}
+
+	decisionCtx := NewContext(waf)
+	require.NotNil(t, decisionCtx)
+	defer decisionCtx.Close()
+	_, matches, _, err := decisionCtx.RunDecision(RunAddressData{Persistent: values}, time.Second)
+	require.NoError(t, err)
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	var out bytes.Buffer
+	actions, err := wafCtx.RunTo(values, time.Second, &out)
+	require.NoError(t, err)
+	require.Equal(t, []string{"block"}, actions)
+	require.Equal(t, string(matches)+"\n", out.String())
+
+	// Nothing is written without events, as the rule already matched the persistent data
+	out.Reset()
+	actions, err = wafCtx.RunTo(values, time.Second, &out)
+	require.NoError(t, err)
+	require.Empty(t, actions)
+	require.Zero(t, out.Len())
 }
 
-func TestActions(t *testing.T) {
-	testActions := func(expectedActions []string) func(t *testing.T) {
-		return func(t *testing.T) {
+func TestMonitorOnly(t *testing.T) {
+	ruleset := newArachniTestRule([]ruleInput{{Address: "my.input"}}, []string{"block"})
+	values := RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}
 
-			waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, expectedActions))
-			require.NoError(t, err)
-			require.NotNil(t, waf)
-			defer waf.Close()
+	t.Run("handle", func(t *testing.T) {
+		waf, err := NewHandleWithOptions(ruleset, "", "", WithMonitorOnly())
+		require.NoError(t, err)
+		defer waf.Close()
+
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		res, err := wafCtx.Run(values, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+		require.Empty(t, res.Actions)
+
+		blocked, matches, actions, err := wafCtx.RunDecision(values, 0)
+		require.NoError(t, err)
+		require.False(t, blocked)
+		require.NotEmpty(t, matches)
+		require.Empty(t, actions)
+	})
+
+	t.Run("context", func(t *testing.T) {
+		waf, err := newDefaultHandle(ruleset)
+		require.NoError(t, err)
+		defer waf.Close()
+
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+		res, err := wafCtx.Run(values, 0)
+		require.NoError(t, err)
+		require.Equal(t, []string{"block"}, res.Actions)
+
+		monitorCtx := NewContextWithOptions(waf, WithMonitorOnly())
+		require.NotNil(t, monitorCtx)
+		defer monitorCtx.Close()
+		res, err = monitorCtx.Run(values, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+		require.Empty(t, res.Actions)
+	})
+}
+
+func TestResultSorted(t *testing.T) {
+	t.Run("events", func(t *testing.T) {
+		waf, err := newDefaultHandle(newArachniTestRulePair(ruleInput{Address: "my.input.1"}, ruleInput{Address: "my.input.2"}))
+		require.NoError(t, err)
+		defer waf.Close()
 
+		run := func() Result {
 			wafCtx := NewContext(waf)
 			require.NotNil(t, wafCtx)
 			defer wafCtx.Close()
 
-			// Not matching because the address value doesn't match the rule
-			values := map[string]interface{}{
-				"my.input": "Arachni",
-			}
-			ephemeral := map[string]interface{}{
-				"my.other.input": map[string]bool{"safe": true},
-			}
-			res, err := wafCtx.Run(RunAddressData{Persistent: values, Ephemeral: ephemeral}, time.Second)
+			res, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{
+				"my.input.2": "Arachni-2",
+				"my.input.1": "Arachni-1",
+			}}, time.Second)
 			require.NoError(t, err)
-			require.NotEmpty(t, res.Events)
-			// FIXME: check with libddwaf why the order of returned actions is not kept the same
-			require.ElementsMatch(t, expectedActions, res.Actions)
+			require.Len(t, res.Events, 2)
+
+			sorted := res.Sorted()
+			sorted.TimeSpent = 0
+			return sorted
 		}
-	}
 
-	t.Run("single", testActions([]string{"block"}))
-	t.Run("multiple-actions", testActions([]string{"action 1", "action 2", "action 3"}))
+		first := run()
+		require.Equal(t, "ua0-600-12x-A", eventRuleID(first.Events[0]))
+		require.Equal(t, "ua0-600-12x-B", eventRuleID(first.Events[1]))
+		require.Equal(t, first, run())
+	})
+
+	t.Run("actions", func(t *testing.T) {
+		res := Result{Actions: []string{"redirect", "block", "monitor"}}
+		sorted := res.Sorted()
+		require.Equal(t, []string{"block", "monitor", "redirect"}, sorted.Actions)
+		// The original result is left untouched
+		require.Equal(t, []string{"redirect", "block", "monitor"}, res.Actions)
+	})
 }
 
 func TestAddresses(t *testing.T) {
@@ -716,6 +2627,166 @@ func TestAddresses(t *testing.T) {
 	require.Equal(t, expectedAddresses, waf.Addresses())
 }
 
+func TestAddressInfo(t *testing.T) {
+	addresses := []ruleInput{{Address: "my.first.input"}, {Address: "my.indexed.input", KeyPath: []string{"indexed"}}, {Address: "my.indexed.input", KeyPath: []string{"nested", "key"}}}
+	waf, err := newDefaultHandle(newArachniTestRule(addresses, nil))
+	require.NoError(t, err)
+
+	require.Equal(t, []AddressInfo{
+		{Name: "my.first.input"},
+		{Name: "my.indexed.input", KeyPath: []string{"indexed"}},
+		{Name: "my.indexed.input", KeyPath: []string{"nested", "key"}},
+	}, waf.AddressInfo())
+
+	waf.Close()
+	require.Nil(t, waf.AddressInfo())
+}
+
+func TestRuleIDs(t *testing.T) {
+	rule := newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil)
+	rules := rule["rules"].([]any)
+	rules = append(rules,
+		map[string]any{
+			"id":         "aaa-000-001",
+			"name":       "Arachni copy",
+			"tags":       map[string]any{"type": "security_scanner", "category": "attack_attempt"},
+			"conditions": rules[0].(map[string]any)["conditions"],
+		},
+		map[string]any{"id": "invalid-rule", "name": "no conditions", "tags": map[string]any{"type": "none"}},
+	)
+	rule["rules"] = rules
+
+	waf, err := newDefaultHandle(rule)
+	require.NoError(t, err)
+	require.Equal(t, []string{"aaa-000-001", "ua0-600-12x"}, waf.RuleIDs())
+	require.Equal(t, []string{"invalid-rule"}, waf.Diagnostics().Rules.Failed)
+
+	waf.Close()
+	require.Nil(t, waf.RuleIDs())
+}
+
+func TestDisabledRules(t *testing.T) {
+	newRuleset := func() map[string]any {
+		rule := newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil)
+		rule["rules"] = append(rule["rules"].([]any), map[string]any{
+			"id":   "other-rule",
+			"name": "Other rule",
+			"tags": map[string]any{"type": "security_scanner", "category": "attack_attempt"},
+			"conditions": []any{map[string]any{
+				"operator": "match_regex",
+				"parameters": map[string]any{
+					"inputs": []any{map[string]any{"address": "my.other.input"}},
+					"regex":  "^Nessus",
+				},
+			}},
+		})
+		return rule
+	}
+	arachni := map[string]any{"my.input": "Arachni"}
+
+	waf, err := NewHandleWithOptions(newRuleset(), "", "", WithDisabledRules("ua0-600-12x"), WithClonableRuleset())
+	require.NoError(t, err)
+	defer waf.Close()
+	require.Equal(t, []string{"other-rule"}, waf.RuleIDs())
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+	defer wafCtx.Close()
+
+	res, err := wafCtx.Run(RunAddressData{Persistent: arachni}, 0)
+	require.NoError(t, err)
+	require.Empty(t, res.Events)
+
+	res, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"my.other.input": "Nessus"}}, 0)
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+
+	t.Run("update", func(t *testing.T) {
+		updated, err := waf.Update(newRuleset())
+		require.NoError(t, err)
+		defer updated.Close()
+		require.Equal(t, []string{"other-rule"}, updated.RuleIDs())
+
+		require.NoError(t, waf.UpdateRuleset(newRuleset()))
+		require.Equal(t, []string{"other-rule"}, waf.RuleIDs())
+	})
+
+	t.Run("clone", func(t *testing.T) {
+		clone, err := waf.CloneWithObfuscators("", "")
+		require.NoError(t, err)
+		defer clone.Close()
+		require.Equal(t, []string{"other-rule"}, clone.RuleIDs())
+	})
+}
+
+func TestUsesAddress(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	require.NoError(t, err)
+	require.True(t, waf.UsesAddress("my.input"))
+	require.False(t, waf.UsesAddress("server.request.body"))
+
+	require.NoError(t, waf.UpdateRuleset(newArachniTestRule([]ruleInput{{Address: "server.request.body"}}, nil)))
+	require.False(t, waf.UsesAddress("my.input"))
+	require.True(t, waf.UsesAddress("server.request.body"))
+
+	waf.Close()
+	require.False(t, waf.UsesAddress("server.request.body"))
+}
+
+func TestAddressSet(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.first.input"}, {Address: "my.second.input"}}, nil))
+	require.NoError(t, err)
+
+	first, second := waf.Addresses(), waf.Addresses()
+	require.ElementsMatch(t, []string{"my.first.input", "my.second.input"}, first)
+	// The same cached slice is returned by every call
+	require.Same(t, &first[0], &second[0])
+
+	set := waf.AddressSet()
+	require.Len(t, set, len(first))
+	for _, addr := range first {
+		require.Contains(t, set, addr)
+	}
+	require.Equal(t, reflect.ValueOf(set).Pointer(), reflect.ValueOf(waf.AddressSet()).Pointer())
+
+	require.NoError(t, waf.UpdateRuleset(newArachniTestRule([]ruleInput{{Address: "server.request.body"}}, nil)))
+	require.Equal(t, []string{"server.request.body"}, waf.Addresses())
+	require.Equal(t, map[string]struct{}{"server.request.body": {}}, waf.AddressSet())
+	// Retained lists are not affected by the update
+	require.ElementsMatch(t, []string{"my.first.input", "my.second.input"}, first)
+
+	waf.Close()
+	require.Nil(t, waf.Addresses())
+	require.Nil(t, waf.AddressSet())
+}
+
+func TestFilterAddresses(t *testing.T) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.first.input"}, {Address: "my.second.input"}}, nil))
+	require.NoError(t, err)
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	require.NotNil(t, wafCtx)
+
+	used, unused := wafCtx.FilterAddresses(map[string]any{
+		"my.second.input":     "value",
+		"my.first.input":      "value",
+		"server.request.body": "value",
+		"my.typo.input":       "value",
+	})
+	require.Equal(t, []string{"my.first.input", "my.second.input"}, used)
+	require.Equal(t, []string{"my.typo.input", "server.request.body"}, unused)
+
+	used, unused = wafCtx.FilterAddresses(nil)
+	require.Empty(t, used)
+	require.Empty(t, unused)
+
+	wafCtx.Close()
+	used, unused = wafCtx.FilterAddresses(map[string]any{"my.first.input": "value"})
+	require.Empty(t, used)
+	require.Equal(t, []string{"my.first.input"}, unused)
+}
+
 func TestConcurrency(t *testing.T) {
 	// Start 200 goroutines that will use the WAF 500 times each
 	nbUsers := 200
@@ -936,43 +3007,190 @@ func TestConcurrency(t *testing.T) {
 		}
 
 		for n := 0; n < nbUsers; n++ {
-			n := n
+			n := n
+			go func() {
+				startBarrier.Wait()
+				defer stopBarrier.Done()
+
+				// A microsecond sleep gives us some scheduler-backed order of execution randomization
+				time.Sleep(time.Microsecond)
+
+				// Half of these goroutines will try to use wafCtx.Run(...), while the other half will try
+				// to use wafCtx.Close(). The expected outcome is that exactly one call to wafCtx.Close()
+				// effectively releases the WAF context, and between 0 and N calls to wafCtx.Run(...) are
+				// done (those that land after `wafCtx.Close()` happened will be silent no-ops).
+				if n%2 == 0 {
+					wafCtx.Run(RunAddressData{Ephemeral: data}, time.Hour)
+				} else {
+					wafCtx.Close()
+				}
+			}()
+		}
+
+		go func() {
+			startBarrier.Wait()
+			defer stopBarrier.Done()
+
+			// A microsecond sleep gives us some scheduler-backed order of execution randomization
+			time.Sleep(time.Microsecond)
+
+			// We also asynchronously release the WAF handle, which is fine to do as the WAF context is
+			// still in use, as the WAF handle has a reference counter guarding it's destruction.
+			waf.Close()
+		}()
+
+		startBarrier.Done()
+		stopBarrier.Wait()
+
+		// Verify the WAF Handle was properly released.
+		require.Zero(t, waf.refCounter.Load())
+	})
+}
+
+func TestUpdateRuleset(t *testing.T) {
+	inputRules := newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil)
+	otherRules := newArachniTestRule([]ruleInput{{Address: "my.other"}}, nil)
+	addressData := RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni", "my.other": "Arachni"}}
+
+	matchedAddress := func(res Result) string {
+		matches := ruleMatches(res.Events)
+		if len(matches) != 1 || len(matches[0].Parameters) != 1 {
+			panic(fmt.Errorf("unexpected events: %v", res.Events))
+		}
+		return matches[0].Parameters[0].Address
+	}
+
+	t.Run("contexts", func(t *testing.T) {
+		waf, err := newDefaultHandle(inputRules)
+		require.NoError(t, err)
+
+		var reloads int
+		waf.OnReload(func(_, _ *Diagnostics) { reloads++ })
+
+		before := NewContext(waf)
+		require.NotNil(t, before)
+
+		require.NoError(t, waf.UpdateRuleset(otherRules))
+		require.Equal(t, 1, reloads)
+		require.Equal(t, []string{"my.other"}, waf.Addresses())
+
+		after := NewContext(waf)
+		require.NotNil(t, after)
+
+		// The context created before the update keeps using the previous ruleset
+		res, err := before.Run(addressData, 0)
+		require.NoError(t, err)
+		require.Equal(t, "my.input", matchedAddress(res))
+
+		res, err = after.Run(addressData, 0)
+		require.NoError(t, err)
+		require.Equal(t, "my.other", matchedAddress(res))
+
+		// Restoring a context also keeps using the previous ruleset
+		require.NoError(t, before.Restore(before.Snapshot()))
+		res, err = before.Run(addressData, 0)
+		require.NoError(t, err)
+		require.Equal(t, "my.input", matchedAddress(res))
+
+		before.Close()
+		after.Close()
+		waf.Close()
+		require.Zero(t, waf.refCounter.Load())
+		require.Error(t, waf.UpdateRuleset(inputRules))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		waf, err := newDefaultHandle(inputRules)
+		require.NoError(t, err)
+		defer waf.Close()
+
+		require.Error(t, waf.UpdateRuleset(map[string]any{"rules": []any{}}))
+		require.Equal(t, []string{"my.input"}, waf.Addresses())
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		waf, err := newDefaultHandle(inputRules)
+		require.NoError(t, err)
+		defer waf.Close()
+
+		nbUsers := 16
+		nbUpdates := 50
+
+		var (
+			startBarrier, stopBarrier sync.WaitGroup
+			done                      atomic.Bool
+		)
+		startBarrier.Add(1)
+		stopBarrier.Add(nbUsers)
+
+		for n := 0; n < nbUsers; n++ {
 			go func() {
 				startBarrier.Wait()
 				defer stopBarrier.Done()
 
-				// A microsecond sleep gives us some scheduler-backed order of execution randomization
-				time.Sleep(time.Microsecond)
+				// A long-lived context, which must keep matching the same address across the updates
+				longLived := NewContext(waf)
+				if longLived == nil {
+					panic("could not create the long-lived context")
+				}
+				defer longLived.Close()
+				expected := ""
 
-				// Half of these goroutines will try to use wafCtx.Run(...), while the other half will try
-				// to use wafCtx.Close(). The expected outcome is that exactly one call to wafCtx.Close()
-				// effectively releases the WAF context, and between 0 and N calls to wafCtx.Run(...) are
-				// done (those that land after `wafCtx.Close()` happened will be silent no-ops).
-				if n%2 == 0 {
-					wafCtx.Run(RunAddressData{Ephemeral: data}, time.Hour)
-				} else {
+				for !done.Load() {
+					wafCtx := NewContext(waf)
+					if wafCtx == nil {
+						panic("could not create the context")
+					}
+					res, err := wafCtx.Run(addressData, 0)
+					if err != nil {
+						panic(err)
+					}
+					matchedAddress(res)
 					wafCtx.Close()
+
+					res, err = longLived.Run(addressData, 0)
+					if err != nil {
+						panic(err)
+					}
+					if addr := matchedAddress(res); expected == "" {
+						expected = addr
+					} else if addr != expected {
+						panic(fmt.Errorf("the long-lived context matched %q instead of %q", addr, expected))
+					}
 				}
 			}()
 		}
 
-		go func() {
-			startBarrier.Wait()
-			defer stopBarrier.Done()
+		startBarrier.Done()
+		for i := 0; i < nbUpdates; i++ {
+			rules := inputRules
+			if i%2 == 0 {
+				rules = otherRules
+			}
+			require.NoError(t, waf.UpdateRuleset(rules))
+		}
+		done.Store(true)
+		stopBarrier.Wait()
 
-			// A microsecond sleep gives us some scheduler-backed order of execution randomization
-			time.Sleep(time.Microsecond)
+		require.Equal(t, int32(1), waf.refCounter.Load())
+		require.Equal(t, int32(1), waf.instance.refCounter.Load())
+	})
 
-			// We also asynchronously release the WAF handle, which is fine to do as the WAF context is
-			// still in use, as the WAF handle has a reference counter guarding it's destruction.
-			waf.Close()
-		}()
+	t.Run("concurrent-close", func(t *testing.T) {
+		waf, err := NewHandleWithOptions(inputRules, "", "", WithClonableRuleset())
+		require.NoError(t, err)
 
-		startBarrier.Done()
-		stopBarrier.Wait()
+		updated := make(chan error, 1)
+		go func() {
+			updated <- waf.UpdateRuleset(otherRules)
+		}()
+		waf.Close()
 
-		// Verify the WAF Handle was properly released.
-		require.Zero(t, waf.refCounter.Load())
+		// The update either happened before the handle was closed, or reports it was closed
+		if err := <-updated; err != nil {
+			require.ErrorIs(t, err, errors.ErrHandleClosed)
+		}
+		require.Nil(t, waf.Addresses())
 	})
 }
 
@@ -1001,6 +3219,10 @@ func TestRunError(t *testing.T) {
 			Err:            errors.ErrOutOfMemory,
 			ExpectedString: "out of memory",
 		},
+		{
+			Err:            errors.ErrBudgetExhausted,
+			ExpectedString: "waf time budget exhausted",
+		},
 		{
 			Err:            errors.RunError(33),
 			ExpectedString: "unknown waf error 33",
@@ -1012,6 +3234,164 @@ func TestRunError(t *testing.T) {
 	}
 }
 
+func TestRunErrorCategories(t *testing.T) {
+	for _, tc := range []struct {
+		Err        errors.RunError
+		Timeout    bool
+		InputError bool
+		Internal   bool
+	}{
+		{Err: errors.ErrInternal, Internal: true},
+		{Err: errors.ErrOutOfMemory, Internal: true},
+		{Err: errors.ErrTimeout, Timeout: true},
+		{Err: errors.ErrBudgetExhausted, Timeout: true},
+		{Err: errors.ErrInvalidObject, InputError: true},
+		{Err: errors.ErrInvalidArgument, InputError: true},
+		{Err: errors.ErrEmptyRuleAddresses},
+		{Err: errors.RunError(33)},
+	} {
+		t.Run(tc.Err.Error(), func(t *testing.T) {
+			require.Equal(t, tc.Timeout, tc.Err.IsTimeout())
+			require.Equal(t, tc.InputError, tc.Err.IsInputError())
+			require.Equal(t, tc.Internal, tc.Err.IsInternal())
+		})
+	}
+}
+
+func TestBudgetExhausted(t *testing.T) {
+	t.Run("is-timeout", func(t *testing.T) {
+		require.ErrorIs(t, errors.ErrBudgetExhausted, errors.ErrTimeout)
+		require.NotErrorIs(t, errors.ErrTimeout, errors.ErrBudgetExhausted)
+		require.NotErrorIs(t, errors.ErrInternal, errors.ErrTimeout)
+	})
+
+	t.Run("libddwaf-timeout", func(t *testing.T) {
+		res, err := unwrapWafResult(bindings.WafOK, &bindings.WafResult{Timeout: 1})
+		require.Equal(t, errors.ErrBudgetExhausted, err)
+		require.True(t, res.TimedOut)
+		require.Empty(t, res.Events)
+	})
+
+	t.Run("libddwaf-timeout-with-match", func(t *testing.T) {
+		encoder := newMaxEncoder()
+		events, err := encoder.Encode([]any{map[string]any{"rule": map[string]any{"id": "ua0-600-12x"}}})
+		require.NoError(t, err)
+		defer unsafe.KeepAlive(encoder.cgoRefs)
+
+		res, err := unwrapWafResult(bindings.WafMatch, &bindings.WafResult{Timeout: 1, Events: *events})
+		require.Equal(t, errors.ErrBudgetExhausted, err)
+		require.True(t, res.TimedOut)
+		require.Len(t, res.Events, 1)
+		require.Equal(t, "ua0-600-12x", eventRuleID(res.Events[0]))
+	})
+
+	t.Run("last-run", func(t *testing.T) {
+		waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+		require.NoError(t, err)
+		defer waf.Close()
+
+		context := NewContext(waf)
+		require.NotNil(t, context)
+		defer context.Close()
+		require.False(t, context.LastRunTimedOut())
+
+		res, err := context.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, 0)
+		require.NoError(t, err)
+		require.False(t, res.TimedOut)
+		require.Len(t, res.Events, 1)
+		require.False(t, context.LastRunTimedOut())
+
+		_, err = context.RunWithLimits(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, EncoderLimits{}, time.Nanosecond)
+		require.ErrorIs(t, err, errors.ErrTimeout)
+		require.True(t, context.LastRunTimedOut())
+
+		_, err = context.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "go client"}}, 0)
+		require.NoError(t, err)
+		require.False(t, context.LastRunTimedOut())
+	})
+
+	t.Run("exhausted-budget", func(t *testing.T) {
+		waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+		require.NoError(t, err)
+		defer waf.Close()
+
+		context := NewContextWithBudget(waf, 0)
+		require.NotNil(t, context)
+		defer context.Close()
+
+		_, err = context.Run(RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}, 0)
+		require.Equal(t, errors.ErrTimeout, err)
+		require.Equal(t, uint64(1), context.Metrics().Timeouts)
+	})
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	require.Nil(t, parseRuleErrors(nil))
+
+	parsed := parseRuleErrors(map[string][]string{
+		"missing key 'tags'":                          {"rule-2", "rule-1"},
+		"invalid type 'array' for key 'name'":         {"rule-3"},
+		"unknown matcher: new_operator":               {"rule-4"},
+		"invalid regular expression: (":               {"rule-5"},
+		"duplicate rule":                              {"rule-6"},
+		"empty address":                               {"rule-7"},
+		"invalid transformer foo":                     {"rule-8"},
+		"something libddwaf may report in the future": {"rule-9"},
+	})
+	require.Equal(t, []RuleError{
+		{Code: ErrDuplicateID, Message: "duplicate rule", RuleIDs: []string{"rule-6"}},
+		{Code: ErrEmptyValue, Message: "empty address", RuleIDs: []string{"rule-7"}},
+		{Code: ErrInvalidRegex, Message: "invalid regular expression: (", RuleIDs: []string{"rule-5"}},
+		{Code: ErrInvalidTransformer, Message: "invalid transformer foo", RuleIDs: []string{"rule-8"}},
+		{Code: ErrInvalidType, Message: "invalid type 'array' for key 'name'", RuleIDs: []string{"rule-3"}},
+		{Code: ErrMissingKey, Message: "missing key 'tags'", RuleIDs: []string{"rule-1", "rule-2"}},
+		{Code: ErrUnclassified, Message: "something libddwaf may report in the future", RuleIDs: []string{"rule-9"}},
+		{Code: ErrUnknownOperator, Message: "unknown matcher: new_operator", RuleIDs: []string{"rule-4"}},
+	}, parsed)
+}
+
+func TestSetLogCallback(t *testing.T) {
+	if log.CallbackFunctionPointer() == 0 {
+		require.Error(t, SetLogCallback(func(LogLevel, string) {}))
+		t.Skip("libddwaf cannot call Go functions on this target")
+	}
+	defer func() { require.NoError(t, SetLogCallback(nil)) }()
+
+	rule := newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil)
+	rule["rules"].([]any)[0].(map[string]any)["conditions"] = "not an array"
+
+	t.Run("malformed-rule", func(t *testing.T) {
+		var (
+			mutex    sync.Mutex
+			warnings []string
+		)
+		require.NoError(t, SetLogCallback(func(level LogLevel, message string) {
+			if level == LogLevelWarning {
+				mutex.Lock()
+				defer mutex.Unlock()
+				warnings = append(warnings, message)
+			}
+		}))
+
+		_, err := newDefaultHandle(rule)
+		require.Error(t, err)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		require.NotEmpty(t, warnings)
+		require.Contains(t, strings.Join(warnings, "\n"), "ua0-600-12x")
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		require.NoError(t, SetLogCallback(func(LogLevel, string) {
+			panic("not from libddwaf")
+		}))
+
+		_, err := newDefaultHandle(rule)
+		require.Error(t, err)
+	})
+}
+
 func TestMetrics(t *testing.T) {
 	rules := `{
   "version": "2.1",
@@ -1083,6 +3463,90 @@ func TestMetrics(t *testing.T) {
 		require.Contains(t, waf.diagnostics.Rules.Loaded, "valid-rule")
 		require.Equal(t, waf.diagnostics.Version, "1.2.7")
 		require.Len(t, waf.diagnostics.Rules.Errors, 1)
+		require.Equal(t, []RuleError{{
+			Code:    ErrUnclassified,
+			Message: "rule has no valid conditions",
+			RuleIDs: []string{"missing-name", "missing-tags-1", "missing-tags-2"},
+		}}, waf.diagnostics.Rules.ParsedErrors)
+	})
+
+	t.Run("DiagnosticsJSON", func(t *testing.T) {
+		encoded, err := json.Marshal(waf.Diagnostics())
+		require.NoError(t, err)
+		require.JSONEq(t, `{
+			"rules": {
+				"addresses": {"required": ["server.request.uri.raw"], "optional": []},
+				"errors": {"rule has no valid conditions": ["missing-name", "missing-tags-1", "missing-tags-2"]},
+				"loaded": ["valid-rule"],
+				"failed": ["missing-tags-1", "missing-tags-2", "missing-name"]
+			},
+			"version": "1.2.7"
+		}`, string(encoded))
+
+		// The output is stable whatever the order the WAF reported the identifiers in
+		diagnostics := waf.Diagnostics()
+		rules := *diagnostics.Rules
+		rules.Errors = map[string][]string{"rule has no valid conditions": {"missing-tags-2", "missing-name", "missing-tags-1"}}
+		diagnostics.Rules = &rules
+		reordered, err := json.Marshal(diagnostics)
+		require.NoError(t, err)
+		require.Equal(t, string(encoded), string(reordered))
+
+		var decoded Diagnostics
+		require.NoError(t, json.Unmarshal(encoded, &decoded))
+		require.Equal(t, waf.diagnostics.Rules.Loaded, decoded.Rules.Loaded)
+		require.Equal(t, waf.diagnostics.Rules.Failed, decoded.Rules.Failed)
+		require.Equal(t, "1.2.7", decoded.Version)
+	})
+
+	t.Run("RuleDetails", func(t *testing.T) {
+		// Only the loaded rules are reported
+		details := waf.RuleDetails()
+		require.Equal(t, map[string]RuleDetail{
+			"valid-rule": {
+				Name:      "Unicode Full/Half Width Abuse Attack Attempt",
+				Tags:      map[string]string{"type": "http_protocol_violation"},
+				Operators: []string{"match_regex"},
+			},
+		}, details)
+
+		// The details are copies
+		details["valid-rule"].Tags["type"] = "altered"
+		require.Equal(t, "http_protocol_violation", waf.RuleDetails()["valid-rule"].Tags["type"])
+	})
+
+	t.Run("LoadSummary", func(t *testing.T) {
+		require.Equal(t, "loaded 1, failed 3: 3 rule has no valid conditions; version 1.2.7", waf.LoadSummary())
+		require.Equal(t, LoadStats{
+			Loaded:  1,
+			Failed:  3,
+			Errors:  map[RuleErrorCode]int{ErrUnclassified: 3},
+			Version: "1.2.7",
+		}, waf.LoadStats())
+
+		diags := Diagnostics{
+			Rules: &DiagnosticEntry{
+				Loaded: []string{"rule-1"},
+				Failed: []string{"rule-2", "rule-3", "rule-4"},
+				Errors: map[string][]string{"missing key 'tags'": {"rule-2", "rule-3"}, "missing key 'name'": {"rule-4"}},
+			},
+			CustomRules: &DiagnosticEntry{
+				Loaded: []string{"custom-1"},
+				Failed: []string{"custom-2"},
+				Errors: map[string][]string{"unknown operator: 'foo'": {"custom-2"}},
+			},
+		}
+		require.Equal(t, "loaded 2, failed 4: 2 missing key 'tags', 1 missing key 'name', 1 unknown operator: 'foo'", loadSummary(diags))
+		stats, _ := loadStats(diags)
+		require.Equal(t, map[RuleErrorCode]int{ErrMissingKey: 3, ErrUnknownOperator: 1}, stats.Errors)
+		require.Equal(t, "loaded 0, failed 0", loadSummary(Diagnostics{}))
+	})
+
+	t.Run("Version", func(t *testing.T) {
+		libVersion, rulesetVersion := waf.Version()
+		require.Equal(t, Version(), libVersion)
+		require.NotEmpty(t, libVersion)
+		require.Equal(t, "1.2.7", rulesetVersion)
 	})
 
 	t.Run("RunDuration", func(t *testing.T) {
@@ -1111,6 +3575,33 @@ func TestMetrics(t *testing.T) {
 		require.LessOrEqual(t, overall, uint64(elapsedNS))
 	})
 
+	t.Run("LastRunDuration", func(t *testing.T) {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		overall, internal := wafCtx.LastRunDuration()
+		require.Zero(t, overall)
+		require.Zero(t, internal)
+
+		_, err := wafCtx.Run(RunAddressData{Persistent: map[string]any{"server.request.uri.raw": "\\%uff00"}}, time.Second)
+		require.NoError(t, err)
+		firstOverall, firstInternal := wafCtx.LastRunDuration()
+		require.Greater(t, firstOverall, firstInternal)
+		require.Positive(t, firstInternal)
+		totalOverall, totalInternal := wafCtx.TotalRuntime()
+		require.Equal(t, uint64(firstOverall), totalOverall)
+		require.Equal(t, uint64(firstInternal), totalInternal)
+
+		_, err = wafCtx.Run(RunAddressData{Persistent: map[string]any{"server.request.body": map[string]bool{"safe": true}}}, time.Second)
+		require.NoError(t, err)
+		secondOverall, secondInternal := wafCtx.LastRunDuration()
+		require.Positive(t, secondOverall)
+		totalOverall, totalInternal = wafCtx.TotalRuntime()
+		require.Equal(t, uint64(firstOverall+secondOverall), totalOverall)
+		require.Equal(t, uint64(firstInternal+secondInternal), totalInternal)
+	})
+
 	t.Run("Timeouts", func(t *testing.T) {
 		wafCtx := NewContextWithBudget(waf, time.Nanosecond)
 		require.NotNil(t, wafCtx)
@@ -1127,7 +3618,13 @@ func TestMetrics(t *testing.T) {
 			_, err := wafCtx.Run(RunAddressData{Persistent: data, Ephemeral: ephemeral}, 0)
 			require.Equal(t, errors.ErrTimeout, err)
 			require.Equal(t, wafCtx.TotalTimeouts(), i)
+			require.Equal(t, wafCtx.TotalRuns(), i)
 		}
+
+		// Calls without address data do not run the WAF
+		_, err := wafCtx.Run(RunAddressData{}, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(10), wafCtx.TotalRuns())
 	})
 }
 
@@ -1198,6 +3695,117 @@ func TestObfuscatorConfig(t *testing.T) {
 		require.NoError(t, err)
 		require.Contains(t, string(events), "sensitive")
 	})
+
+	t.Run("getters", func(t *testing.T) {
+		waf, err := NewHandleWithOptions(rule, "key", "sensitive", WithClonableRuleset())
+		require.NoError(t, err)
+		defer waf.Close()
+		keyRegex, valueRegex := waf.ObfuscatorConfig()
+		require.Equal(t, "key", keyRegex)
+		require.Equal(t, "sensitive", valueRegex)
+
+		clone, err := waf.CloneWithObfuscators("", "other")
+		require.NoError(t, err)
+		defer clone.Close()
+		keyRegex, valueRegex = clone.ObfuscatorConfig()
+		require.Empty(t, keyRegex)
+		require.Equal(t, "other", valueRegex)
+
+		updated, err := waf.Update(rule)
+		require.NoError(t, err)
+		defer updated.Close()
+		keyRegex, valueRegex = updated.ObfuscatorConfig()
+		require.Equal(t, "key", keyRegex)
+		require.Equal(t, "sensitive", valueRegex)
+	})
+}
+
+func TestCloneWithObfuscators(t *testing.T) {
+	rule := newArachniTestRule([]ruleInput{{Address: "my.addr", KeyPath: []string{"key"}}}, nil)
+	addressData := RunAddressData{Ephemeral: map[string]any{
+		"my.addr": map[string]any{"key": "Arachni-sensitive-Arachni"},
+	}}
+
+	runEvents := func(t *testing.T, waf *Handle) string {
+		wafCtx := NewContext(waf)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+		res, err := wafCtx.Run(addressData, 0)
+		require.NoError(t, err)
+		require.Len(t, res.Events, 1)
+		events, err := json.Marshal(res.Events)
+		require.NoError(t, err)
+		return string(events)
+	}
+
+	t.Run("obfuscators", func(t *testing.T) {
+		waf, err := NewHandleWithOptions(rule, "", "", WithClonableRuleset())
+		require.NoError(t, err)
+
+		clone, err := waf.CloneWithObfuscators("", "sensitive")
+		require.NoError(t, err)
+		defer clone.Close()
+		require.Equal(t, waf.Addresses(), clone.Addresses())
+
+		require.Contains(t, runEvents(t, waf), "sensitive")
+		require.NotContains(t, runEvents(t, clone), "sensitive")
+
+		// Closing the original handle doesn't affect its clone
+		waf.Close()
+		require.NotContains(t, runEvents(t, clone), "sensitive")
+
+		_, err = waf.CloneWithObfuscators("", "")
+		require.Error(t, err)
+	})
+
+	t.Run("updated", func(t *testing.T) {
+		waf, err := NewHandleWithOptions(rule, "", "", WithClonableRuleset())
+		require.NoError(t, err)
+		defer waf.Close()
+
+		require.NoError(t, waf.UpdateRuleset(newArachniTestRule([]ruleInput{{Address: "my.other"}}, nil)))
+		clone, err := waf.CloneWithObfuscators("", "")
+		require.NoError(t, err)
+		defer clone.Close()
+		require.Equal(t, []string{"my.other"}, clone.Addresses())
+
+		updated, err := clone.Update(map[string]any{"rules_data": []any{}})
+		require.NoError(t, err)
+		defer updated.Close()
+		cloneOfUpdated, err := updated.CloneWithObfuscators("", "")
+		require.NoError(t, err)
+		defer cloneOfUpdated.Close()
+		require.Equal(t, []string{"my.other"}, cloneOfUpdated.Addresses())
+	})
+
+	t.Run("not-clonable", func(t *testing.T) {
+		waf, err := NewHandle(rule, "", "")
+		require.NoError(t, err)
+		defer waf.Close()
+		require.Empty(t, waf.ruleset.sections)
+
+		_, err = waf.CloneWithObfuscators("", "sensitive")
+		require.ErrorIs(t, err, errors.ErrRulesetNotRetained)
+
+		require.NoError(t, waf.UpdateRuleset(newArachniTestRule([]ruleInput{{Address: "my.other"}}, nil)))
+		require.Empty(t, waf.ruleset.sections)
+	})
+
+	t.Run("own-references", func(t *testing.T) {
+		waf, err := NewHandleWithOptions(rule, "", "", WithClonableRuleset())
+		require.NoError(t, err)
+		defer waf.Close()
+
+		// Each section is a copy holding its own Go references, so that an update only keeps the sections it replaced
+		require.NoError(t, waf.UpdateRuleset(map[string]any{"rules_data": []any{}}))
+		seen := make(map[*cgoRefPool]string, len(waf.ruleset.sections))
+		for key, section := range waf.ruleset.sections {
+			require.NotContains(t, seen, section.cgoRefs, key)
+			seen[section.cgoRefs] = key
+		}
+		require.Contains(t, waf.ruleset.sections, "rules_data")
+		require.Contains(t, waf.ruleset.sections, "rules")
+	})
 }
 
 func TestTruncationInformation(t *testing.T) {
@@ -1229,6 +3837,25 @@ func TestTruncationInformation(t *testing.T) {
 		StringTooLong:     {bindings.WafMaxStringLength + extra + 2, bindings.WafMaxStringLength + extra},
 		ContainerTooLarge: {bindings.WafMaxContainerSize + extra + 2, bindings.WafMaxContainerSize + extra},
 	}, ctx.truncations)
+	require.Equal(t, Truncations{StringTooLong: 2, ContainerTooLarge: 2}, ctx.LastTruncations())
+	require.True(t, ctx.LastTruncations().Any())
+
+	t.Run("last-run-only", func(t *testing.T) {
+		_, err := ctx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": "Arachni"}}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, Truncations{}, ctx.LastTruncations())
+		require.False(t, ctx.LastTruncations().Any())
+	})
+
+	t.Run("object-too-deep", func(t *testing.T) {
+		var deep any = "Arachni"
+		for i := 0; i < bindings.WafMaxContainerDepth+extra; i++ {
+			deep = []any{deep}
+		}
+		_, err := ctx.Run(RunAddressData{Ephemeral: map[string]any{"my.input": deep}}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, Truncations{ObjectTooDeep: 1}, ctx.LastTruncations())
+	})
 }
 
 func BenchmarkEncoder(b *testing.B) {
@@ -1273,3 +3900,138 @@ func BenchmarkEncoder(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkEncodeInto(b *testing.B) {
+	// A JSON-like request body made of many small containers, as the array slabs matter the most for those
+	items := make([]any, 100)
+	for i := range items {
+		items[i] = map[string]any{
+			"id":    strconv.Itoa(i),
+			"name":  "item",
+			"tags":  []any{"a", "b", "c"},
+			"price": map[string]any{"amount": 33.5, "currency": "EUR"},
+		}
+	}
+	data := map[string]any{"server.request.body": map[string]any{"items": items}}
+
+	b.Run("Encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			encoder := newMaxEncoder()
+			if _, err := encoder.Encode(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("EncodeInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var obj bindings.WafObject
+		for n := 0; n < b.N; n++ {
+			encoder := newMaxEncoder()
+			if err := encoder.EncodeInto(&obj, data); err != nil {
+				b.Fatal(err)
+			}
+			encoder.cgoRefs.release()
+		}
+	})
+}
+
+func BenchmarkRunBatch(b *testing.B) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer waf.Close()
+
+	inputs := make([]map[string]any, 100)
+	for i := range inputs {
+		inputs[i] = map[string]any{"my.input": map[string]any{"user-agent": "Arachni/v" + strconv.Itoa(i)}}
+	}
+
+	b.Run("loop", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			wafCtx := NewContext(waf)
+			for _, input := range inputs {
+				if _, err := wafCtx.Run(RunAddressData{Ephemeral: input}, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+			wafCtx.Close()
+		}
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			wafCtx := NewContext(waf)
+			if _, err := wafCtx.RunBatch(inputs, time.Second); err != nil {
+				b.Fatal(err)
+			}
+			wafCtx.Close()
+		}
+	})
+}
+
+func BenchmarkRunSingle(b *testing.B) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer waf.Close()
+
+	wafCtx := NewContext(waf)
+	defer wafCtx.Close()
+
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			if _, err := wafCtx.RunWithLimits(RunAddressData{Ephemeral: map[string]any{"my.input": "go client"}}, EncoderLimits{}, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("single", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			if _, err := wafCtx.RunSingle("my.input", "go client", 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkContextPool(b *testing.B) {
+	waf, err := newDefaultHandle(newArachniTestRule([]ruleInput{{Address: "my.input"}}, nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer waf.Close()
+
+	values := RunAddressData{Persistent: map[string]any{"my.input": "Arachni"}}
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			wafCtx := NewContext(waf)
+			if _, err := wafCtx.Run(values, 0); err != nil {
+				b.Fatal(err)
+			}
+			wafCtx.Close()
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		pool := NewContextPool(waf)
+		for n := 0; n < b.N; n++ {
+			wafCtx := pool.Get()
+			if _, err := wafCtx.Run(values, 0); err != nil {
+				b.Fatal(err)
+			}
+			pool.Put(wafCtx)
+		}
+	})
+}